@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPrefix = "wasatext-"
+	snapshotSuffix = ".db"
+
+	// snapshotTimeFormat is the time in the names of the snapshots. Names sort like the times.
+	snapshotTimeFormat = "20060102T150405.000Z"
+)
+
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	var dbPath = flags.String("db", defaultDatabase, "the database")
+	var dir = flags.String("dir", defaultBackupDir, "the backup directory")
+	var keep = flags.Int("keep", 7, "number of snapshots to keep (0 for all)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return errors.New("keep must not be negative")
+	}
+
+	snapshot, err := backup(context.Background(), *dbPath, *dir, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println(snapshot) //nolint:forbidigo
+
+	removed, err := prune(*dir, *keep)
+	for _, name := range removed {
+		fmt.Println("removed", name) //nolint:forbidigo
+	}
+	return err
+}
+
+// backup writes a snapshot of the database into dir, named after the time, and returns its path. The snapshot is
+// written to a temporary file first, and renamed only once its integrity is checked.
+func backup(ctx context.Context, dbPath string, dir string, now time.Time) (string, error) {
+	// Opening a missing database would create an empty one
+	if _, err := os.Stat(dbPath); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, snapshotPrefix+now.UTC().Format(snapshotTimeFormat)+snapshotSuffix)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+
+	src, err := database.OpenSQLite(dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = src.Close() }()
+
+	tmp := path + ".partial"
+	if err := copyDatabase(ctx, src, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return path, syncDir(dir)
+}
+
+// copyDatabase copies the database src into the new file at path with the online backup API, checks the copy, and
+// syncs it to disk.
+func copyDatabase(ctx context.Context, src *sql.DB, path string) error {
+	dest, err := database.OpenSQLite(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dest.Close() }()
+
+	if err := database.BackupSQLite(ctx, src, dest); err != nil {
+		return fmt.Errorf("copying the database: %w", err)
+	}
+	if err := database.CheckSQLite(ctx, dest); err != nil {
+		return fmt.Errorf("checking the copy: %w", err)
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	return syncFile(path)
+}
+
+// snapshots returns the names of the snapshots in dir, the most recent first.
+func snapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// prune removes the snapshots in dir but the keep most recent ones, and returns the paths of the removed ones. It
+// removes nothing if keep is 0.
+func prune(dir string, keep int) ([]string, error) {
+	if keep == 0 {
+		return nil, nil
+	}
+	names, err := snapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for i := keep; i < len(names); i++ {
+		path := filepath.Join(dir, names[i])
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	var dir = flags.String("dir", defaultBackupDir, "the backup directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	names, err := snapshots(*dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(*dir, name))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%d\n", name, info.Size()) //nolint:forbidigo
+	}
+	return nil
+}
+
+// syncFile flushes the file to disk.
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return f.Sync()
+}
+
+// syncDir flushes the entries of the directory to disk, so a rename in it survives a crash.
+func syncDir(dir string) error {
+	return syncFile(dir)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// openDatabase opens the database in the file, creating it if missing. The test is skipped if SQLite has been built
+// without FTS5.
+func openDatabase(t *testing.T, path string) (*sql.DB, database.AppDatabase) {
+	t.Helper()
+	db, err := database.OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	appdb, err := database.New(db, database.Config{})
+	if errors.Is(err, database.ErrNoFTS5) {
+		t.Skip("run the tests with -tags sqlite_fts5: ", err)
+	} else if err != nil {
+		t.Fatalf("creating the database: %v", err)
+	}
+	return db, appdb
+}
+
+func createUser(t *testing.T, appdb database.AppDatabase, username string) {
+	t.Helper()
+	if _, err := appdb.CreateUser(context.Background(), database.User{Username: username}); err != nil {
+		t.Fatalf("creating %s: %v", username, err)
+	}
+}
+
+// usernames returns the usernames in the database in the file, in order.
+func usernames(t *testing.T, path string) string {
+	t.Helper()
+	db, err := database.OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer func() { _ = db.Close() }()
+	rows, err := db.Query(`SELECT Username FROM users ORDER BY Username`)
+	if err != nil {
+		t.Fatalf("reading the users of %s: %v", path, err)
+	}
+	defer func() { _ = rows.Close() }()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatalf("reading the users of %s: %v", path, err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("reading the users of %s: %v", path, err)
+	}
+	return strings.Join(names, ",")
+}
+
+// newSnapshot returns a snapshot of a database with the user alice, and the path of the database.
+func newSnapshot(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "wasatext.db")
+	_, appdb := openDatabase(t, dbPath)
+	createUser(t, appdb, "alice")
+
+	snapshot, err := backup(context.Background(), dbPath, filepath.Join(dir, "backups"), now)
+	if err != nil {
+		t.Fatalf("taking the snapshot: %v", err)
+	}
+	return snapshot, dbPath
+}
+
+func TestBackupRestore(t *testing.T) {
+	snapshot, dbPath := newSnapshot(t)
+	if want := filepath.Join(filepath.Dir(dbPath), "backups", "wasatext-20240301T120000.000Z.db"); snapshot != want {
+		t.Errorf("snapshot: got %s, want %s", snapshot, want)
+	}
+	if got := usernames(t, snapshot); got != "alice" {
+		t.Errorf("users of the snapshot: got %s, want alice", got)
+	}
+	if _, err := backup(context.Background(), dbPath, filepath.Dir(snapshot), now); err == nil {
+		t.Errorf("a second snapshot at the same time replaced the first")
+	}
+
+	// Changes after the snapshot are undone by the restore, and kept in the replaced database
+	db, err := database.OpenSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (Username) VALUES ('bob')`); err != nil {
+		t.Fatalf("creating bob: %v", err)
+	}
+	_ = db.Close()
+
+	old, err := restore(context.Background(), snapshot, dbPath, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("restoring the snapshot: %v", err)
+	}
+	if want := dbPath + ".before-restore-20240301T130000.000Z"; old != want {
+		t.Errorf("replaced database: got %s, want %s", old, want)
+	}
+	if got := usernames(t, dbPath); got != "alice" {
+		t.Errorf("users of the restored database: got %s, want alice", got)
+	}
+	if got := usernames(t, old); got != "alice,bob" {
+		t.Errorf("users of the replaced database: got %s, want alice,bob", got)
+	}
+	if _, err := os.Stat(dbPath + ".restore"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the copy of the snapshot is left behind: %v", err)
+	}
+}
+
+// checkUnchanged checks that a failed restore left the database in place, with the temporary copy removed.
+func checkUnchanged(t *testing.T, dbPath string) {
+	t.Helper()
+	if got := usernames(t, dbPath); got != "alice" {
+		t.Errorf("users of the database after a failed restore: got %s, want alice", got)
+	}
+	matches, err := filepath.Glob(dbPath + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) > 0 {
+		t.Errorf("files left by a failed restore: %v", matches)
+	}
+}
+
+func TestRestoreCorruptSnapshot(t *testing.T) {
+	snapshot, dbPath := newSnapshot(t)
+
+	// Overwrite the page of the users, which the schema checks don't read
+	db, err := database.OpenSQLite(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page, pageSize int64
+	if err := db.QueryRow(`SELECT rootpage FROM sqlite_master WHERE name = 'users'`).Scan(&page); err != nil {
+		t.Fatalf("finding the page of the users: %v", err)
+	}
+	if err := db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		t.Fatalf("reading the page size: %v", err)
+	}
+	_ = db.Close()
+	f, err := os.OpenFile(snapshot, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte(strings.Repeat("\xff", int(pageSize))), (page-1)*pageSize); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	_, err = restore(context.Background(), snapshot, dbPath, now)
+	if err == nil || !strings.Contains(err.Error(), "checking the copy") {
+		t.Fatalf("restoring a corrupt snapshot: got %v, want an error of the integrity check", err)
+	}
+	checkUnchanged(t, dbPath)
+}
+
+func TestRestoreNewerSnapshot(t *testing.T) {
+	snapshot, dbPath := newSnapshot(t)
+
+	// The snapshot is taken by a version of webapi with one more migration
+	db, err := database.OpenSQLite(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO schema_migrations (Version, Name, AppliedAt)
+        SELECT MAX(Version) + 1, 'future', CURRENT_TIMESTAMP FROM schema_migrations`); err != nil {
+		t.Fatalf("adding a migration to the snapshot: %v", err)
+	}
+	_ = db.Close()
+
+	_, err = restore(context.Background(), snapshot, dbPath, now)
+	if err == nil || !strings.Contains(err.Error(), "newer than this executable") {
+		t.Fatalf("restoring a snapshot with a newer schema: got %v, want an error about the schema version", err)
+	}
+	checkUnchanged(t, dbPath)
+}
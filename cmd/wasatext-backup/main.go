@@ -0,0 +1,88 @@
+/*
+Wasatext-backup takes consistent snapshots of the SQLite database of webapi, and restores them. Snapshots are taken
+with the online backup API of SQLite, so webapi can keep running meanwhile; copying the database file instead can give
+a corrupt copy if a write is in progress.
+
+Usage:
+
+	wasatext-backup backup [flags]
+	wasatext-backup restore [flags]
+	wasatext-backup list [flags]
+
+backup writes a snapshot of the database into the backup directory, named after the time it was taken
+(wasatext-20060102T150405.000Z.db), and checks its integrity. The oldest snapshots are then removed, keeping the most
+recent ones. The flags are:
+
+	-db <path>
+		The database (default /tmp/decaf.db, like webapi).
+
+	-dir <path>
+		The backup directory, created if missing (default ./backups).
+
+	-keep <n>
+		Number of snapshots to keep, the most recent ones; 0 keeps all of them (default 7).
+
+restore replaces the database with a snapshot. The snapshot is copied next to the database and checked first, with
+PRAGMA integrity_check and PRAGMA foreign_key_check, and it is swapped in only if it is sound. The replaced database is
+kept, renamed to <path>.before-restore-<time>. webapi must be stopped while restoring. The flags are:
+
+	-db <path>
+		The database to replace (default /tmp/decaf.db).
+
+	-from <path>
+		The snapshot to restore, or "latest" for the most recent one in -dir.
+
+	-dir <path>
+		The backup directory, for -from latest (default ./backups).
+
+list prints the snapshots in the backup directory, the most recent first, with their sizes. The flags are:
+
+	-dir <path>
+		The backup directory (default ./backups).
+
+Like webapi, the command must be built with -tags sqlite_fts5 to read the full-text index of the messages.
+
+Return values (exit codes):
+
+	0
+		The command was successful
+
+	> 0
+		The command failed; the database is left as it was
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	defaultDatabase  = "/tmp/decaf.db"
+	defaultBackupDir = "backups"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: wasatext-backup backup|restore|list [flags]")
+	}
+
+	switch args[0] {
+	case "backup":
+		return runBackup(args[1:])
+	case "restore":
+		return runRestore(args[1:])
+	case "list":
+		return runList(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q: use backup, restore or list", args[0])
+	}
+}
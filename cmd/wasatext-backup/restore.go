@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sqliteSideFiles are the suffixes of the files SQLite keeps next to a database. They belong to the database file, so
+// they are moved away with it: left behind, they would be applied to the restored database.
+var sqliteSideFiles = []string{"-journal", "-wal", "-shm"}
+
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	var dbPath = flags.String("db", defaultDatabase, "the database to replace")
+	var from = flags.String("from", "", `the snapshot to restore, or "latest"`)
+	var dir = flags.String("dir", defaultBackupDir, "the backup directory, for -from latest")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	snapshot := *from
+	switch snapshot {
+	case "":
+		return errors.New("-from is required")
+	case "latest":
+		names, err := snapshots(*dir)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("no snapshots in %s", *dir)
+		}
+		snapshot = filepath.Join(*dir, names[0])
+	}
+
+	old, err := restore(context.Background(), snapshot, *dbPath, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s into %s\n", snapshot, *dbPath) //nolint:forbidigo
+	if old != "" {
+		fmt.Printf("the previous database is in %s\n", old) //nolint:forbidigo
+	}
+	return nil
+}
+
+// restore replaces the database with a copy of the snapshot, once the copy is checked. The database, if any, is moved
+// to a new name, which is returned.
+func restore(ctx context.Context, snapshot string, dbPath string, now time.Time) (string, error) {
+	// Opening a missing snapshot would create an empty one
+	if _, err := os.Stat(snapshot); err != nil {
+		return "", err
+	}
+	src, err := database.OpenSQLite(snapshot)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = src.Close() }()
+	if err := checkSchema(src); err != nil {
+		return "", fmt.Errorf("%s: %w", snapshot, err)
+	}
+
+	// The copy is made in the directory of the database, so it can be renamed into place
+	tmp := dbPath + ".restore"
+	if err := removeDatabase(tmp); err != nil {
+		return "", err
+	}
+	if err := copyDatabase(ctx, src, tmp); err != nil {
+		_ = removeDatabase(tmp)
+		return "", err
+	}
+
+	var old string
+	if _, err := os.Stat(dbPath); err == nil {
+		old = dbPath + ".before-restore-" + now.UTC().Format(snapshotTimeFormat)
+		if err := moveDatabase(dbPath, old); err != nil {
+			_ = removeDatabase(tmp)
+			return "", fmt.Errorf("moving the database away: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return old, err
+	}
+	return old, syncDir(filepath.Dir(dbPath))
+}
+
+// checkSchema checks that the database can be used by this version of webapi: its schema must not be newer. The
+// missing migrations are applied by webapi when it starts.
+func checkSchema(db *sql.DB) error {
+	pending, err := database.PendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		fmt.Printf("%d migrations will be applied when webapi starts\n", len(pending)) //nolint:forbidigo
+	}
+	return nil
+}
+
+// moveDatabase renames the database, with the files SQLite keeps next to it.
+func moveDatabase(from string, to string) error {
+	for _, suffix := range sqliteSideFiles {
+		if err := os.Rename(from+suffix, to+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(from, to)
+}
+
+// removeDatabase removes the database, if any, with the files SQLite keeps next to it.
+func removeDatabase(path string) error {
+	for _, suffix := range append([]string{""}, sqliteSideFiles...) {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -25,7 +25,61 @@ type WebAPIConfiguration struct {
 	}
 	Debug bool
 	DB    struct {
+		// Driver is the database to use: "sqlite3" (the file in Filename) or "postgres" (the server in DSN)
+		Driver   string `conf:"default:sqlite3"`
 		Filename string `conf:"default:/tmp/decaf.db"`
+		DSN      string `conf:"mask"`
+
+		// QueryTimeout is the longest time a single query can run before being canceled (0 for no limit)
+		QueryTimeout time.Duration `conf:"default:5s"`
+
+		// JournalMode, BusyTimeout and Synchronous set the SQLite connections, see database.SQLiteOptions. With WAL,
+		// reads don't wait for the writes
+		JournalMode string        `conf:"default:WAL"`
+		BusyTimeout time.Duration `conf:"default:5s"`
+		Synchronous string        `conf:"default:NORMAL"`
+
+		// ReadConns is the size of the pool of SQLite connections for reads (0 for no limit). Writes go through a
+		// single connection, waiting in line for it
+		ReadConns int `conf:"default:4"`
+
+		// PendingMigrations prints the migrations that would be applied to the database, and exits without applying them
+		PendingMigrations bool
+	}
+	Auth struct {
+		SessionTTL        time.Duration `conf:"default:720h"`
+		RequirePassphrase bool
+		SigningKeysFile   string
+		AccessTokenTTL    time.Duration `conf:"default:15m"`
+		TokenIssuer       string        `conf:"default:wasatext"`
+	}
+	Throttle struct {
+		FreeAttempts      int           `conf:"default:3"`
+		IPFreeAttempts    int           `conf:"default:20"`
+		BaseDelay         time.Duration `conf:"default:1s"`
+		MaxDelay          time.Duration `conf:"default:5m"`
+		LockoutAttempts   int           `conf:"default:10"`
+		IPLockoutAttempts int           `conf:"default:100"`
+		LockoutDuration   time.Duration `conf:"default:15m"`
+		Window            time.Duration `conf:"default:1h"`
+		SignupsPerIP      int           `conf:"default:10"`
+	}
+	Export struct {
+		// Dir is where the data export archives are built (wasatext-exports in the temporary directory if empty)
+		Dir string
+
+		// TTL is how long an archive can be downloaded once it is ready
+		TTL time.Duration `conf:"default:24h"`
+	}
+	Messages struct {
+		// TombstoneTTL is how long the tombstones of the deleted messages are kept before they are purged
+		TombstoneTTL time.Duration `conf:"default:720h"`
+	}
+	OIDC struct {
+		Issuer       string
+		ClientID     string
+		ClientSecret string `conf:"mask"`
+		RedirectURL  string
 	}
 }
 
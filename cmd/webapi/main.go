@@ -19,7 +19,9 @@ Return values (exit codes):
 		The program ended due to an error
 
 Note that this program will update the schema of the database to the latest version available (embedded in the
-executable during the build).
+executable during the build). To see which migrations would be applied, without applying them, run:
+
+	webapi --db-pending-migrations
 */
 package main
 
@@ -31,8 +33,10 @@ import (
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/jwt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/throttle"
 	"github.com/ardanlabs/conf"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"math/rand"
 	"net/http"
@@ -82,16 +86,40 @@ func run() error {
 
 	// Start Database
 	logger.Println("initializing database support")
-	dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
-	if err != nil {
-		logger.WithError(err).Error("error opening SQLite DB")
-		return fmt.Errorf("opening SQLite: %w", err)
+	if cfg.DB.PendingMigrations {
+		return printPendingMigrations(cfg, logger)
+	}
+	var dbconn *sql.DB
+	var readconn *sql.DB // The pool for reads, if separate
+	switch cfg.DB.Driver {
+	case "sqlite3":
+		dbconn, readconn, err = database.OpenSQLitePools(cfg.DB.Filename, database.SQLiteOptions{
+			JournalMode: cfg.DB.JournalMode,
+			BusyTimeout: cfg.DB.BusyTimeout,
+			Synchronous: cfg.DB.Synchronous,
+			ReadConns:   cfg.DB.ReadConns,
+		})
+		if err != nil {
+			logger.WithError(err).Error("error opening SQLite DB")
+			return fmt.Errorf("opening SQLite: %w", err)
+		}
+	case "postgres":
+		dbconn, err = database.OpenPostgres(cfg.DB.DSN)
+		if err != nil {
+			logger.WithError(err).Error("error opening PostgreSQL DB")
+			return fmt.Errorf("opening PostgreSQL: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown database driver %q", cfg.DB.Driver)
 	}
 	defer func() {
 		logger.Debug("database stopping")
+		if readconn != nil {
+			_ = readconn.Close()
+		}
 		_ = dbconn.Close()
 	}()
-	db, err := database.New(dbconn)
+	db, err := database.New(dbconn, database.Config{QueryTimeout: cfg.DB.QueryTimeout, ReadDB: readconn})
 	if err != nil {
 		logger.WithError(err).Error("error creating AppDatabase")
 		return fmt.Errorf("creating AppDatabase: %w", err)
@@ -109,10 +137,78 @@ func run() error {
 	// buffered channel so the goroutine can exit if we don't collect this error.
 	serverErrors := make(chan error, 1)
 
+	// OpenID Connect login is enabled only if an issuer is configured
+	var oidcClient *oidc.Client
+	if cfg.OIDC.Issuer != "" {
+		oidcClient, err = oidc.NewClient(oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+		})
+		if err != nil {
+			logger.WithError(err).Error("error configuring OpenID Connect")
+			return fmt.Errorf("configuring OpenID Connect: %w", err)
+		}
+		logger.Infof("OpenID Connect login enabled with issuer %s", cfg.OIDC.Issuer)
+	}
+
+	// Access tokens are enabled only if signing keys are configured
+	var signingKeys *jwt.KeySet
+	if cfg.Auth.SigningKeysFile != "" {
+		pemData, err := os.ReadFile(cfg.Auth.SigningKeysFile)
+		if err != nil {
+			logger.WithError(err).Error("error reading the signing keys")
+			return fmt.Errorf("reading the signing keys: %w", err)
+		}
+		signingKeys, err = jwt.LoadKeys(pemData)
+		if err != nil {
+			logger.WithError(err).Error("error loading the signing keys")
+			return fmt.Errorf("loading the signing keys: %w", err)
+		}
+		logger.Infof("access tokens enabled with %d signing keys", len(signingKeys.JWKS().Keys))
+	}
+
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:     logger,
+		Database:   db,
+		SessionTTL: cfg.Auth.SessionTTL,
+
+		RequirePassphrase: cfg.Auth.RequirePassphrase,
+		OIDC:              oidcClient,
+
+		SigningKeys:    signingKeys,
+		AccessTokenTTL: cfg.Auth.AccessTokenTTL,
+		TokenIssuer:    cfg.Auth.TokenIssuer,
+
+		UserThrottle: throttle.Policy{
+			FreeAttempts:    cfg.Throttle.FreeAttempts,
+			BaseDelay:       cfg.Throttle.BaseDelay,
+			MaxDelay:        cfg.Throttle.MaxDelay,
+			LockoutAttempts: cfg.Throttle.LockoutAttempts,
+			LockoutDuration: cfg.Throttle.LockoutDuration,
+			Window:          cfg.Throttle.Window,
+		},
+		IPThrottle: throttle.Policy{
+			FreeAttempts:    cfg.Throttle.IPFreeAttempts,
+			BaseDelay:       cfg.Throttle.BaseDelay,
+			MaxDelay:        cfg.Throttle.MaxDelay,
+			LockoutAttempts: cfg.Throttle.IPLockoutAttempts,
+			LockoutDuration: cfg.Throttle.LockoutDuration,
+			Window:          cfg.Throttle.Window,
+		},
+		SignupThrottle: throttle.Policy{
+			// After SignupsPerIP accounts, no more accounts until the window has passed
+			FreeAttempts:    cfg.Throttle.SignupsPerIP,
+			LockoutAttempts: cfg.Throttle.SignupsPerIP,
+			LockoutDuration: cfg.Throttle.Window,
+			Window:          cfg.Throttle.Window,
+		},
+		ExportDir: cfg.Export.Dir,
+		ExportTTL: cfg.Export.TTL,
+
+		TombstoneTTL: cfg.Messages.TombstoneTTL,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -182,3 +278,42 @@ func run() error {
 
 	return nil
 }
+
+// printPendingMigrations prints the migrations that would be applied to the configured database. The SQLite database is
+// opened read-only, so listing the migrations never creates it or changes its journal mode.
+func printPendingMigrations(cfg WebAPIConfiguration, logger *logrus.Logger) error {
+	var dbconn *sql.DB
+	var err error
+	switch cfg.DB.Driver {
+	case "sqlite3":
+		dbconn, err = database.OpenSQLiteReadOnly(cfg.DB.Filename)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("database %s does not exist", cfg.DB.Filename)
+		} else if err != nil {
+			logger.WithError(err).Error("error opening SQLite DB")
+			return fmt.Errorf("opening SQLite: %w", err)
+		}
+	case "postgres":
+		dbconn, err = database.OpenPostgres(cfg.DB.DSN)
+		if err != nil {
+			logger.WithError(err).Error("error opening PostgreSQL DB")
+			return fmt.Errorf("opening PostgreSQL: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown database driver %q", cfg.DB.Driver)
+	}
+	defer func() { _ = dbconn.Close() }()
+
+	pending, err := database.PendingMigrations(dbconn)
+	if err != nil {
+		logger.WithError(err).Error("error listing pending migrations")
+		return fmt.Errorf("listing pending migrations: %w", err)
+	}
+	if len(pending) == 0 {
+		fmt.Println("no pending migrations") //nolint:forbidigo
+	}
+	for _, m := range pending {
+		fmt.Printf("%04d_%s\n", m.Version, m.Name) //nolint:forbidigo
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/jwt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// issueAccessToken signs a new access token for the session of the user.
+func (rt *_router) issueAccessToken(userId uint64, sessionId int64) (string, time.Time, error) {
+	now := globaltime.Now()
+	expiresAt := now.Add(rt.accessTokenTTL)
+	token, err := rt.signingKeys.Sign(jwt.Claims{
+		Issuer:    rt.tokenIssuer,
+		Subject:   strconv.FormatUint(userId, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		SessionId: sessionId,
+	})
+	return token, time.Unix(expiresAt.Unix(), 0).UTC(), err
+}
+
+// authenticateAccessToken verifies the access token and returns its user, and the ID of the session it was issued
+// for. Access tokens are valid only as long as their session, so logging out, revoking the session or deleting the
+// account rejects them at once. errUnauthorized is returned if the token or its session is not valid.
+func (rt *_router) authenticateAccessToken(ctx context.Context, token string) (database.User, int64, error) {
+	claims, err := rt.signingKeys.Verify(token, globaltime.Now())
+	if errors.Is(err, jwt.ErrInvalidToken) {
+		return database.User{}, 0, errUnauthorized
+	} else if err != nil {
+		return database.User{}, 0, err
+	}
+	if claims.Issuer != rt.tokenIssuer {
+		return database.User{}, 0, errUnauthorized
+	}
+	userId, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return database.User{}, 0, errUnauthorized
+	}
+
+	// The username may have changed since the token was issued
+	user, session, err := rt.db.GetUserBySessionId(ctx, claims.SessionId)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		return database.User{}, 0, errUnauthorized
+	} else if err != nil {
+		return database.User{}, 0, err
+	}
+	if user.Id != userId {
+		return database.User{}, 0, errUnauthorized
+	}
+	return user, session.SessionId, nil
+}
+
+// refreshSession exchanges a refresh token for a new access token. The refresh token is rotated: the one in the
+// request can't be used again, and if two requests present it at once, the session is revoked.
+func (rt *_router) refreshSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if rt.signingKeys == nil {
+		http.Error(w, "Refresh tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "Refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	dbuser, session, err := rt.authenticateSession(r.Context(), req.RefreshToken)
+	if errors.Is(err, errUnauthorized) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't resolve the refresh token")
+		http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+
+	refreshToken, err := newSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+	err = rt.db.RotateSessionToken(r.Context(), session.SessionId, hashToken(req.RefreshToken), hashToken(refreshToken))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		// The token has been rotated in the meantime, by a concurrent refresh: it is being reused, possibly after
+		// being stolen, so the session is revoked
+		ctx.Logger.WithField("session", session.SessionId).Warning("refresh token reused, revoking the session")
+		err = rt.db.RevokeSession(r.Context(), dbuser.Id, session.SessionId)
+		if err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+			ctx.Logger.WithError(err).Error("can't revoke the session")
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't rotate the refresh token")
+		http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, expiresAt, err := rt.issueAccessToken(dbuser.Id, session.SessionId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't sign the access token")
+		http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+
+	var user User
+	user.FromDatabase(dbuser)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(LoginResponse{
+		User:             user,
+		Token:            accessToken,
+		ExpiresAt:        expiresAt,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: &session.ExpiresAt,
+	}); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getJWKS publishes the public keys used to sign access tokens, so other services can verify them.
+func (rt *_router) getJWKS(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if rt.signingKeys == nil {
+		http.Error(w, "Access tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := json.NewEncoder(w).Encode(rt.signingKeys.JWKS()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database/memory"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/jwt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newAccessTokenRouter returns a router issuing access tokens signed with a new key, on db or, if nil, on a new
+// in-memory database.
+func newAccessTokenRouter(t *testing.T, db database.AppDatabase) http.Handler {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating the signing key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("encoding the signing key: %v", err)
+	}
+	keys, err := jwt.LoadKeys(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("loading the signing key: %v", err)
+	}
+
+	cfg := Config{Database: db, SigningKeys: keys, AccessTokenTTL: 15 * time.Minute, TokenIssuer: "wasatext"}
+	h, _ := newTestRouter(t, cfg)
+	return h
+}
+
+// checkAccess checks the status of a request authenticated with the access token.
+func checkAccess(t *testing.T, h http.Handler, token string, want int, what string) {
+	t.Helper()
+	if w := doRequest(t, h, http.MethodGet, "/sessions", token, nil); w.Code != want {
+		t.Errorf("%s: got %d, want %d", what, w.Code, want)
+	}
+}
+
+func TestAccessTokenAfterLogout(t *testing.T) {
+	h := newAccessTokenRouter(t, nil)
+	alice := login(t, h, "alice", "")
+	if alice.RefreshToken == "" {
+		t.Fatalf("the login returned no refresh token")
+	}
+	checkAccess(t, h, alice.Token, http.StatusOK, "access token of an active session")
+
+	if w := doRequest(t, h, http.MethodDelete, "/session", alice.Token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("logging out: got %d %s", w.Code, w.Body.String())
+	}
+	checkAccess(t, h, alice.Token, http.StatusUnauthorized, "access token after logout")
+}
+
+func TestAccessTokenAfterRevocation(t *testing.T) {
+	h := newAccessTokenRouter(t, nil)
+	phone := login(t, h, "alice", "")
+	laptop := login(t, h, "alice", "")
+
+	if w := doRequest(t, h, http.MethodDelete, "/sessions", laptop.Token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking the other sessions: got %d %s", w.Code, w.Body.String())
+	}
+	checkAccess(t, h, phone.Token, http.StatusUnauthorized, "access token of a revoked session")
+	checkAccess(t, h, laptop.Token, http.StatusOK, "access token of the session kept")
+
+	if w := doRequest(t, h, http.MethodDelete, "/user/alice", laptop.Token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("deleting the account: got %d %s", w.Code, w.Body.String())
+	}
+	checkAccess(t, h, laptop.Token, http.StatusUnauthorized, "access token of a deleted account")
+}
+
+// refresh exchanges the refresh token, and returns the status and the new session, if any.
+func refresh(t *testing.T, h http.Handler, refreshToken string) (int, LoginResponse) {
+	t.Helper()
+	w := doRequest(t, h, http.MethodPost, "/session/refresh", "", RefreshRequest{RefreshToken: refreshToken})
+	var resp LoginResponse
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding the refreshed session: %v", err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestRefreshSession(t *testing.T) {
+	h := newAccessTokenRouter(t, nil)
+	alice := login(t, h, "alice", "")
+
+	code, refreshed := refresh(t, h, alice.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("refreshing the session: got %d", code)
+	}
+	if refreshed.Token == "" || refreshed.RefreshToken == "" || refreshed.RefreshToken == alice.RefreshToken {
+		t.Fatalf("refreshing the session: got tokens %q and %q, want a new pair", refreshed.Token, refreshed.RefreshToken)
+	}
+	checkAccess(t, h, refreshed.Token, http.StatusOK, "new access token")
+
+	// The refresh token is used once
+	if code, _ := refresh(t, h, alice.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refreshing with the old refresh token: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := refresh(t, h, refreshed.RefreshToken); code != http.StatusOK {
+		t.Errorf("refreshing with the new refresh token: got %d, want %d", code, http.StatusOK)
+	}
+}
+
+// concurrentRefresh is a database where another refresh with the same refresh token rotates it first, as if it ran
+// concurrently.
+type concurrentRefresh struct {
+	database.AppDatabase
+	winner string
+}
+
+func (db *concurrentRefresh) RotateSessionToken(ctx context.Context, sessionId int64, oldTokenHash string, tokenHash string) error {
+	if db.winner == "" {
+		db.winner = "concurrent"
+		if err := db.AppDatabase.RotateSessionToken(ctx, sessionId, oldTokenHash, hashToken(db.winner)); err != nil {
+			return err
+		}
+	}
+	return db.AppDatabase.RotateSessionToken(ctx, sessionId, oldTokenHash, tokenHash)
+}
+
+// TestRefreshSessionTwice checks that two refreshes presenting the same refresh token don't both get a new one: the
+// token is being reused, so the session is revoked.
+func TestRefreshSessionTwice(t *testing.T) {
+	db := &concurrentRefresh{AppDatabase: memory.New()}
+	h := newAccessTokenRouter(t, db)
+	alice := login(t, h, "alice", "")
+
+	if code, _ := refresh(t, h, alice.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refreshing with a token rotated concurrently: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := refresh(t, h, db.winner); code != http.StatusUnauthorized {
+		t.Errorf("refreshing with the token of the concurrent refresh: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	checkAccess(t, h, alice.Token, http.StatusUnauthorized, "access token of the session of the reused token")
+}
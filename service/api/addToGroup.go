@@ -13,10 +13,8 @@ type AddToGroupRequest struct {
 }
 
 func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get requester's ID from token
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	// Get requester from the request context
+	user := ctx.User
 
 	// Get group ID from URL
 	groupId, err := strconv.Atoi(ps.ByName("group_id"))
@@ -26,7 +24,7 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	// Check if requester is in group
-	isInGroup, err := rt.db.IsUserInGroup(user.Id, groupId)
+	isInGroup, err := rt.db.IsUserInGroup(r.Context(), user.Id, groupId)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -44,9 +42,9 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	// Add user to group directly using username
-	err = rt.db.AddUserToGroup(req.Username, groupId)
+	err = rt.db.AddUserToGroup(r.Context(), req.Username, groupId)
 	if err != nil {
-		http.Error(w, "Failed to add user to group", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to add user to group")
 		return
 	}
 
@@ -1,19 +1,50 @@
 package api
 
 import (
+	"errors"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"time"
 )
 
 // httpRouterHandler is the signature for functions that accepts a reqcontext.RequestContext in addition to those
 // required by the httprouter package.
 type httpRouterHandler func(http.ResponseWriter, *http.Request, httprouter.Params, reqcontext.RequestContext)
 
-// wrap parses the request and adds a reqcontext.RequestContext instance related to the request.
-func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+// sessionTouchInterval is the granularity of the last-used time of sessions
+const sessionTouchInterval = time.Minute
+
+// authPolicy tells wrap who can call a route.
+type authPolicy struct {
+	// authenticated routes require a valid session token or API key. The caller is available in
+	// reqcontext.RequestContext.User
+	authenticated bool
+
+	// scope is the scope that API keys need to call the route. Routes without a scope accept user sessions only
+	scope string
+}
+
+var (
+	// public routes can be called by anyone
+	public = authPolicy{}
+
+	// authenticated routes require a valid user session
+	authenticated = authPolicy{authenticated: true}
+)
+
+// withScope returns the policy of routes that accept both user sessions and API keys carrying the scope.
+func withScope(scope string) authPolicy {
+	return authPolicy{authenticated: true, scope: scope}
+}
+
+// wrap parses the request and adds a reqcontext.RequestContext instance related to the request. If the policy is
+// authenticated, requests without a valid session (or API key, if the route accepts them) are rejected here and never
+// reach the handler.
+func (rt *_router) wrap(fn httpRouterHandler, policy authPolicy) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		reqUUID, err := uuid.NewV4()
 		if err != nil {
@@ -31,6 +62,74 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 			"remote-ip": r.RemoteAddr,
 		})
 
+		if policy.authenticated {
+			token, err := bearerToken(r)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if isAPIKey(token) {
+				user, key, err := rt.authenticateAPIKey(r.Context(), token)
+				if errors.Is(err, errUnauthorized) {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				} else if err != nil {
+					ctx.Logger.WithError(err).Error("can't resolve the API key")
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if policy.scope == "" || !hasScope(key, policy.scope) {
+					http.Error(w, "API key not allowed for this operation", http.StatusForbidden)
+					return
+				}
+				ctx.User = user
+				ctx.APIKey = &key
+				ctx.Logger = ctx.Logger.WithFields(logrus.Fields{"user": user.Id, "apikey": key.KeyId})
+
+				// Record the last use of the key, at most once per sessionTouchInterval to spare writes
+				if globaltime.Since(key.LastUsedAt) > sessionTouchInterval {
+					if err := rt.db.TouchAPIKey(r.Context(), key.KeyId); err != nil {
+						ctx.Logger.WithError(err).Warning("can't update the API key last use")
+					}
+				}
+			} else if rt.signingKeys != nil {
+				// Session tokens are refresh tokens only, and can't be used as bearer tokens
+				user, sessionId, err := rt.authenticateAccessToken(r.Context(), token)
+				if errors.Is(err, errUnauthorized) {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				} else if err != nil {
+					ctx.Logger.WithError(err).Error("can't resolve the access token")
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				ctx.User = user
+				ctx.SessionId = sessionId
+				ctx.Logger = ctx.Logger.WithField("user", user.Id)
+			} else {
+				user, session, err := rt.authenticateSession(r.Context(), token)
+				if errors.Is(err, errUnauthorized) {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				} else if err != nil {
+					ctx.Logger.WithError(err).Error("can't resolve the session")
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				ctx.User = user
+				ctx.SessionId = session.SessionId
+				ctx.Logger = ctx.Logger.WithField("user", user.Id)
+
+				// Record the last use of the session, at most once per sessionTouchInterval to spare writes
+				if globaltime.Since(session.LastUsedAt) > sessionTouchInterval {
+					if err := rt.db.TouchSession(r.Context(), session.SessionId); err != nil {
+						ctx.Logger.WithError(err).Warning("can't update the session last use")
+					}
+				}
+			}
+		}
+
 		// Call the next handler in chain (usually, the handler function for the path)
 		fn(w, r, ps, ctx)
 	}
@@ -9,24 +9,49 @@ import (
 func (rt *_router) Handler() http.Handler {
 	// Register routes
 	// rt.router.GET("/", rt.getHelloWorld)
-	// rt.router.GET("/context", rt.wrap(rt.getContextReply))
+	// rt.router.GET("/context", rt.wrap(rt.getContextReply, authenticated))
 
-	rt.router.POST("/session", rt.wrap(rt.doLogin))
-	rt.router.PUT("/user/:username/setmyusername", rt.wrap(rt.setMyUsername))
-	rt.router.PUT("/user/:username/photo", rt.wrap(rt.setMyPhoto))
-	rt.router.GET("/conversations", rt.wrap(rt.getMyConversations))
-	rt.router.GET("/conversation/:conversation_id", rt.wrap(rt.getConversation))
-	rt.router.POST("/message", rt.wrap(rt.sendMessage))
-	rt.router.POST("/message/:message_id/forward", rt.wrap(rt.forwardMessage))
-	rt.router.POST("/message/:message_id/comment", rt.wrap(rt.commentMessage))
-	rt.router.DELETE("/message/:message_id/uncomment", rt.wrap(rt.uncommentMessage))
-	rt.router.DELETE("/message/:message_id", rt.wrap(rt.deleteMessage))
-	rt.router.POST("/group", rt.wrap(rt.createGroup))
-	rt.router.POST("/group/:group_id/add", rt.wrap(rt.addToGroup))
-	rt.router.DELETE("/group/:group_id/leave", rt.wrap(rt.leaveGroup))
-	rt.router.PUT("/group/:group_id/name", rt.wrap(rt.setGroupName))
-	rt.router.GET("/users/search", rt.wrap(rt.searchUsers))
-	rt.router.PUT("/group/:group_id/photo", rt.wrap(rt.setGroupPhoto))
+	rt.router.POST("/session", rt.wrap(rt.doLogin, public))
+	rt.router.DELETE("/session", rt.wrap(rt.logout, authenticated))
+	rt.router.POST("/session/totp", rt.wrap(rt.completeLogin, public))
+	rt.router.POST("/session/refresh", rt.wrap(rt.refreshSession, public))
+	rt.router.POST("/session/oidc", rt.wrap(rt.startOIDCLogin, public))
+	rt.router.POST("/session/oidc/callback", rt.wrap(rt.completeOIDCLogin, public))
+	rt.router.GET("/sessions", rt.wrap(rt.getMySessions, authenticated))
+	rt.router.DELETE("/sessions", rt.wrap(rt.revokeOtherSessions, authenticated))
+	rt.router.DELETE("/sessions/:session_id", rt.wrap(rt.revokeSession, authenticated))
+	rt.router.DELETE("/user/:username", rt.wrap(rt.deleteMyAccount, authenticated))
+	rt.router.PUT("/user/:username/setmyusername", rt.wrap(rt.setMyUsername, authenticated))
+	rt.router.PUT("/user/:username/photo", rt.wrap(rt.setMyPhoto, authenticated))
+	rt.router.PUT("/user/:username/passphrase", rt.wrap(rt.setMyPassphrase, authenticated))
+	rt.router.POST("/user/:username/totp", rt.wrap(rt.startTOTPEnrollment, authenticated))
+	rt.router.PUT("/user/:username/totp", rt.wrap(rt.confirmTOTPEnrollment, authenticated))
+	rt.router.DELETE("/user/:username/totp", rt.wrap(rt.disableTOTP, authenticated))
+	rt.router.POST("/user/:username/export", rt.wrap(rt.startExport, authenticated))
+	rt.router.GET("/user/:username/export", rt.wrap(rt.getExport, authenticated))
+	rt.router.GET("/user/:username/export/archive", rt.wrap(rt.downloadExport, authenticated))
+	rt.router.GET("/conversations", rt.wrap(rt.getMyConversations, withScope(scopeMessagesRead)))
+	rt.router.GET("/conversation/:conversation_id", rt.wrap(rt.getConversation, withScope(scopeMessagesRead)))
+	rt.router.PUT("/conversation/:conversation_id/retention", rt.wrap(rt.setConversationRetention, authenticated))
+	rt.router.GET("/search/messages", rt.wrap(rt.searchMessages, withScope(scopeMessagesRead)))
+	rt.router.POST("/message", rt.wrap(rt.sendMessage, withScope(scopeMessagesWrite)))
+	rt.router.POST("/message/:message_id/forward", rt.wrap(rt.forwardMessage, authenticated))
+	rt.router.POST("/message/:message_id/comment", rt.wrap(rt.commentMessage, authenticated))
+	rt.router.DELETE("/message/:message_id/uncomment", rt.wrap(rt.uncommentMessage, authenticated))
+	rt.router.DELETE("/message/:message_id", rt.wrap(rt.deleteMessage, authenticated))
+	rt.router.POST("/group", rt.wrap(rt.createGroup, authenticated))
+	rt.router.POST("/group/:group_id/add", rt.wrap(rt.addToGroup, authenticated))
+	rt.router.DELETE("/group/:group_id/leave", rt.wrap(rt.leaveGroup, authenticated))
+	rt.router.PUT("/group/:group_id/name", rt.wrap(rt.setGroupName, authenticated))
+	rt.router.GET("/users/search", rt.wrap(rt.searchUsers, authenticated))
+	rt.router.PUT("/group/:group_id/photo", rt.wrap(rt.setGroupPhoto, authenticated))
+	rt.router.POST("/bots", rt.wrap(rt.createBot, authenticated))
+	rt.router.GET("/bots", rt.wrap(rt.getMyBots, authenticated))
+	rt.router.POST("/bots/:bot_id/keys", rt.wrap(rt.createAPIKey, authenticated))
+	rt.router.GET("/bots/:bot_id/keys", rt.wrap(rt.getAPIKeys, authenticated))
+	rt.router.DELETE("/bots/:bot_id/keys/:key_id", rt.wrap(rt.revokeAPIKey, authenticated))
+
+	rt.router.GET("/.well-known/jwks.json", rt.wrap(rt.getJWKS, public))
 
 	// Special routes
 	rt.router.GET("/liveness", rt.liveness)
@@ -37,11 +37,20 @@ See the `main.go` file inside the `cmd/webapi` for a full usage example.
 package api
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/export"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/jwt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/throttle"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 // Config is used to provide dependencies and configuration to the New function.
@@ -51,8 +60,53 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// SessionTTL is the lifetime of the session tokens issued by doLogin
+	SessionTTL time.Duration
+
+	// RequirePassphrase makes passphrases mandatory for every account
+	RequirePassphrase bool
+
+	// OIDC is the OpenID Connect client used for single sign-on. If nil, single sign-on is disabled
+	OIDC *oidc.Client
+
+	// SigningKeys are the keys used to sign access tokens. If nil, session tokens are used as bearer tokens instead
+	SigningKeys *jwt.KeySet
+
+	// AccessTokenTTL is the lifetime of access tokens. Required if SigningKeys is set
+	AccessTokenTTL time.Duration
+
+	// TokenIssuer is the "iss" claim of access tokens
+	TokenIssuer string
+
+	// UserThrottle slows down failed logins as the same user
+	UserThrottle throttle.Policy
+
+	// IPThrottle slows down failed logins from the same IP address
+	IPThrottle throttle.Policy
+
+	// SignupThrottle limits the accounts created from the same IP address. Each account creation counts as a failure
+	SignupThrottle throttle.Policy
+
+	// ExportDir is the directory where the data export archives are built. If empty, wasatext-exports in the temporary
+	// directory of the system
+	ExportDir string
+
+	// ExportTTL is how long a data export archive can be downloaded once it is ready. If zero, defaultExportTTL
+	ExportTTL time.Duration
+
+	// TombstoneTTL is how long the tombstones of the deleted messages are kept. If zero, defaultTombstoneTTL
+	TombstoneTTL time.Duration
 }
 
+const (
+	// defaultExportTTL is how long data export archives are kept when Config.ExportTTL is zero
+	defaultExportTTL = 24 * time.Hour
+
+	// defaultTombstoneTTL is how long tombstones are kept when Config.TombstoneTTL is zero
+	defaultTombstoneTTL = 30 * 24 * time.Hour
+)
+
 // Router is the package API interface representing an API handler builder
 type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
@@ -71,6 +125,38 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.SessionTTL <= 0 {
+		return nil, errors.New("session TTL must be positive")
+	}
+	if cfg.SigningKeys != nil && cfg.AccessTokenTTL <= 0 {
+		return nil, errors.New("access token TTL must be positive")
+	}
+	if cfg.SigningKeys != nil && cfg.TokenIssuer == "" {
+		return nil, errors.New("token issuer is required")
+	}
+
+	if cfg.TombstoneTTL == 0 {
+		cfg.TombstoneTTL = defaultTombstoneTTL
+	}
+	if cfg.TombstoneTTL < 0 {
+		return nil, errors.New("tombstone TTL must be positive")
+	}
+
+	if cfg.ExportDir == "" {
+		cfg.ExportDir = filepath.Join(os.TempDir(), "wasatext-exports")
+	}
+	if cfg.ExportTTL == 0 {
+		cfg.ExportTTL = defaultExportTTL
+	}
+	exports, err := export.New(export.Config{
+		Logger:   cfg.Logger,
+		Database: cfg.Database,
+		Dir:      cfg.ExportDir,
+		TTL:      cfg.ExportTTL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating the exports: %w", err)
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -78,11 +164,32 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
-	return &_router{
+	rt := &_router{
 		router:     router,
 		baseLogger: cfg.Logger,
 		db:         cfg.Database,
-	}, nil
+		sessionTTL: cfg.SessionTTL,
+
+		requirePassphrase: cfg.RequirePassphrase,
+		oidc:              cfg.OIDC,
+
+		signingKeys:    cfg.SigningKeys,
+		accessTokenTTL: cfg.AccessTokenTTL,
+		tokenIssuer:    cfg.TokenIssuer,
+
+		userThrottle:   throttle.New(cfg.UserThrottle),
+		ipThrottle:     throttle.New(cfg.IPThrottle),
+		signupThrottle: throttle.New(cfg.SignupThrottle),
+
+		exports: exports,
+
+		tombstoneTTL: cfg.TombstoneTTL,
+		purgeDone:    make(chan struct{}),
+	}
+	var purgeCtx context.Context
+	purgeCtx, rt.purgeCancel = context.WithCancel(context.Background())
+	go rt.purgeMessages(purgeCtx)
+	return rt, nil
 }
 
 type _router struct {
@@ -93,4 +200,37 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	// sessionTTL is the lifetime of new session tokens
+	sessionTTL time.Duration
+
+	// requirePassphrase makes doLogin reject logins without a passphrase
+	requirePassphrase bool
+
+	// oidc is the OpenID Connect client, nil if single sign-on is disabled
+	oidc *oidc.Client
+
+	// signingKeys sign access tokens. If nil, session tokens are used as bearer tokens and there are no refresh tokens
+	signingKeys *jwt.KeySet
+
+	// accessTokenTTL is the lifetime of new access tokens
+	accessTokenTTL time.Duration
+
+	// tokenIssuer is the "iss" claim of access tokens
+	tokenIssuer string
+
+	// userThrottle, ipThrottle and signupThrottle keep the failed logins and the created accounts in memory
+	userThrottle   *throttle.Throttler
+	ipThrottle     *throttle.Throttler
+	signupThrottle *throttle.Throttler
+
+	// exports builds the data export archives in the background
+	exports *export.Manager
+
+	// tombstoneTTL is how long the tombstones of the deleted messages are kept before purgeMessages deletes them
+	tombstoneTTL time.Duration
+
+	// purgeCancel stops purgeMessages, which closes purgeDone once it has stopped
+	purgeCancel context.CancelFunc
+	purgeDone   chan struct{}
 }
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database/memory"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestRouter returns the handler of a router on an in-memory database, with the settings of cfg. It is closed at
+// the end of the test.
+func newTestRouter(t *testing.T, cfg Config) (http.Handler, database.AppDatabase) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg.Logger = logger
+	if cfg.Database == nil {
+		cfg.Database = memory.New()
+	}
+	if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = time.Hour
+	}
+	cfg.ExportDir = t.TempDir()
+
+	rt, err := New(cfg)
+	if err != nil {
+		t.Fatalf("creating the router: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := rt.Close(); err != nil {
+			t.Errorf("closing the router: %v", err)
+		}
+	})
+	return rt.Handler(), cfg.Database
+}
+
+// doRequest sends a request to the handler, with the token as bearer token if not empty, and body encoded as JSON if
+// not nil.
+func doRequest(t *testing.T, h http.Handler, method string, path string, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("encoding the request: %v", err)
+		}
+	}
+	r := httptest.NewRequest(method, path, &buf)
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// login logs in as the user, failing the test if the login does not succeed.
+func login(t *testing.T, h http.Handler, username string, passphrase string) LoginResponse {
+	t.Helper()
+	w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: username, Passphrase: passphrase})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("logging in as %s: got %d %s", username, w.Code, w.Body.String())
+	}
+	var resp LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the login response: %v", err)
+	}
+	return resp
+}
+
+func TestSessionAuthentication(t *testing.T) {
+	h, _ := newTestRouter(t, Config{})
+	alice := login(t, h, "alice", "")
+	if w := doRequest(t, h, http.MethodGet, "/sessions", alice.Token, nil); w.Code != http.StatusOK {
+		t.Fatalf("request with a valid session: got %d %s", w.Code, w.Body.String())
+	}
+
+	tests := map[string]string{
+		"no token":      "",
+		"unknown token": "not-a-session-token",
+	}
+	for name, token := range tests {
+		if w := doRequest(t, h, http.MethodGet, "/sessions", token, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want %d", name, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestSessionAuthenticationRevoked(t *testing.T) {
+	h, _ := newTestRouter(t, Config{})
+	phone := login(t, h, "alice", "")
+	laptop := login(t, h, "alice", "")
+
+	if w := doRequest(t, h, http.MethodDelete, "/sessions", laptop.Token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking the other sessions: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(t, h, http.MethodGet, "/sessions", phone.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked session: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := doRequest(t, h, http.MethodGet, "/sessions", laptop.Token, nil); w.Code != http.StatusOK {
+		t.Errorf("session kept: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestSessionAuthenticationExpired(t *testing.T) {
+	globaltime.FixedTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+
+	h, _ := newTestRouter(t, Config{SessionTTL: time.Hour})
+	alice := login(t, h, "alice", "")
+
+	globaltime.FixedTime = globaltime.FixedTime.Add(time.Hour - time.Second)
+	if w := doRequest(t, h, http.MethodGet, "/sessions", alice.Token, nil); w.Code != http.StatusOK {
+		t.Errorf("session about to expire: got %d, want %d", w.Code, http.StatusOK)
+	}
+	globaltime.FixedTime = globaltime.FixedTime.Add(time.Second)
+	if w := doRequest(t, h, http.MethodGet, "/sessions", alice.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired session: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiKeyPrefix distinguishes API keys from session tokens in the Authorization header
+const apiKeyPrefix = "wsk_"
+
+// API key scopes
+const (
+	// scopeMessagesRead allows reading the conversations of the bot
+	scopeMessagesRead = "messages:read"
+
+	// scopeMessagesWrite allows sending messages
+	scopeMessagesWrite = "messages:write"
+)
+
+// apiKeyScopes lists the scopes that can be granted to API keys
+var apiKeyScopes = map[string]bool{
+	scopeMessagesRead:  true,
+	scopeMessagesWrite: true,
+}
+
+// isAPIKey tells whether the bearer token is an API key rather than a session token.
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// hasScope tells whether the API key carries the scope.
+func hasScope(key database.APIKey, scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIKey generates a new random API key.
+func newAPIKey() (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + token, nil
+}
+
+// getOwnedBot parses the bot ID in the URL and returns the bot, if owned by the caller. On failure, the error response
+// is sent and false is returned.
+func (rt *_router) getOwnedBot(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) (database.Bot, bool) {
+	botId, err := strconv.ParseUint(ps.ByName("bot_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid bot ID", http.StatusBadRequest)
+		return database.Bot{}, false
+	}
+
+	bot, err := rt.db.GetBot(r.Context(), ctx.User.Id, botId)
+	if errors.Is(err, database.ErrBotNotFound) {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return database.Bot{}, false
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't get the bot")
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return database.Bot{}, false
+	}
+	return bot, true
+}
+
+// createBot creates a bot account owned by the caller.
+func (rt *_router) createBot(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req CreateBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		http.Error(w, "Bot username is required", http.StatusBadRequest)
+		return
+	}
+
+	dbbot, err := rt.db.CreateBot(r.Context(), ctx.User.Id, req.Username)
+	if errors.Is(err, database.ErrUsernameTaken) {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't create the bot")
+		http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+		return
+	}
+
+	var bot Bot
+	bot.FromDatabase(dbbot)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(bot); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getMyBots lists the bots owned by the caller.
+func (rt *_router) getMyBots(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	dbbots, err := rt.db.ListBots(r.Context(), ctx.User.Id)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't list bots")
+		http.Error(w, "Failed to get bots", http.StatusInternalServerError)
+		return
+	}
+
+	bots := make([]Bot, 0, len(dbbots))
+	for _, dbbot := range dbbots {
+		var bot Bot
+		bot.FromDatabase(dbbot)
+		bots = append(bots, bot)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(bots); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// createAPIKey issues a new API key for a bot of the caller. The key is returned only once.
+func (rt *_router) createAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	bot, ok := rt.getOwnedBot(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !apiKeyScopes[scope] {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The key can be restricted only to conversations the bot is part of
+	for _, conversationId := range req.ConversationIds {
+		isMember, err := rt.db.IsUserInGroup(r.Context(), bot.UserId, conversationId)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !isMember {
+			http.Error(w, "The bot is not a member of conversation "+strconv.Itoa(conversationId), http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret, err := newAPIKey()
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	dbkey, err := rt.db.CreateAPIKey(r.Context(), database.APIKey{
+		BotId:           bot.UserId,
+		Name:            req.Name,
+		Prefix:          secret[:len(apiKeyPrefix)+6],
+		Scopes:          req.Scopes,
+		ConversationIds: req.ConversationIds,
+	}, hashToken(secret))
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't create the API key")
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	response := NewAPIKey{Key: secret}
+	response.APIKey.FromDatabase(dbkey)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getAPIKeys lists the active API keys of a bot of the caller.
+func (rt *_router) getAPIKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	bot, ok := rt.getOwnedBot(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	dbkeys, err := rt.db.ListAPIKeys(r.Context(), bot.UserId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't list API keys")
+		http.Error(w, "Failed to get API keys", http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]APIKey, 0, len(dbkeys))
+	for _, dbkey := range dbkeys {
+		var key APIKey
+		key.FromDatabase(dbkey)
+		keys = append(keys, key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeAPIKey revokes an API key of a bot of the caller.
+func (rt *_router) revokeAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	bot, ok := rt.getOwnedBot(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	keyId, err := strconv.ParseInt(ps.ByName("key_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid key ID", http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.RevokeAPIKey(r.Context(), bot.UserId, keyId)
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't revoke the API key")
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// createBotKey creates an API key of the bot of owner that can send messages to the conversations, or to any
+// conversation if there are none.
+func createBotKey(t *testing.T, h http.Handler, owner LoginResponse, bot Bot, conversationIds ...int) string {
+	t.Helper()
+	w := doRequest(t, h, http.MethodPost, "/bots/"+strconv.FormatUint(bot.Id, 10)+"/keys", owner.Token, CreateAPIKeyRequest{
+		Name:            "test",
+		Scopes:          []string{scopeMessagesWrite},
+		ConversationIds: conversationIds,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the API key: got %d %s", w.Code, w.Body.String())
+	}
+	var key NewAPIKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatalf("decoding the API key: %v", err)
+	}
+	return key.Key
+}
+
+// sendTo sends a direct message to the user with the token, and returns the response.
+func sendTo(t *testing.T, h http.Handler, token string, username string) (Message, int) {
+	t.Helper()
+	w := doRequest(t, h, http.MethodPost, "/message", token, Message{Text: "hello", RecipientUsername: username})
+	var message Message
+	if w.Code == http.StatusCreated {
+		if err := json.NewDecoder(w.Body).Decode(&message); err != nil {
+			t.Fatalf("decoding the message: %v", err)
+		}
+	}
+	return message, w.Code
+}
+
+func TestRestrictedAPIKeyCreatesNoConversation(t *testing.T) {
+	h, db := newTestRouter(t, Config{})
+	alice := login(t, h, "alice", "")
+	carol := login(t, h, "carol", "")
+	bobby := login(t, h, "bobby", "")
+
+	w := doRequest(t, h, http.MethodPost, "/bots", alice.Token, CreateBotRequest{Username: "helper"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the bot: got %d %s", w.Code, w.Body.String())
+	}
+	var bot Bot
+	if err := json.NewDecoder(w.Body).Decode(&bot); err != nil {
+		t.Fatalf("decoding the bot: %v", err)
+	}
+	withCarol, code := sendTo(t, h, carol.Token, "helper")
+	if code != http.StatusCreated {
+		t.Fatalf("sending to the bot: got %d", code)
+	}
+	restricted := createBotKey(t, h, alice, bot, withCarol.ConversationId)
+
+	// The conversation of the key can be used by username
+	message, code := sendTo(t, h, restricted, "carol")
+	if code != http.StatusCreated || message.ConversationId != withCarol.ConversationId {
+		t.Errorf("sending to carol with the restricted key: got %d in conversation %d, want %d in %d",
+			code, message.ConversationId, http.StatusCreated, withCarol.ConversationId)
+	}
+
+	// A new conversation is refused before it is created
+	if _, code := sendTo(t, h, restricted, "bobby"); code != http.StatusForbidden {
+		t.Errorf("sending to bobby with the restricted key: got %d, want %d", code, http.StatusForbidden)
+	}
+	list, err := db.GetConversations(context.Background(), bobby.Id, database.ConversationFilter{})
+	if err != nil {
+		t.Fatalf("listing the conversations: %v", err)
+	}
+	if len(list.Conversations) != 0 {
+		t.Errorf("the refused message created conversations for bobby: %v", list.Conversations)
+	}
+
+	// Unrestricted keys start new conversations
+	if _, code := sendTo(t, h, createBotKey(t, h, alice, bot), "bobby"); code != http.StatusCreated {
+		t.Errorf("sending to bobby with an unrestricted key: got %d, want %d", code, http.StatusCreated)
+	}
+}
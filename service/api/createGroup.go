@@ -13,10 +13,8 @@ type CreateGroupRequest struct {
 }
 
 func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get creator's ID from token
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	// Get creator from the request context
+	user := ctx.User
 
 	// Decode request
 	var req CreateGroupRequest
@@ -32,11 +30,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 
 	// Get creator's username
-	creatorUsername, err := rt.db.GetUsernameById(user.Id)
-	if err != nil {
-		http.Error(w, "Failed to get creator info", http.StatusInternalServerError)
-		return
-	}
+	creatorUsername := user.Username
 
 	// Validate usernames
 	for _, username := range req.Usernames {
@@ -47,7 +41,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 		}
 
 		// Check if user exists
-		_, err := rt.db.GetUserIdByUsername(username)
+		_, err := rt.db.GetUserIdByUsername(r.Context(), username)
 		if err != nil {
 			http.Error(w, "User not found: "+username, http.StatusBadRequest)
 			return
@@ -55,7 +49,7 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 
 	// Only create group if all validations pass
-	group, err := rt.db.CreateGroup(req.Name, user.Id)
+	group, err := rt.db.CreateGroup(r.Context(), req.Name, user.Id)
 	if err != nil {
 		http.Error(w, "Failed to create group", http.StatusInternalServerError)
 		return
@@ -63,13 +57,13 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 
 	// Add other users
 	for _, username := range req.Usernames {
-		err = rt.db.AddUserToGroup(username, group.ConversationId)
+		err = rt.db.AddUserToGroup(r.Context(), username, group.ConversationId)
 		if err != nil {
 			// If we fail to add users, rollback the group creation
-			if delErr := rt.db.DeleteGroup(group.ConversationId); delErr != nil {
-				http.Error(w, "Failed to rollback group creation", http.StatusInternalServerError)
+			if delErr := rt.db.DeleteGroup(r.Context(), group.ConversationId); delErr != nil {
+				ctx.Logger.WithError(delErr).Error("can't roll back the group creation")
 			}
-			http.Error(w, "Failed to add users to group", http.StatusInternalServerError)
+			sendDatabaseError(w, ctx, err, "Failed to add users to group")
 			return
 		}
 	}
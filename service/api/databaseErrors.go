@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"net/http"
+)
+
+// databaseErrorStatus returns the HTTP status for an error of the database, from its kind: 404 for ErrNotFound, 409
+// for ErrAlreadyExists and ErrConflict, 403 for ErrForbidden, and 500 for the other errors.
+func databaseErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrAlreadyExists), errors.Is(err, database.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// sendDatabaseError sends the response for an error of the database, with the status of its kind. The message tells
+// what failed, and is followed by the reason for the errors of a kind (e.g. "Failed to add user to group: User does
+// not exist"). Errors without a kind are logged, and their reason is not sent, as it may reveal the database internals.
+func sendDatabaseError(w http.ResponseWriter, ctx reqcontext.RequestContext, err error, message string) {
+	status := databaseErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		ctx.Logger.WithError(err).Error(message)
+		http.Error(w, message, status)
+		return
+	}
+
+	// The errors of the database package have a message for users, the ones of the database only their kind
+	reason := err.Error()
+	var dbErr *database.Error
+	if errors.As(err, &dbErr) {
+		reason = dbErr.Message
+		if reason == "" {
+			reason = dbErr.Kind.Error()
+		}
+	}
+	http.Error(w, message+": "+reason, status)
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendDatabaseError(t *testing.T) {
+	tests := map[string]struct {
+		err    error
+		status int
+		body   string
+	}{
+		"not found":      {database.ErrNotFound, http.StatusNotFound, "Failed: not found"},
+		"already exists": {database.ErrAlreadyExists, http.StatusConflict, "Failed: already exists"},
+		"conflict":       {database.ErrConflict, http.StatusConflict, "Failed: conflict"},
+		"forbidden":      {database.ErrForbidden, http.StatusForbidden, "Failed: forbidden"},
+		"with a message": {database.ErrUserDoesNotExist, http.StatusNotFound, "Failed: User does not exist"},
+		"wrapped": {
+			fmt.Errorf("adding the participant: %w", database.ErrUserDoesNotExist),
+			http.StatusNotFound, "Failed: User does not exist",
+		},
+		"of the database": {
+			&database.Error{Kind: database.ErrAlreadyExists, Err: errors.New("UNIQUE constraint failed: users.Username")},
+			http.StatusConflict, "Failed: already exists",
+		},
+		"without a kind": {
+			errors.New("open /var/lib/wasatext/wasatext.db: disk I/O error"),
+			http.StatusInternalServerError, "Failed",
+		},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	for name, tt := range tests {
+		if status := databaseErrorStatus(tt.err); status != tt.status {
+			t.Errorf("%s: got status %d, want %d", name, status, tt.status)
+		}
+		w := httptest.NewRecorder()
+		sendDatabaseError(w, reqcontext.RequestContext{Logger: logger}, tt.err, "Failed")
+		if w.Code != tt.status || w.Body.String() != tt.body+"\n" {
+			t.Errorf("%s: got %d %q, want %d %q", name, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+}
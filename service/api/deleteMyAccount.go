@@ -0,0 +1,25 @@
+package api
+
+import (
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// deleteMyAccount deletes the account of the user, with its bots. The messages the user sent are kept for the others,
+// attributed to a deleted user. The username in the path can be "me", as /user/me can't be routed apart from
+// /user/:username.
+func (rt *_router) deleteMyAccount(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if username := ps.ByName("username"); username != "me" && username != ctx.User.Username {
+		http.Error(w, "Not authorized to delete this account", http.StatusForbidden)
+		return
+	}
+
+	if err := rt.db.DeleteUser(r.Context(), ctx.User.Id); err != nil {
+		sendDatabaseError(w, ctx, err, "Failed to delete the account")
+		return
+	}
+	rt.exports.Remove(ctx.User.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
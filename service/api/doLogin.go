@@ -2,30 +2,167 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
-	//	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	var req LoginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	dbuser, err := rt.db.CreateUser(user.ToDatabase())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	// Slow down password guessing, both on the user and from the same client
+	if wait := rt.loginWait(r, req.Username); wait > 0 {
+		tooManyRequests(w, wait)
 		return
 	}
+	if rt.requirePassphrase && req.Passphrase == "" {
+		rt.recordLoginFailure(r, req.Username)
+		http.Error(w, errInvalidCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Limit the accounts created from the same client
+	_, err = rt.db.GetUserIdByUsername(r.Context(), req.Username)
+	isNewUser := errors.Is(err, database.ErrNotFound)
+	if err != nil && !isNewUser {
+		ctx.Logger.WithError(err).Error("can't look up the user")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if isNewUser {
+		if wait := rt.signupThrottle.Wait(clientIP(r), globaltime.Now()); wait > 0 {
+			tooManyRequests(w, wait)
+			return
+		}
+	}
+
+	// A new account gets its passphrase in the same transaction that creates it, so that the passphrase of an
+	// existing account is never set by logging in
+	user := User{Username: req.Username}
+	var dbuser database.User
+	created := false
+	if isNewUser && req.Passphrase != "" {
+		hash, err := hashPassphrase(req.Passphrase)
+		if errors.Is(err, errInvalidPassphrase) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			ctx.Logger.WithError(err).Error("can't hash the passphrase")
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+		dbuser, err = rt.db.CreateUserWithPassphrase(r.Context(), req.Username, hash)
+		if err != nil && !errors.Is(err, database.ErrUsernameTaken) {
+			ctx.Logger.WithError(err).Error("can't create the user")
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+		created = err == nil
+	}
+	if !created {
+		dbuser, err = rt.db.CreateUser(r.Context(), user.ToDatabase())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	user.FromDatabase(dbuser)
+	if isNewUser {
+		rt.signupThrottle.Fail(clientIP(r), globaltime.Now())
+	}
+
+	// Bots authenticate with API keys only
+	if user.IsBot {
+		rt.recordLoginFailure(r, req.Username)
+		http.Error(w, errInvalidCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Single sign-on users log in at their identity provider only
+	isOIDCUser, err := rt.db.IsOIDCUser(r.Context(), user.Id)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't check the user identity")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	} else if isOIDCUser {
+		rt.recordLoginFailure(r, req.Username)
+		http.Error(w, errInvalidCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Check the passphrase, unless the account has just been created with it
+	if !created {
+		err = rt.verifyPassphrase(r.Context(), user.Id, req.Passphrase)
+		if errors.Is(err, errInvalidCredentials) {
+			rt.recordLoginFailure(r, req.Username)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			ctx.Logger.WithError(err).Error("can't verify the passphrase")
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// If two-factor authentication is enabled, the session is issued only after the second factor
+	totp, err := rt.db.GetTOTP(r.Context(), user.Id)
+	if err != nil && !errors.Is(err, database.ErrNoTOTP) {
+		ctx.Logger.WithError(err).Error("can't get the TOTP enrollment")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	} else if err == nil && totp.Confirmed {
+		// Failures are forgotten only once the second factor is verified too
+		rt.issueSecondFactorChallenge(w, r, ctx, user)
+		return
+	}
+
+	rt.recordLoginSuccess(user.Username)
+	rt.issueSession(w, r, ctx, user)
+}
+
+// issueSession creates a new session for the user, and sends the session token as response.
+func (rt *_router) issueSession(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, user User) {
+	token, err := newSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	session, err := rt.db.CreateSession(r.Context(), user.Id, hashToken(token), r.UserAgent(), globaltime.Now().Add(rt.sessionTTL))
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	response := LoginResponse{
+		User:      user,
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
+	}
+
+	// With access tokens, the session token becomes the refresh token
+	if rt.signingKeys != nil {
+		response.RefreshToken = token
+		response.RefreshExpiresAt = &session.ExpiresAt
+		response.Token, response.ExpiresAt, err = rt.issueAccessToken(user.Id, session.SessionId)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("can't sign the access token")
+			http.Error(w, "Failed to create session", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-
-	if err := json.NewEncoder(w).Encode(user); err != nil {
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		// Log the encoding error or handle it appropriately
 		rt.baseLogger.Printf("Failed to encode user: %v", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database/memory"
+	"net/http"
+	"testing"
+)
+
+// failingLookup is a database whose lookups of users by username fail.
+type failingLookup struct {
+	database.AppDatabase
+}
+
+func (failingLookup) GetUserIdByUsername(ctx context.Context, username string) (uint64, error) {
+	return 0, errors.New("database is locked")
+}
+
+func TestLoginLookupError(t *testing.T) {
+	db := memory.New()
+	h, _ := newTestRouter(t, Config{Database: failingLookup{db}})
+
+	w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: "alice"})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("login with a failing lookup: got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if _, err := db.GetUserIdByUsername(context.Background(), "alice"); !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("the failed lookup created the user: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/export"
+	"github.com/julienschmidt/httprouter"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// exportWait is how long startExport waits for the archive, so small exports are ready in the response
+const exportWait = 2 * time.Second
+
+// startExport starts building the archive of the data of the user, unless it is already being built. The response has
+// the status of the export: 200 if the archive is ready, 202 if it is still being built.
+func (rt *_router) startExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") != ctx.User.Username {
+		http.Error(w, "Not authorized to export this account", http.StatusForbidden)
+		return
+	}
+
+	_, done := rt.exports.Start(ctx.User.Id)
+	timer := time.NewTimer(exportWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	job, err := rt.exports.Get(ctx.User.Id)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("export disappeared")
+		http.Error(w, "Failed to export the data", http.StatusInternalServerError)
+		return
+	}
+	sendExport(w, ctx, job)
+}
+
+// getExport returns the status of the export of the user.
+func (rt *_router) getExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") != ctx.User.Username {
+		http.Error(w, "Not authorized to export this account", http.StatusForbidden)
+		return
+	}
+
+	job, err := rt.exports.Get(ctx.User.Id)
+	if errors.Is(err, export.ErrNoExport) {
+		http.Error(w, "No export, or expired", http.StatusNotFound)
+		return
+	}
+	sendExport(w, ctx, job)
+}
+
+// downloadExport sends the archive of the export of the user, once it is ready.
+func (rt *_router) downloadExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") != ctx.User.Username {
+		http.Error(w, "Not authorized to export this account", http.StatusForbidden)
+		return
+	}
+
+	f, job, err := rt.exports.Open(ctx.User.Id)
+	switch {
+	case errors.Is(err, export.ErrNoExport):
+		http.Error(w, "No export, or expired", http.StatusNotFound)
+		return
+	case errors.Is(err, export.ErrNotReady):
+		http.Error(w, "Export not ready", http.StatusConflict)
+		return
+	case err != nil:
+		ctx.Logger.WithError(err).Error("can't open the export")
+		http.Error(w, "Failed to open the export", http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "wasatext-" + ctx.User.Username + ".zip"}))
+	// ServeContent supports Range requests, so interrupted downloads can be resumed
+	http.ServeContent(w, r, "", job.StartedAt, f)
+}
+
+// sendExport sends the status of the export, with 202 while the archive is being built.
+func sendExport(w http.ResponseWriter, ctx reqcontext.RequestContext, job export.Job) {
+	status := http.StatusOK
+	if job.Status == export.StatusPending {
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		ctx.Logger.WithError(err).Error("can't encode the export")
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestExportOwnership(t *testing.T) {
+	h, _ := newTestRouter(t, Config{})
+	alice := login(t, h, "alice", "")
+	bob := login(t, h, "bob", "")
+
+	if w := doRequest(t, h, http.MethodPost, "/user/alice/export", alice.Token, nil); w.Code != http.StatusOK {
+		t.Fatalf("exporting the data of alice: got %d %s", w.Code, w.Body.String())
+	}
+	w := doRequest(t, h, http.MethodGet, "/user/alice/export/archive", alice.Token, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("downloading the export of alice: got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len())); err != nil {
+		t.Errorf("reading the archive: %v", err)
+	}
+
+	// bob can neither start, read nor download the export of alice
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		if w := doRequest(t, h, method, "/user/alice/export", bob.Token, nil); w.Code != http.StatusForbidden {
+			t.Errorf("%s of the export of another user: got %d, want %d", method, w.Code, http.StatusForbidden)
+		}
+	}
+	if w := doRequest(t, h, http.MethodGet, "/user/alice/export/archive", bob.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("downloading the export of another user: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	// The export of alice is not served as the one of bob
+	if w := doRequest(t, h, http.MethodGet, "/user/bob/export/archive", bob.Token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("downloading a missing export: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -13,10 +13,8 @@ type ForwardMessageRequest struct {
 }
 
 func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID from token
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	// Get user from the request context
+	user := ctx.User
 
 	// Get message ID from URL
 	messageId, err := strconv.Atoi(ps.ByName("message_id"))
@@ -33,7 +31,7 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 	}
 
 	// Check if user is part of target conversation
-	isInConv, err := rt.db.IsUserInGroup(user.Id, req.ConversationId)
+	isInConv, err := rt.db.IsUserInGroup(r.Context(), user.Id, req.ConversationId)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -44,9 +42,9 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 	}
 
 	// Forward message
-	forwardedMsg, err := rt.db.ForwardMessage(messageId, user.Id, req.ConversationId)
+	forwardedMsg, err := rt.db.ForwardMessage(r.Context(), messageId, user.Id, req.ConversationId)
 	if err != nil {
-		http.Error(w, "Failed to forward message", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to forward message")
 		return
 	}
 
@@ -2,16 +2,23 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 	"strconv"
 )
 
+const (
+	// defaultMessagePageSize is the number of messages returned when the request has no limit
+	defaultMessagePageSize = 50
+
+	maxMessagePageSize = 200
+)
+
 func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	rt.baseLogger.Printf("Getting conversation. User ID: %d", user.Id)
 
@@ -24,8 +31,14 @@ func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps ht
 
 	rt.baseLogger.Printf("Conversation ID: %d", convId)
 
+	page, err := parseMessagePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Check if user is participant
-	isMember, err := rt.db.IsUserInGroup(user.Id, convId)
+	isMember, err := rt.db.IsUserInGroup(r.Context(), user.Id, convId)
 	if err != nil {
 		rt.baseLogger.Printf("Error checking membership: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -36,18 +49,66 @@ func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps ht
 		http.Error(w, "Not authorized to view conversation", http.StatusForbidden)
 		return
 	}
+	if !ctx.AllowsConversation(convId) {
+		http.Error(w, "API key not allowed for this conversation", http.StatusForbidden)
+		return
+	}
 
 	rt.baseLogger.Printf("Getting conversation details")
-	conversation, err := rt.db.GetConversationDetails(convId, user.Id)
+	conversation, err := rt.db.GetConversationDetails(r.Context(), convId, user.Id, page)
 	if err != nil {
-		rt.baseLogger.Printf("Error getting conversation details: %v", err)
-		http.Error(w, "Failed to get conversation", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to get conversation")
 		return
 	}
 
+	// The user has now seen the messages of the page. The conversation is sent even if this fails, as only the
+	// unread counts would be wrong.
+	lastRead := 0
+	for _, m := range conversation.Messages {
+		if m.MessageId > lastRead {
+			lastRead = m.MessageId
+		}
+	}
+	if lastRead > 0 {
+		if err := rt.db.MarkConversationRead(r.Context(), convId, user.Id, lastRead); err != nil {
+			ctx.Logger.WithError(err).Error("Failed to mark the conversation as read")
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(conversation); err != nil {
 		rt.baseLogger.Printf("Error encoding conversation: %v", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
+
+// parseMessagePage reads the page of messages requested with the before, after and limit query parameters. At most
+// one of the cursors can be given.
+func parseMessagePage(r *http.Request) (database.MessagePage, error) {
+	query := r.URL.Query()
+	page := database.MessagePage{Limit: defaultMessagePageSize}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxMessagePageSize {
+			return page, errors.New("limit must be between 1 and " + strconv.Itoa(maxMessagePageSize))
+		}
+		page.Limit = n
+	}
+
+	for name, cursor := range map[string]**database.MessageCursor{"before": &page.Before, "after": &page.After} {
+		text := query.Get(name)
+		if text == "" {
+			continue
+		}
+		var c database.MessageCursor
+		if err := c.UnmarshalText([]byte(text)); err != nil {
+			return page, errors.New("invalid " + name + " cursor")
+		}
+		*cursor = &c
+	}
+	if page.Before != nil && page.After != nil {
+		return page, errors.New("before and after can't be used together")
+	}
+	return page, nil
+}
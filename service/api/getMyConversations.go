@@ -2,25 +2,46 @@ package api
 
 import (
 	"encoding/json"
-	"net/http"
-	//   "strconv"
+	"errors"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultConversationPageSize is the number of conversations returned when the request has no limit
+	defaultConversationPageSize = 50
+
+	maxConversationPageSize = 200
 )
 
 func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	rt.baseLogger.Printf("Getting conversations for user %d", user.Id) // Add logging
 
-	conversations, err := rt.db.GetConversations(user.Id)
+	filter, err := parseConversationFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// API keys restricted to some conversations only see those
+	if ctx.APIKey != nil {
+		filter.ConversationIds = ctx.APIKey.ConversationIds
+	}
+
+	conversations, err := rt.db.GetConversations(r.Context(), user.Id, filter)
 	if err != nil {
 		rt.baseLogger.Printf("Error getting conversations: %v", err) // Add error logging
 		http.Error(w, "Failed to get conversations", http.StatusInternalServerError)
 		return
 	}
+	if conversations.Conversations == nil {
+		conversations.Conversations = []database.ConversationPreview{}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(conversations); err != nil {
@@ -28,3 +49,52 @@ func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps
 		return
 	}
 }
+
+// parseConversationFilter reads the conversations requested with the query parameters: type (group or direct),
+// unread, name, photos, after and limit.
+func parseConversationFilter(r *http.Request) (database.ConversationFilter, error) {
+	query := r.URL.Query()
+	filter := database.ConversationFilter{
+		Name:  query.Get("name"),
+		Limit: defaultConversationPageSize,
+	}
+
+	switch query.Get("type") {
+	case "":
+	case "group":
+		filter.GroupsOnly = true
+	case "direct":
+		filter.DirectOnly = true
+	default:
+		return filter, errors.New("type must be group or direct")
+	}
+
+	for name, value := range map[string]*bool{"unread": &filter.UnreadOnly, "photos": &filter.WithPhotos} {
+		text := query.Get(name)
+		if text == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return filter, errors.New(name + " must be true or false")
+		}
+		*value = b
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxConversationPageSize {
+			return filter, errors.New("limit must be between 1 and " + strconv.Itoa(maxConversationPageSize))
+		}
+		filter.Limit = n
+	}
+
+	if after := query.Get("after"); after != "" {
+		var cursor database.ConversationCursor
+		if err := cursor.UnmarshalText([]byte(after)); err != nil {
+			return filter, errors.New("invalid after cursor")
+		}
+		filter.After = &cursor
+	}
+	return filter, nil
+}
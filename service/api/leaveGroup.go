@@ -10,10 +10,8 @@ import (
 // Test
 
 func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID from token
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	// Get user from the request context
+	user := ctx.User
 
 	// Get group ID from URL
 	groupId, err := strconv.Atoi(ps.ByName("group_id"))
@@ -23,7 +21,7 @@ func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	// Check if user is in group
-	isInGroup, err := rt.db.IsUserInGroup(user.Id, groupId)
+	isInGroup, err := rt.db.IsUserInGroup(r.Context(), user.Id, groupId)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -34,9 +32,9 @@ func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	// Leave group
-	err = rt.db.LeaveGroup(user.Id, groupId)
+	err = rt.db.LeaveGroup(r.Context(), user.Id, groupId)
 	if err != nil {
-		http.Error(w, "Failed to leave group", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to leave group")
 		return
 	}
 
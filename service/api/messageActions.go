@@ -13,9 +13,7 @@ type CommentRequest struct {
 }
 
 func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	messageId, err := strconv.Atoi(ps.ByName("message_id"))
 	if err != nil {
@@ -23,20 +21,10 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	// Check if user owns the message
-	isOwner, err := rt.db.IsMessageOwner(messageId, user.Id)
+	// Messages of other users are refused with ErrNotMessageOwner
+	err = rt.db.DeleteMessage(r.Context(), messageId, user.Id)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	if !isOwner {
-		http.Error(w, "Not authorized to delete this message", http.StatusForbidden)
-		return
-	}
-
-	err = rt.db.DeleteMessage(messageId, user.Id)
-	if err != nil {
-		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to delete message")
 		return
 	}
 
@@ -44,9 +32,7 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
 }
 
 func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	messageId, err := strconv.Atoi(ps.ByName("message_id"))
 	if err != nil {
@@ -55,7 +41,7 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 	}
 
 	// Check if user is trying to comment their own message
-	isOwner, err := rt.db.IsMessageOwner(messageId, user.Id)
+	isOwner, err := rt.db.IsMessageOwner(r.Context(), messageId, user.Id)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -71,9 +57,9 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 		return
 	}
 
-	err = rt.db.CommentMessage(messageId, user.Id, req.Emoji)
+	err = rt.db.CommentMessage(r.Context(), messageId, user.Id, req.Emoji)
 	if err != nil {
-		http.Error(w, "Failed to comment message", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to comment message")
 		return
 	}
 
@@ -81,9 +67,7 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 }
 
 func (rt *_router) uncommentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	messageId, err := strconv.Atoi(ps.ByName("message_id"))
 	if err != nil {
@@ -91,9 +75,9 @@ func (rt *_router) uncommentMessage(w http.ResponseWriter, r *http.Request, ps h
 		return
 	}
 
-	err = rt.db.UncommentMessage(messageId, user.Id)
+	err = rt.db.UncommentMessage(r.Context(), messageId, user.Id)
 	if err != nil {
-		http.Error(w, "Failed to remove comment", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to remove comment")
 		return
 	}
 
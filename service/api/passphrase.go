@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+const (
+	minPassphraseLength = 8
+
+	// maxPassphraseLength is the longest passphrase (in bytes) that bcrypt can hash
+	maxPassphraseLength = 72
+)
+
+// errInvalidCredentials is returned when the login fails. The message is deliberately generic, so it does not reveal
+// whether the account exists or has a passphrase.
+var errInvalidCredentials = errors.New("invalid username or passphrase")
+
+// errInvalidPassphrase is returned when a new passphrase is too short or too long
+var errInvalidPassphrase = errors.New("passphrase must be between 8 and 72 bytes long")
+
+// hashPassphrase validates the passphrase and hashes it with bcrypt.
+func hashPassphrase(passphrase string) (string, error) {
+	if len(passphrase) < minPassphraseLength || len(passphrase) > maxPassphraseLength {
+		return "", errInvalidPassphrase
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// verifyPassphrase checks the passphrase of the user in constant time. errInvalidCredentials is returned if the
+// passphrase does not match. An account without a passphrase accepts an empty one only, unless passphrases are
+// mandatory: passphrases are set when the account is created or with setMyPassphrase, never by logging in.
+func (rt *_router) verifyPassphrase(ctx context.Context, userId uint64, passphrase string) error {
+	hash, err := rt.db.GetPassphraseHash(ctx, userId)
+	if errors.Is(err, database.ErrNoPassphrase) {
+		if passphrase != "" || rt.requirePassphrase {
+			return errInvalidCredentials
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(passphrase)) != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// setMyPassphrase sets or changes the passphrase of the caller. Changing an existing passphrase requires the current
+// one, and revokes every other session of the caller.
+func (rt *_router) setMyPassphrase(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") != ctx.User.Username {
+		http.Error(w, "Not authorized to change this passphrase", http.StatusForbidden)
+		return
+	}
+
+	var req PassphraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Check the current passphrase, if any
+	current, err := rt.db.GetPassphraseHash(r.Context(), ctx.User.Id)
+	if err != nil && !errors.Is(err, database.ErrNoPassphrase) {
+		ctx.Logger.WithError(err).Error("can't get the passphrase")
+		http.Error(w, "Failed to set passphrase", http.StatusInternalServerError)
+		return
+	} else if err == nil && bcrypt.CompareHashAndPassword([]byte(current), []byte(req.CurrentPassphrase)) != nil {
+		http.Error(w, "Invalid current passphrase", http.StatusForbidden)
+		return
+	}
+
+	hash, err := hashPassphrase(req.Passphrase)
+	if errors.Is(err, errInvalidPassphrase) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't hash the passphrase")
+		http.Error(w, "Failed to set passphrase", http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.SetPassphraseHash(r.Context(), ctx.User.Id, hash)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't set the passphrase")
+		http.Error(w, "Failed to set passphrase", http.StatusInternalServerError)
+		return
+	}
+
+	// Sessions opened with the old passphrase (or without one) are not trusted anymore
+	err = rt.db.RevokeOtherSessions(r.Context(), ctx.User.Id, ctx.SessionId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't revoke the other sessions")
+		http.Error(w, "Failed to revoke the other sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"testing"
+)
+
+func TestLoginDoesNotSetPassphrase(t *testing.T) {
+	h, db := newTestRouter(t, Config{})
+	owner := login(t, h, "alice", "")
+
+	// Someone else logs in with a passphrase to the account without one
+	w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: "alice", Passphrase: "attackerpass1"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a passphrase to an account without one: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if _, err := db.GetPassphraseHash(context.Background(), owner.Id); !errors.Is(err, database.ErrNoPassphrase) {
+		t.Fatalf("the login changed the passphrase of the account: %v", err)
+	}
+
+	// The owner still logs in without it
+	login(t, h, "alice", "")
+}
+
+func TestLoginKeepsPassphrase(t *testing.T) {
+	h, db := newTestRouter(t, Config{})
+	owner := login(t, h, "alice", "")
+	w := doRequest(t, h, http.MethodPut, "/user/alice/passphrase", owner.Token, PassphraseRequest{Passphrase: "ownerpass12"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("setting the passphrase: got %d %s", w.Code, w.Body.String())
+	}
+	hash, err := db.GetPassphraseHash(context.Background(), owner.Id)
+	if err != nil {
+		t.Fatalf("getting the passphrase: %v", err)
+	}
+
+	for _, passphrase := range []string{"", "attackerpass1"} {
+		w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: "alice", Passphrase: passphrase})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("login with passphrase %q: got %d, want %d", passphrase, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if after, err := db.GetPassphraseHash(context.Background(), owner.Id); err != nil || after != hash {
+		t.Fatalf("the failed logins changed the passphrase of the account (err %v)", err)
+	}
+	login(t, h, "alice", "ownerpass12")
+}
+
+func TestSignupSetsPassphrase(t *testing.T) {
+	h, db := newTestRouter(t, Config{RequirePassphrase: true})
+
+	w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: "alice", Passphrase: "short"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("signup with a short passphrase: got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	user := login(t, h, "alice", "alicepass12")
+	hash, err := db.GetPassphraseHash(context.Background(), user.Id)
+	if err != nil {
+		t.Fatalf("getting the passphrase: %v", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("alicepass12")) != nil {
+		t.Errorf("the stored hash does not match the passphrase of the signup")
+	}
+	login(t, h, "alice", "alicepass12")
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"time"
+)
+
+// messagePurgeInterval is how often purgeMessages looks for expired messages and tombstones
+const messagePurgeInterval = time.Minute
+
+// purgeMessages deletes the messages older than the retention period of their conversation, and the tombstones of the
+// messages deleted more than tombstoneTTL ago, at start and then every messagePurgeInterval, until the context is
+// canceled.
+func (rt *_router) purgeMessages(ctx context.Context) {
+	defer close(rt.purgeDone)
+
+	ticker := time.NewTicker(messagePurgeInterval)
+	defer ticker.Stop()
+	for {
+		now := globaltime.Now()
+		purged, err := rt.db.PurgeExpiredMessages(ctx, now)
+		if err != nil && ctx.Err() == nil {
+			rt.baseLogger.WithError(err).Error("can't purge the expired messages")
+		} else if purged > 0 {
+			rt.baseLogger.WithField("purged", purged).Info("expired messages purged")
+		}
+
+		purged, err = rt.db.PurgeDeletedMessages(ctx, now.Add(-rt.tombstoneTTL))
+		if err != nil && ctx.Err() == nil {
+			rt.baseLogger.WithError(err).Error("can't purge the deleted messages")
+		} else if purged > 0 {
+			rt.baseLogger.WithField("purged", purged).Info("deleted messages purged")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
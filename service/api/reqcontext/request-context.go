@@ -7,6 +7,7 @@ Each value here should be assumed valid only per request only, with some excepti
 package reqcontext
 
 import (
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 )
@@ -18,4 +19,33 @@ type RequestContext struct {
 
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
+
+	// User is the caller of the request. It is set only for routes that require authentication
+	User database.User
+
+	// SessionId is the ID of the session used by the caller. It is set only for routes that require authentication
+	SessionId int64
+
+	// APIKey is the API key used by the caller, if the caller is a bot. It is nil for user sessions
+	APIKey *database.APIKey
+}
+
+// AllowsConversation tells whether the credentials of the request give access to the conversation. User sessions give
+// access to every conversation of the user, while API keys can be restricted to some conversations only.
+func (ctx RequestContext) AllowsConversation(conversationId int) bool {
+	if ctx.APIKey == nil || len(ctx.APIKey.ConversationIds) == 0 {
+		return true
+	}
+	for _, id := range ctx.APIKey.ConversationIds {
+		if id == conversationId {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsNewConversations tells whether the credentials of the request can start new conversations. API keys restricted
+// to some conversations can't, as the new conversation would never be one of them.
+func (ctx RequestContext) AllowsNewConversations() bool {
+	return ctx.APIKey == nil || len(ctx.APIKey.ConversationIds) == 0
 }
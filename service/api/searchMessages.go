@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// searchMessages searches the messages of the conversations of the user. Messages of the conversations the user has
+// left are never returned.
+func (rt *_router) searchMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	search, err := parseMessageSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if search.ConversationId != 0 && !ctx.AllowsConversation(search.ConversationId) {
+		http.Error(w, "API key not allowed for this conversation", http.StatusForbidden)
+		return
+	}
+
+	// API keys restricted to some conversations only search those
+	if ctx.APIKey != nil {
+		search.ConversationIds = ctx.APIKey.ConversationIds
+	}
+
+	results, err := rt.db.SearchMessages(r.Context(), ctx.User.Id, search)
+	if err != nil {
+		sendDatabaseError(w, ctx, err, "Failed to search messages")
+		return
+	}
+	if results.Results == nil {
+		results.Results = []database.SearchResult{}
+	}
+	for i := range results.Results {
+		results.Results[i].Snippet = snippetHTML(results.Results[i].Snippet)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		rt.baseLogger.Printf("Error encoding search results: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// parseMessageSearch reads the search requested with the query parameters: q, conversation_id, before and limit.
+func parseMessageSearch(r *http.Request) (database.MessageSearch, error) {
+	query := r.URL.Query()
+	search := database.MessageSearch{Query: query.Get("q"), Limit: defaultMessagePageSize}
+
+	if len(database.SearchTerms(search.Query)) == 0 {
+		return search, errors.New("q must have at least a word")
+	}
+
+	if id := query.Get("conversation_id"); id != "" {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 1 {
+			return search, errors.New("invalid conversation_id")
+		}
+		search.ConversationId = n
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxMessagePageSize {
+			return search, errors.New("limit must be between 1 and " + strconv.Itoa(maxMessagePageSize))
+		}
+		search.Limit = n
+	}
+
+	if before := query.Get("before"); before != "" {
+		var cursor database.MessageCursor
+		if err := cursor.UnmarshalText([]byte(before)); err != nil {
+			return search, errors.New("invalid before cursor")
+		}
+		search.Before = &cursor
+	}
+	return search, nil
+}
+
+// snippetHTML escapes the snippet of a search result as HTML, with the matching words in <mark> elements.
+func snippetHTML(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	return strings.NewReplacer(database.HighlightStart, "<mark>", database.HighlightEnd, "</mark>").Replace(escaped)
+}
@@ -21,7 +21,7 @@ func (rt *_router) searchUsers(w http.ResponseWriter, r *http.Request, ps httpro
 	}
 
 	rt.baseLogger.Printf("Calling database SearchUsers with query: %s", query)
-	users, err := rt.db.SearchUsers(query)
+	users, err := rt.db.SearchUsers(r.Context(), query)
 	if err != nil {
 		rt.baseLogger.Printf("Database error in SearchUsers: %v", err)
 		http.Error(w, "Failed to search users", http.StatusInternalServerError)
@@ -2,19 +2,19 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
-	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
 	"github.com/julienschmidt/httprouter"
 )
 
 func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID from Authorization header
+	// Get user from the request context
 	rt.baseLogger.Println("SendMessage endpoint called")
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	// Decode the request body
 	var message Message
@@ -33,7 +33,7 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 
 	// Handle conversation lookup by name
 	if message.ConversationName != "" {
-		convId, err := rt.db.GetConversationIdByName(message.ConversationName)
+		convId, err := rt.db.GetConversationIdByName(r.Context(), message.ConversationName)
 		if err != nil {
 			http.Error(w, "Conversation not found", http.StatusNotFound)
 			return
@@ -43,7 +43,7 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 
 	// Handle recipient lookup by username
 	if message.RecipientUsername != "" {
-		recipientId, err := rt.db.GetRecipientIdByUsername(message.RecipientUsername)
+		recipientId, err := rt.db.GetRecipientIdByUsername(r.Context(), message.RecipientUsername)
 		if err != nil {
 			http.Error(w, "Recipient not found", http.StatusNotFound)
 			return
@@ -54,7 +54,7 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 	// Check if it's a group message or direct message
 	if message.ConversationId != 0 {
 		// It's a message to an existing conversation (group or direct)
-		isParticipant, err := rt.db.IsUserInGroup(user.Id, message.ConversationId)
+		isParticipant, err := rt.db.IsUserInGroup(r.Context(), user.Id, message.ConversationId)
 		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
@@ -64,10 +64,14 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 			return
 		}
 	} else if message.RecipientId != 0 {
-		// It's a new direct message
-		newConvId, err := rt.db.GetOrCreateDirectConversation(user.Id, message.RecipientId)
-		if err != nil {
-			http.Error(w, "Failed to handle conversation", http.StatusInternalServerError)
+		// It's a new direct message. Restricted API keys can only use an existing conversation, so nothing is created
+		// before the key is refused
+		newConvId, err := rt.db.GetOrCreateDirectConversation(r.Context(), user.Id, message.RecipientId, ctx.AllowsNewConversations())
+		if errors.Is(err, database.ErrConversationNotFound) {
+			http.Error(w, "API key not allowed for this conversation", http.StatusForbidden)
+			return
+		} else if err != nil {
+			sendDatabaseError(w, ctx, err, "Failed to handle conversation")
 			return
 		}
 		message.ConversationId = newConvId
@@ -76,16 +80,22 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
+	// API keys can be restricted to some conversations
+	if !ctx.AllowsConversation(message.ConversationId) {
+		http.Error(w, "API key not allowed for this conversation", http.StatusForbidden)
+		return
+	}
+
 	// Set message metadata
 	message.SenderId = user.Id
-	message.SendTime = time.Now()
+	message.SendTime = globaltime.Now()
 	message.Status = "Sent"
 
 	// Store message in database
 	dbMsg := message.ToDatabase()
-	dbMsg, err = rt.db.CreateMessage(dbMsg)
+	dbMsg, err = rt.db.CreateMessage(r.Context(), dbMsg)
 	if err != nil {
-		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to send message")
 		return
 	}
 
@@ -93,9 +103,9 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
 	message.FromDatabase(dbMsg)
 
 	// Update conversation's last message
-	err = rt.db.UpdateLastMessage(message.MessageId, message.ConversationId)
+	err = rt.db.UpdateLastMessage(r.Context(), message.MessageId, message.ConversationId)
 	if err != nil {
-		http.Error(w, "Failed to update conversation", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to update conversation")
 		return
 	}
 
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+)
+
+// logout revokes the session used for the request.
+func (rt *_router) logout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	err := rt.db.RevokeSession(r.Context(), ctx.User.Id, ctx.SessionId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't revoke the session")
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getMySessions lists the active sessions of the caller. The session used for the request is marked as current.
+func (rt *_router) getMySessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	dbsessions, err := rt.db.ListSessions(r.Context(), ctx.User.Id)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't list sessions")
+		http.Error(w, "Failed to get sessions", http.StatusInternalServerError)
+		return
+	}
+
+	sessions := make([]Session, 0, len(dbsessions))
+	for _, dbsession := range dbsessions {
+		var session Session
+		session.FromDatabase(dbsession)
+		session.Current = dbsession.SessionId == ctx.SessionId
+		sessions = append(sessions, session)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeSession revokes one of the sessions of the caller.
+func (rt *_router) revokeSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	sessionId, err := strconv.ParseInt(ps.ByName("session_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	err = rt.db.RevokeSession(r.Context(), ctx.User.Id, sessionId)
+	if errors.Is(err, database.ErrSessionNotFound) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't revoke the session")
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOtherSessions revokes every session of the caller, except the one used for the request.
+func (rt *_router) revokeOtherSessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	err := rt.db.RevokeOtherSessions(r.Context(), ctx.User.Id, ctx.SessionId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't revoke sessions")
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minRetention and maxRetention bound the retention period of a conversation
+	minRetention = time.Minute
+	maxRetention = 365 * 24 * time.Hour
+)
+
+// SetRetentionRequest sets the retention period of a conversation: a duration like "24h" or "90m", or a number of days
+// like "7d". An empty retention, or "off", keeps the messages forever.
+type SetRetentionRequest struct {
+	Retention string `json:"retention"`
+}
+
+// setConversationRetention sets how long the messages of the conversation are kept, and returns the event recording
+// the change in the conversation.
+func (rt *_router) setConversationRetention(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	convId, err := strconv.Atoi(ps.ByName("conversation_id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	var req SetRetentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	retention, err := parseRetention(req.Retention)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !ctx.AllowsConversation(convId) {
+		http.Error(w, "API key not allowed for this conversation", http.StatusForbidden)
+		return
+	}
+	event, err := rt.db.SetConversationRetention(r.Context(), convId, ctx.User.Id, retention)
+	if err != nil {
+		sendDatabaseError(w, ctx, err, "Failed to set the retention")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(event); err != nil {
+		ctx.Logger.WithError(err).Error("can't encode the event")
+	}
+}
+
+// errRetentionRange is returned by parseRetention for a retention period out of minRetention and maxRetention.
+var errRetentionRange = errors.New("retention must be between 1 minute and 365 days")
+
+// parseRetention parses the retention period of SetRetentionRequest, 0 to keep the messages forever.
+func parseRetention(s string) (time.Duration, error) {
+	if s == "" || s == "off" {
+		return 0, nil
+	}
+
+	var retention time.Duration
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, errors.New("invalid retention")
+		}
+		// Bounded before multiplying, as a large number of days would overflow into an accepted retention
+		if n < 0 || n > int(maxRetention/(24*time.Hour)) {
+			return 0, errRetentionRange
+		}
+		retention = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if retention, err = time.ParseDuration(s); err != nil {
+			return 0, errors.New("invalid retention")
+		}
+	}
+
+	if retention < minRetention || retention > maxRetention {
+		return 0, errRetentionRange
+	}
+	if retention%time.Second != 0 {
+		return 0, errors.New("retention must be a whole number of seconds")
+	}
+	return retention, nil
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	valid := map[string]time.Duration{
+		"":     0,
+		"off":  0,
+		"1m":   time.Minute,
+		"90m":  90 * time.Minute,
+		"7d":   7 * 24 * time.Hour,
+		"365d": maxRetention,
+	}
+	for s, want := range valid {
+		if got, err := parseRetention(s); err != nil || got != want {
+			t.Errorf("parseRetention(%q): got %v, %v, want %v", s, got, err, want)
+		}
+	}
+
+	invalid := []string{
+		"59s",
+		"366d",
+		"0d",
+		"-1d",
+		"90.5s",
+		"d",
+		"forever",
+		// Days overflowing time.Duration into 17h 33m 52s
+		"416999965498d",
+		"9223372036854775807d",
+	}
+	for _, s := range invalid {
+		if got, err := parseRetention(s); err == nil {
+			t.Errorf("parseRetention(%q): got %v, want an error", s, got)
+		}
+	}
+}
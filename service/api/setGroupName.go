@@ -13,10 +13,8 @@ type SetGroupNameRequest struct {
 }
 
 func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID from token
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	// Get user from the request context
+	user := ctx.User
 
 	// Get group ID from URL
 	groupId, err := strconv.Atoi(ps.ByName("group_id"))
@@ -26,7 +24,7 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 	}
 
 	// Check if user is in group
-	isInGroup, err := rt.db.IsUserInGroup(user.Id, groupId)
+	isInGroup, err := rt.db.IsUserInGroup(r.Context(), user.Id, groupId)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -50,9 +48,9 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 	}
 
 	// Set new name
-	err = rt.db.SetGroupName(groupId, req.Name)
+	err = rt.db.SetGroupName(r.Context(), groupId, req.Name)
 	if err != nil {
-		http.Error(w, "Failed to update group name", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to update group name")
 		return
 	}
 
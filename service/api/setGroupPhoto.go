@@ -14,9 +14,7 @@ type PhotoRequest struct {
 }
 
 func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	groupId, err := strconv.Atoi(ps.ByName("group_id"))
 	if err != nil {
@@ -25,7 +23,7 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 	}
 
 	// Check if user is in group
-	isMember, err := rt.db.IsUserInGroup(user.Id, groupId)
+	isMember, err := rt.db.IsUserInGroup(r.Context(), user.Id, groupId)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -47,9 +45,9 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	err = rt.db.SetGroupPhoto(groupId, req.Photo)
+	err = rt.db.SetGroupPhoto(r.Context(), groupId, req.Photo)
 	if err != nil {
-		http.Error(w, "Failed to set photo", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to set photo")
 		return
 	}
 
@@ -10,9 +10,7 @@ import (
 )
 
 func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
+	user := ctx.User
 
 	var req PhotoRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -26,9 +24,9 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	err := rt.db.SetUserPhoto(user.Id, req.Photo)
+	err := rt.db.SetUserPhoto(r.Context(), user.Id, req.Photo)
 	if err != nil {
-		http.Error(w, "Failed to set photo", http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to set photo")
 		return
 	}
 
@@ -17,11 +17,10 @@ func (rt *_router) setMyUsername(w http.ResponseWriter, r *http.Request, ps http
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	token := getToken(r.Header.Get("Authorization"))
-	user.Id = token
-	dbuser, err := rt.db.SetUsername(user.ToDatabase(), username)
+	user.Id = ctx.User.Id
+	dbuser, err := rt.db.SetUsername(r.Context(), user.ToDatabase(), username)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		sendDatabaseError(w, ctx, err, "Failed to set username")
 		return
 	}
 	user.FromDatabase(dbuser)
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// oidcLoginTTL is the time given to the user to log in at the identity provider
+	oidcLoginTTL = 10 * time.Minute
+
+	// maxUsernameLength is the maximum length of usernames, as accepted by the web UI
+	maxUsernameLength = 30
+
+	// maxUsernameAttempts is the number of suffixes tried when the username of a new single sign-on user is taken
+	maxUsernameAttempts = 100
+)
+
+// invalidUsernameChars matches the characters not allowed in usernames
+var invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// oidcUsername returns the preferred username for a new single sign-on user, from the claims of the identity
+// provider.
+func oidcUsername(claims oidc.Claims) string {
+	username := claims.PreferredUsername
+	if username == "" {
+		username = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	if username == "" {
+		username = claims.Name
+	}
+
+	username = strings.Trim(invalidUsernameChars.ReplaceAllString(username, "_"), "_")
+	if username == "" {
+		username = "user"
+	}
+	// Leave room for the suffix added when the username is taken
+	if len(username) > maxUsernameLength-4 {
+		username = username[:maxUsernameLength-4]
+	}
+	return username
+}
+
+// oidcLoginKey returns the key of the OIDC login with the state and the binding, as stored in the database.
+func oidcLoginKey(state string, binding string) string {
+	return hashToken(state + "." + binding)
+}
+
+// startOIDCLogin starts a single sign-on login, and returns the URL of the identity provider where the user has to be
+// sent. The provider sends the user back to the configured redirect URL, which has to pass the code and state to
+// completeOIDCLogin, with the binding returned here.
+func (rt *_router) startOIDCLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if rt.oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	state, err := oidc.NewState()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	binding, err := oidc.NewState()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := oidc.NewState()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	authorizationURL, err := rt.oidc.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't reach the identity provider")
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	expiresAt := globaltime.Now().Add(oidcLoginTTL)
+	err = rt.db.CreateOIDCLogin(r.Context(), oidcLoginKey(state, binding), database.OIDCLogin{
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    expiresAt,
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't store the OIDC login")
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(OIDCAuthorization{
+		AuthorizationURL: authorizationURL,
+		State:            state,
+		Binding:          binding,
+		ExpiresAt:        expiresAt,
+	}); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// completeOIDCLogin redeems the authorization code returned by the identity provider, and issues a session. The user
+// is created on the first login, and found by the subject of the identity provider afterwards.
+func (rt *_router) completeOIDCLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if rt.oidc == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	var req OIDCCallback
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.State == "" || req.Binding == "" {
+		http.Error(w, "State and binding are required", http.StatusBadRequest)
+		return
+	}
+
+	// The state is accepted only once, whatever the outcome, and only with the binding of the browser that started
+	// the login: a callback URL of another login, e.g. sent by an attacker to log the user in to the attacker's
+	// account, is refused
+	login, err := rt.db.TakeOIDCLogin(r.Context(), oidcLoginKey(req.State, req.Binding))
+	if errors.Is(err, database.ErrOIDCLoginNotFound) {
+		http.Error(w, "Login expired, log in again", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't get the OIDC login")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Error != "" || req.Code == "" {
+		ctx.Logger.WithField("error", req.Error).Info("login refused by the identity provider")
+		http.Error(w, "Single sign-on failed", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := rt.oidc.Exchange(r.Context(), req.Code, login.CodeVerifier, login.Nonce)
+	if errors.Is(err, oidc.ErrLoginFailed) {
+		ctx.Logger.WithError(err).Warning("OIDC login failed")
+		http.Error(w, "Single sign-on failed", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't reach the identity provider")
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	dbuser, err := rt.getOrCreateOIDCUser(r.Context(), claims)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't get the OIDC user")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	var user User
+	user.FromDatabase(dbuser)
+	rt.issueSession(w, r, ctx, user)
+}
+
+// getOrCreateOIDCUser returns the user linked to the identity, creating it on the first login. If the preferred
+// username is taken, a numeric suffix is added.
+func (rt *_router) getOrCreateOIDCUser(ctx context.Context, claims oidc.Claims) (database.User, error) {
+	issuer := rt.oidc.Issuer()
+	user, err := rt.db.GetOIDCUser(ctx, issuer, claims.Subject)
+	if !errors.Is(err, database.ErrUserDoesNotExist) {
+		return user, err
+	}
+
+	base := oidcUsername(claims)
+	for i := 1; i <= maxUsernameAttempts; i++ {
+		username := base
+		if i > 1 {
+			username = fmt.Sprintf("%s_%d", base, i)
+		}
+		user, err = rt.db.CreateOIDCUser(ctx, issuer, claims.Subject, username)
+		if !errors.Is(err, database.ErrUsernameTaken) {
+			return user, err
+		}
+	}
+	return database.User{}, fmt.Errorf("no free username for %q", base)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc/oidctest"
+	"net/http"
+	"testing"
+)
+
+// newOIDCRouter returns a router with single sign-on at a new mock issuer.
+func newOIDCRouter(t *testing.T) (http.Handler, *oidctest.Issuer) {
+	t.Helper()
+	issuer := oidctest.NewIssuer(t, "wasatext")
+	client, err := oidc.NewClient(oidc.Config{Issuer: issuer.URL, ClientID: "wasatext", RedirectURL: oidctest.RedirectURL})
+	if err != nil {
+		t.Fatalf("creating the OIDC client: %v", err)
+	}
+	h, _ := newTestRouter(t, Config{OIDC: client})
+	return h, issuer
+}
+
+// startOIDCLogin starts a single sign-on login, completes it at the provider as subject, and returns the parameters
+// sent back to the redirect URL, with the binding kept by the browser.
+func startOIDCLogin(t *testing.T, h http.Handler, issuer *oidctest.Issuer, subject string) OIDCCallback {
+	t.Helper()
+	w := doRequest(t, h, http.MethodPost, "/session/oidc", "", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("starting the login: got %d %s", w.Code, w.Body.String())
+	}
+	var authorization OIDCAuthorization
+	if err := json.NewDecoder(w.Body).Decode(&authorization); err != nil {
+		t.Fatalf("decoding the authorization: %v", err)
+	}
+	code, err := issuer.Authorize(authorization.AuthorizationURL, subject)
+	if err != nil {
+		t.Fatalf("logging in at the provider: %v", err)
+	}
+	if authorization.Binding == "" {
+		t.Fatalf("the login has no binding")
+	}
+	return OIDCCallback{Code: code, State: authorization.State, Binding: authorization.Binding}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	h, issuer := newOIDCRouter(t)
+
+	callback := startOIDCLogin(t, h, issuer, "alice")
+	w := doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", callback)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("completing the login: got %d %s", w.Code, w.Body.String())
+	}
+	var first LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&first); err != nil {
+		t.Fatalf("decoding the session: %v", err)
+	}
+	if first.Username != "alice" {
+		t.Errorf("username: got %q, want alice", first.Username)
+	}
+
+	// The state is accepted once
+	w = doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", callback)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("completing the login again: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The next login of the subject gets the same user
+	w = doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", startOIDCLogin(t, h, issuer, "alice"))
+	var second LoginResponse
+	if err := json.NewDecoder(w.Body).Decode(&second); err != nil || second.Id != first.Id {
+		t.Errorf("second login: got user %d (%v), want %d", second.Id, err, first.Id)
+	}
+
+	// Single sign-on users can't log in with a username only
+	w = doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: "alice"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login of a single sign-on user: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCLoginBadState(t *testing.T) {
+	h, issuer := newOIDCRouter(t)
+	callback := startOIDCLogin(t, h, issuer, "alice")
+
+	forged := callback
+	forged.State = "forged"
+	w := doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", forged)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("callback with an unknown state: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The code of a login can't complete another one, as the PKCE verifier does not match
+	other := startOIDCLogin(t, h, issuer, "mallory")
+	forged = OIDCCallback{Code: callback.Code, State: other.State, Binding: other.Binding}
+	w = doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", forged)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("callback with the state of another login: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestOIDCLoginForeignState checks that the callback URL of a login started by an attacker, and sent to the victim,
+// can't log the victim in to the account of the attacker.
+func TestOIDCLoginForeignState(t *testing.T) {
+	h, issuer := newOIDCRouter(t)
+	attacker := startOIDCLogin(t, h, issuer, "mallory")
+	victim := startOIDCLogin(t, h, issuer, "alice")
+
+	tests := map[string]OIDCCallback{
+		"binding of another login": {Code: attacker.Code, State: attacker.State, Binding: victim.Binding},
+		"no binding":               {Code: attacker.Code, State: attacker.State},
+	}
+	for name, callback := range tests {
+		w := doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", callback)
+		if w.Code != http.StatusUnauthorized && w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d or %d", name, w.Code, http.StatusUnauthorized, http.StatusBadRequest)
+		}
+	}
+
+	// Neither login has been consumed by the refused callbacks
+	if w := doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", victim); w.Code != http.StatusCreated {
+		t.Errorf("login of the victim: got %d %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(t, h, http.MethodPost, "/session/oidc/callback", "", attacker); w.Code != http.StatusCreated {
+		t.Errorf("login of the attacker in their own browser: got %d %s", w.Code, w.Body.String())
+	}
+}
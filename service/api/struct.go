@@ -11,12 +11,14 @@ type User struct {
 	Id           uint64 `json:"id"`
 	Username     string `json:"username"`
 	ProfilePhoto string `json:"profilePhoto,omitempty"`
+	IsBot        bool   `json:"isBot,omitempty"`
 }
 
 func (u *User) FromDatabase(user database.User) {
 	u.Id = user.Id
 	u.Username = user.Username
 	u.ProfilePhoto = user.ProfilePhoto
+	u.IsBot = user.IsBot
 }
 
 func (u *User) ToDatabase() database.User {
@@ -24,9 +26,158 @@ func (u *User) ToDatabase() database.User {
 		Id:           u.Id,
 		Username:     u.Username,
 		ProfilePhoto: u.ProfilePhoto,
+		IsBot:        u.IsBot,
 	}
 }
 
+// Login struct
+
+type LoginRequest struct {
+	Username   string `json:"username"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// LoginResponse is returned by doLogin: the user, plus the token to send in the Authorization header. When access
+// tokens are enabled, Token is a short-lived access token, and RefreshToken is used to get a new one
+type LoginResponse struct {
+	User
+	Token            string     `json:"token"`
+	ExpiresAt        time.Time  `json:"expiresAt"`
+	RefreshToken     string     `json:"refreshToken,omitempty"`
+	RefreshExpiresAt *time.Time `json:"refreshExpiresAt,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Two-factor authentication structs
+
+// SecondFactorChallenge is returned by doLogin in place of the session when the user has enabled two-factor
+// authentication. The challenge must be completed with a TOTP code or a recovery code.
+type SecondFactorChallenge struct {
+	SecondFactorRequired bool      `json:"secondFactorRequired"`
+	Challenge            string    `json:"challenge"`
+	ExpiresAt            time.Time `json:"expiresAt"`
+}
+
+type SecondFactorRequest struct {
+	Challenge    string `json:"challenge,omitempty"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recoveryCode,omitempty"`
+}
+
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// Single sign-on structs
+
+// OIDCAuthorization is returned when a single sign-on login starts: the user has to be sent to AuthorizationURL.
+// Binding stays in the browser that started the login, and is sent back with the callback: the state alone, which
+// travels in URLs, can't complete the login in another browser.
+type OIDCAuthorization struct {
+	AuthorizationURL string    `json:"authorizationUrl"`
+	State            string    `json:"state"`
+	Binding          string    `json:"binding"`
+	ExpiresAt        time.Time `json:"expiresAt"`
+}
+
+// OIDCCallback carries the parameters the identity provider adds to the redirect URL, and the binding of the login
+// kept by the browser
+type OIDCCallback struct {
+	Code    string `json:"code"`
+	State   string `json:"state"`
+	Binding string `json:"binding"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Passphrase struct
+
+type PassphraseRequest struct {
+	CurrentPassphrase string `json:"currentPassphrase,omitempty"`
+	Passphrase        string `json:"passphrase"`
+}
+
+// Session struct
+
+type Session struct {
+	SessionId  int64     `json:"sessionId"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+func (s *Session) FromDatabase(session database.Session) {
+	s.SessionId = session.SessionId
+	s.UserAgent = session.UserAgent
+	s.CreatedAt = session.CreatedAt
+	s.LastUsedAt = session.LastUsedAt
+	s.ExpiresAt = session.ExpiresAt
+}
+
+// Bot structs
+
+type Bot struct {
+	Id        uint64    `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (b *Bot) FromDatabase(bot database.Bot) {
+	b.Id = bot.UserId
+	b.Username = bot.Username
+	b.CreatedAt = bot.CreatedAt
+}
+
+type CreateBotRequest struct {
+	Username string `json:"username"`
+}
+
+type APIKey struct {
+	KeyId           int64      `json:"keyId"`
+	Name            string     `json:"name"`
+	Prefix          string     `json:"prefix"`
+	Scopes          []string   `json:"scopes"`
+	ConversationIds []int      `json:"conversationIds,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	LastUsedAt      *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+func (k *APIKey) FromDatabase(key database.APIKey) {
+	k.KeyId = key.KeyId
+	k.Name = key.Name
+	k.Prefix = key.Prefix
+	k.Scopes = key.Scopes
+	k.ConversationIds = key.ConversationIds
+	k.CreatedAt = key.CreatedAt
+	if !key.LastUsedAt.IsZero() {
+		lastUsedAt := key.LastUsedAt
+		k.LastUsedAt = &lastUsedAt
+	}
+}
+
+// CreateAPIKeyRequest creates an API key with the given scopes. If ConversationIds is not empty, the key can only be
+// used on those conversations.
+type CreateAPIKeyRequest struct {
+	Name            string   `json:"name"`
+	Scopes          []string `json:"scopes"`
+	ConversationIds []int    `json:"conversationIds,omitempty"`
+}
+
+// NewAPIKey is returned when an API key is created. The key itself is never shown again.
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
 // Message struct
 
 type Message struct {
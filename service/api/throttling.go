@@ -0,0 +1,48 @@
+package api
+
+import (
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// clientIP returns the IP address of the client. Proxy headers are not trusted, as anyone can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginWait returns how long the client has to wait before trying to log in as the user, or zero if it can try now.
+func (rt *_router) loginWait(r *http.Request, username string) time.Duration {
+	now := globaltime.Now()
+	wait := rt.ipThrottle.Wait(clientIP(r), now)
+	if userWait := rt.userThrottle.Wait(username, now); userWait > wait {
+		wait = userWait
+	}
+	return wait
+}
+
+// recordLoginFailure records a failed login as the user, both for the user and for the client IP.
+func (rt *_router) recordLoginFailure(r *http.Request, username string) {
+	now := globaltime.Now()
+	rt.ipThrottle.Fail(clientIP(r), now)
+	rt.userThrottle.Fail(username, now)
+}
+
+// recordLoginSuccess forgets the failed logins as the user. Failures of the client IP are kept, so an attacker can't
+// reset them by logging in to its own account.
+func (rt *_router) recordLoginSuccess(username string) {
+	rt.userThrottle.Reset(username)
+}
+
+// tooManyRequests sends the 429 response, telling the client when to try again.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+}
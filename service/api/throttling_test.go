@@ -0,0 +1,55 @@
+package api
+
+import (
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/throttle"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottling(t *testing.T) {
+	globaltime.FixedTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+	h, _ := newTestRouter(t, Config{UserThrottle: throttle.Policy{
+		FreeAttempts: 2,
+		BaseDelay:    10 * time.Second,
+		MaxDelay:     time.Minute,
+		Window:       time.Hour,
+	}})
+	login(t, h, "alice", "correct horse")
+
+	wrongLogin := func() *http.Response {
+		w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: "alice", Passphrase: "wrong passphrase"})
+		return w.Result()
+	}
+	for i := 1; i <= 3; i++ {
+		if resp := wrongLogin(); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong passphrase %d: got %d, want %d", i, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// The third failure blocks the user for the base delay
+	resp := wrongLogin()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "10" {
+		t.Fatalf("login while blocked: got %d with Retry-After %q, want %d with 10", resp.StatusCode,
+			resp.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	// The wait is rounded up to the next second
+	globaltime.FixedTime = globaltime.FixedTime.Add(4500 * time.Millisecond)
+	w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: "alice", Passphrase: "correct horse"})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "6" {
+		t.Fatalf("correct passphrase while blocked: got %d with Retry-After %q, want %d with 6", w.Code,
+			w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	// Once the delay is over a successful login resets the failures
+	globaltime.FixedTime = globaltime.FixedTime.Add(6 * time.Second)
+	login(t, h, "alice", "correct horse")
+	for i := 1; i <= 3; i++ {
+		if resp := wrongLogin(); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong passphrase %d after a successful login: got %d, want %d", i, resp.StatusCode,
+				http.StatusUnauthorized)
+		}
+	}
+}
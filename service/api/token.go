@@ -1,13 +1,66 @@
 package api
 
 import (
-	"regexp"
-	"strconv"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"net/http"
+	"strings"
 )
 
-func getToken(message string) uint64 {
-	re := regexp.MustCompile(`[-]?\d[\d,]*[\.]?[\d{2}]*`)
-	stringToken := re.FindAllString(message, -1)
-	token, _ := strconv.Atoi(stringToken[0])
-	return uint64(token)
+// errUnauthorized is returned when the request does not carry a valid session token
+var errUnauthorized = errors.New("missing or invalid session token")
+
+// newSessionToken generates a random opaque session token. The token is returned to the client, while only its hash
+// is stored in the database.
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken returns the hash of the token as stored in the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the bearer token in the Authorization header. errUnauthorized is returned if the header is
+// missing or malformed.
+func bearerToken(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", errUnauthorized
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if token == "" {
+		return "", errUnauthorized
+	}
+	return token, nil
+}
+
+// authenticateSession resolves the session token to the user owning the session, and to the session itself.
+// errUnauthorized is returned if the session is unknown, expired or revoked.
+func (rt *_router) authenticateSession(ctx context.Context, token string) (database.User, database.Session, error) {
+	user, session, err := rt.db.GetUserBySession(ctx, hashToken(token))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		return database.User{}, database.Session{}, errUnauthorized
+	}
+	return user, session, err
+}
+
+// authenticateAPIKey resolves the API key to the bot owning it, and to the key itself. errUnauthorized is returned if
+// the key is unknown or revoked.
+func (rt *_router) authenticateAPIKey(ctx context.Context, key string) (database.User, database.APIKey, error) {
+	user, apiKey, err := rt.db.GetUserByAPIKey(ctx, hashToken(key))
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		return database.User{}, database.APIKey{}, errUnauthorized
+	}
+	return user, apiKey, err
 }
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/totp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// totpIssuer is the issuer shown by authenticator apps
+	totpIssuer = "WASAText"
+
+	// recoveryCodeCount is the number of recovery codes issued when enrolling TOTP
+	recoveryCodeCount = 10
+
+	// challengeTTL is the time given to complete a login with the second factor
+	challengeTTL = 5 * time.Minute
+
+	// maxChallengeAttempts is the number of wrong second factors after which the login has to start over
+	maxChallengeAttempts = 5
+)
+
+// errInvalidSecondFactor is returned when a TOTP code or a recovery code is wrong or has already been used
+var errInvalidSecondFactor = errors.New("invalid or already used code")
+
+// newRecoveryCode generates a random one-time recovery code, formatted as two groups of five characters.
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 7)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(buf))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode returns the hash of the recovery code as stored in the database. Case, spaces and dashes are
+// ignored, as users often type the code by hand.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
+
+// verifySecondFactor checks a TOTP code or, if the code is empty, a recovery code of the user. Both are accepted only
+// once. errInvalidSecondFactor is returned if the check fails.
+func (rt *_router) verifySecondFactor(ctx context.Context, userId uint64, code string, recoveryCode string) error {
+	if code == "" {
+		err := rt.db.UseRecoveryCode(ctx, userId, hashRecoveryCode(recoveryCode))
+		if errors.Is(err, database.ErrRecoveryCodeNotFound) {
+			return errInvalidSecondFactor
+		}
+		return err
+	}
+
+	enrollment, err := rt.db.GetTOTP(ctx, userId)
+	if errors.Is(err, database.ErrNoTOTP) {
+		return errInvalidSecondFactor
+	} else if err != nil {
+		return err
+	}
+
+	step, ok := totp.Validate(enrollment.Secret, code, globaltime.Now())
+	if !ok {
+		return errInvalidSecondFactor
+	}
+	err = rt.db.UseTOTPStep(ctx, userId, step)
+	if errors.Is(err, database.ErrTOTPCodeReused) {
+		return errInvalidSecondFactor
+	}
+	return err
+}
+
+// issueSecondFactorChallenge starts a login that has to be completed with completeLogin, and sends the challenge as
+// response.
+func (rt *_router) issueSecondFactorChallenge(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, user User) {
+	challenge, err := newSessionToken()
+	if err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := globaltime.Now().Add(challengeTTL)
+	err = rt.db.CreateLoginChallenge(r.Context(), hashToken(challenge), database.LoginChallenge{
+		UserId:    user.Id,
+		UserAgent: r.UserAgent(),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't create the login challenge")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(SecondFactorChallenge{
+		SecondFactorRequired: true,
+		Challenge:            challenge,
+		ExpiresAt:            expiresAt,
+	}); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// completeLogin completes a login started by doLogin with a TOTP code or a recovery code, and issues the session.
+func (rt *_router) completeLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req SecondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Challenge == "" || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "Challenge and code or recovery code are required", http.StatusBadRequest)
+		return
+	}
+
+	challengeHash := hashToken(req.Challenge)
+	challenge, err := rt.db.GetLoginChallenge(r.Context(), challengeHash)
+	if errors.Is(err, database.ErrChallengeNotFound) {
+		http.Error(w, "Login challenge expired, log in again", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't get the login challenge")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	username, err := rt.db.GetUsernameById(r.Context(), challenge.UserId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't get the user")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	// Wrong codes count as failed logins, so restarting the login does not give more attempts
+	if wait := rt.loginWait(r, username); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	err = rt.verifySecondFactor(r.Context(), challenge.UserId, req.Code, req.RecoveryCode)
+	if errors.Is(err, errInvalidSecondFactor) {
+		rt.recordLoginFailure(r, username)
+		// Too many wrong codes: the login has to start over, passphrase included
+		if challenge.Attempts+1 >= maxChallengeAttempts {
+			err = rt.db.DeleteLoginChallenge(r.Context(), challengeHash)
+		} else {
+			err = rt.db.RecordLoginChallengeFailure(r.Context(), challengeHash)
+		}
+		if err != nil {
+			ctx.Logger.WithError(err).Error("can't record the failed login")
+		}
+		http.Error(w, errInvalidSecondFactor.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't verify the second factor")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.DeleteLoginChallenge(r.Context(), challengeHash)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't delete the login challenge")
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	rt.recordLoginSuccess(username)
+	rt.issueSession(w, r, ctx, User{Id: challenge.UserId, Username: username})
+}
+
+// startTOTPEnrollment generates a new TOTP secret for the caller. Two-factor authentication is enabled only after the
+// first code is verified by confirmTOTPEnrollment.
+func (rt *_router) startTOTPEnrollment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") != ctx.User.Username {
+		http.Error(w, "Not authorized to change two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	enrollment, err := rt.db.GetTOTP(r.Context(), ctx.User.Id)
+	if err != nil && !errors.Is(err, database.ErrNoTOTP) {
+		ctx.Logger.WithError(err).Error("can't get the TOTP enrollment")
+		http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+		return
+	} else if err == nil && enrollment.Confirmed {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+		return
+	}
+	err = rt.db.SetTOTPSecret(r.Context(), ctx.User.Id, secret)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't set the TOTP secret")
+		http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(totpIssuer, ctx.User.Username, secret),
+	}); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// confirmTOTPEnrollment verifies the first code from the authenticator app, enables two-factor authentication and
+// returns the recovery codes. Recovery codes are shown only once.
+func (rt *_router) confirmTOTPEnrollment(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") != ctx.User.Username {
+		http.Error(w, "Not authorized to change two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	var req SecondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	enrollment, err := rt.db.GetTOTP(r.Context(), ctx.User.Id)
+	if errors.Is(err, database.ErrNoTOTP) {
+		http.Error(w, "Enrollment not started", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't get the TOTP enrollment")
+		http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+		return
+	} else if enrollment.Confirmed {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	step, ok := totp.Validate(enrollment.Secret, req.Code, globaltime.Now())
+	if !ok {
+		http.Error(w, errInvalidSecondFactor.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var codes RecoveryCodes
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+			return
+		}
+		codes.RecoveryCodes = append(codes.RecoveryCodes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	err = rt.db.ConfirmTOTP(r.Context(), ctx.User.Id, step, hashes)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't confirm the TOTP enrollment")
+		http.Error(w, "Failed to enroll", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(codes); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// disableTOTP disables two-factor authentication for the caller. A valid TOTP code or recovery code is required.
+func (rt *_router) disableTOTP(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	if ps.ByName("username") != ctx.User.Username {
+		http.Error(w, "Not authorized to change two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	var req SecondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := rt.verifySecondFactor(r.Context(), ctx.User.Id, req.Code, req.RecoveryCode)
+	if errors.Is(err, errInvalidSecondFactor) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't verify the second factor")
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.DeleteTOTP(r.Context(), ctx.User.Id)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't delete the TOTP enrollment")
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
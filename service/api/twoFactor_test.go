@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/totp"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// enrollTOTP enables two-factor authentication for the user at the current globaltime, and returns the secret and the
+// recovery codes.
+func enrollTOTP(t *testing.T, h http.Handler, user LoginResponse) (string, []string) {
+	t.Helper()
+	w := doRequest(t, h, http.MethodPost, "/user/"+user.Username+"/totp", user.Token, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("starting the enrollment: got %d %s", w.Code, w.Body.String())
+	}
+	var enrollment TOTPEnrollment
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+		t.Fatalf("decoding the enrollment: %v", err)
+	}
+
+	code, err := totp.Code(enrollment.Secret, totp.Step(globaltime.Now()))
+	if err != nil {
+		t.Fatalf("computing the code: %v", err)
+	}
+	w = doRequest(t, h, http.MethodPut, "/user/"+user.Username+"/totp", user.Token, SecondFactorRequest{Code: code})
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirming the enrollment: got %d %s", w.Code, w.Body.String())
+	}
+	var codes RecoveryCodes
+	if err := json.NewDecoder(w.Body).Decode(&codes); err != nil {
+		t.Fatalf("decoding the recovery codes: %v", err)
+	}
+	if len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes.RecoveryCodes), recoveryCodeCount)
+	}
+	return enrollment.Secret, codes.RecoveryCodes
+}
+
+// startLogin logs in as the user with two-factor authentication, and returns the challenge.
+func startLogin(t *testing.T, h http.Handler, username string) string {
+	t.Helper()
+	w := doRequest(t, h, http.MethodPost, "/session", "", LoginRequest{Username: username})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("logging in: got %d %s, want a challenge", w.Code, w.Body.String())
+	}
+	var challenge SecondFactorChallenge
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil {
+		t.Fatalf("decoding the challenge: %v", err)
+	}
+	return challenge.Challenge
+}
+
+func TestSecondFactorCode(t *testing.T) {
+	globaltime.FixedTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+
+	h, _ := newTestRouter(t, Config{})
+	secret, _ := enrollTOTP(t, h, login(t, h, "alice", ""))
+
+	// The code used to confirm the enrollment can't log in
+	code, _ := totp.Code(secret, totp.Step(globaltime.Now()))
+	w := doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{Challenge: startLogin(t, h, "alice"), Code: code})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login with the code of the enrollment: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The next code logs in once, even while it is still valid
+	globaltime.FixedTime = globaltime.FixedTime.Add(totp.Period)
+	code, _ = totp.Code(secret, totp.Step(globaltime.Now()))
+	w = doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{Challenge: startLogin(t, h, "alice"), Code: code})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("login with a new code: got %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{Challenge: startLogin(t, h, "alice"), Code: code})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a used code: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Codes outside the skew window are rejected
+	globaltime.FixedTime = globaltime.FixedTime.Add(10 * totp.Period)
+	code, _ = totp.Code(secret, totp.Step(globaltime.Now())-totp.Skew-1)
+	w = doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{Challenge: startLogin(t, h, "alice"), Code: code})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login with an old code: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSecondFactorRecoveryCode(t *testing.T) {
+	globaltime.FixedTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+
+	h, _ := newTestRouter(t, Config{})
+	_, recoveryCodes := enrollTOTP(t, h, login(t, h, "alice", ""))
+
+	// Recovery codes are accepted once, however they are typed
+	w := doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{
+		Challenge:    startLogin(t, h, "alice"),
+		RecoveryCode: " " + recoveryCodes[0] + " ",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("login with a recovery code: got %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{
+		Challenge:    startLogin(t, h, "alice"),
+		RecoveryCode: recoveryCodes[0],
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a used recovery code: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// The other codes are still valid
+	w = doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{
+		Challenge:    startLogin(t, h, "alice"),
+		RecoveryCode: recoveryCodes[1],
+	})
+	if w.Code != http.StatusCreated {
+		t.Errorf("login with another recovery code: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSecondFactorChallengeAttempts(t *testing.T) {
+	h, _ := newTestRouter(t, Config{})
+	enrollTOTP(t, h, login(t, h, "alice", ""))
+
+	// After too many wrong codes the challenge is gone, and the login has to start over
+	challenge := startLogin(t, h, "alice")
+	for i := 0; i < maxChallengeAttempts; i++ {
+		w := doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{Challenge: challenge, Code: "abcdef"})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: got %d, want %d", i, w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := doRequest(t, h, http.MethodPost, "/session/totp", "", SecondFactorRequest{Challenge: challenge, RecoveryCode: "x"})
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "Login challenge expired, log in again\n" {
+		t.Errorf("challenge after too many wrong codes: got %d %s", w.Code, w.Body.String())
+	}
+}
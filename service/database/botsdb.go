@@ -0,0 +1,265 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"log"
+	"strings"
+)
+
+// CreateBot creates a bot account owned by a human user. Bots are regular users (so they can join conversations and
+// send messages) that can't log in, and authenticate with API keys only. ErrUsernameTaken is returned if the username
+// is already used.
+func (db *appdbimpl) CreateBot(ctx context.Context, ownerId uint64, username string) (Bot, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return Bot{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE Username = ?)", username).Scan(&exists)
+	if err != nil {
+		return Bot{}, err
+	}
+	if exists {
+		return Bot{}, ErrUsernameTaken
+	}
+
+	botId, err := tx.insert(ctx, "INSERT INTO users (Username) VALUES (?)", "Id", username)
+	if err != nil {
+		return Bot{}, err
+	}
+
+	bot := Bot{
+		UserId:    uint64(botId),
+		Username:  username,
+		OwnerId:   ownerId,
+		CreatedAt: globaltime.Now().UTC(),
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO bots (UserId, OwnerId, CreatedAt) VALUES (?, ?, ?)", bot.UserId, bot.OwnerId, bot.CreatedAt)
+	if err != nil {
+		return Bot{}, err
+	}
+
+	return bot, tx.Commit()
+}
+
+// ListBots returns the bots owned by the user.
+func (db *appdbimpl) ListBots(ctx context.Context, ownerId uint64) ([]Bot, error) {
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT b.UserId, u.Username, b.CreatedAt
+        FROM bots b
+        JOIN users u ON b.UserId = u.Id
+        WHERE b.OwnerId = ?
+        ORDER BY u.Username`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bots []Bot
+	for rows.Next() {
+		bot := Bot{OwnerId: ownerId}
+		if err := rows.Scan(&bot.UserId, &bot.Username, &bot.CreatedAt); err != nil {
+			return nil, err
+		}
+		bots = append(bots, bot)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows error in bots: %v", err)
+		return nil, err
+	}
+
+	return bots, nil
+}
+
+// GetBot returns a bot owned by the user. ErrBotNotFound is returned if the bot does not exist or has another owner.
+func (db *appdbimpl) GetBot(ctx context.Context, ownerId uint64, botId uint64) (Bot, error) {
+	bot := Bot{UserId: botId, OwnerId: ownerId}
+	err := db.c.QueryRowContext(ctx, `
+        SELECT u.Username, b.CreatedAt
+        FROM bots b
+        JOIN users u ON b.UserId = u.Id
+        WHERE b.UserId = ? AND b.OwnerId = ?`, botId, ownerId).Scan(&bot.Username, &bot.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Bot{}, ErrBotNotFound
+	}
+	return bot, err
+}
+
+// CreateAPIKey stores a new API key for the bot. Only the hash of the key is saved.
+func (db *appdbimpl) CreateAPIKey(ctx context.Context, key APIKey, keyHash string) (APIKey, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return APIKey{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	key.CreatedAt = globaltime.Now().UTC()
+	key.KeyId, err = tx.insert(ctx, `
+        INSERT INTO api_keys (BotId, KeyHash, Name, Prefix, Scopes, CreatedAt)
+        VALUES (?, ?, ?, ?, ?, ?)`, "KeyId",
+		key.BotId, keyHash, key.Name, key.Prefix, strings.Join(key.Scopes, " "), key.CreatedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	for _, conversationId := range key.ConversationIds {
+		_, err = tx.ExecContext(ctx, "INSERT INTO api_key_conversations (KeyId, ConversationId) VALUES (?, ?)", key.KeyId, conversationId)
+		if err != nil {
+			return APIKey{}, err
+		}
+	}
+
+	return key, tx.Commit()
+}
+
+// ListAPIKeys returns the active API keys of the bot.
+func (db *appdbimpl) ListAPIKeys(ctx context.Context, botId uint64) ([]APIKey, error) {
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT KeyId, Name, Prefix, Scopes, CreatedAt, LastUsedAt
+        FROM api_keys
+        WHERE BotId = ? AND RevokedAt IS NULL
+        ORDER BY KeyId`, botId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key := APIKey{BotId: botId}
+		var scopes string
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&key.KeyId, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		key.Scopes = strings.Fields(scopes)
+		if lastUsedAt.Valid {
+			key.LastUsedAt = lastUsedAt.Time
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows error in API keys: %v", err)
+		return nil, err
+	}
+	_ = rows.Close()
+
+	for i := range keys {
+		keys[i].ConversationIds, err = db.getAPIKeyConversations(ctx, keys[i].KeyId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes an API key of the bot. ErrAPIKeyNotFound is returned if the key does not belong to the bot or
+// has already been revoked.
+func (db *appdbimpl) RevokeAPIKey(ctx context.Context, botId uint64, keyId int64) error {
+	result, err := db.c.ExecContext(ctx, "UPDATE api_keys SET RevokedAt = ? WHERE KeyId = ? AND BotId = ? AND RevokedAt IS NULL",
+		globaltime.Now().UTC(), keyId, botId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// GetUserByAPIKey returns the bot authenticated by the API key hash, together with the key itself.
+// ErrAPIKeyNotFound is returned if the key does not exist or has been revoked.
+func (db *appdbimpl) GetUserByAPIKey(ctx context.Context, keyHash string) (User, APIKey, error) {
+	var user User
+	var key APIKey
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+	err := db.c.QueryRowContext(ctx, `
+        SELECT u.Id, u.Username, k.KeyId, k.Name, k.Prefix, k.Scopes, k.CreatedAt, k.LastUsedAt, k.RevokedAt
+        FROM api_keys k
+        JOIN users u ON k.BotId = u.Id
+        WHERE k.KeyHash = ?`, keyHash).Scan(
+		&user.Id,
+		&user.Username,
+		&key.KeyId,
+		&key.Name,
+		&key.Prefix,
+		&scopes,
+		&key.CreatedAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, APIKey{}, ErrAPIKeyNotFound
+	} else if err != nil {
+		return User{}, APIKey{}, err
+	}
+	if revokedAt.Valid {
+		return User{}, APIKey{}, ErrAPIKeyNotFound
+	}
+
+	user.IsBot = true
+	key.BotId = user.Id
+	key.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		key.LastUsedAt = lastUsedAt.Time
+	}
+	key.ConversationIds, err = db.getAPIKeyConversations(ctx, key.KeyId)
+	if err != nil {
+		return User{}, APIKey{}, err
+	}
+	return user, key, nil
+}
+
+// TouchAPIKey records that the API key has just been used.
+func (db *appdbimpl) TouchAPIKey(ctx context.Context, keyId int64) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE api_keys SET LastUsedAt = ? WHERE KeyId = ?", globaltime.Now().UTC(), keyId)
+	return err
+}
+
+// getAPIKeyConversations returns the conversations the API key is restricted to. An empty list means that the key is
+// not restricted.
+func (db *appdbimpl) getAPIKeyConversations(ctx context.Context, keyId int64) ([]int, error) {
+	rows, err := db.c.QueryContext(ctx, "SELECT ConversationId FROM api_key_conversations WHERE KeyId = ? ORDER BY ConversationId", keyId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversationIds []int
+	for rows.Next() {
+		var conversationId int
+		if err := rows.Scan(&conversationId); err != nil {
+			return nil, err
+		}
+		conversationIds = append(conversationIds, conversationId)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows error in API key conversations: %v", err)
+		return nil, err
+	}
+
+	return conversationIds, nil
+}
@@ -1,12 +1,14 @@
 package database
 
+import "context"
+
 // import (
 //	"database/sql"
 // )
 
-func (db *appdbimpl) CheckIfConversationExists(conversationId int) (bool, error) {
+func (db *appdbimpl) CheckIfConversationExists(ctx context.Context, conversationId int) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM conversations WHERE ConversationId = ?)", conversationId).Scan(&exists)
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM conversations WHERE ConversationId = ?)", conversationId).Scan(&exists)
 	if err != nil {
 		return false, err
 	}
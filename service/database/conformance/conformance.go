@@ -0,0 +1,1583 @@
+/*
+Package conformance checks that an implementation of database.AppDatabase behaves like the others: the SQL one of
+package database (on SQLite and PostgreSQL) and the in-memory one of package memory. Every case runs against a new
+empty database, and checks the results of a few methods: uniqueness, membership checks, ordering, errors.
+
+The tests of each implementation run all the cases with Run:
+
+	func TestConformance(t *testing.T) {
+		conformance.Run(t, func(t *testing.T) database.AppDatabase {
+			return memory.New()
+		})
+	}
+
+Cases change globaltime.FixedTime, so they must not run in parallel.
+*/
+package conformance
+
+import (
+	"context"
+	"database/sql"
+	"encoding"
+	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Case is a check of the behavior of an AppDatabase, starting from an empty database.
+type Case struct {
+	Name string
+	Run  func(t *testing.T, db database.AppDatabase)
+}
+
+// Run runs each of the Cases as a subtest of t, against a new empty database returned by open. open should close the
+// database with t.Cleanup.
+func Run(t *testing.T, open func(t *testing.T) database.AppDatabase) {
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			defer setTime(globaltime.FixedTime)
+			c.Run(t, open(t))
+		})
+	}
+}
+
+// Cases are all the checks of the suite.
+var Cases = []Case{
+	{"Users", testUsers},
+	{"SetUsername", testSetUsername},
+	{"SearchUsers", testSearchUsers},
+	{"DirectConversations", testDirectConversations},
+	{"Groups", testGroups},
+	{"DeleteGroup", testDeleteGroup},
+	{"ConversationPreviews", testConversationPreviews},
+	{"ConversationList", testConversationList},
+	{"ConversationDetails", testConversationDetails},
+	{"Comments", testComments},
+	{"ManyComments", testManyComments},
+	{"MessagePages", testMessagePages},
+	{"DeleteMessage", testDeleteMessage},
+	{"ForwardMessage", testForwardMessage},
+	{"Retention", testRetention},
+	{"SearchMessages", testSearchMessages},
+	{"Sessions", testSessions},
+	{"Passphrases", testPassphrases},
+	{"TOTP", testTOTP},
+	{"LoginChallenges", testLoginChallenges},
+	{"Bots", testBots},
+	{"APIKeys", testAPIKeys},
+	{"OIDC", testOIDC},
+	{"DeleteUser", testDeleteUser},
+	{"Concurrency", testConcurrency},
+	{"Canceled", testCanceled},
+}
+
+// ctx is the context of the calls of the cases, except the ones checking cancellation.
+var ctx = context.Background()
+
+// start is the time of the cases using globaltime: a whole second, as the databases may store less precise times.
+var start = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// setTime makes globaltime.Now return tm.
+func setTime(tm time.Time) {
+	globaltime.FixedTime = tm
+}
+
+func check(t *testing.T, err error, format string, args ...interface{}) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+	}
+}
+
+func checkIs(t *testing.T, err error, target error, format string, args ...interface{}) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Errorf("%s: got error %v, want %v", fmt.Sprintf(format, args...), err, target)
+	}
+}
+
+func checkEqual(t *testing.T, got interface{}, want interface{}, format string, args ...interface{}) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s: got %v, want %v", fmt.Sprintf(format, args...), got, want)
+	}
+}
+
+func checkTime(t *testing.T, got time.Time, want time.Time, format string, args ...interface{}) {
+	t.Helper()
+	if !got.Equal(want) {
+		t.Errorf("%s: got %v, want %v", fmt.Sprintf(format, args...), got, want)
+	}
+}
+
+func checkBot(t *testing.T, got database.Bot, want database.Bot, name string) {
+	t.Helper()
+	checkEqual(t, got.UserId, want.UserId, "ID of the %s", name)
+	checkEqual(t, got.Username, want.Username, "username of the %s", name)
+	checkEqual(t, got.OwnerId, want.OwnerId, "owner of the %s", name)
+	checkTime(t, got.CreatedAt, want.CreatedAt, "creation time of the %s", name)
+}
+
+func createUser(t *testing.T, db database.AppDatabase, username string) database.User {
+	t.Helper()
+	u, err := db.CreateUser(ctx, database.User{Username: username})
+	check(t, err, "creating user %s", username)
+	return u
+}
+
+func createGroup(t *testing.T, db database.AppDatabase, name string, creator database.User, members ...database.User) int {
+	t.Helper()
+	g, err := db.CreateGroup(ctx, name, creator.Id)
+	check(t, err, "creating group %s", name)
+	for _, m := range members {
+		check(t, db.AddUserToGroup(ctx, m.Username, g.ConversationId), "adding %s to group %s", m.Username, name)
+	}
+	return g.ConversationId
+}
+
+func sendMessage(t *testing.T, db database.AppDatabase, conversationId int, sender database.User, text string, sendTime time.Time) database.Message {
+	t.Helper()
+	m, err := db.CreateMessage(ctx, database.Message{
+		ConversationId: conversationId,
+		SenderId:       sender.Id,
+		Text:           text,
+		Status:         "sent",
+		SendTime:       sendTime,
+	})
+	check(t, err, "sending %q", text)
+	check(t, db.UpdateLastMessage(ctx, m.MessageId, conversationId), "updating the last message to %q", text)
+	return m
+}
+
+func conversationNames(previews []database.ConversationPreview) string {
+	var names []string
+	for _, p := range previews {
+		names = append(names, p.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func messageTexts(details database.ConversationDetails) string {
+	var texts []string
+	for _, m := range details.Messages {
+		texts = append(texts, m.Text)
+	}
+	return strings.Join(texts, ",")
+}
+
+func testUsers(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	if alice.Id == 0 || alice.Id == bob.Id {
+		t.Fatalf("user IDs: got %d and %d, want distinct non-zero IDs", alice.Id, bob.Id)
+	}
+
+	again := createUser(t, db, "alice")
+	checkEqual(t, again, alice, "creating an existing user")
+
+	u, err := db.GetUser(ctx, bob.Id)
+	check(t, err, "getting bob")
+	checkEqual(t, u, bob, "GetUser")
+	username, err := db.GetUsernameById(ctx, alice.Id)
+	check(t, err, "getting the username of alice")
+	checkEqual(t, username, "alice", "GetUsernameById")
+	id, err := db.GetUserIdByUsername(ctx, "bob")
+	check(t, err, "getting the ID of bob")
+	checkEqual(t, id, bob.Id, "GetUserIdByUsername")
+	id, err = db.GetRecipientIdByUsername(ctx, "alice")
+	check(t, err, "getting the ID of alice")
+	checkEqual(t, id, alice.Id, "GetRecipientIdByUsername")
+
+	// Usernames are case sensitive
+	_, err = db.GetUserIdByUsername(ctx, "Alice")
+	checkIs(t, err, sql.ErrNoRows, "GetUserIdByUsername of a missing user")
+	_, err = db.GetRecipientIdByUsername(ctx, "carol")
+	checkIs(t, err, sql.ErrNoRows, "GetRecipientIdByUsername of a missing user")
+	_, err = db.GetUsernameById(ctx, bob.Id+100)
+	checkIs(t, err, sql.ErrNoRows, "GetUsernameById of a missing user")
+	checkIs(t, err, database.ErrNotFound, "kind of GetUsernameById of a missing user")
+	_, err = db.GetUser(ctx, bob.Id+100)
+	checkIs(t, err, database.ErrUserDoesNotExist, "GetUser of a missing user")
+	checkIs(t, err, database.ErrNotFound, "kind of GetUser of a missing user")
+
+	photo, err := db.GetUserPhoto(ctx, bob.Id)
+	check(t, err, "getting the photo of bob")
+	checkEqual(t, photo, "", "photo of a new user")
+	check(t, db.SetUserPhoto(ctx, bob.Id, "photo"), "setting the photo of bob")
+	photo, err = db.GetUserPhoto(ctx, bob.Id)
+	check(t, err, "getting the photo of bob")
+	checkEqual(t, photo, "photo", "GetUserPhoto")
+	_, err = db.GetUserPhoto(ctx, bob.Id+100)
+	checkIs(t, err, database.ErrUserDoesNotExist, "GetUserPhoto of a missing user")
+
+	check(t, db.SetUserPhoto(ctx, alice.Id, "photo"), "setting the photo of alice")
+	check(t, db.SetUserPhoto(ctx, bob.Id+100, "photo"), "setting the photo of a missing user")
+}
+
+func testSetUsername(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	createUser(t, db, "bob")
+
+	_, err := db.SetUsername(ctx, database.User{Id: alice.Id, Username: "alicia"}, "alice")
+	check(t, err, "renaming alice")
+	_, err = db.GetUserIdByUsername(ctx, "alice")
+	checkIs(t, err, sql.ErrNoRows, "old username")
+	id, err := db.GetUserIdByUsername(ctx, "alicia")
+	check(t, err, "new username")
+	checkEqual(t, id, alice.Id, "ID of the new username")
+
+	_, err = db.SetUsername(ctx, database.User{Id: alice.Id, Username: "bob"}, "alicia")
+	checkIs(t, err, database.ErrAlreadyExists, "renaming to a taken username")
+	username, err := db.GetUsernameById(ctx, alice.Id)
+	check(t, err, "getting the username")
+	checkEqual(t, username, "alicia", "username after a failed rename")
+
+	// The current username must match
+	_, err = db.SetUsername(ctx, database.User{Id: alice.Id, Username: "carol"}, "alice")
+	check(t, err, "renaming with a wrong current username")
+	username, err = db.GetUsernameById(ctx, alice.Id)
+	check(t, err, "getting the username")
+	checkEqual(t, username, "alicia", "username after a rename with a wrong current username")
+}
+
+func testSearchUsers(t *testing.T, db database.AppDatabase) {
+	owner := createUser(t, db, "Marco")
+	createUser(t, db, "amaro")
+	createUser(t, db, "luca")
+	createUser(t, db, "boxboy")
+	_, err := db.CreateBot(ctx, owner.Id, "marco_bot")
+	check(t, err, "creating a bot")
+
+	users, err := db.SearchUsers(ctx, "MAR")
+	check(t, err, "searching users")
+	var found []string
+	for _, u := range users {
+		found = append(found, fmt.Sprintf("%s:%t", u.Username, u.IsBot))
+	}
+	checkEqual(t, strings.Join(found, ","), "Marco:false,amaro:false,marco_bot:true", "search results")
+
+	users, err = db.SearchUsers(ctx, "nobody")
+	check(t, err, "searching users")
+	checkEqual(t, len(users), 0, "results of a search without matches")
+
+	// The wildcards of LIKE patterns are matched literally
+	users, err = db.SearchUsers(ctx, "O_B")
+	check(t, err, "searching users")
+	found = nil
+	for _, u := range users {
+		found = append(found, u.Username)
+	}
+	checkEqual(t, strings.Join(found, ","), "marco_bot", "results of a search with _")
+	for _, query := range []string{"%", `\`, `o\_b`} {
+		users, err = db.SearchUsers(ctx, query)
+		check(t, err, "searching users")
+		checkEqual(t, len(users), 0, "results of a search for %s", query)
+	}
+}
+
+func testDirectConversations(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	carol := createUser(t, db, "carol")
+
+	ab, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating the conversation of alice and bob")
+	ba, err := db.GetOrCreateDirectConversation(ctx, bob.Id, alice.Id, true)
+	check(t, err, "getting the conversation of bob and alice")
+	checkEqual(t, ba, ab, "conversation of bob and alice")
+
+	// Without create, existing conversations are found and nothing is created
+	ba, err = db.GetOrCreateDirectConversation(ctx, bob.Id, alice.Id, false)
+	check(t, err, "getting the conversation of bob and alice without creating it")
+	checkEqual(t, ba, ab, "conversation of bob and alice without creating it")
+	_, err = db.GetOrCreateDirectConversation(ctx, carol.Id, bob.Id, false)
+	checkIs(t, err, database.ErrConversationNotFound, "getting a missing conversation without creating it")
+	list, err := db.GetConversations(ctx, carol.Id, database.ConversationFilter{})
+	check(t, err, "listing the conversations")
+	checkEqual(t, len(list.Conversations), 0, "conversations of carol after a lookup without create")
+
+	ac, err := db.GetOrCreateDirectConversation(ctx, alice.Id, carol.Id, true)
+	check(t, err, "creating the conversation of alice and carol")
+	if ac == ab {
+		t.Errorf("alice and carol got the conversation of alice and bob")
+	}
+
+	// Groups with the same participants are not direct conversations
+	group := createGroup(t, db, "friends", alice, carol)
+	ac2, err := db.GetOrCreateDirectConversation(ctx, carol.Id, alice.Id, true)
+	check(t, err, "getting the conversation of carol and alice")
+	checkEqual(t, ac2, ac, "conversation of carol and alice")
+	if ac2 == group {
+		t.Errorf("the group was used as direct conversation")
+	}
+
+	for _, id := range []int{ab, ac, group} {
+		exists, err := db.CheckIfConversationExists(ctx, id)
+		check(t, err, "checking conversation %d", id)
+		checkEqual(t, exists, true, "conversation %d exists", id)
+	}
+	exists, err := db.CheckIfConversationExists(ctx, group+100)
+	check(t, err, "checking a missing conversation")
+	checkEqual(t, exists, false, "missing conversation exists")
+
+	inConversation, err := db.IsUserInGroup(ctx, carol.Id, ab)
+	check(t, err, "checking the participants")
+	checkEqual(t, inConversation, false, "carol in the conversation of alice and bob")
+	inConversation, err = db.IsUserInGroup(ctx, bob.Id, ab)
+	check(t, err, "checking the participants")
+	checkEqual(t, inConversation, true, "bob in the conversation of alice and bob")
+
+	conv, err := db.CreateConversation(ctx, alice.Id, 0)
+	check(t, err, "creating a conversation")
+	checkEqual(t, conv.GroupId, 0, "group ID of a new conversation")
+	inConversation, err = db.IsUserInGroup(ctx, alice.Id, conv.ConversationId)
+	check(t, err, "checking the participants")
+	checkEqual(t, inConversation, true, "creator in the new conversation")
+}
+
+func testGroups(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+
+	group, err := db.CreateGroup(ctx, "friends", alice.Id)
+	check(t, err, "creating a group")
+	checkEqual(t, group.GroupId, 1, "group ID of a group")
+	checkEqual(t, group.Name, "friends", "name of the group")
+	id, err := db.GetConversationIdByName(ctx, "friends")
+	check(t, err, "getting the group by name")
+	checkEqual(t, id, group.ConversationId, "group by name")
+	_, err = db.GetConversationIdByName(ctx, "enemies")
+	checkIs(t, err, sql.ErrNoRows, "getting a missing group by name")
+
+	checkIs(t, db.AddUserToGroup(ctx, "nobody", group.ConversationId), database.ErrUserDoesNotExist, "adding a missing user")
+	check(t, db.AddUserToGroup(ctx, "bob", group.ConversationId), "adding bob")
+	check(t, db.AddUserToGroup(ctx, "bob", group.ConversationId), "adding bob again")
+	checkIs(t, db.AddUserToGroup(ctx, "bob", group.ConversationId+100), database.ErrGroupNotFound, "adding bob to a missing group")
+	isMember, err := db.IsUserInGroup(ctx, bob.Id, group.ConversationId)
+	check(t, err, "checking the members")
+	checkEqual(t, isMember, true, "bob is a member")
+
+	check(t, db.SetGroupName(ctx, group.ConversationId, "best friends"), "renaming the group")
+	_, err = db.GetConversationIdByName(ctx, "friends")
+	checkIs(t, err, sql.ErrNoRows, "getting the group by its old name")
+	checkIs(t, db.SetGroupName(ctx, group.ConversationId+100, "x"), database.ErrGroupNotFound, "renaming a missing group")
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a direct conversation")
+	checkIs(t, db.SetGroupName(ctx, direct, "x"), database.ErrNotGroup, "renaming a direct conversation")
+	checkIs(t, db.AddUserToGroup(ctx, "carol", direct), database.ErrNotGroup, "adding carol to a direct conversation")
+
+	check(t, db.SetGroupPhoto(ctx, group.ConversationId, "group photo"), "setting the group photo")
+	checkIs(t, db.SetGroupPhoto(ctx, direct, "direct photo"), database.ErrNotGroup, "setting the photo of a direct conversation")
+	checkIs(t, db.SetGroupPhoto(ctx, group.ConversationId+100, "photo"), database.ErrGroupNotFound, "setting the photo of a missing group")
+	details, err := db.GetConversationDetails(ctx, group.ConversationId, alice.Id, database.MessagePage{})
+	check(t, err, "getting the group")
+	checkEqual(t, details.Photo, "group photo", "group photo")
+	checkEqual(t, details.Name, "best friends", "group name")
+	checkEqual(t, details.IsGroup, true, "group is a group")
+	details, err = db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the direct conversation")
+	checkEqual(t, details.Photo, "", "photo of a direct conversation")
+
+	checkIs(t, db.LeaveGroup(ctx, alice.Id, direct+100), database.ErrNotMember, "leaving a missing group")
+	check(t, db.LeaveGroup(ctx, bob.Id, group.ConversationId), "bob leaving")
+	err = db.LeaveGroup(ctx, bob.Id, group.ConversationId)
+	checkIs(t, err, database.ErrNotMember, "bob leaving again")
+	checkIs(t, err, database.ErrForbidden, "kind of bob leaving again")
+	exists, err := db.CheckIfConversationExists(ctx, group.ConversationId)
+	check(t, err, "checking the group")
+	checkEqual(t, exists, true, "group exists with a member left")
+
+	sendMessage(t, db, group.ConversationId, alice, "bye", start)
+	check(t, db.LeaveGroup(ctx, alice.Id, group.ConversationId), "alice leaving")
+	exists, err = db.CheckIfConversationExists(ctx, group.ConversationId)
+	check(t, err, "checking the group")
+	checkEqual(t, exists, false, "group exists without members")
+}
+
+func testDeleteGroup(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	group := createGroup(t, db, "friends", alice, bob)
+	m := sendMessage(t, db, group, alice, "hello", start)
+	check(t, db.CommentMessage(ctx, m.MessageId, bob.Id, "👍"), "commenting")
+
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a direct conversation")
+	check(t, db.DeleteGroup(ctx, direct), "deleting a direct conversation")
+	exists, err := db.CheckIfConversationExists(ctx, direct)
+	check(t, err, "checking the direct conversation")
+	checkEqual(t, exists, true, "direct conversation exists after DeleteGroup")
+
+	check(t, db.DeleteGroup(ctx, group), "deleting the group")
+	exists, err = db.CheckIfConversationExists(ctx, group)
+	check(t, err, "checking the group")
+	checkEqual(t, exists, false, "group exists after DeleteGroup")
+	isMember, err := db.IsUserInGroup(ctx, bob.Id, group)
+	check(t, err, "checking the members")
+	checkEqual(t, isMember, false, "bob is a member of the deleted group")
+	isOwner, err := db.IsMessageOwner(ctx, m.MessageId, alice.Id)
+	check(t, err, "checking the message")
+	checkEqual(t, isOwner, false, "message of the deleted group exists")
+	_, err = db.ForwardMessage(ctx, m.MessageId, alice.Id, direct)
+	checkIs(t, err, database.ErrMessageNotFound, "forwarding a message of the deleted group")
+
+	list, err := db.GetConversations(ctx, bob.Id, database.ConversationFilter{})
+	check(t, err, "listing the conversations")
+	previews := list.Conversations
+	checkEqual(t, conversationNames(previews), "alice", "conversations after DeleteGroup")
+}
+
+func testConversationPreviews(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	carol := createUser(t, db, "carol")
+	dave := createUser(t, db, "dave")
+
+	withBob, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	withCarol, err := db.GetOrCreateDirectConversation(ctx, carol.Id, alice.Id, true)
+	check(t, err, "creating a conversation")
+	group := createGroup(t, db, "friends", alice, bob)
+	_, err = db.GetOrCreateDirectConversation(ctx, alice.Id, dave.Id, true)
+	check(t, err, "creating a conversation")
+	_, err = db.CreateGroup(ctx, "other", bob.Id)
+	check(t, err, "creating a group without alice")
+	check(t, db.SetGroupPhoto(ctx, group, "photo"), "setting the group photo")
+
+	sendMessage(t, db, withBob, alice, "first", start)
+	sendMessage(t, db, group, bob, "second", start.Add(time.Minute))
+	sendMessage(t, db, withCarol, carol, "", start.Add(2*time.Minute))
+	photo, err := db.CreateMessage(ctx, database.Message{
+		ConversationId: withCarol, SenderId: carol.Id, Status: "sent", SendTime: start.Add(3 * time.Minute), Photo: "data",
+	})
+	check(t, err, "sending a photo")
+	check(t, db.UpdateLastMessage(ctx, photo.MessageId, withCarol), "updating the last message")
+	sendMessage(t, db, withBob, bob, "third", start.Add(4*time.Minute))
+
+	list, err := db.GetConversations(ctx, alice.Id, database.ConversationFilter{WithPhotos: true})
+	check(t, err, "listing the conversations")
+	previews := list.Conversations
+	checkEqual(t, conversationNames(previews), "bob,carol,friends,dave", "conversations, most recent first")
+	if len(previews) != 4 {
+		t.Fatalf("got %d conversations, want 4", len(previews))
+	}
+
+	checkEqual(t, previews[0].ConversationId, withBob, "ID of the first conversation")
+	checkEqual(t, previews[0].LastMessageText, "third", "last message")
+	checkTime(t, previews[0].LastMessageTime, start.Add(4*time.Minute), "time of the last message")
+	checkEqual(t, previews[0].IsGroup, false, "direct conversation is a group")
+	checkEqual(t, previews[0].IsPhoto, false, "last text message is a photo")
+	checkEqual(t, previews[1].IsPhoto, true, "last photo message is a photo")
+	checkEqual(t, previews[2].IsGroup, true, "group is a group")
+	checkEqual(t, previews[2].Photo, "photo", "group photo")
+	checkEqual(t, previews[2].LastMessageText, "second", "last message of the group")
+	checkEqual(t, previews[3].LastMessageText, "", "last message of a conversation without messages")
+
+	list, err = db.GetConversations(ctx, carol.Id, database.ConversationFilter{})
+	check(t, err, "listing the conversations")
+	previews = list.Conversations
+	checkEqual(t, conversationNames(previews), "alice", "conversations of carol")
+}
+
+func testConversationList(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	carol := createUser(t, db, "carol")
+	dave := createUser(t, db, "dave")
+
+	withBob, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	friends := createGroup(t, db, "Friends", alice, bob, carol)
+	withCarol, err := db.GetOrCreateDirectConversation(ctx, alice.Id, carol.Id, true)
+	check(t, err, "creating a conversation")
+	_, err = db.GetOrCreateDirectConversation(ctx, dave.Id, alice.Id, true)
+	check(t, err, "creating a conversation")
+	family := createGroup(t, db, "family", alice, dave)
+	_, err = db.CreateGroup(ctx, "other", bob.Id)
+	check(t, err, "creating a group without alice")
+	check(t, db.SetGroupPhoto(ctx, friends, "photo"), "setting the group photo")
+
+	// The groups have their last messages at the same time; the direct conversations with carol and dave have none
+	fromBob := sendMessage(t, db, withBob, bob, "hi", start.Add(time.Minute))
+	reply := sendMessage(t, db, withBob, alice, "hello", start.Add(2*time.Minute))
+	sendMessage(t, db, friends, carol, "party?", start.Add(3*time.Minute))
+	fromDave := sendMessage(t, db, family, dave, "dinner", start.Add(3*time.Minute))
+
+	// list lists the conversations of alice, and returns their names and the next cursor as sent to clients
+	list := func(filter database.ConversationFilter) (database.ConversationList, *database.ConversationCursor) {
+		t.Helper()
+		list, err := db.GetConversations(ctx, alice.Id, filter)
+		check(t, err, "listing the conversations")
+		if list.NextCursor == nil {
+			return list, nil
+		}
+		var next database.ConversationCursor
+		cursorRoundTrip(t, list.NextCursor, &next)
+		return list, &next
+	}
+
+	all, next := list(database.ConversationFilter{})
+	checkEqual(t, conversationNames(all.Conversations), "family,Friends,bob,dave,carol", "conversations, most recent first")
+	checkEqual(t, next == nil, true, "whole list has a next cursor")
+	for _, p := range all.Conversations {
+		checkEqual(t, p.Photo, "", "photo of %s without WithPhotos", p.Name)
+	}
+	withPhotos, _ := list(database.ConversationFilter{WithPhotos: true, GroupsOnly: true})
+	checkEqual(t, conversationNames(withPhotos.Conversations), "family,Friends", "groups")
+	if len(withPhotos.Conversations) == 2 {
+		checkEqual(t, withPhotos.Conversations[1].Photo, "photo", "photo of the group with WithPhotos")
+	}
+	direct, _ := list(database.ConversationFilter{DirectOnly: true})
+	checkEqual(t, conversationNames(direct.Conversations), "bob,dave,carol", "direct conversations")
+
+	byName, _ := list(database.ConversationFilter{Name: "FRI"})
+	checkEqual(t, conversationNames(byName.Conversations), "Friends", "conversations named like FRI")
+	byName, _ = list(database.ConversationFilter{Name: "a", DirectOnly: true})
+	checkEqual(t, conversationNames(byName.Conversations), "dave,carol", "direct conversations named like a")
+	for _, name := range []string{"_", "%", `\`} {
+		byName, _ = list(database.ConversationFilter{Name: name})
+		checkEqual(t, conversationNames(byName.Conversations), "", "conversations named like %s", name)
+	}
+	allowed, _ := list(database.ConversationFilter{ConversationIds: []int{withBob, withCarol, friends + 100}})
+	checkEqual(t, conversationNames(allowed.Conversations), "bob,carol", "conversations with the given IDs")
+
+	// A page at a time, across the conversations without messages
+	var pages []string
+	var cursor *database.ConversationCursor
+	for i := 0; i < 5; i++ {
+		page, next := list(database.ConversationFilter{After: cursor, Limit: 2})
+		pages = append(pages, conversationNames(page.Conversations))
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	checkEqual(t, strings.Join(pages, "|"), "family,Friends|bob,dave|carol", "pages of the conversations")
+	page, next := list(database.ConversationFilter{GroupsOnly: true, Limit: 1})
+	checkEqual(t, conversationNames(page.Conversations), "family", "first page of the groups")
+	page, next = list(database.ConversationFilter{GroupsOnly: true, After: next, Limit: 1})
+	checkEqual(t, conversationNames(page.Conversations), "Friends", "second page of the groups")
+	checkEqual(t, next == nil, true, "last page of the groups has a next cursor")
+
+	// Only the messages of the others count as unread
+	unread := func() string {
+		t.Helper()
+		all, _ := list(database.ConversationFilter{})
+		var counts []string
+		for _, p := range all.Conversations {
+			counts = append(counts, fmt.Sprintf("%s:%d", p.Name, p.UnreadCount))
+		}
+		return strings.Join(counts, ",")
+	}
+	checkEqual(t, unread(), "family:1,Friends:1,bob:1,dave:0,carol:0", "unread messages")
+	check(t, db.MarkConversationRead(ctx, withBob, alice.Id, reply.MessageId), "reading the conversation with bob")
+	check(t, db.MarkConversationRead(ctx, family, alice.Id, fromDave.MessageId), "reading the family group")
+	check(t, db.MarkConversationRead(ctx, withBob, alice.Id, fromBob.MessageId), "reading an older message")
+	checkEqual(t, unread(), "family:0,Friends:1,bob:0,dave:0,carol:0", "unread messages after reading")
+	unreadOnly, _ := list(database.ConversationFilter{UnreadOnly: true})
+	checkEqual(t, conversationNames(unreadOnly.Conversations), "Friends", "conversations with unread messages")
+
+	// Read messages are per user
+	bobs, err := db.GetConversations(ctx, bob.Id, database.ConversationFilter{UnreadOnly: true})
+	check(t, err, "listing the conversations of bob")
+	checkEqual(t, conversationNames(bobs.Conversations), "Friends,alice", "conversations of bob with unread messages")
+}
+
+func testConversationDetails(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+
+	// Sent out of order
+	sendMessage(t, db, direct, alice, "second", start.Add(time.Minute))
+	sendMessage(t, db, direct, bob, "first", start)
+	last := sendMessage(t, db, direct, alice, "third", start.Add(2*time.Minute))
+	sendMessage(t, db, direct, bob, "also first", start) // Same time: the last sent first
+
+	details, err := db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, details.ConversationId, direct, "conversation ID")
+	checkEqual(t, details.Name, "bob", "name seen by alice")
+	checkEqual(t, details.IsGroup, false, "direct conversation is a group")
+	checkEqual(t, messageTexts(details), "third,second,also first,first", "messages, most recent first")
+	if len(details.Messages) != 4 {
+		t.Fatalf("got %d messages, want 4", len(details.Messages))
+	}
+	m := details.Messages[0]
+	checkEqual(t, m.MessageId, last.MessageId, "message ID")
+	checkEqual(t, m.SenderId, alice.Id, "sender")
+	checkEqual(t, m.SenderUsername, "alice", "sender username")
+	checkEqual(t, m.Status, "sent", "status")
+	checkTime(t, m.SendTime, start.Add(2*time.Minute), "send time")
+	checkEqual(t, len(m.Comments), 0, "comments")
+
+	details, err = db.GetConversationDetails(ctx, direct, bob.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, details.Name, "alice", "name seen by bob")
+
+	alone, err := db.CreateConversation(ctx, alice.Id, 0)
+	check(t, err, "creating a conversation")
+	details, err = db.GetConversationDetails(ctx, alone.ConversationId, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, details.Name, database.DeletedUsername, "name of a conversation without other participants")
+	checkEqual(t, len(details.Messages), 0, "messages of an empty conversation")
+
+	_, err = db.GetConversationDetails(ctx, alone.ConversationId+100, alice.Id, database.MessagePage{})
+	checkIs(t, err, sql.ErrNoRows, "getting a missing conversation")
+}
+
+func testComments(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	m := sendMessage(t, db, direct, alice, "hello", start)
+
+	check(t, db.CommentMessage(ctx, m.MessageId, bob.Id, "👍"), "bob commenting")
+	checkIs(t, db.CommentMessage(ctx, m.MessageId, bob.Id, "❤"), database.ErrAlreadyExists, "bob commenting twice")
+	check(t, db.CommentMessage(ctx, m.MessageId, alice.Id, "😀"), "alice commenting")
+	checkIs(t, db.CommentMessage(ctx, m.MessageId+100, bob.Id, "👍"), database.ErrNotFound, "commenting a missing message")
+
+	details, err := db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	if len(details.Messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(details.Messages))
+	}
+	checkEqual(t, details.Messages[0].Comments, []database.Comment{
+		{UserId: bob.Id, Username: "bob", Emoji: "👍"},
+		{UserId: alice.Id, Username: "alice", Emoji: "😀"},
+	}, "comments")
+
+	check(t, db.UncommentMessage(ctx, m.MessageId, bob.Id), "bob uncommenting")
+	check(t, db.UncommentMessage(ctx, m.MessageId, bob.Id), "bob uncommenting again")
+	check(t, db.CommentMessage(ctx, m.MessageId, bob.Id, "❤"), "bob commenting again")
+	details, err = db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, details.Messages[0].Comments, []database.Comment{
+		{UserId: alice.Id, Username: "alice", Emoji: "😀"},
+		{UserId: bob.Id, Username: "bob", Emoji: "❤"},
+	}, "comments after uncommenting")
+}
+
+// testManyComments checks the comments of a conversation with more messages than fit in a batched query.
+func testManyComments(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+
+	const messages = 1100
+	commented := make(map[int]string)
+	for i := 0; i < messages; i++ {
+		m, err := db.CreateMessage(ctx, database.Message{
+			ConversationId: direct, SenderId: alice.Id, Text: fmt.Sprint(i), Status: "sent",
+			SendTime: start.Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatalf("sending message %d: %v", i, err)
+		}
+		if i%250 == 0 || i == messages-1 {
+			check(t, db.CommentMessage(ctx, m.MessageId, bob.Id, "👍"), "commenting message %d", i)
+			commented[m.MessageId] = fmt.Sprint(i)
+		}
+	}
+
+	details, err := db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, len(details.Messages), messages, "messages")
+	for _, m := range details.Messages {
+		if _, ok := commented[m.MessageId]; ok {
+			checkEqual(t, m.Comments, []database.Comment{{UserId: bob.Id, Username: "bob", Emoji: "👍"}}, "comments of message %s", m.Text)
+			delete(commented, m.MessageId)
+		} else if len(m.Comments) > 0 {
+			t.Errorf("message %s: got comments %v, want none", m.Text, m.Comments)
+		}
+	}
+	checkEqual(t, len(commented), 0, "commented messages not returned")
+}
+
+func testMessagePages(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+
+	// Some sent at the same time, and the last one in another time zone
+	var last database.Message
+	for _, m := range []struct {
+		text     string
+		sendTime time.Time
+	}{
+		{"a", start},
+		{"b", start.Add(time.Minute)},
+		{"c", start.Add(time.Minute)},
+		{"d", start.Add(time.Minute)},
+		{"e", start.Add(2 * time.Minute)},
+		{"f", start.Add(2 * time.Minute)},
+		{"g", start.Add(3 * time.Minute).In(time.FixedZone("UTC+5", 5*60*60))},
+	} {
+		last = sendMessage(t, db, direct, alice, m.text, m.sendTime)
+	}
+
+	// checkPage checks the messages of the page and which cursors it has, and returns the cursors as sent to clients
+	checkPage := func(name string, page database.MessagePage, texts string, hasNext bool, hasPrev bool) (*database.MessageCursor, *database.MessageCursor) {
+		t.Helper()
+		details, err := db.GetConversationDetails(ctx, direct, alice.Id, page)
+		check(t, err, "getting the %s", name)
+		var next, prev *database.MessageCursor
+		if details.NextCursor != nil {
+			next = &database.MessageCursor{}
+			cursorRoundTrip(t, details.NextCursor, next)
+		}
+		if details.PrevCursor != nil {
+			prev = &database.MessageCursor{}
+			cursorRoundTrip(t, details.PrevCursor, prev)
+		}
+		checkEqual(t, messageTexts(details), texts, "messages of the %s", name)
+		checkEqual(t, next != nil, hasNext, "%s has a next cursor", name)
+		checkEqual(t, prev != nil, hasPrev, "%s has a previous cursor", name)
+		return next, prev
+	}
+
+	checkPage("whole history", database.MessagePage{}, "g,f,e,d,c,b,a", false, false)
+
+	// Backward, from the most recent messages
+	next, _ := checkPage("first page", database.MessagePage{Limit: 3}, "g,f,e", true, false)
+	next, prev := checkPage("second page", database.MessagePage{Before: next, Limit: 3}, "d,c,b", true, true)
+	_, oldest := checkPage("last page", database.MessagePage{Before: next, Limit: 3}, "a", false, true)
+
+	// Forward, back to the most recent messages
+	checkPage("page newer than the second", database.MessagePage{After: prev, Limit: 3}, "g,f,e", true, false)
+	_, prev = checkPage("page newer than the last", database.MessagePage{After: oldest, Limit: 2}, "c,b", true, true)
+	_, prev = checkPage("next newer page", database.MessagePage{After: prev, Limit: 2}, "e,d", true, true)
+	checkPage("newest page", database.MessagePage{After: prev, Limit: 2}, "g,f", true, false)
+
+	// Between two cursors, and past the ends of the history
+	newest := database.CursorOf(last)
+	checkPage("range", database.MessagePage{After: oldest, Before: &newest}, "f,e,d,c,b", true, true)
+	checkPage("limited range", database.MessagePage{After: oldest, Before: &newest, Limit: 2}, "f,e", true, true)
+	checkPage("page newer than the newest", database.MessagePage{After: &newest, Limit: 2}, "", false, false)
+	checkPage("page older than the oldest", database.MessagePage{Before: oldest, Limit: 2}, "", false, false)
+}
+
+// cursorRoundTrip encodes the cursor like the API, and decodes it into decoded.
+func cursorRoundTrip(t *testing.T, c encoding.TextMarshaler, decoded encoding.TextUnmarshaler) {
+	t.Helper()
+	text, err := c.MarshalText()
+	check(t, err, "encoding cursor")
+	check(t, decoded.UnmarshalText(text), "decoding cursor %s", text)
+}
+
+func testDeleteMessage(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	first := sendMessage(t, db, direct, alice, "first", start)
+	second := sendMessage(t, db, direct, bob, "second", start.Add(time.Minute))
+	check(t, db.CommentMessage(ctx, second.MessageId, alice.Id, "👍"), "commenting")
+
+	isOwner, err := db.IsMessageOwner(ctx, second.MessageId, alice.Id)
+	check(t, err, "checking the sender")
+	checkEqual(t, isOwner, false, "alice is the sender of the message of bob")
+	isOwner, err = db.IsMessageOwner(ctx, second.MessageId, bob.Id)
+	check(t, err, "checking the sender")
+	checkEqual(t, isOwner, true, "bob is the sender of his message")
+
+	// Only the sender can delete a message
+	checkIs(t, db.DeleteMessage(ctx, second.MessageId, alice.Id), database.ErrNotMessageOwner, "alice deleting the message of bob")
+	details, err := db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, messageTexts(details), "second,first", "messages")
+
+	// The message is kept as a tombstone, without its comments
+	setTime(start.Add(time.Hour))
+	check(t, db.DeleteMessage(ctx, second.MessageId, bob.Id), "bob deleting his message")
+	details, err = db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, messageTexts(details), database.DeletedMessageText+",first", "messages after a delete")
+	tombstone := details.Messages[0]
+	if tombstone.DeletedAt == nil {
+		t.Fatalf("the deleted message has no deletion time")
+	}
+	checkTime(t, *tombstone.DeletedAt, start.Add(time.Hour), "deletion time")
+	checkEqual(t, tombstone.Photo, "", "photo of the deleted message")
+	checkEqual(t, len(tombstone.Comments), 0, "comments of the deleted message")
+	checkIs(t, db.DeleteMessage(ctx, second.MessageId, bob.Id), database.ErrMessageNotFound, "deleting the message again")
+	checkIs(t, db.CommentMessage(ctx, second.MessageId, alice.Id, "👍"), database.ErrMessageNotFound, "commenting the deleted message")
+	_, err = db.ForwardMessage(ctx, second.MessageId, alice.Id, direct)
+	checkIs(t, err, database.ErrMessageNotFound, "forwarding the deleted message")
+	check(t, db.CommentMessage(ctx, first.MessageId, alice.Id, "👍"), "commenting the first message")
+
+	// The preview shows that the last message was deleted
+	list, err := db.GetConversations(ctx, alice.Id, database.ConversationFilter{})
+	check(t, err, "listing the conversations")
+	previews := list.Conversations
+	if len(previews) != 1 {
+		t.Fatalf("got %d conversations, want 1", len(previews))
+	}
+	checkEqual(t, previews[0].LastMessageText, database.DeletedMessageText, "last message after a delete")
+	checkEqual(t, previews[0].LastMessageDeleted, true, "last message deleted")
+	checkEqual(t, previews[0].UnreadCount, 0, "unread messages with a deleted one")
+
+	// Tombstones are purged only once they are old enough, and the preview shows the previous message
+	purged, err := db.PurgeDeletedMessages(ctx, start.Add(time.Hour))
+	check(t, err, "purging the recent tombstones")
+	checkEqual(t, purged, int64(0), "purged tombstones")
+	purged, err = db.PurgeDeletedMessages(ctx, start.Add(2*time.Hour))
+	check(t, err, "purging the tombstones")
+	checkEqual(t, purged, int64(1), "purged tombstones")
+	details, err = db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, messageTexts(details), "first", "messages after the purge")
+	list, err = db.GetConversations(ctx, alice.Id, database.ConversationFilter{})
+	check(t, err, "listing the conversations")
+	previews = list.Conversations
+	checkEqual(t, previews[0].LastMessageText, "first", "last message after the purge")
+	checkEqual(t, previews[0].LastMessageDeleted, false, "last message deleted after the purge")
+
+	check(t, db.DeleteMessage(ctx, first.MessageId, alice.Id), "alice deleting her message")
+	_, err = db.PurgeDeletedMessages(ctx, start.Add(2*time.Hour))
+	check(t, err, "purging the tombstones")
+	list, err = db.GetConversations(ctx, alice.Id, database.ConversationFilter{})
+	check(t, err, "listing the conversations")
+	previews = list.Conversations
+	checkEqual(t, previews[0].LastMessageText, "", "last message after deleting all")
+	checkIs(t, db.DeleteMessage(ctx, first.MessageId, alice.Id), database.ErrMessageNotFound, "deleting a missing message")
+}
+
+func testForwardMessage(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	carol := createUser(t, db, "carol")
+	withBob, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	withCarol, err := db.GetOrCreateDirectConversation(ctx, alice.Id, carol.Id, true)
+	check(t, err, "creating a conversation")
+
+	original, err := db.CreateMessage(ctx, database.Message{
+		ConversationId: withBob, SenderId: bob.Id, Text: "look", Status: "sent", SendTime: start, Photo: "data",
+	})
+	check(t, err, "sending a message")
+
+	forwarded, err := db.ForwardMessage(ctx, original.MessageId, alice.Id, withCarol)
+	check(t, err, "forwarding the message")
+	if forwarded.MessageId == original.MessageId {
+		t.Errorf("the forwarded message has the ID of the original")
+	}
+	checkEqual(t, forwarded.ConversationId, withCarol, "conversation of the forwarded message")
+
+	details, err := db.GetConversationDetails(ctx, withCarol, carol.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	if len(details.Messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(details.Messages))
+	}
+	m := details.Messages[0]
+	checkEqual(t, m.MessageId, forwarded.MessageId, "ID of the forwarded message")
+	checkEqual(t, m.Text, "look", "text of the forwarded message")
+	checkEqual(t, m.Photo, "data", "photo of the forwarded message")
+	checkEqual(t, m.SenderUsername, "alice", "sender of the forwarded message")
+
+	_, err = db.ForwardMessage(ctx, original.MessageId+100, alice.Id, withCarol)
+	checkIs(t, err, database.ErrMessageNotFound, "forwarding a missing message")
+	_, err = db.ForwardMessage(ctx, original.MessageId, alice.Id, withCarol+100)
+	checkIs(t, err, database.ErrNotFound, "forwarding to a missing conversation")
+}
+
+func testRetention(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	carol := createUser(t, db, "carol")
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	group := createGroup(t, db, "friends", alice, bob)
+	old := sendMessage(t, db, direct, bob, "old", start)
+	sendMessage(t, db, direct, alice, "new", start.Add(2*time.Hour))
+	sendMessage(t, db, group, alice, "kept", start)
+	check(t, db.CommentMessage(ctx, old.MessageId, alice.Id, "👍"), "commenting")
+
+	_, err = db.SetConversationRetention(ctx, direct, carol.Id, 24*time.Hour)
+	checkIs(t, err, database.ErrNotMember, "carol setting the retention of a conversation of others")
+
+	// The change is an event of the timeline, sent by bob
+	setTime(start.Add(3 * time.Hour))
+	event, err := db.SetConversationRetention(ctx, direct, bob.Id, 24*time.Hour)
+	check(t, err, "setting the retention")
+	checkEqual(t, event.Event, database.EventRetention, "kind of the event")
+	checkEqual(t, event.Text, "bob set disappearing messages to 1 day", "text of the event")
+	checkEqual(t, event.SenderId, bob.Id, "sender of the event")
+	checkTime(t, event.SendTime, start.Add(3*time.Hour), "time of the event")
+
+	details, err := db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, details.RetentionSeconds, int64(24*60*60), "retention")
+	checkEqual(t, messageTexts(details), event.Text+",new,old", "messages with the event")
+	checkEqual(t, details.Messages[0].Event, database.EventRetention, "kind of the event in the timeline")
+	checkEqual(t, details.Messages[1].Event, "", "kind of a message")
+
+	list, err := db.GetConversations(ctx, alice.Id, database.ConversationFilter{ConversationIds: []int{direct}})
+	check(t, err, "listing the conversations")
+	checkEqual(t, list.Conversations[0].LastMessageText, event.Text, "last message")
+	checkEqual(t, list.Conversations[0].UnreadCount, 1, "unread messages, without the event")
+
+	// Events can't be changed like messages, nor found by searches
+	_, err = db.ForwardMessage(ctx, event.MessageId, alice.Id, group)
+	checkIs(t, err, database.ErrMessageNotFound, "forwarding the event")
+	checkIs(t, db.CommentMessage(ctx, event.MessageId, alice.Id, "👍"), database.ErrMessageNotFound, "commenting the event")
+	checkIs(t, db.DeleteMessage(ctx, event.MessageId, bob.Id), database.ErrMessageNotFound, "deleting the event")
+	results, err := db.SearchMessages(ctx, alice.Id, database.MessageSearch{Query: "disappearing"})
+	check(t, err, "searching the event")
+	checkEqual(t, len(results.Results), 0, "events found")
+
+	// Messages expire once older than the retention period, with their reactions; the events and the other
+	// conversations are kept
+	purged, err := db.PurgeExpiredMessages(ctx, start.Add(24*time.Hour))
+	check(t, err, "purging the messages")
+	checkEqual(t, purged, int64(0), "purged messages, none expired")
+	purged, err = db.PurgeExpiredMessages(ctx, start.Add(25*time.Hour))
+	check(t, err, "purging the messages")
+	checkEqual(t, purged, int64(1), "purged messages")
+	details, err = db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, messageTexts(details), event.Text+",new", "messages after the purge")
+	checkIs(t, db.CommentMessage(ctx, old.MessageId, bob.Id, "👍"), database.ErrMessageNotFound, "commenting a purged message")
+
+	purged, err = db.PurgeExpiredMessages(ctx, start.Add(30*24*time.Hour))
+	check(t, err, "purging the messages")
+	checkEqual(t, purged, int64(1), "purged messages")
+	details, err = db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, messageTexts(details), event.Text, "messages after purging all")
+	details, err = db.GetConversationDetails(ctx, group, alice.Id, database.MessagePage{})
+	check(t, err, "getting the group")
+	checkEqual(t, messageTexts(details), "kept", "messages of the group")
+	checkEqual(t, details.RetentionSeconds, int64(0), "retention of the group")
+
+	// Without a retention period, messages are kept again
+	off, err := db.SetConversationRetention(ctx, direct, alice.Id, 0)
+	check(t, err, "turning off the retention")
+	checkEqual(t, off.Text, "alice turned off disappearing messages", "text of the event")
+	sendMessage(t, db, direct, alice, "forever", start)
+	purged, err = db.PurgeExpiredMessages(ctx, start.Add(30*24*time.Hour))
+	check(t, err, "purging the messages")
+	checkEqual(t, purged, int64(0), "purged messages without retention")
+	details, err = db.GetConversationDetails(ctx, direct, alice.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, details.RetentionSeconds, int64(0), "retention after turning it off")
+	checkEqual(t, messageTexts(details), off.Text+","+event.Text+",forever", "messages without retention")
+
+	// Purging the last message shows the previous one in the preview
+	_, err = db.SetConversationRetention(ctx, group, alice.Id, 90*24*time.Hour)
+	check(t, err, "setting the retention of the group")
+	sendMessage(t, db, group, bob, "last", start.Add(time.Hour))
+	_, err = db.PurgeExpiredMessages(ctx, start.Add(100*24*time.Hour))
+	check(t, err, "purging the messages of the group")
+	list, err = db.GetConversations(ctx, alice.Id, database.ConversationFilter{ConversationIds: []int{group}})
+	check(t, err, "listing the conversations")
+	checkEqual(t, list.Conversations[0].LastMessageText, "alice set disappearing messages to 90 days", "last message of the group")
+}
+
+func testSearchMessages(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	carol := createUser(t, db, "carol")
+
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	trip := createGroup(t, db, "Trip", alice, bob, carol)
+	work := createGroup(t, db, "Work", bob, carol)
+
+	question := sendMessage(t, db, direct, bob, "Lunch at noon?", start.Add(time.Minute))
+	sendMessage(t, db, direct, alice, "Noon works, see you at lunch", start.Add(2*time.Minute))
+	sendMessage(t, db, trip, carol, "Lunch tomorrow before the train", start.Add(3*time.Minute))
+	sendMessage(t, db, trip, bob, "Train tickets booked", start.Add(4*time.Minute))
+	sendMessage(t, db, work, bob, "lunch meeting", start.Add(5*time.Minute))
+
+	// search returns the texts of the results, and the next cursor as sent to clients
+	search := func(user database.User, s database.MessageSearch) (string, []database.SearchResult, *database.MessageCursor) {
+		t.Helper()
+		results, err := db.SearchMessages(ctx, user.Id, s)
+		check(t, err, "searching %q", s.Query)
+		var texts []string
+		for _, r := range results.Results {
+			texts = append(texts, strings.NewReplacer(database.HighlightStart, "", database.HighlightEnd, "").Replace(r.Snippet))
+		}
+		if results.NextCursor == nil {
+			return strings.Join(texts, "|"), results.Results, nil
+		}
+		var next database.MessageCursor
+		cursorRoundTrip(t, results.NextCursor, &next)
+		return strings.Join(texts, "|"), results.Results, &next
+	}
+
+	texts, _, next := search(alice, database.MessageSearch{Query: "lunch"})
+	checkEqual(t, texts, "Lunch tomorrow before the train|Noon works, see you at lunch|Lunch at noon?", "messages with lunch, most recent first")
+	checkEqual(t, next == nil, true, "all the results have a next cursor")
+	texts, _, _ = search(bob, database.MessageSearch{Query: "lunch"})
+	checkEqual(t, strings.Count(texts, "|"), 3, "results of bob, in all his conversations: %s", texts)
+	texts, _, _ = search(alice, database.MessageSearch{Query: "NOON, lunch?"})
+	checkEqual(t, texts, "Noon works, see you at lunch|Lunch at noon?", "messages with both noon and lunch")
+	texts, _, _ = search(alice, database.MessageSearch{Query: `lunch" OR "train`})
+	checkEqual(t, texts, "", "messages with the words of operators")
+	for _, query := range []string{"pizza", "", "?!"} {
+		texts, _, _ = search(alice, database.MessageSearch{Query: query})
+		checkEqual(t, texts, "", "messages matching %q", query)
+	}
+
+	texts, _, _ = search(alice, database.MessageSearch{Query: "lunch", ConversationId: trip})
+	checkEqual(t, texts, "Lunch tomorrow before the train", "messages of the group with lunch")
+	texts, _, _ = search(alice, database.MessageSearch{Query: "lunch", ConversationIds: []int{direct, work}})
+	checkEqual(t, texts, "Noon works, see you at lunch|Lunch at noon?", "messages of the given conversations with lunch")
+	texts, _, _ = search(alice, database.MessageSearch{Query: "lunch", ConversationId: work})
+	checkEqual(t, texts, "", "messages of a group alice isn't in")
+
+	// A page at a time
+	texts, _, next = search(alice, database.MessageSearch{Query: "lunch", Limit: 2})
+	checkEqual(t, texts, "Lunch tomorrow before the train|Noon works, see you at lunch", "first page")
+	if next == nil {
+		t.Fatalf("first page has no next cursor")
+	}
+	texts, _, next = search(alice, database.MessageSearch{Query: "lunch", Limit: 2, Before: next})
+	checkEqual(t, texts, "Lunch at noon?", "second page")
+	checkEqual(t, next == nil, true, "last page has a next cursor")
+
+	// The matching words are highlighted
+	_, results, _ := search(alice, database.MessageSearch{Query: "tickets"})
+	if len(results) != 1 {
+		t.Fatalf("got %d results for tickets, want 1", len(results))
+	}
+	r := results[0]
+	checkEqual(t, r.ConversationId, trip, "conversation of the result")
+	checkEqual(t, r.SenderUsername, "bob", "sender of the result")
+	checkTime(t, r.SendTime, start.Add(4*time.Minute), "send time of the result")
+	checkEqual(t, strings.Contains(strings.ToLower(r.Snippet), database.HighlightStart+"tickets"+database.HighlightEnd), true,
+		"snippet %q highlights tickets", r.Snippet)
+
+	// Deleted messages, and the messages of the groups the user has left, are not found
+	check(t, db.DeleteMessage(ctx, question.MessageId, bob.Id), "deleting a message")
+	check(t, db.LeaveGroup(ctx, alice.Id, trip), "leaving the group")
+	texts, _, _ = search(alice, database.MessageSearch{Query: "lunch"})
+	checkEqual(t, texts, "Noon works, see you at lunch", "messages with lunch after leaving and deleting")
+	texts, _, _ = search(alice, database.MessageSearch{Query: "train", ConversationId: trip})
+	checkEqual(t, texts, "", "messages of the group alice has left")
+	texts, _, _ = search(carol, database.MessageSearch{Query: "train"})
+	checkEqual(t, texts, "Train tickets booked|Lunch tomorrow before the train", "messages of the group for the others")
+	check(t, db.DeleteGroup(ctx, work), "deleting a group")
+	texts, _, _ = search(bob, database.MessageSearch{Query: "meeting"})
+	checkEqual(t, texts, "", "messages of a deleted group")
+}
+
+func testSessions(t *testing.T, db database.AppDatabase) {
+	setTime(start)
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+
+	first, err := db.CreateSession(ctx, alice.Id, "hash1", "firefox", start.Add(time.Hour))
+	check(t, err, "creating a session")
+	checkTime(t, first.CreatedAt, start, "creation time")
+	_, err = db.CreateSession(ctx, bob.Id, "hash1", "chrome", start.Add(time.Hour))
+	checkIs(t, err, database.ErrAlreadyExists, "creating a session with the same token")
+	setTime(start.Add(time.Minute))
+	second, err := db.CreateSession(ctx, alice.Id, "hash2", "chrome", start.Add(2*time.Hour))
+	check(t, err, "creating a session")
+	_, err = db.CreateSession(ctx, bob.Id, "hash3", "curl", start.Add(time.Hour))
+	check(t, err, "creating a session")
+
+	u, s, err := db.GetUserBySession(ctx, "hash1")
+	check(t, err, "getting the session")
+	checkEqual(t, u.Id, alice.Id, "user of the session")
+	checkEqual(t, u.Username, "alice", "username of the session")
+	checkEqual(t, s.SessionId, first.SessionId, "session ID")
+	checkEqual(t, s.UserId, alice.Id, "user ID of the session")
+	checkEqual(t, s.UserAgent, "firefox", "user agent")
+	checkTime(t, s.ExpiresAt, start.Add(time.Hour), "expiration time")
+	_, _, err = db.GetUserBySession(ctx, "missing")
+	checkIs(t, err, database.ErrSessionNotFound, "getting a missing session")
+	u, s, err = db.GetUserBySessionId(ctx, second.SessionId)
+	check(t, err, "getting the session by ID")
+	checkEqual(t, u.Id, alice.Id, "user of the session")
+	checkEqual(t, s.SessionId, second.SessionId, "session ID")
+	_, _, err = db.GetUserBySessionId(ctx, second.SessionId+100)
+	checkIs(t, err, database.ErrSessionNotFound, "getting a missing session by ID")
+
+	// Most recently used first
+	setTime(start.Add(2 * time.Minute))
+	check(t, db.TouchSession(ctx, first.SessionId), "touching the session")
+	sessions, err := db.ListSessions(ctx, alice.Id)
+	check(t, err, "listing the sessions")
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	checkEqual(t, sessions[0].SessionId, first.SessionId, "most recently used session")
+	checkTime(t, sessions[0].LastUsedAt, start.Add(2*time.Minute), "last use")
+	checkEqual(t, sessions[1].SessionId, second.SessionId, "least recently used session")
+
+	// Expired sessions are gone
+	setTime(start.Add(time.Hour))
+	_, _, err = db.GetUserBySession(ctx, "hash1")
+	checkIs(t, err, database.ErrSessionNotFound, "getting an expired session")
+	_, _, err = db.GetUserBySessionId(ctx, first.SessionId)
+	checkIs(t, err, database.ErrSessionNotFound, "getting an expired session by ID")
+	sessions, err = db.ListSessions(ctx, alice.Id)
+	check(t, err, "listing the sessions")
+	checkEqual(t, len(sessions), 1, "active sessions")
+
+	check(t, db.RotateSessionToken(ctx, second.SessionId, "hash2", "hash4"), "rotating the token")
+	checkIs(t, db.RotateSessionToken(ctx, second.SessionId, "hash2", "hash7"), database.ErrSessionNotFound,
+		"rotating the old token again")
+	_, _, err = db.GetUserBySession(ctx, "hash2")
+	checkIs(t, err, database.ErrSessionNotFound, "getting a session with its old token")
+	_, s, err = db.GetUserBySession(ctx, "hash4")
+	check(t, err, "getting a session with its new token")
+	checkEqual(t, s.SessionId, second.SessionId, "session of the new token")
+	checkTime(t, s.LastUsedAt, start.Add(time.Hour), "last use after the rotation")
+
+	checkIs(t, db.RevokeSession(ctx, bob.Id, second.SessionId), database.ErrSessionNotFound, "bob revoking alice's session")
+	check(t, db.RevokeSession(ctx, alice.Id, second.SessionId), "revoking the session")
+	checkIs(t, db.RevokeSession(ctx, alice.Id, second.SessionId), database.ErrSessionNotFound, "revoking the session again")
+	_, _, err = db.GetUserBySession(ctx, "hash4")
+	checkIs(t, err, database.ErrSessionNotFound, "getting a revoked session")
+	_, _, err = db.GetUserBySessionId(ctx, second.SessionId)
+	checkIs(t, err, database.ErrSessionNotFound, "getting a revoked session by ID")
+	checkIs(t, db.RotateSessionToken(ctx, second.SessionId, "hash4", "hash5"), database.ErrSessionNotFound,
+		"rotating a revoked session")
+
+	setTime(start)
+	keep, err := db.CreateSession(ctx, bob.Id, "hash6", "firefox", start.Add(time.Hour))
+	check(t, err, "creating a session")
+	check(t, db.RevokeOtherSessions(ctx, bob.Id, keep.SessionId), "revoking the other sessions")
+	sessions, err = db.ListSessions(ctx, bob.Id)
+	check(t, err, "listing the sessions")
+	if len(sessions) != 1 || sessions[0].SessionId != keep.SessionId {
+		t.Errorf("sessions after revoking the others: got %v, want only %d", sessions, keep.SessionId)
+	}
+}
+
+func testPassphrases(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+
+	_, err := db.GetPassphraseHash(ctx, alice.Id)
+	checkIs(t, err, database.ErrNoPassphrase, "getting a missing passphrase")
+	check(t, db.SetPassphraseHash(ctx, alice.Id, "hash1"), "setting the passphrase")
+	check(t, db.SetPassphraseHash(ctx, alice.Id, "hash2"), "replacing the passphrase")
+	hash, err := db.GetPassphraseHash(ctx, alice.Id)
+	check(t, err, "getting the passphrase")
+	checkEqual(t, hash, "hash2", "passphrase")
+	checkIs(t, db.SetPassphraseHash(ctx, alice.Id+100, "hash"), database.ErrNotFound, "setting the passphrase of a missing user")
+
+	// Creating a user with a passphrase never sets the passphrase of an existing one
+	_, err = db.CreateUserWithPassphrase(ctx, "alice", "hash3")
+	checkIs(t, err, database.ErrUsernameTaken, "creating a user with a taken username")
+	hash, err = db.GetPassphraseHash(ctx, alice.Id)
+	check(t, err, "getting the passphrase")
+	checkEqual(t, hash, "hash2", "passphrase after creating a user with a taken username")
+
+	bob, err := db.CreateUserWithPassphrase(ctx, "bob", "hash4")
+	check(t, err, "creating a user with a passphrase")
+	hash, err = db.GetPassphraseHash(ctx, bob.Id)
+	check(t, err, "getting the passphrase of the new user")
+	checkEqual(t, hash, "hash4", "passphrase of the new user")
+	if user, err := db.CreateUser(ctx, database.User{Username: "bob"}); err != nil || user.Id != bob.Id {
+		t.Errorf("logging in as the new user: got %v (%v), want %d", user, err, bob.Id)
+	}
+}
+
+func testTOTP(t *testing.T, db database.AppDatabase) {
+	setTime(start)
+	alice := createUser(t, db, "alice")
+
+	_, err := db.GetTOTP(ctx, alice.Id)
+	checkIs(t, err, database.ErrNoTOTP, "getting a missing enrollment")
+	checkIs(t, db.ConfirmTOTP(ctx, alice.Id, 10, nil), database.ErrNoTOTP, "confirming a missing enrollment")
+
+	check(t, db.SetTOTPSecret(ctx, alice.Id, "secret"), "enrolling")
+	totp, err := db.GetTOTP(ctx, alice.Id)
+	check(t, err, "getting the enrollment")
+	checkEqual(t, totp, database.TOTP{UserId: alice.Id, Secret: "secret"}, "new enrollment")
+	checkIs(t, db.UseTOTPStep(ctx, alice.Id, 10), database.ErrTOTPCodeReused, "using an unconfirmed enrollment")
+
+	check(t, db.ConfirmTOTP(ctx, alice.Id, 10, []string{"code1", "code2"}), "confirming")
+	totp, err = db.GetTOTP(ctx, alice.Id)
+	check(t, err, "getting the enrollment")
+	checkEqual(t, totp, database.TOTP{UserId: alice.Id, Secret: "secret", Confirmed: true, LastUsedStep: 10}, "confirmed enrollment")
+
+	checkIs(t, db.UseTOTPStep(ctx, alice.Id, 10), database.ErrTOTPCodeReused, "reusing the confirmation step")
+	check(t, db.UseTOTPStep(ctx, alice.Id, 12), "using a later step")
+	checkIs(t, db.UseTOTPStep(ctx, alice.Id, 11), database.ErrTOTPCodeReused, "using an earlier step")
+
+	check(t, db.UseRecoveryCode(ctx, alice.Id, "code1"), "using a recovery code")
+	checkIs(t, db.UseRecoveryCode(ctx, alice.Id, "code1"), database.ErrRecoveryCodeNotFound, "reusing a recovery code")
+	checkIs(t, db.UseRecoveryCode(ctx, alice.Id, "code3"), database.ErrRecoveryCodeNotFound, "using a missing recovery code")
+
+	// A new enrollment replaces the codes
+	check(t, db.SetTOTPSecret(ctx, alice.Id, "secret2"), "enrolling again")
+	totp, err = db.GetTOTP(ctx, alice.Id)
+	check(t, err, "getting the enrollment")
+	checkEqual(t, totp, database.TOTP{UserId: alice.Id, Secret: "secret2"}, "new enrollment")
+	check(t, db.ConfirmTOTP(ctx, alice.Id, 20, []string{"code1", "code3"}), "confirming again")
+	check(t, db.UseRecoveryCode(ctx, alice.Id, "code1"), "using a new recovery code")
+	checkIs(t, db.UseRecoveryCode(ctx, alice.Id, "code2"), database.ErrRecoveryCodeNotFound, "using a replaced recovery code")
+
+	check(t, db.DeleteTOTP(ctx, alice.Id), "disabling")
+	_, err = db.GetTOTP(ctx, alice.Id)
+	checkIs(t, err, database.ErrNoTOTP, "getting a deleted enrollment")
+	checkIs(t, db.UseRecoveryCode(ctx, alice.Id, "code3"), database.ErrRecoveryCodeNotFound, "using a recovery code after disabling")
+}
+
+func testLoginChallenges(t *testing.T, db database.AppDatabase) {
+	setTime(start)
+	alice := createUser(t, db, "alice")
+
+	challenge := database.LoginChallenge{UserId: alice.Id, UserAgent: "firefox", ExpiresAt: start.Add(time.Minute)}
+	check(t, db.CreateLoginChallenge(ctx, "hash1", challenge), "creating a challenge")
+	checkIs(t, db.CreateLoginChallenge(ctx, "hash1", challenge), database.ErrAlreadyExists, "creating a challenge with the same hash")
+	check(t, db.CreateLoginChallenge(ctx, "hash2", database.LoginChallenge{UserId: alice.Id, ExpiresAt: start.Add(time.Second)}),
+		"creating a challenge")
+
+	check(t, db.RecordLoginChallengeFailure(ctx, "hash1"), "recording a failure")
+	check(t, db.RecordLoginChallengeFailure(ctx, "hash1"), "recording a failure")
+	got, err := db.GetLoginChallenge(ctx, "hash1")
+	check(t, err, "getting the challenge")
+	checkEqual(t, got.UserId, alice.Id, "user of the challenge")
+	checkEqual(t, got.UserAgent, "firefox", "user agent of the challenge")
+	checkEqual(t, got.Attempts, 2, "attempts")
+	checkTime(t, got.ExpiresAt, start.Add(time.Minute), "expiration time")
+	_, err = db.GetLoginChallenge(ctx, "missing")
+	checkIs(t, err, database.ErrChallengeNotFound, "getting a missing challenge")
+
+	setTime(start.Add(time.Second))
+	_, err = db.GetLoginChallenge(ctx, "hash2")
+	checkIs(t, err, database.ErrChallengeNotFound, "getting an expired challenge")
+
+	// Deleting a challenge deletes the expired ones
+	check(t, db.CreateLoginChallenge(ctx, "hash3", database.LoginChallenge{UserId: alice.Id, ExpiresAt: start.Add(time.Minute)}),
+		"creating a challenge")
+	setTime(start.Add(2 * time.Second))
+	check(t, db.DeleteLoginChallenge(ctx, "hash3"), "deleting the challenge")
+	_, err = db.GetLoginChallenge(ctx, "hash3")
+	checkIs(t, err, database.ErrChallengeNotFound, "getting a deleted challenge")
+	check(t, db.CreateLoginChallenge(ctx, "hash2", challenge), "reusing the hash of an expired challenge")
+	_, err = db.GetLoginChallenge(ctx, "hash1")
+	check(t, err, "getting a challenge that has not expired")
+}
+
+func testBots(t *testing.T, db database.AppDatabase) {
+	setTime(start)
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+
+	ci, err := db.CreateBot(ctx, alice.Id, "ci")
+	check(t, err, "creating a bot")
+	checkEqual(t, ci.OwnerId, alice.Id, "owner")
+	checkEqual(t, ci.Username, "ci", "username")
+	checkTime(t, ci.CreatedAt, start, "creation time")
+	_, err = db.CreateBot(ctx, alice.Id, "bob")
+	checkIs(t, err, database.ErrUsernameTaken, "creating a bot with a taken username")
+	_, err = db.CreateBot(ctx, bob.Id, "ci")
+	checkIs(t, err, database.ErrUsernameTaken, "creating a bot with a taken username")
+	alerts, err := db.CreateBot(ctx, alice.Id, "alerts")
+	check(t, err, "creating a bot")
+	_, err = db.CreateBot(ctx, bob.Id, "bobot")
+	check(t, err, "creating a bot")
+
+	u, err := db.GetUser(ctx, ci.UserId)
+	check(t, err, "getting the bot user")
+	checkEqual(t, u, database.User{Id: ci.UserId, Username: "ci", IsBot: true}, "bot user")
+	u, err = db.CreateUser(ctx, database.User{Username: "ci"})
+	check(t, err, "logging in as the bot")
+	checkEqual(t, u.IsBot, true, "bot logging in is a bot")
+
+	bots, err := db.ListBots(ctx, alice.Id)
+	check(t, err, "listing the bots")
+	if len(bots) != 2 {
+		t.Fatalf("got %d bots, want 2", len(bots))
+	}
+	checkBot(t, bots[0], alerts, "first bot")
+	checkBot(t, bots[1], ci, "second bot")
+
+	bot, err := db.GetBot(ctx, alice.Id, ci.UserId)
+	check(t, err, "getting the bot")
+	checkBot(t, bot, ci, "bot")
+	_, err = db.GetBot(ctx, bob.Id, ci.UserId)
+	checkIs(t, err, database.ErrBotNotFound, "getting the bot of another user")
+	_, err = db.GetBot(ctx, alice.Id, bob.Id)
+	checkIs(t, err, database.ErrBotNotFound, "getting a user that is not a bot")
+}
+
+func testAPIKeys(t *testing.T, db database.AppDatabase) {
+	setTime(start)
+	alice := createUser(t, db, "alice")
+	bot, err := db.CreateBot(ctx, alice.Id, "ci")
+	check(t, err, "creating a bot")
+	botUser := database.User{Id: bot.UserId, Username: bot.Username}
+	group := createGroup(t, db, "builds", alice, botUser)
+	other := createGroup(t, db, "deploys", alice, botUser)
+
+	key, err := db.CreateAPIKey(ctx, database.APIKey{
+		BotId: bot.UserId, Name: "main", Prefix: "wt_1", Scopes: []string{"messages:read", "messages:write"},
+		ConversationIds: []int{other, group},
+	}, "hash1")
+	check(t, err, "creating an API key")
+	checkTime(t, key.CreatedAt, start, "creation time")
+	_, err = db.CreateAPIKey(ctx, database.APIKey{BotId: bot.UserId, Prefix: "wt_2"}, "hash1")
+	checkIs(t, err, database.ErrAlreadyExists, "creating an API key with the same hash")
+	_, err = db.CreateAPIKey(ctx, database.APIKey{BotId: alice.Id, Prefix: "wt_3"}, "hash3")
+	checkIs(t, err, database.ErrNotFound, "creating an API key for a user that is not a bot")
+	_, err = db.CreateAPIKey(ctx, database.APIKey{BotId: bot.UserId, Prefix: "wt_4", ConversationIds: []int{other + 100}}, "hash4")
+	checkIs(t, err, database.ErrNotFound, "creating an API key for a missing conversation")
+	unrestricted, err := db.CreateAPIKey(ctx, database.APIKey{BotId: bot.UserId, Prefix: "wt_5"}, "hash5")
+	check(t, err, "creating an unrestricted API key")
+
+	keys, err := db.ListAPIKeys(ctx, bot.UserId)
+	check(t, err, "listing the API keys")
+	if len(keys) != 2 {
+		t.Fatalf("got %d API keys, want 2", len(keys))
+	}
+	checkEqual(t, keys[0].KeyId, key.KeyId, "first key")
+	checkEqual(t, keys[0].Scopes, []string{"messages:read", "messages:write"}, "scopes")
+	checkEqual(t, keys[0].ConversationIds, []int{group, other}, "conversations, in order")
+	checkEqual(t, keys[0].Name, "main", "name")
+	checkEqual(t, keys[0].Prefix, "wt_1", "prefix")
+	checkEqual(t, keys[0].LastUsedAt.IsZero(), true, "unused key has a last use")
+	checkEqual(t, keys[1].KeyId, unrestricted.KeyId, "second key")
+	checkEqual(t, len(keys[1].ConversationIds), 0, "conversations of an unrestricted key")
+	checkEqual(t, len(keys[1].Scopes), 0, "scopes of a key without scopes")
+
+	setTime(start.Add(time.Minute))
+	check(t, db.TouchAPIKey(ctx, key.KeyId), "touching the key")
+	u, got, err := db.GetUserByAPIKey(ctx, "hash1")
+	check(t, err, "getting the key")
+	checkEqual(t, u, database.User{Id: bot.UserId, Username: "ci", IsBot: true}, "user of the key")
+	checkEqual(t, got.KeyId, key.KeyId, "key ID")
+	checkEqual(t, got.BotId, bot.UserId, "bot of the key")
+	checkEqual(t, got.ConversationIds, []int{group, other}, "conversations of the key")
+	checkTime(t, got.LastUsedAt, start.Add(time.Minute), "last use")
+	_, _, err = db.GetUserByAPIKey(ctx, "missing")
+	checkIs(t, err, database.ErrAPIKeyNotFound, "getting a missing key")
+
+	// Deleting a conversation removes it from the keys
+	check(t, db.DeleteGroup(ctx, other), "deleting a group")
+	_, got, err = db.GetUserByAPIKey(ctx, "hash1")
+	check(t, err, "getting the key")
+	checkEqual(t, got.ConversationIds, []int{group}, "conversations after deleting one")
+
+	checkIs(t, db.RevokeAPIKey(ctx, alice.Id, key.KeyId), database.ErrAPIKeyNotFound, "revoking the key of another bot")
+	check(t, db.RevokeAPIKey(ctx, bot.UserId, key.KeyId), "revoking the key")
+	checkIs(t, db.RevokeAPIKey(ctx, bot.UserId, key.KeyId), database.ErrAPIKeyNotFound, "revoking the key again")
+	_, _, err = db.GetUserByAPIKey(ctx, "hash1")
+	checkIs(t, err, database.ErrAPIKeyNotFound, "getting a revoked key")
+	keys, err = db.ListAPIKeys(ctx, bot.UserId)
+	check(t, err, "listing the API keys")
+	checkEqual(t, len(keys), 1, "active keys")
+}
+
+func testOIDC(t *testing.T, db database.AppDatabase) {
+	setTime(start)
+
+	login := database.OIDCLogin{Nonce: "nonce", CodeVerifier: "verifier", ExpiresAt: start.Add(time.Minute)}
+	check(t, db.CreateOIDCLogin(ctx, "state1", login), "creating a login")
+	checkIs(t, db.CreateOIDCLogin(ctx, "state1", login), database.ErrAlreadyExists, "creating a login with the same state")
+	check(t, db.CreateOIDCLogin(ctx, "state2", database.OIDCLogin{ExpiresAt: start.Add(time.Second)}), "creating a login")
+
+	got, err := db.TakeOIDCLogin(ctx, "state1")
+	check(t, err, "taking the login")
+	checkEqual(t, got.Nonce, "nonce", "nonce")
+	checkEqual(t, got.CodeVerifier, "verifier", "code verifier")
+	checkTime(t, got.ExpiresAt, start.Add(time.Minute), "expiration time")
+	_, err = db.TakeOIDCLogin(ctx, "state1")
+	checkIs(t, err, database.ErrOIDCLoginNotFound, "taking the login again")
+	setTime(start.Add(time.Second))
+	_, err = db.TakeOIDCLogin(ctx, "state2")
+	checkIs(t, err, database.ErrOIDCLoginNotFound, "taking an expired login")
+
+	alice := createUser(t, db, "alice")
+	_, err = db.CreateOIDCUser(ctx, "https://idp", "sub1", "alice")
+	checkIs(t, err, database.ErrUsernameTaken, "creating a user with a taken username")
+	u, err := db.CreateOIDCUser(ctx, "https://idp", "sub1", "bob")
+	check(t, err, "creating a user")
+	_, err = db.CreateOIDCUser(ctx, "https://idp", "sub1", "carol")
+	checkIs(t, err, database.ErrAlreadyExists, "creating a user for the same identity")
+	_, err = db.GetUserIdByUsername(ctx, "carol")
+	checkIs(t, err, sql.ErrNoRows, "user of a failed creation")
+
+	got2, err := db.GetOIDCUser(ctx, "https://idp", "sub1")
+	check(t, err, "getting the user")
+	checkEqual(t, got2, u, "user of the identity")
+	_, err = db.GetOIDCUser(ctx, "https://other", "sub1")
+	checkIs(t, err, database.ErrUserDoesNotExist, "getting the user of another issuer")
+
+	isOIDC, err := db.IsOIDCUser(ctx, u.Id)
+	check(t, err, "checking the user")
+	checkEqual(t, isOIDC, true, "OIDC user")
+	isOIDC, err = db.IsOIDCUser(ctx, alice.Id)
+	check(t, err, "checking the user")
+	checkEqual(t, isOIDC, false, "user created with a username")
+}
+
+func testDeleteUser(t *testing.T, db database.AppDatabase) {
+	setTime(start)
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	carol := createUser(t, db, "carol")
+	check(t, db.SetUserPhoto(ctx, alice.Id, "photo"), "setting the photo")
+	check(t, db.SetPassphraseHash(ctx, alice.Id, "hash"), "setting the passphrase")
+	_, err := db.CreateSession(ctx, alice.Id, "token", "firefox", start.Add(time.Hour))
+	check(t, err, "creating a session")
+	ci, err := db.CreateBot(ctx, alice.Id, "ci")
+	check(t, err, "creating a bot")
+
+	direct, err := db.GetOrCreateDirectConversation(ctx, alice.Id, bob.Id, true)
+	check(t, err, "creating a conversation")
+	withBot, err := db.GetOrCreateDirectConversation(ctx, carol.Id, ci.UserId, true)
+	check(t, err, "creating a conversation")
+	trip := createGroup(t, db, "Trip", alice, bob)
+	solo := createGroup(t, db, "Solo", alice)
+	question := sendMessage(t, db, direct, alice, "Lunch today?", start)
+	answer := sendMessage(t, db, direct, bob, "Sure", start.Add(time.Minute))
+	check(t, db.CommentMessage(ctx, question.MessageId, bob.Id, "👍"), "commenting")
+	check(t, db.CommentMessage(ctx, answer.MessageId, alice.Id, "🎉"), "commenting")
+	sendMessage(t, db, trip, alice, "Tickets booked", start.Add(2*time.Minute))
+	sendMessage(t, db, solo, alice, "Notes", start.Add(3*time.Minute))
+	sendMessage(t, db, withBot, database.User{Id: ci.UserId}, "Build passed", start.Add(4*time.Minute))
+
+	check(t, db.DeleteUser(ctx, alice.Id), "deleting the user")
+	checkIs(t, db.DeleteUser(ctx, alice.Id), database.ErrUserDoesNotExist, "deleting the user again")
+	_, err = db.GetUser(ctx, alice.Id)
+	checkIs(t, err, database.ErrUserDoesNotExist, "getting the deleted user")
+	_, err = db.GetUserPhoto(ctx, alice.Id)
+	checkIs(t, err, database.ErrUserDoesNotExist, "getting the photo of the deleted user")
+	_, err = db.GetUser(ctx, ci.UserId)
+	checkIs(t, err, database.ErrUserDoesNotExist, "getting the bot of the deleted user")
+	_, _, err = db.GetUserBySession(ctx, "token")
+	checkIs(t, err, database.ErrSessionNotFound, "getting a session of the deleted user")
+	_, err = db.GetPassphraseHash(ctx, alice.Id)
+	checkIs(t, err, database.ErrNoPassphrase, "getting the passphrase of the deleted user")
+
+	// The messages are kept for the others, from the deleted user, with the reactions of the others only
+	details, err := db.GetConversationDetails(ctx, direct, bob.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	if len(details.Messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(details.Messages))
+	}
+	checkEqual(t, details.Messages[0].SenderUsername, "bob", "sender of the answer")
+	checkEqual(t, len(details.Messages[0].Comments), 0, "reactions of the deleted user")
+	checkEqual(t, details.Messages[1].Text, "Lunch today?", "text of the message of the deleted user")
+	checkEqual(t, details.Messages[1].SenderId, database.DeletedUserId, "sender ID of the message of the deleted user")
+	checkEqual(t, details.Messages[1].SenderUsername, database.DeletedUsername, "sender of the message of the deleted user")
+	checkEqual(t, len(details.Messages[1].Comments), 1, "reactions of the others")
+	details, err = db.GetConversationDetails(ctx, withBot, carol.Id, database.MessagePage{})
+	check(t, err, "getting the conversation with the bot")
+	checkEqual(t, messageTexts(details), "Build passed", "messages of the deleted bot")
+	checkEqual(t, details.Messages[0].SenderUsername, database.DeletedUsername, "sender of the message of the bot")
+	results, err := db.SearchMessages(ctx, bob.Id, database.MessageSearch{Query: "tickets"})
+	check(t, err, "searching")
+	if len(results.Results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results.Results))
+	}
+	checkEqual(t, results.Results[0].SenderUsername, database.DeletedUsername, "sender of the result")
+
+	// The group left without members is deleted
+	list, err := db.GetConversations(ctx, bob.Id, database.ConversationFilter{})
+	check(t, err, "listing the conversations")
+	checkEqual(t, conversationNames(list.Conversations), "Trip,"+database.DeletedUsername, "conversations of bob")
+	exists, err := db.CheckIfConversationExists(ctx, solo)
+	check(t, err, "checking the group")
+	checkEqual(t, exists, false, "group of the deleted user exists")
+
+	// The username can be taken again, by a new user
+	u := createUser(t, db, "alice")
+	if u.Id == alice.Id {
+		t.Errorf("the new alice has the ID of the deleted one")
+	}
+	details, err = db.GetConversationDetails(ctx, direct, bob.Id, database.MessagePage{})
+	check(t, err, "getting the conversation")
+	checkEqual(t, details.Messages[1].SenderUsername, database.DeletedUsername, "sender after the username is taken again")
+}
+
+func testConcurrency(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	group := createGroup(t, db, "crowd", alice)
+
+	const writers, messages = 8, 20
+	errs := make(chan error, writers*(messages+1))
+	done := make(chan struct{})
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			u, err := db.CreateUser(ctx, database.User{Username: fmt.Sprintf("user%d", i)})
+			if err == nil {
+				err = db.AddUserToGroup(ctx, u.Username, group)
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < messages; j++ {
+				_, err := db.CreateMessage(ctx, database.Message{
+					ConversationId: group, SenderId: u.Id, Text: fmt.Sprintf("%d-%d", i, j), Status: "sent",
+					SendTime: start.Add(time.Duration(j) * time.Second),
+				})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		<-done
+	}
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent write: %v", err)
+	}
+
+	details, err := db.GetConversationDetails(ctx, group, alice.Id, database.MessagePage{})
+	check(t, err, "getting the group")
+	checkEqual(t, len(details.Messages), writers*messages, "messages")
+	ids := make(map[int]bool)
+	for _, m := range details.Messages {
+		ids[m.MessageId] = true
+	}
+	checkEqual(t, len(ids), writers*messages, "distinct message IDs")
+	for i := 0; i < writers; i++ {
+		id, err := db.GetUserIdByUsername(ctx, fmt.Sprintf("user%d", i))
+		check(t, err, "getting user%d", i)
+		isMember, err := db.IsUserInGroup(ctx, id, group)
+		check(t, err, "checking the members")
+		checkEqual(t, isMember, true, "user%d is a member", i)
+	}
+}
+
+func testCanceled(t *testing.T, db database.AppDatabase) {
+	alice := createUser(t, db, "alice")
+	bob := createUser(t, db, "bob")
+	group := createGroup(t, db, "friends", alice, bob)
+	m := sendMessage(t, db, group, alice, "hi", start)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err := db.GetConversationDetails(canceled, group, alice.Id, database.MessagePage{})
+	checkIs(t, err, context.Canceled, "reading with a canceled context")
+	_, err = db.CreateUser(canceled, database.User{Username: "carol"})
+	checkIs(t, err, context.Canceled, "writing with a canceled context")
+	err = db.LeaveGroup(canceled, bob.Id, group)
+	checkIs(t, err, context.Canceled, "leaving with a canceled context")
+	err = db.DeleteMessage(canceled, m.MessageId, alice.Id)
+	checkIs(t, err, context.Canceled, "deleting with a canceled context")
+
+	_, err = db.GetUserIdByUsername(ctx, "carol")
+	checkIs(t, err, sql.ErrNoRows, "user created with a canceled context")
+	isMember, err := db.IsUserInGroup(ctx, bob.Id, group)
+	check(t, err, "checking the members")
+	checkEqual(t, isMember, true, "bob is still a member")
+	details, err := db.GetConversationDetails(ctx, group, alice.Id, database.MessagePage{})
+	check(t, err, "getting the group")
+	checkEqual(t, messageTexts(details), "hi", "messages")
+}
@@ -0,0 +1,104 @@
+package database_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database/conformance"
+	"github.com/lib/pq"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postgresEnv is the environment variable with the data source name of the PostgreSQL database used by the tests.
+// The PostgreSQL tests are skipped if it is not set.
+const postgresEnv = "WASATEXT_TEST_POSTGRES"
+
+func TestConformanceSQLite(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) database.AppDatabase {
+		db, err := database.OpenSQLite(filepath.Join(t.TempDir(), "wasatext.db"))
+		if err != nil {
+			t.Fatalf("opening the database: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return newAppDatabase(t, db, database.Config{})
+	})
+}
+
+// TestConformanceSQLitePools opens the database like webapi does by default: in WAL mode, writing through a single
+// connection and reading through read-only ones, so a write sent to the read pool fails.
+func TestConformanceSQLitePools(t *testing.T) {
+	conformance.Run(t, func(t *testing.T) database.AppDatabase {
+		writer, reader, err := database.OpenSQLitePools(filepath.Join(t.TempDir(), "wasatext.db"), database.SQLiteOptions{
+			JournalMode: "WAL",
+			BusyTimeout: 5 * time.Second,
+			Synchronous: "NORMAL",
+			ReadConns:   4,
+		})
+		if err != nil {
+			t.Fatalf("opening the database: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = reader.Close()
+			_ = writer.Close()
+		})
+		return newAppDatabase(t, writer, database.Config{ReadDB: reader})
+	})
+}
+
+// TestConformancePostgres runs each case in a new schema of the database in WASATEXT_TEST_POSTGRES, dropped at the end.
+func TestConformancePostgres(t *testing.T) {
+	dsn := os.Getenv(postgresEnv)
+	if dsn == "" {
+		t.Skip(postgresEnv + " is not set")
+	}
+	// URLs are converted to key=value pairs, so the search path can be added
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if dsn, err = pq.ParseURL(dsn); err != nil {
+			t.Fatalf("parsing %s: %v", postgresEnv, err)
+		}
+	}
+
+	n := 0
+	conformance.Run(t, func(t *testing.T) database.AppDatabase {
+		admin, err := database.OpenPostgres(dsn)
+		if err != nil {
+			t.Fatalf("opening the database: %v", err)
+		}
+		n++
+		schema := fmt.Sprintf("conformance_%d_%d", os.Getpid(), n)
+		if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+			_ = admin.Close()
+			t.Fatalf("creating the schema: %v", err)
+		}
+		t.Cleanup(func() {
+			_, _ = admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+			_ = admin.Close()
+		})
+
+		db, err := database.OpenPostgres(dsn + " search_path=" + schema)
+		if err != nil {
+			t.Fatalf("opening the schema: %v", err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return newAppDatabase(t, db, database.Config{})
+	})
+}
+
+// newAppDatabase returns the AppDatabase of the connection. The test is skipped if SQLite has been built without
+// FTS5, as the tests run without the sqlite_fts5 tag unless it is given.
+func newAppDatabase(t *testing.T, db *sql.DB, cfg database.Config) database.AppDatabase {
+	t.Helper()
+	appdb, err := database.New(db, cfg)
+	if errors.Is(err, database.ErrNoFTS5) {
+		t.Skip("run the tests with -tags sqlite_fts5: ", err)
+	} else if err != nil {
+		t.Fatalf("creating the database: %v", err)
+	}
+	return appdb
+}
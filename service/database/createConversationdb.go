@@ -1,25 +1,22 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	//	"fmt"
 	"errors"
 	"log"
 )
 
-func (db *appdbimpl) CreateConversation(userId uint64, conversationId int) (Conversation, error) {
+func (db *appdbimpl) CreateConversation(ctx context.Context, userId uint64, conversationId int) (Conversation, error) {
 	// First create the conversation
-	res, err := db.c.Exec("INSERT INTO conversations (GroupId, LastMessageId) VALUES (?, 0)", conversationId)
-	if err != nil {
-		return Conversation{}, err
-	}
-	lastInsertID, err := res.LastInsertId()
+	lastInsertID, err := db.c.insert(ctx, "INSERT INTO conversations (GroupId) VALUES (?)", "ConversationId", conversationId)
 	if err != nil {
 		return Conversation{}, err
 	}
 
 	// Then add the user as a participant
-	_, err = db.c.Exec("INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)", lastInsertID, userId)
+	_, err = db.c.ExecContext(ctx, "INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)", lastInsertID, userId)
 	if err != nil {
 		return Conversation{}, err
 	}
@@ -31,15 +28,27 @@ func (db *appdbimpl) CreateConversation(userId uint64, conversationId int) (Conv
 	}, nil
 }
 
-func (db *appdbimpl) UpdateLastMessage(messageId int, conversationId int) error {
-	_, err := db.c.Exec("UPDATE conversations SET LastMessageId = ? WHERE ConversationId = ?", messageId, conversationId)
+func (db *appdbimpl) UpdateLastMessage(ctx context.Context, messageId int, conversationId int) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE conversations SET LastMessageId = ? WHERE ConversationId = ?", messageId, conversationId)
 	return err
 }
 
-func (db *appdbimpl) GetOrCreateDirectConversation(userId, recipientId uint64) (int, error) {
+// GetOrCreateDirectConversation returns the direct conversation of the two users. If there is none, it is created when
+// create is true, otherwise ErrConversationNotFound is returned: both happen in the same transaction as the lookup.
+func (db *appdbimpl) GetOrCreateDirectConversation(ctx context.Context, userId, recipientId uint64, create bool) (int, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
 	// First try to find existing conversation
 	var conversationId int
-	err := db.c.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
         SELECT c.ConversationId 
         FROM conversations c
         JOIN participants p1 ON c.ConversationId = p1.ConversationId
@@ -54,38 +63,26 @@ func (db *appdbimpl) GetOrCreateDirectConversation(userId, recipientId uint64) (
 
 	if err == nil {
 		return conversationId, nil
-	}
-
-	// If not found, create new conversation
-	tx, err := db.c.Begin()
-	if err != nil {
-		return 0, err
-	}
-	defer func() {
-		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
-			log.Printf("Transaction rollback failed: %v\n", err)
-		}
-	}()
-
-	// Create conversation
-	result, err := tx.Exec("INSERT INTO conversations (GroupId, LastMessageId) VALUES (0, 0)")
-	if err != nil {
+	} else if !errors.Is(err, sql.ErrNoRows) {
 		return 0, err
+	} else if !create {
+		return 0, ErrConversationNotFound
 	}
 
-	lastId, err := result.LastInsertId()
+	// If not found, create new conversation
+	lastId, err := tx.insert(ctx, "INSERT INTO conversations (GroupId) VALUES (0)", "ConversationId")
 	if err != nil {
 		return 0, err
 	}
 	conversationId = int(lastId)
 
 	// Add participants
-	_, err = tx.Exec("INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)", conversationId, userId)
+	_, err = tx.ExecContext(ctx, "INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)", conversationId, userId)
 	if err != nil {
 		return 0, err
 	}
 
-	_, err = tx.Exec("INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)", conversationId, recipientId)
+	_, err = tx.ExecContext(ctx, "INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)", conversationId, recipientId)
 	if err != nil {
 		return 0, err
 	}
@@ -1,13 +1,14 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"log"
 )
 
-func (db *appdbimpl) CreateGroup(name string, creatorId uint64) (Conversation, error) {
-	tx, err := db.c.Begin()
+func (db *appdbimpl) CreateGroup(ctx context.Context, name string, creatorId uint64) (Conversation, error) {
+	tx, err := db.c.BeginTx(ctx)
 	if err != nil {
 		return Conversation{}, err
 	}
@@ -18,18 +19,13 @@ func (db *appdbimpl) CreateGroup(name string, creatorId uint64) (Conversation, e
 	}()
 
 	// Create the conversation/group
-	result, err := tx.Exec("INSERT INTO conversations (GroupId, LastMessageId, Name) VALUES (1, 0, ?)", name)
-	if err != nil {
-		return Conversation{}, err
-	}
-
-	conversationId, err := result.LastInsertId()
+	conversationId, err := tx.insert(ctx, "INSERT INTO conversations (GroupId, Name) VALUES (1, ?)", "ConversationId", name)
 	if err != nil {
 		return Conversation{}, err
 	}
 
 	// Add creator to participants
-	_, err = tx.Exec("INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)",
+	_, err = tx.ExecContext(ctx, "INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)",
 		conversationId, creatorId)
 	if err != nil {
 		return Conversation{}, err
@@ -48,17 +44,25 @@ func (db *appdbimpl) CreateGroup(name string, creatorId uint64) (Conversation, e
 	}, nil
 }
 
-func (db *appdbimpl) AddUserToGroup(username string, groupId int) error {
+// AddUserToGroup adds the user to the group, if not a member yet. ErrUserDoesNotExist is returned if there is no user
+// with the username, ErrGroupNotFound if the group does not exist and ErrNotGroup if it is a direct conversation.
+func (db *appdbimpl) AddUserToGroup(ctx context.Context, username string, groupId int) error {
+	if err := db.checkGroup(ctx, groupId); err != nil {
+		return err
+	}
+
 	// First get the user ID from username
 	var userId uint64
-	err := db.c.QueryRow("SELECT Id FROM users WHERE Username = ?", username).Scan(&userId)
-	if err != nil {
-		return err // Return error if user doesn't exist
+	err := db.c.QueryRowContext(ctx, "SELECT Id FROM users WHERE Username = ?", username).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserDoesNotExist
+	} else if err != nil {
+		return err
 	}
 
 	// Check if user is already in group
 	var exists bool
-	err = db.c.QueryRow(`
+	err = db.c.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 FROM participants 
             WHERE UserId = ? AND ConversationId = ?
@@ -71,20 +75,20 @@ func (db *appdbimpl) AddUserToGroup(username string, groupId int) error {
 	}
 
 	// Add user to group
-	_, err = db.c.Exec("INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)",
+	_, err = db.c.ExecContext(ctx, "INSERT INTO participants (ConversationId, UserId) VALUES (?, ?)",
 		groupId, userId)
 	return err
 }
 
-func (db *appdbimpl) GetUserIdByUsername(username string) (uint64, error) {
+func (db *appdbimpl) GetUserIdByUsername(ctx context.Context, username string) (uint64, error) {
 	var userId uint64
-	err := db.c.QueryRow("SELECT Id FROM users WHERE Username = ?", username).Scan(&userId)
+	err := db.c.QueryRowContext(ctx, "SELECT Id FROM users WHERE Username = ?", username).Scan(&userId)
 	return userId, err
 }
 
-func (db *appdbimpl) IsUserInGroup(userId uint64, groupId int) (bool, error) {
+func (db *appdbimpl) IsUserInGroup(ctx context.Context, userId uint64, groupId int) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow(`
+	err := db.c.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 FROM participants 
             WHERE UserId = ? AND ConversationId = ?
@@ -92,9 +96,16 @@ func (db *appdbimpl) IsUserInGroup(userId uint64, groupId int) (bool, error) {
 	return exists, err
 }
 
-func (db *appdbimpl) DeleteGroup(groupId int) error {
-	// Start transaction
-	tx, err := db.c.Begin()
+func (db *appdbimpl) DeleteGroup(ctx context.Context, groupId int) error {
+	// Participants, messages and their comments are deleted by the foreign keys
+	_, err := db.c.ExecContext(ctx, "DELETE FROM conversations WHERE ConversationId = ? AND GroupId = 1", groupId)
+	return err
+}
+
+// LeaveGroup removes the user from the group, and deletes the group if it was its last member. ErrNotMember is
+// returned if the user is not a member.
+func (db *appdbimpl) LeaveGroup(ctx context.Context, userId uint64, groupId int) error {
+	tx, err := db.c.BeginTx(ctx)
 	if err != nil {
 		return err
 	}
@@ -104,14 +115,25 @@ func (db *appdbimpl) DeleteGroup(groupId int) error {
 		}
 	}()
 
-	// Delete from participants first (due to foreign key)
-	_, err = tx.Exec("DELETE FROM participants WHERE ConversationId = ?", groupId)
+	result, err := tx.ExecContext(ctx, "DELETE FROM participants WHERE UserId = ? AND ConversationId = ?",
+		userId, groupId)
 	if err != nil {
 		return err
 	}
 
-	// Delete the conversation
-	_, err = tx.Exec("DELETE FROM conversations WHERE ConversationId = ?", groupId)
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotMember
+	}
+
+	// Nobody can see a group without members anymore, so delete it with its messages
+	_, err = tx.ExecContext(ctx, `
+        DELETE FROM conversations
+        WHERE ConversationId = ? AND GroupId = 1
+        AND NOT EXISTS (SELECT 1 FROM participants WHERE ConversationId = ?)`, groupId, groupId)
 	if err != nil {
 		return err
 	}
@@ -119,9 +141,15 @@ func (db *appdbimpl) DeleteGroup(groupId int) error {
 	return tx.Commit()
 }
 
-func (db *appdbimpl) LeaveGroup(userId uint64, groupId int) error {
-	result, err := db.c.Exec("DELETE FROM participants WHERE UserId = ? AND ConversationId = ?",
-		userId, groupId)
+// SetGroupName renames the group. ErrGroupNotFound is returned if the group does not exist, and ErrNotGroup if it is a
+// direct conversation.
+func (db *appdbimpl) SetGroupName(ctx context.Context, groupId int, newName string) error {
+	if err := db.checkGroup(ctx, groupId); err != nil {
+		return err
+	}
+
+	result, err := db.c.ExecContext(ctx, "UPDATE conversations SET Name = ? WHERE ConversationId = ? AND GroupId = 1",
+		newName, groupId)
 	if err != nil {
 		return err
 	}
@@ -131,24 +159,23 @@ func (db *appdbimpl) LeaveGroup(userId uint64, groupId int) error {
 		return err
 	}
 	if rows == 0 {
-		return errors.New("user not found in group")
+		return ErrGroupNotFound
 	}
 	return nil
 }
 
-func (db *appdbimpl) SetGroupName(groupId int, newName string) error {
-	result, err := db.c.Exec("UPDATE conversations SET Name = ? WHERE ConversationId = ? AND GroupId = 1",
-		newName, groupId)
-	if err != nil {
-		return err
-	}
-
-	rows, err := result.RowsAffected()
-	if err != nil {
+// checkGroup returns ErrGroupNotFound if the conversation does not exist, and ErrNotGroup if it is a direct
+// conversation.
+func (db *appdbimpl) checkGroup(ctx context.Context, groupId int) error {
+	var isGroup int
+	err := db.c.QueryRowContext(ctx, "SELECT GroupId FROM conversations WHERE ConversationId = ?", groupId).Scan(&isGroup)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrGroupNotFound
+	} else if err != nil {
 		return err
 	}
-	if rows == 0 {
-		return errors.New("group not found")
+	if isGroup != 1 {
+		return ErrNotGroup
 	}
 	return nil
 }
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MessageCursor is the position of a message in the history of a conversation, used to read the history a page at a
+// time. Messages are ordered by SendTime and then by MessageId, as two messages can be sent at the same time.
+//
+// A cursor is sent to clients as an opaque string: it implements encoding.TextMarshaler and encoding.TextUnmarshaler.
+type MessageCursor struct {
+	SendTime  time.Time
+	MessageId int
+}
+
+// ConversationCursor is the position of a conversation in the list of GetConversations, ordered by the time of their
+// last messages and then by ConversationId. LastMessageTime is NoMessageTime for the conversations without messages.
+//
+// Like MessageCursor, it is sent to clients as an opaque string.
+type ConversationCursor struct {
+	LastMessageTime time.Time
+	ConversationId  int
+}
+
+// NoMessageTime is the time of the last message of the conversations without messages when ordering them, so they
+// come after the others
+var NoMessageTime = time.Unix(0, 0).UTC()
+
+// ErrInvalidCursor is returned when a cursor sent by a client can't be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// CursorOf returns the cursor of the message.
+func CursorOf(m Message) MessageCursor {
+	return MessageCursor{SendTime: m.SendTime, MessageId: m.MessageId}
+}
+
+// Before tells whether the position c comes before other, i.e. whether its message is older.
+func (c MessageCursor) Before(other MessageCursor) bool {
+	if !c.SendTime.Equal(other.SendTime) {
+		return c.SendTime.Before(other.SendTime)
+	}
+	return c.MessageId < other.MessageId
+}
+
+func (c MessageCursor) MarshalText() ([]byte, error) {
+	return encodeCursor(c.SendTime, c.MessageId), nil
+}
+
+func (c *MessageCursor) UnmarshalText(text []byte) error {
+	var err error
+	c.SendTime, c.MessageId, err = decodeCursor(text)
+	return err
+}
+
+// PreviewCursorOf returns the cursor of the conversation in the list of GetConversations.
+func PreviewCursorOf(p ConversationPreview) ConversationCursor {
+	lastMessageTime := NoMessageTime
+	if p.LastMessageId != 0 {
+		lastMessageTime = p.LastMessageTime
+	}
+	return ConversationCursor{LastMessageTime: lastMessageTime, ConversationId: p.ConversationId}
+}
+
+// Before tells whether the conversation at c comes before other in the list of GetConversations, i.e. whether its
+// last message is more recent.
+func (c ConversationCursor) Before(other ConversationCursor) bool {
+	if !c.LastMessageTime.Equal(other.LastMessageTime) {
+		return c.LastMessageTime.After(other.LastMessageTime)
+	}
+	return c.ConversationId > other.ConversationId
+}
+
+func (c ConversationCursor) MarshalText() ([]byte, error) {
+	return encodeCursor(c.LastMessageTime, c.ConversationId), nil
+}
+
+func (c *ConversationCursor) UnmarshalText(text []byte) error {
+	var err error
+	c.LastMessageTime, c.ConversationId, err = decodeCursor(text)
+	return err
+}
+
+// encodeCursor encodes the time and the ID of a cursor, in a form safe to be used in URLs.
+func encodeCursor(tm time.Time, id int) []byte {
+	text := tm.UTC().Format(time.RFC3339Nano) + " " + strconv.Itoa(id)
+	return []byte(base64.RawURLEncoding.EncodeToString([]byte(text)))
+}
+
+// decodeCursor decodes a cursor encoded by encodeCursor. The time is in UTC.
+func decodeCursor(text []byte) (time.Time, int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(string(text))
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	fields := strings.SplitN(string(decoded), " ", 2)
+	if len(fields) != 2 {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	tm, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	return tm.UTC(), id, nil
+}
+
+// MessagePage selects a page of the history of a conversation: the messages older than Before and newer than After,
+// when set, at most Limit of them (all of them if Limit is 0). The page holds the most recent of the selected messages,
+// unless only After is set: then it holds the ones right after it, so a client can read the history forward.
+type MessagePage struct {
+	Before *MessageCursor
+	After  *MessageCursor
+	Limit  int
+}
+
+// ConversationFilter selects the conversations listed by GetConversations, and a page of them: the ones after After,
+// at most Limit of them (all of them if Limit is 0).
+type ConversationFilter struct {
+	// GroupsOnly and DirectOnly select only the groups, or only the direct conversations
+	GroupsOnly bool
+	DirectOnly bool
+
+	// UnreadOnly selects the conversations with messages the user hasn't read
+	UnreadOnly bool
+
+	// Name selects the conversations whose name contains it, ignoring case
+	Name string
+
+	// ConversationIds selects only these conversations, if not empty
+	ConversationIds []int
+
+	// WithPhotos includes the photos of the groups in the previews
+	WithPhotos bool
+
+	After *ConversationCursor
+	Limit int
+}
+
+// MessageSearch selects the messages found by SearchMessages, and a page of them: the ones older than Before, at most
+// Limit of them (all of them if Limit is 0).
+type MessageSearch struct {
+	// Query is the text to search: messages match if they have all its words (see SearchTerms)
+	Query string
+
+	// ConversationId selects only the messages of the conversation, if not 0
+	ConversationId int
+
+	// ConversationIds selects only the messages of these conversations, if not empty
+	ConversationIds []int
+
+	Before *MessageCursor
+	Limit  int
+}
@@ -2,8 +2,9 @@
 Package database is the middleware between the app database and the code. All data (de)serialization (save/load) from a
 persistent database are handled here. Database specific logic should never escape this package.
 
-To use this package you need to apply migrations to the database if needed/wanted, connect to it (using the database
-data source name from config), and then initialize an instance of AppDatabase from the DB connection.
+To use this package you need to connect to the database (using the database data source name from config), and then
+initialize an instance of AppDatabase from the DB connection. New applies the pending migrations (see Migrate), so the
+schema is always up to date; PendingMigrations lists them without applying them.
 
 For example, this code adds a parameter in `webapi` executable for the database data source name (add it to the
 main.WebAPIConfiguration structure):
@@ -16,7 +17,7 @@ This is an example on how to migrate the DB and connect to it:
 
 	// Start Database
 	logger.Println("initializing database support")
-	db, err := sql.Open("sqlite3", "./foo.db")
+	db, err := database.OpenSQLite("./foo.db")
 	if err != nil {
 		logger.WithError(err).Error("error opening SQLite DB")
 		return fmt.Errorf("opening SQLite: %w", err)
@@ -26,24 +27,145 @@ This is an example on how to migrate the DB and connect to it:
 		_ = db.Close()
 	}()
 
-Then you can initialize the AppDatabase and pass it to the api package.
+Under concurrent load, OpenSQLitePools opens a single connection for the writes and a pool of read-only ones, passed
+to New as Config.ReadDB, so that writes wait in line instead of failing on the lock of the database.
+
+Then you can initialize the AppDatabase with New and pass it to the api package. Its methods take the context of the
+request, so that queries are canceled when the client goes away; Config.QueryTimeout limits each query as well.
+
+Both SQLite (OpenSQLite) and PostgreSQL (OpenPostgres) are supported by the same AppDatabase implementation: queries
+are written once, and the differences between the databases are handled by a dialect, chosen from the driver of the
+connection.
 */
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"time"
 )
 
-var ErrUserDoesNotExist = errors.New("User does not exist")
+// The kinds of the errors returned by AppDatabase. Every error of a kind matches it with errors.Is, so callers (e.g.
+// the API, to choose the HTTP status) can handle a kind at once instead of each error.
+var (
+	// ErrNotFound is the kind of the errors about a missing row, including a missing row referenced by a change
+	ErrNotFound = errors.New("not found")
+
+	// ErrAlreadyExists is the kind of the errors about a change duplicating an existing row, e.g. a taken username
+	ErrAlreadyExists = errors.New("already exists")
+
+	// ErrForbidden is the kind of the errors about a user changing something that isn't theirs
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrConflict is the kind of the errors about a change that doesn't fit the current state of the row
+	ErrConflict = errors.New("conflict")
+)
+
+// Error is an error of one of the kinds above, and matches Kind with errors.Is. The errors of this package have a
+// Message that can be shown to users. The errors of the database are turned into an Error by kindOf, so that the
+// constraints of the schema give the right kind, and unwrap to the original error in Err: a missing row read by a
+// query, for example, is both ErrNotFound and sql.ErrNoRows.
+type Error struct {
+	Kind    error
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newError returns an Error of the kind with the text.
+func newError(kind error, text string) error {
+	return &Error{Kind: kind, Message: text}
+}
+
+// ErrUserDoesNotExist is returned when a user is unknown
+var ErrUserDoesNotExist = newError(ErrNotFound, "User does not exist")
+
+// The messages of deleted users are kept, and attributed to DeletedUserId, which no user has. They are shown as sent by
+// DeletedUsername, which is also the name of a direct conversation whose other participant has been deleted.
+const (
+	DeletedUserId   uint64 = 0
+	DeletedUsername        = "Deleted user"
+)
+
+// DeletedMessageText is the text of the tombstones of the deleted messages.
+const DeletedMessageText = "This message was deleted"
+
+// Events are the messages WASAText adds to the timeline of a conversation when its settings change, sent by the
+// participant who changed them. Message.Event is their kind; their text describes the change.
+const (
+	// EventRetention is the event of a change of the retention period of a conversation
+	EventRetention = "retention"
+)
+
+// ErrSessionNotFound is returned when a session token is unknown, expired or revoked
+var ErrSessionNotFound = newError(ErrNotFound, "session does not exist")
+
+// ErrNoPassphrase is returned when the user has not set a passphrase
+var ErrNoPassphrase = newError(ErrNotFound, "passphrase not set")
+
+// ErrNoTOTP is returned when the user has not enrolled a TOTP authenticator
+var ErrNoTOTP = newError(ErrNotFound, "TOTP not enrolled")
+
+// ErrTOTPCodeReused is returned when a TOTP code (or an older one) has already been used
+var ErrTOTPCodeReused = newError(ErrConflict, "TOTP code already used")
+
+// ErrRecoveryCodeNotFound is returned when a recovery code is unknown or has already been used
+var ErrRecoveryCodeNotFound = newError(ErrNotFound, "recovery code does not exist")
+
+// ErrChallengeNotFound is returned when a login challenge is unknown or expired
+var ErrChallengeNotFound = newError(ErrNotFound, "login challenge does not exist")
+
+// ErrUsernameTaken is returned when creating a user with a username that already exists
+var ErrUsernameTaken = newError(ErrAlreadyExists, "username already taken")
+
+// ErrBotNotFound is returned when a bot does not exist or is owned by someone else
+var ErrBotNotFound = newError(ErrNotFound, "bot does not exist")
+
+// ErrAPIKeyNotFound is returned when an API key is unknown or revoked
+var ErrAPIKeyNotFound = newError(ErrNotFound, "API key does not exist")
+
+// ErrOIDCLoginNotFound is returned when a pending OpenID Connect login is unknown, expired or already completed
+var ErrOIDCLoginNotFound = newError(ErrNotFound, "OIDC login does not exist")
+
+// ErrConversationNotFound is returned when a conversation does not exist
+var ErrConversationNotFound = newError(ErrNotFound, "conversation does not exist")
+
+// ErrGroupNotFound is returned when a group does not exist
+var ErrGroupNotFound = newError(ErrNotFound, "group does not exist")
+
+// ErrNotGroup is returned when changing the members or the name of a direct conversation, which can't be changed
+var ErrNotGroup = newError(ErrConflict, "conversation is not a group")
+
+// ErrNotMember is returned when a user leaves a conversation they are not a member of
+var ErrNotMember = newError(ErrForbidden, "user is not a member of the conversation")
+
+// ErrMessageNotFound is returned when a message does not exist
+var ErrMessageNotFound = newError(ErrNotFound, "message does not exist")
+
+// ErrNotMessageOwner is returned when a user deletes a message sent by someone else
+var ErrNotMessageOwner = newError(ErrForbidden, "message sent by another user")
 
 type User struct {
 	Id           uint64 `json:"id"`
 	Username     string `json:"username"`
 	ProfilePhoto string `json:"profilePhoto,omitempty"`
+	IsBot        bool   `json:"isBot"`
 }
 
 type Message struct {
@@ -55,6 +177,11 @@ type Message struct {
 	RecipientId    uint64    `json:"recipientId"`
 	ConversationId int       `json:"conversationId"`
 	Photo          string    `json:"photo"`
+	// DeletedAt is when the message was deleted, if it is a tombstone. Tombstones have no photo, and DeletedMessageText
+	// as text
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// Event is the kind of event, if the message is an event rather than a message of a participant
+	Event string `json:"event,omitempty"`
 }
 
 type Conversation struct {
@@ -70,18 +197,54 @@ type ConversationPreview struct {
 	ConversationId  int       `json:"conversationId"`
 	Name            string    `json:"name"`
 	Photo           string    `json:"photo,omitempty"`
+	LastMessageId   int       `json:"lastMessageId,omitempty"`
 	LastMessageTime time.Time `json:"lastMessageTime"`
 	LastMessageText string    `json:"lastMessageText"`
 	IsPhoto         bool      `json:"isPhoto"`
 	IsGroup         bool      `json:"isGroup"`
+	// LastMessageDeleted tells that the last message is a tombstone
+	LastMessageDeleted bool `json:"lastMessageDeleted"`
+	// UnreadCount is the number of messages of the others the user hasn't read
+	UnreadCount int `json:"unreadCount"`
+}
+
+// ConversationList is a page of the conversations of a user. NextCursor reads the next page, if any, when passed as
+// ConversationFilter.After.
+type ConversationList struct {
+	Conversations []ConversationPreview `json:"conversations"`
+	NextCursor    *ConversationCursor   `json:"nextCursor,omitempty"`
 }
 
 type ConversationDetails struct {
-	ConversationId int                   `json:"conversationId"`
-	Name           string                `json:"name"`
-	Photo          string                `json:"photo,omitempty"`
-	IsGroup        bool                  `json:"isGroup"`
-	Messages       []MessageWithComments `json:"messages"`
+	ConversationId int    `json:"conversationId"`
+	Name           string `json:"name"`
+	Photo          string `json:"photo,omitempty"`
+	IsGroup        bool   `json:"isGroup"`
+	// RetentionSeconds is how long the messages are kept before they are purged, 0 if they are kept forever
+	RetentionSeconds int64                 `json:"retentionSeconds,omitempty"`
+	Messages         []MessageWithComments `json:"messages"`
+	// NextCursor reads the older messages, if any, when passed as MessagePage.Before; PrevCursor reads the newer ones
+	// when passed as MessagePage.After
+	NextCursor *MessageCursor `json:"nextCursor,omitempty"`
+	PrevCursor *MessageCursor `json:"prevCursor,omitempty"`
+}
+
+// SearchResult is a message found by SearchMessages.
+type SearchResult struct {
+	MessageId      int       `json:"messageId"`
+	ConversationId int       `json:"conversationId"`
+	SenderId       uint64    `json:"senderId"`
+	SenderUsername string    `json:"senderUsername"`
+	SendTime       time.Time `json:"sendTime"`
+	// Snippet is the part of the text around the matching words, each between HighlightStart and HighlightEnd
+	Snippet string `json:"snippet"`
+}
+
+// SearchResults is a page of the results of SearchMessages. NextCursor reads the next page, if any, when passed as
+// MessageSearch.Before.
+type SearchResults struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor *MessageCursor `json:"nextCursor,omitempty"`
 }
 
 type MessageWithComments struct {
@@ -96,181 +259,193 @@ type Comment struct {
 	Emoji    string `json:"emoji"`
 }
 
+type Session struct {
+	SessionId  int64     `json:"sessionId"`
+	UserId     uint64    `json:"userId"`
+	UserAgent  string    `json:"userAgent"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type TOTP struct {
+	UserId       uint64 `json:"userId"`
+	Secret       string `json:"-"`
+	Confirmed    bool   `json:"confirmed"`
+	LastUsedStep int64  `json:"-"`
+}
+
+type LoginChallenge struct {
+	UserId    uint64    `json:"userId"`
+	UserAgent string    `json:"userAgent"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Attempts  int       `json:"attempts"`
+}
+
+type Bot struct {
+	UserId    uint64    `json:"userId"`
+	Username  string    `json:"username"`
+	OwnerId   uint64    `json:"ownerId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type APIKey struct {
+	KeyId           int64     `json:"keyId"`
+	BotId           uint64    `json:"botId"`
+	Name            string    `json:"name"`
+	Prefix          string    `json:"prefix"`
+	Scopes          []string  `json:"scopes"`
+	ConversationIds []int     `json:"conversationIds"`
+	CreatedAt       time.Time `json:"createdAt"`
+	LastUsedAt      time.Time `json:"lastUsedAt"`
+}
+
+// OIDCLogin is an OpenID Connect login waiting for the user to come back from the identity provider
+type OIDCLogin struct {
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
 // End of new structs
 
-// AppDatabase is the high level interface for the DB
+// AppDatabase is the high level interface for the DB. Every method takes the context of the request: its queries are
+// canceled when the context is done, and the method returns the error of the context.
 type AppDatabase interface {
-	GetName() (string, error)
-	SetName(name string) error
-	CreateUser(User) (User, error)
-	SetUsername(User, string) (User, error)
-	GetOrCreateDirectConversation(userId, recipientId uint64) (int, error)
-	CreateMessage(Message) (Message, error)
-	CheckIfConversationExists(conversationId int) (bool, error)
-	CreateConversation(userId uint64, conversationId int) (Conversation, error)
-	UpdateLastMessage(messageId int, conversationId int) error
+	GetName(ctx context.Context) (string, error)
+	SetName(ctx context.Context, name string) error
+	CreateUser(ctx context.Context, u User) (User, error)
+	SetUsername(ctx context.Context, u User, username string) (User, error)
+	GetOrCreateDirectConversation(ctx context.Context, userId, recipientId uint64, create bool) (int, error)
+	CreateMessage(ctx context.Context, m Message) (Message, error)
+	CheckIfConversationExists(ctx context.Context, conversationId int) (bool, error)
+	CreateConversation(ctx context.Context, userId uint64, conversationId int) (Conversation, error)
+	UpdateLastMessage(ctx context.Context, messageId int, conversationId int) error
 	// The group implementation
-	GetUsernameById(userId uint64) (string, error)
-	CreateGroup(name string, creatorId uint64) (Conversation, error)
-	AddUserToGroup(username string, groupId int) error
-	GetUserIdByUsername(username string) (uint64, error)
-	IsUserInGroup(userId uint64, groupId int) (bool, error)
-	DeleteGroup(groupId int) error
+	GetUsernameById(ctx context.Context, userId uint64) (string, error)
+	GetUser(ctx context.Context, userId uint64) (User, error)
+	CreateGroup(ctx context.Context, name string, creatorId uint64) (Conversation, error)
+	AddUserToGroup(ctx context.Context, username string, groupId int) error
+	GetUserIdByUsername(ctx context.Context, username string) (uint64, error)
+	IsUserInGroup(ctx context.Context, userId uint64, groupId int) (bool, error)
+	DeleteGroup(ctx context.Context, groupId int) error
 	// Messaging to groups
-	GetConversationIdByName(name string) (int, error)
-	GetRecipientIdByUsername(username string) (uint64, error)
+	GetConversationIdByName(ctx context.Context, name string) (int, error)
+	GetRecipientIdByUsername(ctx context.Context, username string) (uint64, error)
 	// Leave group and set group name
-	LeaveGroup(userId uint64, groupId int) error
-	SetGroupName(groupId int, newName string) error
+	LeaveGroup(ctx context.Context, userId uint64, groupId int) error
+	SetGroupName(ctx context.Context, groupId int, newName string) error
 	// Comments
-	ForwardMessage(messageId int, userId uint64, targetConvId int) (Message, error)
-	DeleteMessage(messageId int, userId uint64) error
-	CommentMessage(messageId int, userId uint64, emoji string) error
-	UncommentMessage(messageId int, userId uint64) error
-	IsMessageOwner(messageId int, userId uint64) (bool, error)
+	ForwardMessage(ctx context.Context, messageId int, userId uint64, targetConvId int) (Message, error)
+	DeleteMessage(ctx context.Context, messageId int, userId uint64) error
+	PurgeDeletedMessages(ctx context.Context, deletedBefore time.Time) (int64, error)
+	SetConversationRetention(ctx context.Context, convId int, userId uint64, retention time.Duration) (Message, error)
+	PurgeExpiredMessages(ctx context.Context, now time.Time) (int64, error)
+	CommentMessage(ctx context.Context, messageId int, userId uint64, emoji string) error
+	UncommentMessage(ctx context.Context, messageId int, userId uint64) error
+	IsMessageOwner(ctx context.Context, messageId int, userId uint64) (bool, error)
 	// Last functions
-	SetUserPhoto(userId uint64, photoData string) error
-	SetGroupPhoto(groupId int, photoData string) error
-	GetConversations(userId uint64) ([]ConversationPreview, error)
-	GetConversationDetails(convId int, userId uint64) (ConversationDetails, error)
-	SearchUsers(query string) ([]User, error)
+	SetUserPhoto(ctx context.Context, userId uint64, photoData string) error
+	GetUserPhoto(ctx context.Context, userId uint64) (string, error)
+	DeleteUser(ctx context.Context, userId uint64) error
+	SetGroupPhoto(ctx context.Context, groupId int, photoData string) error
+	GetConversations(ctx context.Context, userId uint64, filter ConversationFilter) (ConversationList, error)
+	MarkConversationRead(ctx context.Context, convId int, userId uint64, messageId int) error
+	SearchMessages(ctx context.Context, userId uint64, search MessageSearch) (SearchResults, error)
+	GetConversationDetails(ctx context.Context, convId int, userId uint64, page MessagePage) (ConversationDetails, error)
+	SearchUsers(ctx context.Context, query string) ([]User, error)
+	// Sessions
+	CreateSession(ctx context.Context, userId uint64, tokenHash string, userAgent string, expiresAt time.Time) (Session, error)
+	GetUserBySession(ctx context.Context, tokenHash string) (User, Session, error)
+	GetUserBySessionId(ctx context.Context, sessionId int64) (User, Session, error)
+	TouchSession(ctx context.Context, sessionId int64) error
+	ListSessions(ctx context.Context, userId uint64) ([]Session, error)
+	RevokeSession(ctx context.Context, userId uint64, sessionId int64) error
+	RevokeOtherSessions(ctx context.Context, userId uint64, keepSessionId int64) error
+	RotateSessionToken(ctx context.Context, sessionId int64, oldTokenHash string, tokenHash string) error
+	// Passphrases
+	GetPassphraseHash(ctx context.Context, userId uint64) (string, error)
+	SetPassphraseHash(ctx context.Context, userId uint64, hash string) error
+	CreateUserWithPassphrase(ctx context.Context, username string, hash string) (User, error)
+	// Two-factor authentication
+	GetTOTP(ctx context.Context, userId uint64) (TOTP, error)
+	SetTOTPSecret(ctx context.Context, userId uint64, secret string) error
+	ConfirmTOTP(ctx context.Context, userId uint64, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(ctx context.Context, userId uint64, step int64) error
+	UseRecoveryCode(ctx context.Context, userId uint64, codeHash string) error
+	DeleteTOTP(ctx context.Context, userId uint64) error
+	CreateLoginChallenge(ctx context.Context, challengeHash string, challenge LoginChallenge) error
+	GetLoginChallenge(ctx context.Context, challengeHash string) (LoginChallenge, error)
+	RecordLoginChallengeFailure(ctx context.Context, challengeHash string) error
+	DeleteLoginChallenge(ctx context.Context, challengeHash string) error
+	// Bots and API keys
+	CreateBot(ctx context.Context, ownerId uint64, username string) (Bot, error)
+	ListBots(ctx context.Context, ownerId uint64) ([]Bot, error)
+	GetBot(ctx context.Context, ownerId uint64, botId uint64) (Bot, error)
+	CreateAPIKey(ctx context.Context, key APIKey, keyHash string) (APIKey, error)
+	ListAPIKeys(ctx context.Context, botId uint64) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, botId uint64, keyId int64) error
+	GetUserByAPIKey(ctx context.Context, keyHash string) (User, APIKey, error)
+	TouchAPIKey(ctx context.Context, keyId int64) error
+	// OpenID Connect
+	CreateOIDCLogin(ctx context.Context, stateHash string, login OIDCLogin) error
+	TakeOIDCLogin(ctx context.Context, stateHash string) (OIDCLogin, error)
+	GetOIDCUser(ctx context.Context, issuer string, subject string) (User, error)
+	CreateOIDCUser(ctx context.Context, issuer string, subject string, username string) (User, error)
+	IsOIDCUser(ctx context.Context, userId uint64) (bool, error)
 
-	Ping() error
+	Ping(ctx context.Context) error
+}
+
+// Config is the configuration of the AppDatabase returned by New.
+type Config struct {
+	// QueryTimeout is the maximum duration of each query, in addition to the deadline of the context passed to the
+	// methods. Zero means no timeout
+	QueryTimeout time.Duration
+
+	// ReadDB is a pool of connections to the same database for the queries outside transactions, which only read
+	// (see OpenSQLitePools). The pool passed to New is then used for the writes and the transactions. If nil, it is
+	// used for all the queries
+	ReadDB *sql.DB
 }
 
 type appdbimpl struct {
-	c *sql.DB
+	c dbconn
 }
 
-// New returns a new instance of AppDatabase based on the SQLite connection `db`.
+// New returns a new instance of AppDatabase based on the connection `db` (see OpenSQLite and OpenPostgres), after
+// migrating its schema. The SQL dialect is chosen from the driver of `db`.
 // `db` is required - an error will be returned if `db` is `nil`.
-func New(db *sql.DB) (AppDatabase, error) {
+func New(db *sql.DB, cfg Config) (AppDatabase, error) {
 	if db == nil {
 		return nil, errors.New("database is required when building a AppDatabase")
 	}
-
-	// Check if table exists. If not, the database is empty, and we need to create the structure
-	var tableName string
-	err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='users';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		log.Println("Creating 'users' table...")
-		usersDatabase := `CREATE TABLE users (
-			Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-			Username TEXT NOT NULL UNIQUE,
-			ProfilePhoto TEXT
-			);`
-		_, err = db.Exec(usersDatabase)
-		if err != nil {
-			log.Fatalf("Error creating table: %v", err)
-		} else {
-			log.Println("'users' table successfully created.")
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("error checking table existence: %w", err)
-	} else {
-		log.Println("'users' table already exists.")
+	d, err := dialectOf(db)
+	if err != nil {
+		return nil, err
 	}
-
-	// Message table
-	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='messages';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		log.Println("Creating 'messages' table...")
-		messagesDatabase := `CREATE TABLE messages (
-            MessageId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-            ConversationId INTEGER NOT NULL,
-            Text TEXT NOT NULL,
-            SendTime DATETIME NOT NULL,
-            Status TEXT NOT NULL,
-            SenderId INTEGER NOT NULL,
-            RecipientId INTEGER NOT NULL,
-            Photo TEXT,
-            FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId)
-        );`
-		_, err = db.Exec(messagesDatabase)
-		if err != nil {
-			log.Fatalf("Error creating table: %v", err)
-		} else {
-			log.Println("'messages' table successfully created.")
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("error checking table existence: %w", err)
-	} else {
-		log.Println("'messages' table already exists.")
+	if err := d.checkConnection(db); err != nil {
+		return nil, err
 	}
-
-	// Conversation table
-	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='conversations';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		log.Println("Creating 'conversations' table...")
-		conversationsDatabase := `CREATE TABLE conversations (
-			ConversationId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-			GroupId INTEGER NOT NULL,
-			LastMessageId INTEGER,
-			Name TEXT,
-			GroupPhoto TEXT,
-			FOREIGN KEY (LastMessageId) REFERENCES messages(MessageId)
-		);`
-
-		_, err = db.Exec(conversationsDatabase)
-		if err != nil {
-			log.Fatalf("Error creating table: %v", err)
-		} else {
-			log.Println("'conversations' table successfully created.")
+	if cfg.ReadDB != nil {
+		if err := d.checkConnection(cfg.ReadDB); err != nil {
+			return nil, fmt.Errorf("read pool: %w", err)
 		}
-	} else if err != nil {
-		return nil, fmt.Errorf("error checking table existence: %w", err)
-	} else {
-		log.Println("'conversations' table already exists.")
 	}
 
-	// Participants table
-	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='participants';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		log.Println("Creating 'participants' table...")
-		participantsDatabase := `CREATE TABLE participants (
-            ConversationId INTEGER NOT NULL,
-            UserId INTEGER NOT NULL,
-            PRIMARY KEY (ConversationId, UserId),
-            FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId),
-            FOREIGN KEY (UserId) REFERENCES users(Id)
-        );`
-		_, err = db.Exec(participantsDatabase)
-		if err != nil {
-			log.Fatalf("Error creating table: %v", err)
-		} else {
-			log.Println("'participants' table successfully created.")
-		}
-	} else if err != nil {
-		return nil, fmt.Errorf("error checking table existence: %w", err)
-	} else {
-		log.Println("'participants' table already exists.")
-	}
-
-	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='comments';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		log.Println("Creating 'comments' table...")
-		commentsDatabase := `CREATE TABLE comments (
-        CommentId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-        MessageId INTEGER NOT NULL,
-        UserId INTEGER NOT NULL,
-        Emoji TEXT NOT NULL,
-        FOREIGN KEY (MessageId) REFERENCES messages(MessageId),
-        FOREIGN KEY (UserId) REFERENCES users(Id),
-        UNIQUE(MessageId, UserId)
-    );`
-		_, err = db.Exec(commentsDatabase)
-		if err != nil {
-			log.Fatalf("Error creating table: %v", err)
-		} else {
-			log.Println("'comments' table successfully created.")
-		}
+	// Bring the schema up to date
+	if err := Migrate(db); err != nil {
+		return nil, fmt.Errorf("migrating the database: %w", err)
 	}
 
 	return &appdbimpl{
-		c: db,
+		c: dbconn{DB: db, reader: cfg.ReadDB, dialect: d, queryTimeout: cfg.QueryTimeout},
 	}, nil
 }
 
-func (db *appdbimpl) Ping() error {
-	return db.c.Ping()
+func (db *appdbimpl) Ping(ctx context.Context) error {
+	if err := db.c.PingContext(ctx); err != nil {
+		return err
+	}
+	return db.c.readDB().PingContext(ctx)
 }
@@ -0,0 +1,250 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialect hides the differences between the SQL of the supported databases. Queries are written once, with ?
+// placeholders, and run through a dialect by dbconn and dbtx.
+type dialect interface {
+	// rebind rewrites the ? placeholders of the query in the syntax of the database
+	rebind(query string) string
+
+	// insert runs the INSERT query and returns the value of idColumn in the new row
+	insert(ctx context.Context, e execer, query string, idColumn string, args ...interface{}) (int64, error)
+
+	// constraintKind returns the kind of the error if it is about a broken constraint: ErrAlreadyExists for UNIQUE
+	// and primary keys, ErrNotFound for foreign keys. Otherwise, it returns nil.
+	constraintKind(err error) error
+
+	// tableExists tells whether the table exists
+	tableExists(ctx context.Context, q queryer, table string) (bool, error)
+
+	// checkConnection returns an error if the connection can't be used, e.g. because it is missing a setting
+	checkConnection(db *sql.DB) error
+
+	// messageSearch returns the join selecting the messages m matching a full-text search, with one placeholder for
+	// the searchQuery, and the expression of the snippet of the matching text
+	messageSearch() (join string, snippet string)
+
+	// searchQuery returns the argument of the messageSearch join matching the messages with all the terms
+	searchQuery(terms []string) string
+
+	// migrationsDir is the directory of migrationFiles with the migrations of the database
+	migrationsDir() string
+
+	// schemaMigrationsTable is the statement creating the table where applied migrations are recorded
+	schemaMigrationsTable() string
+
+	// beginMigration prepares the connection to apply a migration, and returns the function restoring it
+	beginMigration(ctx context.Context, conn *sql.Conn) (func(), error)
+
+	// endMigration checks the migration, before it is committed
+	endMigration(tx *sql.Tx, m Migration) error
+}
+
+// execer is implemented by *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// dialectOf returns the dialect of the database, from its driver.
+func dialectOf(db *sql.DB) (dialect, error) {
+	switch drv := db.Driver().(type) {
+	case *sqlite3.SQLiteDriver:
+		return sqliteDialect{}, nil
+	case *pq.Driver:
+		return postgresDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %T", drv)
+	}
+}
+
+// dbconn is a database connection pool running its queries through a dialect. It has the same methods as *sql.DB, so
+// queries can be written once for all the databases. Each query runs with the timeout of the pool, if any, in addition
+// to the deadline of its context. QueryContext and QueryRowContext run on reader, if set, and the other methods on DB.
+type dbconn struct {
+	*sql.DB
+	reader       *sql.DB
+	dialect      dialect
+	queryTimeout time.Duration
+}
+
+// readDB returns the pool of the queries that only read.
+func (c dbconn) readDB() *sql.DB {
+	if c.reader != nil {
+		return c.reader
+	}
+	return c.DB
+}
+
+func (c dbconn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := withQueryTimeout(ctx, c.queryTimeout)
+	defer cancel()
+	result, err := c.DB.ExecContext(ctx, c.dialect.rebind(query), args...)
+	return result, kindOf(c.dialect, err)
+}
+
+func (c dbconn) QueryContext(ctx context.Context, query string, args ...interface{}) (*dbrows, error) {
+	ctx, cancel := withQueryTimeout(ctx, c.queryTimeout)
+	rows, err := c.readDB().QueryContext(ctx, c.dialect.rebind(query), args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &dbrows{Rows: rows, cancel: cancel}, nil
+}
+
+func (c dbconn) QueryRowContext(ctx context.Context, query string, args ...interface{}) *dbrow {
+	ctx, cancel := withQueryTimeout(ctx, c.queryTimeout)
+	return &dbrow{Row: c.readDB().QueryRowContext(ctx, c.dialect.rebind(query), args...), dialect: c.dialect, cancel: cancel}
+}
+
+// insert runs the INSERT query and returns the value of idColumn in the new row.
+func (c dbconn) insert(ctx context.Context, query string, idColumn string, args ...interface{}) (int64, error) {
+	ctx, cancel := withQueryTimeout(ctx, c.queryTimeout)
+	defer cancel()
+	id, err := c.dialect.insert(ctx, c.DB, c.dialect.rebind(query), idColumn, args...)
+	return id, kindOf(c.dialect, err)
+}
+
+// BeginTx starts a transaction, which is rolled back if the context is done before it is committed. The timeout
+// applies to each query of the transaction, not to the whole transaction.
+func (c dbconn) BeginTx(ctx context.Context) (*dbtx, error) {
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &dbtx{Tx: tx, dialect: c.dialect, queryTimeout: c.queryTimeout}, nil
+}
+
+// dbtx is a transaction running its queries through a dialect, like dbconn.
+type dbtx struct {
+	*sql.Tx
+	dialect      dialect
+	queryTimeout time.Duration
+}
+
+func (tx *dbtx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := withQueryTimeout(ctx, tx.queryTimeout)
+	defer cancel()
+	result, err := tx.Tx.ExecContext(ctx, tx.dialect.rebind(query), args...)
+	return result, kindOf(tx.dialect, err)
+}
+
+func (tx *dbtx) QueryContext(ctx context.Context, query string, args ...interface{}) (*dbrows, error) {
+	ctx, cancel := withQueryTimeout(ctx, tx.queryTimeout)
+	rows, err := tx.Tx.QueryContext(ctx, tx.dialect.rebind(query), args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &dbrows{Rows: rows, cancel: cancel}, nil
+}
+
+func (tx *dbtx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *dbrow {
+	ctx, cancel := withQueryTimeout(ctx, tx.queryTimeout)
+	return &dbrow{Row: tx.Tx.QueryRowContext(ctx, tx.dialect.rebind(query), args...), dialect: tx.dialect, cancel: cancel}
+}
+
+// insert runs the INSERT query and returns the value of idColumn in the new row.
+func (tx *dbtx) insert(ctx context.Context, query string, idColumn string, args ...interface{}) (int64, error) {
+	ctx, cancel := withQueryTimeout(ctx, tx.queryTimeout)
+	defer cancel()
+	id, err := tx.dialect.insert(ctx, tx.Tx, tx.dialect.rebind(query), idColumn, args...)
+	return id, kindOf(tx.dialect, err)
+}
+
+// dbrows are the rows of a query, whose timeout ends when they are closed.
+type dbrows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *dbrows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// dbrow is the row of a query, whose timeout ends when it is scanned.
+type dbrow struct {
+	*sql.Row
+	dialect dialect
+	cancel  context.CancelFunc
+}
+
+func (r *dbrow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return kindOf(r.dialect, r.Row.Scan(dest...))
+}
+
+// kindOf returns the error of a query as an Error of its kind, if it has one: ErrNotFound for a missing row, or the
+// kind of a broken constraint. Other errors are returned as they are.
+func kindOf(d dialect, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return &Error{Kind: ErrNotFound, Err: err}
+	}
+	if kind := d.constraintKind(err); kind != nil {
+		return &Error{Kind: kind, Err: err}
+	}
+	return err
+}
+
+// withQueryTimeout returns the context of a query, which is done after the timeout (if positive) or with ctx.
+func withQueryTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// numberedPlaceholders rewrites the ? placeholders of the query as $1, $2, ..., skipping string literals, quoted
+// identifiers and comments.
+func numberedPlaceholders(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+
+	n := 0
+	var quote rune
+	comment := false
+	prev := rune(0)
+	for _, r := range query {
+		switch {
+		case comment:
+			comment = r != '\n'
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '-' && prev == '-':
+			comment = true
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			prev = r
+			continue
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return b.String()
+}
@@ -1,31 +1,33 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 )
 
-func (db *appdbimpl) CreateUser(u User) (User, error) {
-	res, err := db.c.Exec("INSERT INTO users(username) VALUES (?)", u.Username)
+func (db *appdbimpl) CreateUser(ctx context.Context, u User) (User, error) {
+	lastInsertID, err := db.c.insert(ctx, "INSERT INTO users(username) VALUES (?)", "Id", u.Username)
 	if err != nil {
 		var user User
-		if err := db.c.QueryRow(`SELECT id, username FROM users WHERE username = ?`, u.Username).Scan(&user.Id, &user.Username); err != nil {
+		if err := db.c.QueryRowContext(ctx, `
+            SELECT u.Id, u.Username, b.UserId IS NOT NULL
+            FROM users u
+            LEFT JOIN bots b ON b.UserId = u.Id
+            WHERE u.Username = ?`, u.Username).Scan(&user.Id, &user.Username, &user.IsBot); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return user, ErrUserDoesNotExist
 			}
+			return user, err
 		}
 		return user, nil
 	}
-	lastInsertID, err := res.LastInsertId()
-	if err != nil {
-		return u, err
-	}
 	u.Id = uint64(lastInsertID)
 	return u, nil
 }
 
-func (db *appdbimpl) SetUsername(u User, username string) (User, error) {
-	res, err := db.c.Exec(`UPDATE users SET Username=? WHERE Id=? AND Username=?`, u.Username, u.Id, username)
+func (db *appdbimpl) SetUsername(ctx context.Context, u User, username string) (User, error) {
+	res, err := db.c.ExecContext(ctx, `UPDATE users SET Username=? WHERE Id=? AND Username=?`, u.Username, u.Id, username)
 	if err != nil {
 		return u, err
 	}
@@ -38,21 +40,35 @@ func (db *appdbimpl) SetUsername(u User, username string) (User, error) {
 	return u, nil
 }
 
-func (db *appdbimpl) GetUsernameById(userId uint64) (string, error) {
+func (db *appdbimpl) GetUsernameById(ctx context.Context, userId uint64) (string, error) {
 	var username string
-	err := db.c.QueryRow("SELECT Username FROM users WHERE Id = ?", userId).Scan(&username)
+	err := db.c.QueryRowContext(ctx, "SELECT Username FROM users WHERE Id = ?", userId).Scan(&username)
 	return username, err
 }
 
+// GetUser returns the user with the given ID. ErrUserDoesNotExist is returned if there is no such user.
+func (db *appdbimpl) GetUser(ctx context.Context, userId uint64) (User, error) {
+	var user User
+	err := db.c.QueryRowContext(ctx, `
+        SELECT u.Id, u.Username, b.UserId IS NOT NULL
+        FROM users u
+        LEFT JOIN bots b ON b.UserId = u.Id
+        WHERE u.Id = ?`, userId).Scan(&user.Id, &user.Username, &user.IsBot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserDoesNotExist
+	}
+	return user, err
+}
+
 // User operations
-func (db *appdbimpl) GetRecipientIdByUsername(username string) (uint64, error) {
+func (db *appdbimpl) GetRecipientIdByUsername(ctx context.Context, username string) (uint64, error) {
 	var userId uint64
-	err := db.c.QueryRow("SELECT Id FROM users WHERE Username = ?", username).Scan(&userId)
+	err := db.c.QueryRowContext(ctx, "SELECT Id FROM users WHERE Username = ?", username).Scan(&userId)
 	return userId, err
 }
 
-func (db *appdbimpl) GetConversationIdByName(name string) (int, error) {
+func (db *appdbimpl) GetConversationIdByName(ctx context.Context, name string) (int, error) {
 	var convId int
-	err := db.c.QueryRow("SELECT ConversationId FROM conversations WHERE Name = ?", name).Scan(&convId)
+	err := db.c.QueryRowContext(ctx, "SELECT ConversationId FROM conversations WHERE Name = ?", name).Scan(&convId)
 	return convId, err
 }
@@ -0,0 +1,394 @@
+package memory
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"sort"
+	"time"
+)
+
+// CreateSession stores a new session for the user.
+func (db *memdb) CreateSession(ctx context.Context, userId uint64, tokenHash string, userAgent string, expiresAt time.Time) (database.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Session{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[userId]; !ok {
+		return database.Session{}, errForeignKey("sessions.UserId")
+	}
+	if db.sessionByToken(tokenHash) != nil {
+		return database.Session{}, errUnique("sessions.TokenHash")
+	}
+
+	now := stored(globaltime.Now())
+	db.lastSessionId++
+	s := &session{
+		Session: database.Session{
+			SessionId:  db.lastSessionId,
+			UserId:     userId,
+			UserAgent:  userAgent,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			ExpiresAt:  stored(expiresAt),
+		},
+		tokenHash: tokenHash,
+	}
+	db.sessions[s.SessionId] = s
+	return s.Session, nil
+}
+
+// GetUserBySession returns the owner of the session identified by the token hash, together with the session itself.
+// ErrSessionNotFound is returned if the session does not exist, has expired or has been revoked.
+func (db *memdb) GetUserBySession(ctx context.Context, tokenHash string) (database.User, database.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, database.Session{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.activeSession(db.sessionByToken(tokenHash))
+}
+
+// GetUserBySessionId is like GetUserBySession, for the session with the given ID.
+func (db *memdb) GetUserBySessionId(ctx context.Context, sessionId int64) (database.User, database.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, database.Session{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.activeSession(db.sessions[sessionId])
+}
+
+// activeSession returns the owner of the session and the session, if it is active.
+func (db *memdb) activeSession(s *session) (database.User, database.Session, error) {
+	if s == nil || s.revoked || !s.ExpiresAt.After(globaltime.Now()) {
+		return database.User{}, database.Session{}, database.ErrSessionNotFound
+	}
+	u := db.users[s.UserId]
+	return database.User{Id: u.Id, Username: u.Username}, s.Session, nil
+}
+
+// TouchSession records that the session has just been used.
+func (db *memdb) TouchSession(ctx context.Context, sessionId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if s, ok := db.sessions[sessionId]; ok {
+		s.LastUsedAt = stored(globaltime.Now())
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of the user, most recently used first.
+func (db *memdb) ListSessions(ctx context.Context, userId uint64) ([]database.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := globaltime.Now()
+	var sessions []database.Session
+	for _, s := range db.sessions {
+		if s.UserId == userId && !s.revoked && s.ExpiresAt.After(now) {
+			sessions = append(sessions, s.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].SessionId > sessions[j].SessionId
+	})
+	return sessions, nil
+}
+
+// RevokeSession revokes one of the sessions of the user. ErrSessionNotFound is returned if the session does not
+// belong to the user or has already been revoked.
+func (db *memdb) RevokeSession(ctx context.Context, userId uint64, sessionId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok := db.sessions[sessionId]
+	if !ok || s.UserId != userId || s.revoked {
+		return database.ErrSessionNotFound
+	}
+	s.revoked = true
+	return nil
+}
+
+// RevokeOtherSessions revokes every session of the user except keepSessionId.
+func (db *memdb) RevokeOtherSessions(ctx context.Context, userId uint64, keepSessionId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, s := range db.sessions {
+		if s.UserId == userId && s.SessionId != keepSessionId {
+			s.revoked = true
+		}
+	}
+	return nil
+}
+
+// RotateSessionToken replaces the token oldTokenHash of the session with tokenHash, so the previous token can't be used
+// anymore.
+func (db *memdb) RotateSessionToken(ctx context.Context, sessionId int64, oldTokenHash string, tokenHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s, ok := db.sessions[sessionId]
+	if !ok || s.revoked || s.tokenHash != oldTokenHash {
+		return database.ErrSessionNotFound
+	}
+	if other := db.sessionByToken(tokenHash); other != nil && other != s {
+		return errUnique("sessions.TokenHash")
+	}
+	s.tokenHash = tokenHash
+	s.LastUsedAt = stored(globaltime.Now())
+	return nil
+}
+
+func (db *memdb) sessionByToken(tokenHash string) *session {
+	for _, s := range db.sessions {
+		if s.tokenHash == tokenHash {
+			return s
+		}
+	}
+	return nil
+}
+
+// GetPassphraseHash returns the stored hash of the user passphrase. ErrNoPassphrase is returned if the user has not
+// set a passphrase.
+func (db *memdb) GetPassphraseHash(ctx context.Context, userId uint64) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	hash, ok := db.passphrases[userId]
+	if !ok {
+		return "", database.ErrNoPassphrase
+	}
+	return hash, nil
+}
+
+// SetPassphraseHash sets or replaces the hash of the user passphrase.
+func (db *memdb) SetPassphraseHash(ctx context.Context, userId uint64, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[userId]; !ok {
+		return errForeignKey("passphrases.UserId")
+	}
+	db.passphrases[userId] = hash
+	return nil
+}
+
+// CreateUserWithPassphrase creates a new user with the hash of their passphrase, at once. ErrUsernameTaken is returned
+// if the username is already used.
+func (db *memdb) CreateUserWithPassphrase(ctx context.Context, username string, hash string) (database.User, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.userByUsername(username) != nil {
+		return database.User{}, database.ErrUsernameTaken
+	}
+	userId := db.insertUser(username)
+	db.passphrases[userId] = hash
+	return database.User{Id: userId, Username: username}, nil
+}
+
+// GetTOTP returns the TOTP enrollment of the user. ErrNoTOTP is returned if the user never started an enrollment.
+func (db *memdb) GetTOTP(ctx context.Context, userId uint64) (database.TOTP, error) {
+	if err := ctx.Err(); err != nil {
+		return database.TOTP{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	totp, ok := db.totp[userId]
+	if !ok {
+		return database.TOTP{}, database.ErrNoTOTP
+	}
+	return *totp, nil
+}
+
+// SetTOTPSecret starts a new (unconfirmed) enrollment, replacing any previous one.
+func (db *memdb) SetTOTPSecret(ctx context.Context, userId uint64, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[userId]; !ok {
+		return errForeignKey("totp.UserId")
+	}
+	db.totp[userId] = &database.TOTP{UserId: userId, Secret: secret}
+	return nil
+}
+
+// ConfirmTOTP completes the enrollment after the first code has been verified, and replaces the recovery codes of
+// the user.
+func (db *memdb) ConfirmTOTP(ctx context.Context, userId uint64, step int64, recoveryCodeHashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	totp, ok := db.totp[userId]
+	if !ok {
+		return database.ErrNoTOTP
+	}
+	codes := make(map[string]bool, len(recoveryCodeHashes))
+	for _, codeHash := range recoveryCodeHashes {
+		if _, ok := codes[codeHash]; ok {
+			return errUnique("recovery_codes.UserId, recovery_codes.CodeHash")
+		}
+		codes[codeHash] = false
+	}
+
+	totp.Confirmed = true
+	totp.LastUsedStep = step
+	db.recoveryCodes[userId] = codes
+	return nil
+}
+
+// UseTOTPStep marks the time step as used. ErrTOTPCodeReused is returned if the step (or a later one) has already been
+// used, so each code is accepted only once.
+func (db *memdb) UseTOTPStep(ctx context.Context, userId uint64, step int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	totp, ok := db.totp[userId]
+	if !ok || !totp.Confirmed || totp.LastUsedStep >= step {
+		return database.ErrTOTPCodeReused
+	}
+	totp.LastUsedStep = step
+	return nil
+}
+
+// UseRecoveryCode marks the recovery code as used. ErrRecoveryCodeNotFound is returned if the code does not exist or
+// has already been used.
+func (db *memdb) UseRecoveryCode(ctx context.Context, userId uint64, codeHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	used, ok := db.recoveryCodes[userId][codeHash]
+	if !ok || used {
+		return database.ErrRecoveryCodeNotFound
+	}
+	db.recoveryCodes[userId][codeHash] = true
+	return nil
+}
+
+// DeleteTOTP disables two-factor authentication for the user, removing the secret and the recovery codes.
+func (db *memdb) DeleteTOTP(ctx context.Context, userId uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	delete(db.recoveryCodes, userId)
+	delete(db.totp, userId)
+	return nil
+}
+
+// CreateLoginChallenge stores a pending login that is waiting for the second factor.
+func (db *memdb) CreateLoginChallenge(ctx context.Context, challengeHash string, challenge database.LoginChallenge) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.challenges[challengeHash]; ok {
+		return errUnique("login_challenges.ChallengeHash")
+	}
+	if _, ok := db.users[challenge.UserId]; !ok {
+		return errForeignKey("login_challenges.UserId")
+	}
+	db.challenges[challengeHash] = &database.LoginChallenge{
+		UserId:    challenge.UserId,
+		UserAgent: challenge.UserAgent,
+		ExpiresAt: stored(challenge.ExpiresAt),
+	}
+	return nil
+}
+
+// GetLoginChallenge returns a pending login. ErrChallengeNotFound is returned if it does not exist or has expired.
+func (db *memdb) GetLoginChallenge(ctx context.Context, challengeHash string) (database.LoginChallenge, error) {
+	if err := ctx.Err(); err != nil {
+		return database.LoginChallenge{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	challenge, ok := db.challenges[challengeHash]
+	if !ok || !challenge.ExpiresAt.After(globaltime.Now()) {
+		return database.LoginChallenge{}, database.ErrChallengeNotFound
+	}
+	return *challenge, nil
+}
+
+// RecordLoginChallengeFailure counts a wrong second factor for the pending login.
+func (db *memdb) RecordLoginChallengeFailure(ctx context.Context, challengeHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if challenge, ok := db.challenges[challengeHash]; ok {
+		challenge.Attempts++
+	}
+	return nil
+}
+
+// DeleteLoginChallenge removes a pending login, and any other expired one.
+func (db *memdb) DeleteLoginChallenge(ctx context.Context, challengeHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := globaltime.Now()
+	for hash, challenge := range db.challenges {
+		if hash == challengeHash || challenge.ExpiresAt.Before(now) {
+			delete(db.challenges, hash)
+		}
+	}
+	return nil
+}
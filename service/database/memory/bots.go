@@ -0,0 +1,199 @@
+package memory
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"sort"
+	"strings"
+)
+
+// CreateBot creates a bot account owned by a human user. ErrUsernameTaken is returned if the username is already
+// used.
+func (db *memdb) CreateBot(ctx context.Context, ownerId uint64, username string) (database.Bot, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Bot{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.userByUsername(username) != nil {
+		return database.Bot{}, database.ErrUsernameTaken
+	}
+	if _, ok := db.users[ownerId]; !ok {
+		return database.Bot{}, errForeignKey("bots.OwnerId")
+	}
+
+	bot := &database.Bot{
+		UserId:    db.insertUser(username),
+		Username:  username,
+		OwnerId:   ownerId,
+		CreatedAt: stored(globaltime.Now()),
+	}
+	db.bots[bot.UserId] = bot
+	return *bot, nil
+}
+
+// ListBots returns the bots owned by the user.
+func (db *memdb) ListBots(ctx context.Context, ownerId uint64) ([]database.Bot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var bots []database.Bot
+	for _, b := range db.bots {
+		if b.OwnerId == ownerId {
+			bots = append(bots, db.bot(b))
+		}
+	}
+	sort.Slice(bots, func(i, j int) bool { return bots[i].Username < bots[j].Username })
+	return bots, nil
+}
+
+// GetBot returns a bot owned by the user. ErrBotNotFound is returned if the bot does not exist or has another owner.
+func (db *memdb) GetBot(ctx context.Context, ownerId uint64, botId uint64) (database.Bot, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Bot{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	b, ok := db.bots[botId]
+	if !ok || b.OwnerId != ownerId {
+		return database.Bot{}, database.ErrBotNotFound
+	}
+	return db.bot(b), nil
+}
+
+// CreateAPIKey stores a new API key for the bot.
+func (db *memdb) CreateAPIKey(ctx context.Context, key database.APIKey, keyHash string) (database.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return database.APIKey{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.bots[key.BotId]; !ok {
+		return database.APIKey{}, errForeignKey("api_keys.BotId")
+	}
+	for _, k := range db.apiKeys {
+		if k.keyHash == keyHash {
+			return database.APIKey{}, errUnique("api_keys.KeyHash")
+		}
+	}
+	conversationIds := make(map[int]bool, len(key.ConversationIds))
+	for _, conversationId := range key.ConversationIds {
+		if _, ok := db.conversations[conversationId]; !ok {
+			return database.APIKey{}, errForeignKey("api_key_conversations.ConversationId")
+		}
+		if conversationIds[conversationId] {
+			return database.APIKey{}, errUnique("api_key_conversations.KeyId, api_key_conversations.ConversationId")
+		}
+		conversationIds[conversationId] = true
+	}
+
+	db.lastKeyId++
+	key.KeyId = db.lastKeyId
+	key.CreatedAt = stored(globaltime.Now())
+	db.apiKeys[key.KeyId] = &apiKey{
+		APIKey: database.APIKey{
+			KeyId:     key.KeyId,
+			BotId:     key.BotId,
+			Name:      key.Name,
+			Prefix:    key.Prefix,
+			Scopes:    strings.Fields(strings.Join(key.Scopes, " ")),
+			CreatedAt: key.CreatedAt,
+		},
+		keyHash: keyHash,
+	}
+	db.apiKeyConvs[key.KeyId] = conversationIds
+	return key, nil
+}
+
+// ListAPIKeys returns the active API keys of the bot.
+func (db *memdb) ListAPIKeys(ctx context.Context, botId uint64) ([]database.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var keys []database.APIKey
+	for _, k := range db.apiKeys {
+		if k.BotId == botId && !k.revoked {
+			keys = append(keys, db.apiKey(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].KeyId < keys[j].KeyId })
+	return keys, nil
+}
+
+// RevokeAPIKey revokes an API key of the bot. ErrAPIKeyNotFound is returned if the key does not belong to the bot or
+// has already been revoked.
+func (db *memdb) RevokeAPIKey(ctx context.Context, botId uint64, keyId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	k, ok := db.apiKeys[keyId]
+	if !ok || k.BotId != botId || k.revoked {
+		return database.ErrAPIKeyNotFound
+	}
+	k.revoked = true
+	return nil
+}
+
+// GetUserByAPIKey returns the bot authenticated by the API key hash, together with the key itself.
+// ErrAPIKeyNotFound is returned if the key does not exist or has been revoked.
+func (db *memdb) GetUserByAPIKey(ctx context.Context, keyHash string) (database.User, database.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, database.APIKey{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, k := range db.apiKeys {
+		if k.keyHash != keyHash {
+			continue
+		}
+		if k.revoked {
+			break
+		}
+		u := db.users[k.BotId]
+		return database.User{Id: u.Id, Username: u.Username, IsBot: true}, db.apiKey(k), nil
+	}
+	return database.User{}, database.APIKey{}, database.ErrAPIKeyNotFound
+}
+
+// TouchAPIKey records that the API key has just been used.
+func (db *memdb) TouchAPIKey(ctx context.Context, keyId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if k, ok := db.apiKeys[keyId]; ok {
+		k.LastUsedAt = stored(globaltime.Now())
+	}
+	return nil
+}
+
+// bot returns a copy of the bot, with its current username.
+func (db *memdb) bot(b *database.Bot) database.Bot {
+	bot := *b
+	bot.Username = db.users[b.UserId].Username
+	return bot
+}
+
+// apiKey returns a copy of the key, with the conversations it is restricted to.
+func (db *memdb) apiKey(k *apiKey) database.APIKey {
+	key := k.APIKey
+	key.Scopes = append([]string{}, k.Scopes...)
+	key.ConversationIds = sortedInts(db.apiKeyConvs[k.KeyId])
+	return key
+}
@@ -0,0 +1,494 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"sort"
+	"strings"
+	"time"
+)
+
+func (db *memdb) CreateConversation(ctx context.Context, userId uint64, conversationId int) (database.Conversation, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Conversation{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Like the SQL implementation, the conversation is kept even if the participant can't be added
+	c := db.insertConversation(conversationId, sql.NullString{})
+	if err := db.addParticipant(c, userId); err != nil {
+		return database.Conversation{}, err
+	}
+
+	return database.Conversation{
+		ConversationId: c.id,
+		GroupId:        conversationId,
+		LastMessageId:  0, // Initializing with no messages
+	}, nil
+}
+
+func (db *memdb) UpdateLastMessage(ctx context.Context, messageId int, conversationId int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.conversations[conversationId]
+	if !ok {
+		return nil
+	}
+	if _, ok := db.messages[messageId]; !ok {
+		return errForeignKey("conversations.LastMessageId")
+	}
+	c.lastMessageId = messageId
+	return nil
+}
+
+// GetOrCreateDirectConversation returns the direct conversation of the two users. If there is none, it is created when
+// create is true, otherwise ErrConversationNotFound is returned.
+func (db *memdb) GetOrCreateDirectConversation(ctx context.Context, userId, recipientId uint64, create bool) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// First try to find existing conversation
+	for _, c := range db.sortedConversations() {
+		if c.groupId != 0 || !c.participants[userId] || !c.participants[recipientId] {
+			continue
+		}
+		others := false
+		for p := range c.participants {
+			others = others || (p != userId && p != recipientId)
+		}
+		if !others {
+			return c.id, nil
+		}
+	}
+	if !create {
+		return 0, database.ErrConversationNotFound
+	}
+
+	// Check the participants first, as nothing is created if they can't be added
+	if userId == recipientId {
+		return 0, errUnique("participants.ConversationId, participants.UserId")
+	}
+	if _, ok := db.users[userId]; !ok {
+		return 0, errForeignKey("participants.UserId")
+	}
+	if _, ok := db.users[recipientId]; !ok {
+		return 0, errForeignKey("participants.UserId")
+	}
+
+	c := db.insertConversation(0, sql.NullString{})
+	c.participants[userId] = true
+	c.participants[recipientId] = true
+	return c.id, nil
+}
+
+func (db *memdb) CheckIfConversationExists(ctx context.Context, conversationId int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, ok := db.conversations[conversationId]
+	return ok, nil
+}
+
+func (db *memdb) GetConversationIdByName(ctx context.Context, name string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, c := range db.sortedConversations() {
+		if c.name.Valid && c.name.String == name {
+			return c.id, nil
+		}
+	}
+	return 0, errNoRows
+}
+
+func (db *memdb) CreateGroup(ctx context.Context, name string, creatorId uint64) (database.Conversation, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Conversation{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[creatorId]; !ok {
+		return database.Conversation{}, errForeignKey("participants.UserId")
+	}
+	c := db.insertConversation(1, sql.NullString{String: name, Valid: true})
+	c.participants[creatorId] = true
+
+	return database.Conversation{
+		ConversationId: c.id,
+		GroupId:        1, // 1 indicates it's a group
+		LastMessageId:  0,
+		Name:           name,
+	}, nil
+}
+
+func (db *memdb) AddUserToGroup(ctx context.Context, username string, groupId int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, err := db.group(groupId)
+	if err != nil {
+		return err
+	}
+	u := db.userByUsername(username)
+	if u == nil {
+		return database.ErrUserDoesNotExist
+	}
+	if c.participants[u.Id] {
+		return nil // User is already in group
+	}
+	return db.addParticipant(c, u.Id)
+}
+
+func (db *memdb) IsUserInGroup(ctx context.Context, userId uint64, groupId int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	c, ok := db.conversations[groupId]
+	return ok && c.participants[userId], nil
+}
+
+func (db *memdb) DeleteGroup(ctx context.Context, groupId int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if c, ok := db.conversations[groupId]; ok && c.groupId == 1 {
+		db.deleteConversation(c)
+	}
+	return nil
+}
+
+func (db *memdb) LeaveGroup(ctx context.Context, userId uint64, groupId int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.conversations[groupId]
+	if !ok || !c.participants[userId] {
+		return database.ErrNotMember
+	}
+	delete(c.participants, userId)
+	delete(c.lastRead, userId)
+
+	// Nobody can see a group without members anymore, so delete it with its messages
+	if c.groupId == 1 && len(c.participants) == 0 {
+		db.deleteConversation(c)
+	}
+	return nil
+}
+
+func (db *memdb) SetGroupName(ctx context.Context, groupId int, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, err := db.group(groupId)
+	if err != nil {
+		return err
+	}
+	c.name = sql.NullString{String: newName, Valid: true}
+	return nil
+}
+
+func (db *memdb) SetGroupPhoto(ctx context.Context, groupId int, photoData string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, err := db.group(groupId)
+	if err != nil {
+		return err
+	}
+	c.photo = photoData
+	return nil
+}
+
+// group returns the group, like checkGroup of the SQL implementation: ErrGroupNotFound is returned if the conversation
+// does not exist, and ErrNotGroup if it is a direct conversation.
+func (db *memdb) group(groupId int) (*conversation, error) {
+	c, ok := db.conversations[groupId]
+	if !ok {
+		return nil, database.ErrGroupNotFound
+	}
+	if c.groupId != 1 {
+		return nil, database.ErrNotGroup
+	}
+	return c, nil
+}
+
+// GetConversations returns a page of the previews of the conversations of the user selected by the filter, the most
+// recent last message first and the conversations without messages last.
+func (db *memdb) GetConversations(ctx context.Context, userId uint64, filter database.ConversationFilter) (database.ConversationList, error) {
+	if err := ctx.Err(); err != nil {
+		return database.ConversationList{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	allowed := make(map[int]bool)
+	for _, id := range filter.ConversationIds {
+		allowed[id] = true
+	}
+	name := strings.ToLower(filter.Name)
+
+	var conversations []database.ConversationPreview
+	for _, c := range db.sortedConversations() {
+		if !c.participants[userId] || (len(allowed) > 0 && !allowed[c.id]) {
+			continue
+		}
+		if (filter.GroupsOnly && c.groupId != 1) || (filter.DirectOnly && c.groupId == 1) {
+			continue
+		}
+
+		conv := database.ConversationPreview{
+			ConversationId:  c.id,
+			Name:            db.conversationName(c, userId),
+			LastMessageTime: globaltime.Now(),
+			IsGroup:         c.groupId == 1,
+			UnreadCount:     db.unreadCount(c, userId),
+		}
+		if filter.WithPhotos {
+			conv.Photo = c.photo
+		}
+		if m, ok := db.messages[c.lastMessageId]; ok {
+			conv.LastMessageId = m.MessageId
+			conv.LastMessageTime = m.SendTime
+			conv.LastMessageText = m.Text
+			conv.IsPhoto = m.Photo != ""
+			if m.DeletedAt != nil {
+				conv.LastMessageText = database.DeletedMessageText
+				conv.LastMessageDeleted = true
+			}
+		}
+		if (filter.UnreadOnly && conv.UnreadCount == 0) || !strings.Contains(strings.ToLower(conv.Name), name) {
+			continue
+		}
+		if filter.After != nil && !filter.After.Before(database.PreviewCursorOf(conv)) {
+			continue
+		}
+		conversations = append(conversations, conv)
+	}
+
+	sort.Slice(conversations, func(i, j int) bool {
+		return database.PreviewCursorOf(conversations[i]).Before(database.PreviewCursorOf(conversations[j]))
+	})
+
+	list := database.ConversationList{Conversations: conversations}
+	if filter.Limit > 0 && len(conversations) > filter.Limit {
+		list.Conversations = conversations[:filter.Limit]
+		next := database.PreviewCursorOf(list.Conversations[filter.Limit-1])
+		list.NextCursor = &next
+	}
+	return list, nil
+}
+
+// unreadCount returns the number of messages of the conversation sent by the others after the last one read by the
+// user, without the deleted ones and the events.
+func (db *memdb) unreadCount(c *conversation, userId uint64) int {
+	count := 0
+	for _, m := range db.messages {
+		if m.ConversationId == c.id && m.MessageId > c.lastRead[userId] && m.SenderId != userId &&
+			m.DeletedAt == nil && m.Event == "" {
+			count++
+		}
+	}
+	return count
+}
+
+// MarkConversationRead records that the user has read the messages of the conversation up to messageId. The messages
+// read before are not marked unread if messageId is older.
+func (db *memdb) MarkConversationRead(ctx context.Context, convId int, userId uint64, messageId int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if c, ok := db.conversations[convId]; ok && c.participants[userId] && c.lastRead[userId] < messageId {
+		c.lastRead[userId] = messageId
+	}
+	return nil
+}
+
+// GetConversationDetails returns the conversation with a page of its messages, the most recent first, and their
+// comments in the order they were added. The cursors of the older and newer messages are set if there are any.
+func (db *memdb) GetConversationDetails(ctx context.Context, convId int, userId uint64, page database.MessagePage) (database.ConversationDetails, error) {
+	if err := ctx.Err(); err != nil {
+		return database.ConversationDetails{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	c, ok := db.conversations[convId]
+	if !ok {
+		return database.ConversationDetails{}, errNoRows
+	}
+	conv := database.ConversationDetails{
+		ConversationId: c.id,
+		Name:           db.conversationName(c, userId),
+		Photo:          c.photo,
+		IsGroup:        c.groupId == 1,
+
+		RetentionSeconds: int64(c.retention / time.Second),
+	}
+
+	var history []*database.Message
+	for _, m := range db.sortedMessages() {
+		if m.ConversationId == convId {
+			history = append(history, m)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return database.CursorOf(*history[j]).Before(database.CursorOf(*history[i]))
+	})
+
+	// The messages selected by the cursors, newest first, and the page of them
+	var selected []*database.Message
+	for _, m := range history {
+		cursor := database.CursorOf(*m)
+		if (page.Before == nil || cursor.Before(*page.Before)) && (page.After == nil || page.After.Before(cursor)) {
+			selected = append(selected, m)
+		}
+	}
+	if page.Limit > 0 && len(selected) > page.Limit {
+		if page.After != nil && page.Before == nil {
+			selected = selected[len(selected)-page.Limit:]
+		} else {
+			selected = selected[:page.Limit]
+		}
+	}
+
+	for _, m := range selected {
+		msg := database.MessageWithComments{
+			Message: database.Message{
+				MessageId: m.MessageId,
+				Text:      m.Text,
+				SendTime:  m.SendTime,
+				Status:    m.Status,
+				SenderId:  m.SenderId,
+				Photo:     m.Photo,
+				DeletedAt: m.DeletedAt,
+				Event:     m.Event,
+			},
+			SenderUsername: db.senderUsername(m),
+		}
+		if m.DeletedAt != nil {
+			msg.Text = database.DeletedMessageText
+		}
+		for _, cm := range db.comments {
+			if u, ok := db.users[cm.userId]; ok && cm.messageId == m.MessageId {
+				msg.Comments = append(msg.Comments, database.Comment{UserId: cm.userId, Username: u.Username, Emoji: cm.emoji})
+			}
+		}
+		conv.Messages = append(conv.Messages, msg)
+	}
+
+	if len(selected) > 0 {
+		newest := database.CursorOf(*selected[0])
+		oldest := database.CursorOf(*selected[len(selected)-1])
+		if history[0] != selected[0] {
+			conv.PrevCursor = &newest
+		}
+		if history[len(history)-1] != selected[len(selected)-1] {
+			conv.NextCursor = &oldest
+		}
+	}
+	return conv, nil
+}
+
+// conversationName is the name of the conversation seen by the user: the name of the group, or else the username of
+// the other participant with the lowest ID, or database.DeletedUsername if there is none left.
+func (db *memdb) conversationName(c *conversation, userId uint64) string {
+	if c.groupId == 1 {
+		return c.name.String
+	}
+	var other *database.User
+	for p := range c.participants {
+		if u, ok := db.users[p]; ok && p != userId && (other == nil || p < other.Id) {
+			other = u
+		}
+	}
+	if other == nil {
+		return database.DeletedUsername
+	}
+	return other.Username
+}
+
+// insertConversation adds a conversation without participants.
+func (db *memdb) insertConversation(groupId int, name sql.NullString) *conversation {
+	db.lastConversationId++
+	c := &conversation{
+		id:           db.lastConversationId,
+		groupId:      groupId,
+		name:         name,
+		participants: make(map[uint64]bool),
+		lastRead:     make(map[uint64]int),
+	}
+	db.conversations[c.id] = c
+	return c
+}
+
+func (db *memdb) addParticipant(c *conversation, userId uint64) error {
+	if _, ok := db.users[userId]; !ok {
+		return errForeignKey("participants.UserId")
+	}
+	if c.participants[userId] {
+		return errUnique("participants.ConversationId, participants.UserId")
+	}
+	c.participants[userId] = true
+	return nil
+}
+
+// deleteConversation deletes the conversation with the rows referencing it, like ON DELETE CASCADE.
+func (db *memdb) deleteConversation(c *conversation) {
+	for _, m := range db.messages {
+		if m.ConversationId == c.id {
+			db.deleteMessage(m)
+		}
+	}
+	for _, convs := range db.apiKeyConvs {
+		delete(convs, c.id)
+	}
+	delete(db.conversations, c.id)
+}
+
+// sortedConversations returns the conversations in the order of their IDs, which is the order of the SQL scans.
+func (db *memdb) sortedConversations() []*conversation {
+	conversations := make([]*conversation, 0, len(db.conversations))
+	for _, c := range db.conversations {
+		conversations = append(conversations, c)
+	}
+	sort.Slice(conversations, func(i, j int) bool { return conversations[i].id < conversations[j].id })
+	return conversations
+}
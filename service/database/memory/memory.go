@@ -0,0 +1,170 @@
+/*
+Package memory is an implementation of database.AppDatabase keeping all the data in memory, without SQL. It is meant
+for tests of the code using the database (like the API handlers), which can run against a new empty database in a
+few microseconds instead of a SQLite file.
+
+It has the same semantics as the SQL implementation of package database: the same constraints (unique usernames,
+foreign keys, cascading deletes), the same errors, and the same ordering of the results. Where the SQL implementation
+returns a driver error (e.g. on a UNIQUE constraint), an error is returned as well, but its message differs. The
+conformance package checks that the two implementations behave the same.
+
+The database is safe for concurrent use by multiple goroutines; every method is atomic, like a transaction. Methods
+return the error of their context if it is done, as SQL queries are canceled.
+
+	apirouter, err := api.New(api.Config{Logger: logger, Database: memory.New(), SessionTTL: time.Hour})
+*/
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"sort"
+	"sync"
+	"time"
+)
+
+type conversation struct {
+	id            int
+	groupId       int
+	lastMessageId int // 0 is NULL
+	name          sql.NullString
+	photo         string
+	participants  map[uint64]bool
+	lastRead      map[uint64]int // The last message read by each participant
+	retention     time.Duration  // 0 is NULL
+}
+
+type comment struct {
+	id        int64
+	messageId int
+	userId    uint64
+	emoji     string
+}
+
+type session struct {
+	database.Session
+	tokenHash string
+	revoked   bool
+}
+
+type apiKey struct {
+	database.APIKey
+	keyHash string
+	revoked bool
+}
+
+type oidcIdentity struct {
+	issuer  string
+	subject string
+}
+
+type memdb struct {
+	mu sync.RWMutex
+
+	name *string // example_table
+
+	users         map[uint64]*database.User
+	conversations map[int]*conversation
+	messages      map[int]*database.Message
+	comments      []comment
+	sessions      map[int64]*session
+	passphrases   map[uint64]string
+	totp          map[uint64]*database.TOTP
+	recoveryCodes map[uint64]map[string]bool // code hash -> used
+	challenges    map[string]*database.LoginChallenge
+	bots          map[uint64]*database.Bot
+	apiKeys       map[int64]*apiKey
+	apiKeyConvs   map[int64]map[int]bool
+	identities    map[oidcIdentity]uint64
+	oidcLogins    map[string]database.OIDCLogin
+
+	// Last IDs: like AUTOINCREMENT columns, IDs of deleted rows are never reused
+	lastUserId         uint64
+	lastConversationId int
+	lastMessageId      int
+	lastCommentId      int64
+	lastSessionId      int64
+	lastKeyId          int64
+}
+
+// New returns a new empty in-memory database.
+func New() database.AppDatabase {
+	return &memdb{
+		users:         make(map[uint64]*database.User),
+		conversations: make(map[int]*conversation),
+		messages:      make(map[int]*database.Message),
+		sessions:      make(map[int64]*session),
+		passphrases:   make(map[uint64]string),
+		totp:          make(map[uint64]*database.TOTP),
+		recoveryCodes: make(map[uint64]map[string]bool),
+		challenges:    make(map[string]*database.LoginChallenge),
+		bots:          make(map[uint64]*database.Bot),
+		apiKeys:       make(map[int64]*apiKey),
+		apiKeyConvs:   make(map[int64]map[int]bool),
+		identities:    make(map[oidcIdentity]uint64),
+		oidcLogins:    make(map[string]database.OIDCLogin),
+	}
+}
+
+func (db *memdb) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// GetName is the example of package database, reading the name saved by SetName.
+func (db *memdb) GetName(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.name == nil {
+		return "", errNoRows
+	}
+	return *db.name, nil
+}
+
+// SetName is the example of package database. The name can be saved only once, like the row with id 1.
+func (db *memdb) SetName(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.name != nil {
+		return errUnique("example_table.id")
+	}
+	db.name = &name
+	return nil
+}
+
+// errNoRows is the error of a query finding no row, like in the SQL implementation.
+var errNoRows error = &database.Error{Kind: database.ErrNotFound, Err: sql.ErrNoRows}
+
+// errUnique is the error of a change breaking a UNIQUE constraint (or a primary key) of the SQL schema.
+func errUnique(column string) error {
+	return &database.Error{Kind: database.ErrAlreadyExists, Err: fmt.Errorf("UNIQUE constraint failed: %s", column)}
+}
+
+// errForeignKey is the error of a change referencing a missing row, which the SQL schema forbids.
+func errForeignKey(column string) error {
+	return &database.Error{Kind: database.ErrNotFound, Err: fmt.Errorf("FOREIGN KEY constraint failed: %s", column)}
+}
+
+// stored returns the time as read back from the SQL databases, which store it in UTC.
+func stored(tm time.Time) time.Time {
+	return tm.UTC()
+}
+
+// sortedInts returns the keys of the set in increasing order, or nil if it is empty.
+func sortedInts(set map[int]bool) []int {
+	var ids []int
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
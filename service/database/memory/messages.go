@@ -0,0 +1,193 @@
+package memory
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"sort"
+	"time"
+)
+
+func (db *memdb) CreateMessage(ctx context.Context, m database.Message) (database.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Message{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.insertMessage(m)
+}
+
+func (db *memdb) ForwardMessage(ctx context.Context, messageId int, userId uint64, targetConvId int) (database.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Message{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	original, ok := db.messages[messageId]
+	if !ok || original.DeletedAt != nil || original.Event != "" {
+		return database.Message{}, database.ErrMessageNotFound
+	}
+
+	return db.insertMessage(database.Message{
+		Text:           original.Text,
+		Status:         original.Status,
+		Photo:          original.Photo,
+		ConversationId: targetConvId,
+		SenderId:       userId,
+		SendTime:       globaltime.Now(),
+	})
+}
+
+func (db *memdb) DeleteMessage(ctx context.Context, messageId int, userId uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, ok := db.messages[messageId]
+	if !ok || m.DeletedAt != nil || m.Event != "" {
+		return database.ErrMessageNotFound
+	}
+	if m.SenderId != userId {
+		return database.ErrNotMessageOwner
+	}
+
+	// The tombstone stays the last message of the conversation
+	deletedAt := stored(globaltime.Now())
+	m.Text = ""
+	m.Photo = ""
+	m.DeletedAt = &deletedAt
+	db.deleteComments(func(c comment) bool { return c.messageId == messageId })
+	return nil
+}
+
+// PurgeDeletedMessages deletes the tombstones of the messages deleted before the time, and returns how many. The
+// previews of their conversations show the previous messages instead.
+func (db *memdb) PurgeDeletedMessages(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var purged int64
+	for _, m := range db.messages {
+		if m.DeletedAt != nil && m.DeletedAt.Before(deletedBefore) {
+			db.deleteMessage(m)
+			purged++
+		}
+	}
+
+	db.resetLastMessages()
+	return purged, nil
+}
+
+// resetLastMessages sets the last message of the conversations whose last message was deleted to the previous one.
+func (db *memdb) resetLastMessages() {
+	for _, c := range db.conversations {
+		if c.lastMessageId == 0 {
+			for id, other := range db.messages {
+				if other.ConversationId == c.id && id > c.lastMessageId {
+					c.lastMessageId = id
+				}
+			}
+		}
+	}
+}
+
+func (db *memdb) CommentMessage(ctx context.Context, messageId int, userId uint64, emoji string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if m, ok := db.messages[messageId]; !ok || m.DeletedAt != nil || m.Event != "" {
+		return database.ErrMessageNotFound
+	}
+	if _, ok := db.users[userId]; !ok {
+		return errForeignKey("comments.UserId")
+	}
+	for _, c := range db.comments {
+		if c.messageId == messageId && c.userId == userId {
+			return errUnique("comments.MessageId, comments.UserId")
+		}
+	}
+
+	db.lastCommentId++
+	db.comments = append(db.comments, comment{id: db.lastCommentId, messageId: messageId, userId: userId, emoji: emoji})
+	return nil
+}
+
+func (db *memdb) UncommentMessage(ctx context.Context, messageId int, userId uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.deleteComments(func(c comment) bool { return c.messageId == messageId && c.userId == userId })
+	return nil
+}
+
+func (db *memdb) IsMessageOwner(ctx context.Context, messageId int, userId uint64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	m, ok := db.messages[messageId]
+	return ok && m.SenderId == userId, nil
+}
+
+// insertMessage adds the message to its conversation, and returns it with its ID.
+func (db *memdb) insertMessage(m database.Message) (database.Message, error) {
+	if _, ok := db.conversations[m.ConversationId]; !ok {
+		return m, errForeignKey("messages.ConversationId")
+	}
+
+	db.lastMessageId++
+	m.MessageId = db.lastMessageId
+	row := m
+	row.SendTime = stored(m.SendTime)
+	row.DeletedAt = nil
+	row.Event = ""
+	db.messages[m.MessageId] = &row
+	return m, nil
+}
+
+// deleteMessage deletes the message with its comments, and clears it from the conversation preview, like the foreign
+// keys of the SQL schema.
+func (db *memdb) deleteMessage(m *database.Message) {
+	db.deleteComments(func(c comment) bool { return c.messageId == m.MessageId })
+	for _, c := range db.conversations {
+		if c.lastMessageId == m.MessageId {
+			c.lastMessageId = 0
+		}
+	}
+	delete(db.messages, m.MessageId)
+}
+
+func (db *memdb) deleteComments(match func(comment) bool) {
+	comments := db.comments[:0]
+	for _, c := range db.comments {
+		if !match(c) {
+			comments = append(comments, c)
+		}
+	}
+	db.comments = comments
+}
+
+// sortedMessages returns the messages in the order of their IDs.
+func (db *memdb) sortedMessages() []*database.Message {
+	messages := make([]*database.Message, 0, len(db.messages))
+	for _, m := range db.messages {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].MessageId < messages[j].MessageId })
+	return messages
+}
@@ -0,0 +1,105 @@
+package memory
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// CreateOIDCLogin stores a login waiting for the user to come back from the identity provider.
+func (db *memdb) CreateOIDCLogin(ctx context.Context, stateHash string, login database.OIDCLogin) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.oidcLogins[stateHash]; ok {
+		return errUnique("oidc_logins.StateHash")
+	}
+	login.ExpiresAt = stored(login.ExpiresAt)
+	db.oidcLogins[stateHash] = login
+	return nil
+}
+
+// TakeOIDCLogin returns a pending login and removes it, so each state is accepted only once. Expired logins are
+// removed as well. ErrOIDCLoginNotFound is returned if the login does not exist or has expired.
+func (db *memdb) TakeOIDCLogin(ctx context.Context, stateHash string) (database.OIDCLogin, error) {
+	if err := ctx.Err(); err != nil {
+		return database.OIDCLogin{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	login, ok := db.oidcLogins[stateHash]
+	if !ok {
+		return database.OIDCLogin{}, database.ErrOIDCLoginNotFound
+	}
+
+	now := globaltime.Now()
+	for hash, other := range db.oidcLogins {
+		if hash == stateHash || other.ExpiresAt.Before(now) {
+			delete(db.oidcLogins, hash)
+		}
+	}
+
+	if !login.ExpiresAt.After(now) {
+		return database.OIDCLogin{}, database.ErrOIDCLoginNotFound
+	}
+	return login, nil
+}
+
+// GetOIDCUser returns the user linked to the identity. ErrUserDoesNotExist is returned if the identity has never
+// logged in.
+func (db *memdb) GetOIDCUser(ctx context.Context, issuer string, subject string) (database.User, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	userId, ok := db.identities[oidcIdentity{issuer: issuer, subject: subject}]
+	if !ok {
+		return database.User{}, database.ErrUserDoesNotExist
+	}
+	u := db.users[userId]
+	return database.User{Id: u.Id, Username: u.Username}, nil
+}
+
+// CreateOIDCUser creates a new user linked to the identity. ErrUsernameTaken is returned if the username is already
+// used.
+func (db *memdb) CreateOIDCUser(ctx context.Context, issuer string, subject string, username string) (database.User, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.userByUsername(username) != nil {
+		return database.User{}, database.ErrUsernameTaken
+	}
+	identity := oidcIdentity{issuer: issuer, subject: subject}
+	if _, ok := db.identities[identity]; ok {
+		return database.User{}, errUnique("oidc_identities.Issuer, oidc_identities.Subject")
+	}
+
+	userId := db.insertUser(username)
+	db.identities[identity] = userId
+	return database.User{Id: userId, Username: username}, nil
+}
+
+// IsOIDCUser tells whether the user has been created by an OpenID Connect login.
+func (db *memdb) IsOIDCUser(ctx context.Context, userId uint64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, id := range db.identities {
+		if id == userId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"time"
+)
+
+// SetConversationRetention sets the retention period of the conversation, and records the change with an event sent by
+// the user. ErrNotMember is returned if the user is not a participant.
+func (db *memdb) SetConversationRetention(ctx context.Context, convId int, userId uint64, retention time.Duration) (database.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return database.Message{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	c, ok := db.conversations[convId]
+	u, exists := db.users[userId]
+	if !ok || !c.participants[userId] || !exists {
+		return database.Message{}, database.ErrNotMember
+	}
+
+	// Like the column of the SQL schema, the period is stored in seconds
+	c.retention = 0
+	if retention > 0 {
+		c.retention = retention / time.Second * time.Second
+	}
+
+	event, err := db.insertMessage(database.Message{
+		ConversationId: convId,
+		SenderId:       userId,
+		Text:           database.RetentionEventText(u.Username, retention),
+		Status:         "Sent",
+		SendTime:       stored(globaltime.Now()),
+	})
+	if err != nil {
+		return database.Message{}, err
+	}
+	event.Event = database.EventRetention
+	db.messages[event.MessageId].Event = database.EventRetention
+	c.lastMessageId = event.MessageId
+	return event, nil
+}
+
+// PurgeExpiredMessages deletes the messages, but not the events, older than the retention period of their conversation
+// at the time now, and returns how many.
+func (db *memdb) PurgeExpiredMessages(ctx context.Context, now time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var purged int64
+	for _, m := range db.messages {
+		c := db.conversations[m.ConversationId]
+		if c.retention > 0 && m.Event == "" && m.SendTime.Before(now.Add(-c.retention)) {
+			db.deleteMessage(m)
+			purged++
+		}
+	}
+	db.resetLastMessages()
+	return purged, nil
+}
@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchMessages returns the messages, of the conversations the user is a participant of, whose text has all the
+// words of the query, the most recent first. The snippet of a result is its whole text.
+func (db *memdb) SearchMessages(ctx context.Context, userId uint64, search database.MessageSearch) (database.SearchResults, error) {
+	if err := ctx.Err(); err != nil {
+		return database.SearchResults{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	terms := database.SearchTerms(search.Query)
+	if len(terms) == 0 {
+		return database.SearchResults{}, nil
+	}
+	allowed := make(map[int]bool)
+	for _, id := range search.ConversationIds {
+		allowed[id] = true
+	}
+
+	var found []*database.Message
+	for _, m := range db.messages {
+		c, ok := db.conversations[m.ConversationId]
+		if !ok || !c.participants[userId] || m.Event != "" {
+			continue
+		}
+		if search.ConversationId != 0 && m.ConversationId != search.ConversationId {
+			continue
+		}
+		if len(allowed) > 0 && !allowed[m.ConversationId] {
+			continue
+		}
+		if search.Before != nil && !database.CursorOf(*m).Before(*search.Before) {
+			continue
+		}
+		if hasTerms(m.Text, terms) {
+			found = append(found, m)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return database.CursorOf(*found[j]).Before(database.CursorOf(*found[i]))
+	})
+
+	var results database.SearchResults
+	if search.Limit > 0 && len(found) > search.Limit {
+		found = found[:search.Limit]
+		next := database.CursorOf(*found[search.Limit-1])
+		results.NextCursor = &next
+	}
+	for _, m := range found {
+		results.Results = append(results.Results, database.SearchResult{
+			MessageId:      m.MessageId,
+			ConversationId: m.ConversationId,
+			SenderId:       m.SenderId,
+			SenderUsername: db.senderUsername(m),
+			SendTime:       m.SendTime,
+			Snippet:        highlight(m.Text, terms),
+		})
+	}
+	return results, nil
+}
+
+// hasTerms tells whether the text has all the terms among its words.
+func hasTerms(text string, terms []string) bool {
+	words := make(map[string]bool)
+	for _, w := range database.SearchTerms(text) {
+		words[w] = true
+	}
+	for _, t := range terms {
+		if !words[t] {
+			return false
+		}
+	}
+	return true
+}
+
+// highlight returns the text with its words among the terms between database.HighlightStart and
+// database.HighlightEnd.
+func highlight(text string, terms []string) string {
+	match := make(map[string]bool)
+	for _, t := range terms {
+		match[t] = true
+	}
+
+	var b strings.Builder
+	start := -1 // The start of the current word, if any
+	for i, r := range text + " " {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			word := text[start:i]
+			if match[strings.ToLower(word)] {
+				word = database.HighlightStart + word + database.HighlightEnd
+			}
+			b.WriteString(word)
+			start = -1
+		}
+		if i < len(text) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,246 @@
+package memory
+
+import (
+	"context"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"sort"
+	"strings"
+)
+
+func (db *memdb) CreateUser(ctx context.Context, u database.User) (database.User, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// An existing user logs in
+	if existing := db.userByUsername(u.Username); existing != nil {
+		return db.user(existing), nil
+	}
+
+	u.Id = db.insertUser(u.Username)
+	return u, nil
+}
+
+func (db *memdb) SetUsername(ctx context.Context, u database.User, username string) (database.User, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	current, ok := db.users[u.Id]
+	if !ok || current.Username != username {
+		return u, nil
+	}
+	if other := db.userByUsername(u.Username); other != nil && other.Id != u.Id {
+		return u, errUnique("users.Username")
+	}
+	current.Username = u.Username
+	return u, nil
+}
+
+func (db *memdb) GetUsernameById(ctx context.Context, userId uint64) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	u, ok := db.users[userId]
+	if !ok {
+		return "", errNoRows
+	}
+	return u.Username, nil
+}
+
+// GetUser returns the user with the given ID. ErrUserDoesNotExist is returned if there is no such user.
+func (db *memdb) GetUser(ctx context.Context, userId uint64) (database.User, error) {
+	if err := ctx.Err(); err != nil {
+		return database.User{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	u, ok := db.users[userId]
+	if !ok {
+		return database.User{}, database.ErrUserDoesNotExist
+	}
+	return db.user(u), nil
+}
+
+func (db *memdb) GetRecipientIdByUsername(ctx context.Context, username string) (uint64, error) {
+	return db.GetUserIdByUsername(ctx, username)
+}
+
+func (db *memdb) GetUserIdByUsername(ctx context.Context, username string) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	u := db.userByUsername(username)
+	if u == nil {
+		return 0, errNoRows
+	}
+	return u.Id, nil
+}
+
+func (db *memdb) SetUserPhoto(ctx context.Context, userId uint64, photoData string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if u, ok := db.users[userId]; ok {
+		u.ProfilePhoto = photoData
+	}
+	return nil
+}
+
+func (db *memdb) GetUserPhoto(ctx context.Context, userId uint64) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	u, ok := db.users[userId]
+	if !ok {
+		return "", database.ErrUserDoesNotExist
+	}
+	return u.ProfilePhoto, nil
+}
+
+// DeleteUser deletes the user with the bots it owns, and the conversations left without participants. Their messages
+// are kept, attributed to database.DeletedUserId. ErrUserDoesNotExist is returned if the user does not exist.
+func (db *memdb) DeleteUser(ctx context.Context, userId uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.users[userId]; !ok {
+		return database.ErrUserDoesNotExist
+	}
+	deleted := map[uint64]bool{userId: true}
+	for _, b := range db.bots {
+		if b.OwnerId == userId {
+			deleted[b.UserId] = true
+		}
+	}
+
+	for _, m := range db.messages {
+		if deleted[m.SenderId] {
+			m.SenderId = database.DeletedUserId
+		}
+		if deleted[m.RecipientId] {
+			m.RecipientId = database.DeletedUserId
+		}
+	}
+	for id := range deleted {
+		db.deleteUser(id)
+	}
+	return nil
+}
+
+// SearchUsers returns the users whose username contains the query, ignoring case, in the order of their usernames.
+// Like in the SQL implementation, % and _ in the query are matched literally.
+func (db *memdb) SearchUsers(ctx context.Context, query string) ([]database.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	query = strings.ToLower(query)
+	var users []database.User
+	for _, u := range db.users {
+		if strings.Contains(strings.ToLower(u.Username), query) {
+			users = append(users, database.User{Id: u.Id, Username: u.Username, IsBot: db.isBot(u.Id)})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// insertUser adds a user with the username, which must not be taken, and returns its ID.
+func (db *memdb) insertUser(username string) uint64 {
+	db.lastUserId++
+	db.users[db.lastUserId] = &database.User{Id: db.lastUserId, Username: username}
+	return db.lastUserId
+}
+
+// deleteUser deletes the user with the rows referencing it, like ON DELETE CASCADE, and the conversations it leaves
+// without participants.
+func (db *memdb) deleteUser(userId uint64) {
+	for _, c := range db.sortedConversations() {
+		if !c.participants[userId] {
+			continue
+		}
+		delete(c.participants, userId)
+		delete(c.lastRead, userId)
+		if len(c.participants) == 0 {
+			db.deleteConversation(c)
+		}
+	}
+	db.deleteComments(func(c comment) bool { return c.userId == userId })
+	for id, s := range db.sessions {
+		if s.UserId == userId {
+			delete(db.sessions, id)
+		}
+	}
+	delete(db.passphrases, userId)
+	delete(db.totp, userId)
+	delete(db.recoveryCodes, userId)
+	for hash, challenge := range db.challenges {
+		if challenge.UserId == userId {
+			delete(db.challenges, hash)
+		}
+	}
+	delete(db.bots, userId)
+	for id, k := range db.apiKeys {
+		if k.BotId == userId {
+			delete(db.apiKeys, id)
+			delete(db.apiKeyConvs, id)
+		}
+	}
+	for identity, id := range db.identities {
+		if id == userId {
+			delete(db.identities, identity)
+		}
+	}
+	delete(db.users, userId)
+}
+
+// senderUsername returns the username of the sender of the message, or database.DeletedUsername once it is deleted.
+func (db *memdb) senderUsername(m *database.Message) string {
+	if u, ok := db.users[m.SenderId]; ok {
+		return u.Username
+	}
+	return database.DeletedUsername
+}
+
+// userByUsername returns the user with the username, or nil.
+func (db *memdb) userByUsername(username string) *database.User {
+	for _, u := range db.users {
+		if u.Username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+// user returns the user as read by GetUser: without profile photo, and with IsBot.
+func (db *memdb) user(u *database.User) database.User {
+	return database.User{Id: u.Id, Username: u.Username, IsBot: db.isBot(u.Id)}
+}
+
+func (db *memdb) isBot(userId uint64) bool {
+	_, ok := db.bots[userId]
+	return ok
+}
@@ -1,45 +1,71 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"log"
 	"time"
 )
 
-func (db *appdbimpl) ForwardMessage(messageId int, userId uint64, targetConvId int) (Message, error) {
+// ForwardMessage sends a copy of the message to the target conversation, from the user. ErrMessageNotFound is returned
+// if the message does not exist, is deleted or is an event.
+func (db *appdbimpl) ForwardMessage(ctx context.Context, messageId int, userId uint64, targetConvId int) (Message, error) {
 	// Get original message
 	var msg Message
-	err := db.c.QueryRow(`
+	err := db.c.QueryRowContext(ctx, `
         SELECT Text, Status, SenderId, Photo 
         FROM messages 
-        WHERE MessageId = ?`, messageId).Scan(&msg.Text, &msg.Status, &msg.SenderId, &msg.Photo)
-	if err != nil {
+        WHERE MessageId = ? AND DeletedAt IS NULL AND Event IS NULL`, messageId).Scan(&msg.Text, &msg.Status, &msg.SenderId, &msg.Photo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrMessageNotFound
+	} else if err != nil {
 		return Message{}, err
 	}
 
 	// Create new message
 	msg.ConversationId = targetConvId
 	msg.SenderId = userId
-	msg.SendTime = time.Now()
+	msg.SendTime = globaltime.Now()
 
-	return db.CreateMessage(msg)
+	return db.CreateMessage(ctx, msg)
 }
 
-func (db *appdbimpl) DeleteMessage(messageId int, userId uint64) error {
+// DeleteMessage deletes the message for everyone: it is kept as a tombstone, without its text, photo and comments,
+// until PurgeDeletedMessages. ErrMessageNotFound is returned if the message does not exist, is already deleted or is an
+// event, and ErrNotMessageOwner if it was sent by another user.
+func (db *appdbimpl) DeleteMessage(ctx context.Context, messageId int, userId uint64) error {
 	// Start transaction
-	tx, err := db.c.Begin()
+	tx, err := db.c.BeginTx(ctx)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
 
-	// Delete comments first
-	_, err = tx.Exec("DELETE FROM comments WHERE MessageId = ?", messageId)
-	if err != nil {
+	var senderId uint64
+	err = tx.QueryRowContext(ctx, "SELECT SenderId FROM messages WHERE MessageId = ? AND DeletedAt IS NULL AND Event IS NULL",
+		messageId).Scan(&senderId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrMessageNotFound
+	} else if err != nil {
 		return err
 	}
+	if senderId != userId {
+		return ErrNotMessageOwner
+	}
 
-	// Delete message
-	_, err = tx.Exec("DELETE FROM messages WHERE MessageId = ? AND SenderId = ?",
-		messageId, userId)
+	// The tombstone stays the last message of the conversation, so the preview shows that it was deleted
+	_, err = tx.ExecContext(ctx, "UPDATE messages SET Text = '', Photo = NULL, DeletedAt = ? WHERE MessageId = ?",
+		globaltime.Now().UTC(), messageId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM comments WHERE MessageId = ?", messageId)
 	if err != nil {
 		return err
 	}
@@ -47,23 +73,73 @@ func (db *appdbimpl) DeleteMessage(messageId int, userId uint64) error {
 	return tx.Commit()
 }
 
-func (db *appdbimpl) CommentMessage(messageId int, userId uint64, emoji string) error {
-	_, err := db.c.Exec(`
+// PurgeDeletedMessages deletes the tombstones of the messages deleted before the time, and returns how many. The
+// previews of their conversations show the previous messages instead.
+func (db *appdbimpl) PurgeDeletedMessages(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE DeletedAt IS NOT NULL AND DeletedAt < ?",
+		deletedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	if err != nil || purged == 0 {
+		return 0, err
+	}
+
+	if err := resetLastMessages(ctx, tx); err != nil {
+		return 0, err
+	}
+	return purged, tx.Commit()
+}
+
+// resetLastMessages sets the last message of the conversations whose last message was deleted, and cleared by the
+// foreign key, to the previous one.
+func resetLastMessages(ctx context.Context, tx *dbtx) error {
+	_, err := tx.ExecContext(ctx, `
+        UPDATE conversations
+        SET LastMessageId = (SELECT MAX(m.MessageId) FROM messages m WHERE m.ConversationId = conversations.ConversationId)
+        WHERE LastMessageId IS NULL`)
+	return err
+}
+
+// CommentMessage adds the reaction of the user to the message. An error of kind ErrNotFound is returned if the message
+// does not exist, is deleted or is an event, and of kind ErrAlreadyExists if the user has already reacted to it.
+func (db *appdbimpl) CommentMessage(ctx context.Context, messageId int, userId uint64, emoji string) error {
+	var unavailable bool
+	err := db.c.QueryRowContext(ctx, "SELECT DeletedAt IS NOT NULL OR Event IS NOT NULL FROM messages WHERE MessageId = ?",
+		messageId).Scan(&unavailable)
+	if errors.Is(err, sql.ErrNoRows) || unavailable {
+		return ErrMessageNotFound
+	} else if err != nil {
+		return err
+	}
+
+	_, err = db.c.ExecContext(ctx, `
         INSERT INTO comments (MessageId, UserId, Emoji) 
         VALUES (?, ?, ?)`, messageId, userId, emoji)
 	return err
 }
 
-func (db *appdbimpl) UncommentMessage(messageId int, userId uint64) error {
-	_, err := db.c.Exec(`
+func (db *appdbimpl) UncommentMessage(ctx context.Context, messageId int, userId uint64) error {
+	_, err := db.c.ExecContext(ctx, `
         DELETE FROM comments 
         WHERE MessageId = ? AND UserId = ?`, messageId, userId)
 	return err
 }
 
-func (db *appdbimpl) IsMessageOwner(messageId int, userId uint64) (bool, error) {
+func (db *appdbimpl) IsMessageOwner(ctx context.Context, messageId int, userId uint64) (bool, error) {
 	var exists bool
-	err := db.c.QueryRow(`
+	err := db.c.QueryRowContext(ctx, `
         SELECT EXISTS(
             SELECT 1 FROM messages 
             WHERE MessageId = ? AND SenderId = ?
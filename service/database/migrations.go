@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles are the migrations of the schema, one directory per database, named "<version>_<name>.sql". Versions
+// must start at 1 and have no gaps. Applied migrations must never be changed: to change the schema, add a new
+// migration (to every database).
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// Migration is a change of the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrations returns all the migrations of the dialect embedded in the executable, in order.
+func migrations(d dialect) ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, path.Join("migrations", d.migrationsDir(), "*.sql"))
+	if err != nil {
+		return nil, fmt.Errorf("listing migrations: %w", err)
+	}
+
+	var migrations []Migration
+	for _, file := range files {
+		base := strings.TrimSuffix(path.Base(file), ".sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s: name must be <version>_<name>.sql", file)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %w", file, err)
+		}
+		data, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %s: %w", file, err)
+		}
+		migrations = append(migrations, Migration{Version: version, Name: parts[1], SQL: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d_%s: expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// PendingMigrations returns the migrations that have not been applied to the database yet, in order. The database is
+// not changed.
+func PendingMigrations(db *sql.DB) ([]Migration, error) {
+	d, err := dialectOf(db)
+	if err != nil {
+		return nil, err
+	}
+	return pendingMigrations(context.Background(), dbconn{DB: db, dialect: d})
+}
+
+// Migrate applies the pending migrations to the database, in order. Each migration is applied in its own transaction,
+// so a failed migration leaves the database at the previous version.
+func Migrate(db *sql.DB) error {
+	d, err := dialectOf(db)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(d.schemaMigrationsTable()); err != nil {
+		return fmt.Errorf("creating the migrations table: %w", err)
+	}
+
+	pending, err := pendingMigrations(context.Background(), dbconn{DB: db, dialect: d})
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		log.Printf("Applying migration %04d_%s...\n", m.Version, m.Name)
+		if err := applyMigration(db, d, m); err != nil {
+			return fmt.Errorf("applying migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// pendingMigrations returns the migrations that have not been applied to the database yet, in order.
+func pendingMigrations(ctx context.Context, c dbconn) ([]Migration, error) {
+	migrations, err := migrations(c.dialect)
+	if err != nil {
+		return nil, err
+	}
+	current, err := schemaVersion(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if current > len(migrations) {
+		return nil, fmt.Errorf("database schema version %d is newer than this executable (%d)", current, len(migrations))
+	}
+	return migrations[current:], nil
+}
+
+// applyMigration runs the migration and records it, in a single transaction on a dedicated connection, which the
+// dialect can prepare (see dialect.beginMigration).
+func applyMigration(db *sql.DB, d dialect, m Migration) (err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	restore, err := d.beginMigration(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	// Another instance may have applied it in the meantime
+	var applied bool
+	err = conn.QueryRowContext(ctx, d.rebind(`SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE Version = ?)`),
+		m.Version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				log.Printf("Transaction rollback failed: %v\n", rbErr)
+			}
+		}
+	}()
+
+	if _, err = tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if err = d.endMigration(tx, m); err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.rebind(`INSERT INTO schema_migrations (Version, Name, AppliedAt) VALUES (?, ?, ?)`),
+		m.Version, m.Name, globaltime.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// schemaVersion returns the version of the last migration applied to the database, or zero if none has been applied.
+func schemaVersion(ctx context.Context, c dbconn) (int, error) {
+	exists, err := c.dialect.tableExists(ctx, c.DB, "schema_migrations")
+	if err != nil {
+		return 0, fmt.Errorf("checking the migrations table: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version int
+	err = c.QueryRowContext(ctx, `SELECT COALESCE(MAX(Version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("reading the schema version: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,132 @@
+-- Same schema as the SQLite databases after their foreign keys migration. IDs are identity columns, and times are
+-- stored with their time zone.
+
+CREATE TABLE users (
+    Id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    Username TEXT NOT NULL UNIQUE,
+    ProfilePhoto TEXT
+);
+
+CREATE TABLE conversations (
+    ConversationId BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    GroupId INTEGER NOT NULL,
+    LastMessageId BIGINT,
+    Name TEXT,
+    GroupPhoto TEXT
+);
+
+CREATE TABLE messages (
+    MessageId BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    ConversationId BIGINT NOT NULL REFERENCES conversations(ConversationId) ON DELETE CASCADE,
+    Text TEXT NOT NULL,
+    SendTime TIMESTAMPTZ NOT NULL,
+    Status TEXT NOT NULL,
+    SenderId BIGINT NOT NULL,
+    RecipientId BIGINT NOT NULL,
+    Photo TEXT
+);
+CREATE INDEX messages_conversation ON messages (ConversationId);
+
+-- Conversations and messages reference each other
+ALTER TABLE conversations ADD FOREIGN KEY (LastMessageId) REFERENCES messages(MessageId) ON DELETE SET NULL;
+CREATE INDEX conversations_last_message ON conversations (LastMessageId);
+
+CREATE TABLE participants (
+    ConversationId BIGINT NOT NULL REFERENCES conversations(ConversationId) ON DELETE CASCADE,
+    UserId BIGINT NOT NULL REFERENCES users(Id) ON DELETE CASCADE,
+    PRIMARY KEY (ConversationId, UserId)
+);
+CREATE INDEX participants_user ON participants (UserId);
+
+CREATE TABLE comments (
+    CommentId BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    MessageId BIGINT NOT NULL REFERENCES messages(MessageId) ON DELETE CASCADE,
+    UserId BIGINT NOT NULL REFERENCES users(Id) ON DELETE CASCADE,
+    Emoji TEXT NOT NULL,
+    UNIQUE (MessageId, UserId)
+);
+CREATE INDEX comments_user ON comments (UserId);
+
+CREATE TABLE sessions (
+    SessionId BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    TokenHash TEXT NOT NULL UNIQUE,
+    UserId BIGINT NOT NULL REFERENCES users(Id) ON DELETE CASCADE,
+    UserAgent TEXT NOT NULL DEFAULT '',
+    CreatedAt TIMESTAMPTZ NOT NULL,
+    LastUsedAt TIMESTAMPTZ NOT NULL,
+    ExpiresAt TIMESTAMPTZ NOT NULL,
+    RevokedAt TIMESTAMPTZ
+);
+CREATE INDEX sessions_user ON sessions (UserId);
+
+CREATE TABLE passphrases (
+    UserId BIGINT NOT NULL PRIMARY KEY REFERENCES users(Id) ON DELETE CASCADE,
+    Hash TEXT NOT NULL,
+    UpdatedAt TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE totp (
+    UserId BIGINT NOT NULL PRIMARY KEY REFERENCES users(Id) ON DELETE CASCADE,
+    Secret TEXT NOT NULL,
+    Confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+    LastUsedStep BIGINT NOT NULL DEFAULT 0,
+    CreatedAt TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE recovery_codes (
+    UserId BIGINT NOT NULL REFERENCES users(Id) ON DELETE CASCADE,
+    CodeHash TEXT NOT NULL,
+    UsedAt TIMESTAMPTZ,
+    PRIMARY KEY (UserId, CodeHash)
+);
+
+CREATE TABLE login_challenges (
+    ChallengeHash TEXT NOT NULL PRIMARY KEY,
+    UserId BIGINT NOT NULL REFERENCES users(Id) ON DELETE CASCADE,
+    UserAgent TEXT NOT NULL DEFAULT '',
+    ExpiresAt TIMESTAMPTZ NOT NULL,
+    Attempts INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX login_challenges_user ON login_challenges (UserId);
+
+CREATE TABLE bots (
+    UserId BIGINT NOT NULL PRIMARY KEY REFERENCES users(Id) ON DELETE CASCADE,
+    OwnerId BIGINT NOT NULL REFERENCES users(Id) ON DELETE CASCADE,
+    CreatedAt TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX bots_owner ON bots (OwnerId);
+
+CREATE TABLE api_keys (
+    KeyId BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    BotId BIGINT NOT NULL REFERENCES bots(UserId) ON DELETE CASCADE,
+    KeyHash TEXT NOT NULL UNIQUE,
+    Name TEXT NOT NULL DEFAULT '',
+    Prefix TEXT NOT NULL,
+    Scopes TEXT NOT NULL,
+    CreatedAt TIMESTAMPTZ NOT NULL,
+    LastUsedAt TIMESTAMPTZ,
+    RevokedAt TIMESTAMPTZ
+);
+CREATE INDEX api_keys_bot ON api_keys (BotId);
+
+CREATE TABLE api_key_conversations (
+    KeyId BIGINT NOT NULL REFERENCES api_keys(KeyId) ON DELETE CASCADE,
+    ConversationId BIGINT NOT NULL REFERENCES conversations(ConversationId) ON DELETE CASCADE,
+    PRIMARY KEY (KeyId, ConversationId)
+);
+CREATE INDEX api_key_conversations_conversation ON api_key_conversations (ConversationId);
+
+CREATE TABLE oidc_identities (
+    Issuer TEXT NOT NULL,
+    Subject TEXT NOT NULL,
+    UserId BIGINT NOT NULL UNIQUE REFERENCES users(Id) ON DELETE CASCADE,
+    CreatedAt TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (Issuer, Subject)
+);
+
+CREATE TABLE oidc_logins (
+    StateHash TEXT NOT NULL PRIMARY KEY,
+    Nonce TEXT NOT NULL,
+    CodeVerifier TEXT NOT NULL,
+    ExpiresAt TIMESTAMPTZ NOT NULL
+);
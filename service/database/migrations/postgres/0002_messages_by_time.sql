@@ -0,0 +1,4 @@
+-- Messages of a conversation are read newest first: index them in that order, so opening a conversation doesn't sort
+-- all its messages. The new index also serves the lookups by conversation of the previous one.
+CREATE INDEX messages_conversation_time ON messages (ConversationId, SendTime, MessageId);
+DROP INDEX messages_conversation;
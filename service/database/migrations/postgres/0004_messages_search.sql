@@ -0,0 +1,3 @@
+-- Full-text index of the text of the messages, for SearchMessages. The expression must be the same as in the queries
+-- for the index to be used.
+CREATE INDEX messages_text_search ON messages USING GIN (to_tsvector('simple', Text));
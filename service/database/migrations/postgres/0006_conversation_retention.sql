@@ -0,0 +1,5 @@
+-- Conversations can have a retention period, in seconds: their messages older than it are purged. NULL keeps them
+-- forever. Event is the kind of the messages added by WASAText when the settings of a conversation change, NULL for
+-- the messages of the participants.
+ALTER TABLE conversations ADD COLUMN RetentionSeconds BIGINT;
+ALTER TABLE messages ADD COLUMN Event TEXT;
@@ -0,0 +1,137 @@
+-- Schema of the databases created before migrations were introduced. Tables are created only if missing, so that
+-- those databases can adopt the migrations as they are.
+
+CREATE TABLE IF NOT EXISTS users (
+    Id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    Username TEXT NOT NULL UNIQUE,
+    ProfilePhoto TEXT
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    MessageId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    ConversationId INTEGER NOT NULL,
+    Text TEXT NOT NULL,
+    SendTime DATETIME NOT NULL,
+    Status TEXT NOT NULL,
+    SenderId INTEGER NOT NULL,
+    RecipientId INTEGER NOT NULL,
+    Photo TEXT,
+    FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId)
+);
+
+CREATE TABLE IF NOT EXISTS conversations (
+    ConversationId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    GroupId INTEGER NOT NULL,
+    LastMessageId INTEGER,
+    Name TEXT,
+    GroupPhoto TEXT,
+    FOREIGN KEY (LastMessageId) REFERENCES messages(MessageId)
+);
+
+CREATE TABLE IF NOT EXISTS participants (
+    ConversationId INTEGER NOT NULL,
+    UserId INTEGER NOT NULL,
+    PRIMARY KEY (ConversationId, UserId),
+    FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId),
+    FOREIGN KEY (UserId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS comments (
+    CommentId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    MessageId INTEGER NOT NULL,
+    UserId INTEGER NOT NULL,
+    Emoji TEXT NOT NULL,
+    FOREIGN KEY (MessageId) REFERENCES messages(MessageId),
+    FOREIGN KEY (UserId) REFERENCES users(Id),
+    UNIQUE(MessageId, UserId)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    SessionId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    TokenHash TEXT NOT NULL UNIQUE,
+    UserId INTEGER NOT NULL,
+    UserAgent TEXT NOT NULL DEFAULT '',
+    CreatedAt DATETIME NOT NULL,
+    LastUsedAt DATETIME NOT NULL,
+    ExpiresAt DATETIME NOT NULL,
+    RevokedAt DATETIME,
+    FOREIGN KEY (UserId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS passphrases (
+    UserId INTEGER NOT NULL PRIMARY KEY,
+    Hash TEXT NOT NULL,
+    UpdatedAt DATETIME NOT NULL,
+    FOREIGN KEY (UserId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS totp (
+    UserId INTEGER NOT NULL PRIMARY KEY,
+    Secret TEXT NOT NULL,
+    Confirmed BOOLEAN NOT NULL DEFAULT 0,
+    LastUsedStep INTEGER NOT NULL DEFAULT 0,
+    CreatedAt DATETIME NOT NULL,
+    FOREIGN KEY (UserId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    UserId INTEGER NOT NULL,
+    CodeHash TEXT NOT NULL,
+    UsedAt DATETIME,
+    PRIMARY KEY (UserId, CodeHash),
+    FOREIGN KEY (UserId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS login_challenges (
+    ChallengeHash TEXT NOT NULL PRIMARY KEY,
+    UserId INTEGER NOT NULL,
+    UserAgent TEXT NOT NULL DEFAULT '',
+    ExpiresAt DATETIME NOT NULL,
+    Attempts INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (UserId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS bots (
+    UserId INTEGER NOT NULL PRIMARY KEY,
+    OwnerId INTEGER NOT NULL,
+    CreatedAt DATETIME NOT NULL,
+    FOREIGN KEY (UserId) REFERENCES users(Id),
+    FOREIGN KEY (OwnerId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    KeyId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    BotId INTEGER NOT NULL,
+    KeyHash TEXT NOT NULL UNIQUE,
+    Name TEXT NOT NULL DEFAULT '',
+    Prefix TEXT NOT NULL,
+    Scopes TEXT NOT NULL,
+    CreatedAt DATETIME NOT NULL,
+    LastUsedAt DATETIME,
+    RevokedAt DATETIME,
+    FOREIGN KEY (BotId) REFERENCES bots(UserId)
+);
+
+CREATE TABLE IF NOT EXISTS api_key_conversations (
+    KeyId INTEGER NOT NULL,
+    ConversationId INTEGER NOT NULL,
+    PRIMARY KEY (KeyId, ConversationId),
+    FOREIGN KEY (KeyId) REFERENCES api_keys(KeyId),
+    FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_identities (
+    Issuer TEXT NOT NULL,
+    Subject TEXT NOT NULL,
+    UserId INTEGER NOT NULL UNIQUE,
+    CreatedAt DATETIME NOT NULL,
+    PRIMARY KEY (Issuer, Subject),
+    FOREIGN KEY (UserId) REFERENCES users(Id)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    StateHash TEXT NOT NULL PRIMARY KEY,
+    Nonce TEXT NOT NULL,
+    CodeVerifier TEXT NOT NULL,
+    ExpiresAt DATETIME NOT NULL
+);
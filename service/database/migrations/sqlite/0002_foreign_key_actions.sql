@@ -0,0 +1,228 @@
+-- Foreign keys were declared but never enforced, so deleted rows left dangling references behind. This migration
+-- removes the orphaned rows, then rebuilds the tables with ON DELETE rules (SQLite can't alter constraints in place).
+
+-- Repair the orphaned rows first, parents before children
+DELETE FROM participants
+WHERE UserId NOT IN (SELECT Id FROM users)
+   OR ConversationId NOT IN (SELECT ConversationId FROM conversations);
+
+-- Groups left by all their members
+DELETE FROM conversations
+WHERE GroupId = 1 AND ConversationId NOT IN (SELECT ConversationId FROM participants);
+
+DELETE FROM messages WHERE ConversationId NOT IN (SELECT ConversationId FROM conversations);
+
+DELETE FROM comments
+WHERE MessageId NOT IN (SELECT MessageId FROM messages)
+   OR UserId NOT IN (SELECT Id FROM users);
+
+-- Conversations without messages used 0 instead of NULL
+UPDATE conversations SET LastMessageId = NULL
+WHERE LastMessageId IS NOT NULL AND LastMessageId NOT IN (SELECT MessageId FROM messages);
+
+DELETE FROM sessions WHERE UserId NOT IN (SELECT Id FROM users);
+DELETE FROM passphrases WHERE UserId NOT IN (SELECT Id FROM users);
+DELETE FROM totp WHERE UserId NOT IN (SELECT Id FROM users);
+DELETE FROM recovery_codes WHERE UserId NOT IN (SELECT Id FROM users);
+DELETE FROM login_challenges WHERE UserId NOT IN (SELECT Id FROM users);
+DELETE FROM oidc_identities WHERE UserId NOT IN (SELECT Id FROM users);
+
+DELETE FROM bots
+WHERE UserId NOT IN (SELECT Id FROM users)
+   OR OwnerId NOT IN (SELECT Id FROM users);
+
+DELETE FROM api_keys WHERE BotId NOT IN (SELECT UserId FROM bots);
+
+DELETE FROM api_key_conversations
+WHERE KeyId NOT IN (SELECT KeyId FROM api_keys)
+   OR ConversationId NOT IN (SELECT ConversationId FROM conversations);
+
+-- Rebuild the tables. Rows are copied by column name, as older databases may have columns in a different order, and
+-- AUTOINCREMENT counters are carried over so that IDs of deleted rows are never reused.
+
+CREATE TABLE messages_new (
+    MessageId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    ConversationId INTEGER NOT NULL,
+    Text TEXT NOT NULL,
+    SendTime DATETIME NOT NULL,
+    Status TEXT NOT NULL,
+    SenderId INTEGER NOT NULL,
+    RecipientId INTEGER NOT NULL,
+    Photo TEXT,
+    FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId) ON DELETE CASCADE
+);
+INSERT INTO messages_new (MessageId, ConversationId, Text, SendTime, Status, SenderId, RecipientId, Photo)
+SELECT MessageId, ConversationId, Text, SendTime, Status, SenderId, RecipientId, Photo FROM messages;
+DELETE FROM sqlite_sequence WHERE name = 'messages_new';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'messages_new', seq FROM sqlite_sequence WHERE name = 'messages';
+DROP TABLE messages;
+ALTER TABLE messages_new RENAME TO messages;
+CREATE INDEX messages_conversation ON messages (ConversationId);
+
+CREATE TABLE conversations_new (
+    ConversationId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    GroupId INTEGER NOT NULL,
+    LastMessageId INTEGER,
+    Name TEXT,
+    GroupPhoto TEXT,
+    FOREIGN KEY (LastMessageId) REFERENCES messages(MessageId) ON DELETE SET NULL
+);
+INSERT INTO conversations_new (ConversationId, GroupId, LastMessageId, Name, GroupPhoto)
+SELECT ConversationId, GroupId, LastMessageId, Name, GroupPhoto FROM conversations;
+DELETE FROM sqlite_sequence WHERE name = 'conversations_new';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'conversations_new', seq FROM sqlite_sequence WHERE name = 'conversations';
+DROP TABLE conversations;
+ALTER TABLE conversations_new RENAME TO conversations;
+CREATE INDEX conversations_last_message ON conversations (LastMessageId);
+
+CREATE TABLE participants_new (
+    ConversationId INTEGER NOT NULL,
+    UserId INTEGER NOT NULL,
+    PRIMARY KEY (ConversationId, UserId),
+    FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId) ON DELETE CASCADE,
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO participants_new (ConversationId, UserId) SELECT ConversationId, UserId FROM participants;
+DROP TABLE participants;
+ALTER TABLE participants_new RENAME TO participants;
+CREATE INDEX participants_user ON participants (UserId);
+
+CREATE TABLE comments_new (
+    CommentId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    MessageId INTEGER NOT NULL,
+    UserId INTEGER NOT NULL,
+    Emoji TEXT NOT NULL,
+    FOREIGN KEY (MessageId) REFERENCES messages(MessageId) ON DELETE CASCADE,
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE,
+    UNIQUE(MessageId, UserId)
+);
+INSERT INTO comments_new (CommentId, MessageId, UserId, Emoji) SELECT CommentId, MessageId, UserId, Emoji FROM comments;
+DELETE FROM sqlite_sequence WHERE name = 'comments_new';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'comments_new', seq FROM sqlite_sequence WHERE name = 'comments';
+DROP TABLE comments;
+ALTER TABLE comments_new RENAME TO comments;
+CREATE INDEX comments_user ON comments (UserId);
+
+CREATE TABLE sessions_new (
+    SessionId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    TokenHash TEXT NOT NULL UNIQUE,
+    UserId INTEGER NOT NULL,
+    UserAgent TEXT NOT NULL DEFAULT '',
+    CreatedAt DATETIME NOT NULL,
+    LastUsedAt DATETIME NOT NULL,
+    ExpiresAt DATETIME NOT NULL,
+    RevokedAt DATETIME,
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO sessions_new (SessionId, TokenHash, UserId, UserAgent, CreatedAt, LastUsedAt, ExpiresAt, RevokedAt)
+SELECT SessionId, TokenHash, UserId, UserAgent, CreatedAt, LastUsedAt, ExpiresAt, RevokedAt FROM sessions;
+DELETE FROM sqlite_sequence WHERE name = 'sessions_new';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'sessions_new', seq FROM sqlite_sequence WHERE name = 'sessions';
+DROP TABLE sessions;
+ALTER TABLE sessions_new RENAME TO sessions;
+CREATE INDEX sessions_user ON sessions (UserId);
+
+CREATE TABLE passphrases_new (
+    UserId INTEGER NOT NULL PRIMARY KEY,
+    Hash TEXT NOT NULL,
+    UpdatedAt DATETIME NOT NULL,
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO passphrases_new (UserId, Hash, UpdatedAt) SELECT UserId, Hash, UpdatedAt FROM passphrases;
+DROP TABLE passphrases;
+ALTER TABLE passphrases_new RENAME TO passphrases;
+
+CREATE TABLE totp_new (
+    UserId INTEGER NOT NULL PRIMARY KEY,
+    Secret TEXT NOT NULL,
+    Confirmed BOOLEAN NOT NULL DEFAULT 0,
+    LastUsedStep INTEGER NOT NULL DEFAULT 0,
+    CreatedAt DATETIME NOT NULL,
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO totp_new (UserId, Secret, Confirmed, LastUsedStep, CreatedAt)
+SELECT UserId, Secret, Confirmed, LastUsedStep, CreatedAt FROM totp;
+DROP TABLE totp;
+ALTER TABLE totp_new RENAME TO totp;
+
+CREATE TABLE recovery_codes_new (
+    UserId INTEGER NOT NULL,
+    CodeHash TEXT NOT NULL,
+    UsedAt DATETIME,
+    PRIMARY KEY (UserId, CodeHash),
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO recovery_codes_new (UserId, CodeHash, UsedAt) SELECT UserId, CodeHash, UsedAt FROM recovery_codes;
+DROP TABLE recovery_codes;
+ALTER TABLE recovery_codes_new RENAME TO recovery_codes;
+
+CREATE TABLE login_challenges_new (
+    ChallengeHash TEXT NOT NULL PRIMARY KEY,
+    UserId INTEGER NOT NULL,
+    UserAgent TEXT NOT NULL DEFAULT '',
+    ExpiresAt DATETIME NOT NULL,
+    Attempts INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO login_challenges_new (ChallengeHash, UserId, UserAgent, ExpiresAt, Attempts)
+SELECT ChallengeHash, UserId, UserAgent, ExpiresAt, Attempts FROM login_challenges;
+DROP TABLE login_challenges;
+ALTER TABLE login_challenges_new RENAME TO login_challenges;
+CREATE INDEX login_challenges_user ON login_challenges (UserId);
+
+CREATE TABLE bots_new (
+    UserId INTEGER NOT NULL PRIMARY KEY,
+    OwnerId INTEGER NOT NULL,
+    CreatedAt DATETIME NOT NULL,
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE,
+    FOREIGN KEY (OwnerId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO bots_new (UserId, OwnerId, CreatedAt) SELECT UserId, OwnerId, CreatedAt FROM bots;
+DROP TABLE bots;
+ALTER TABLE bots_new RENAME TO bots;
+CREATE INDEX bots_owner ON bots (OwnerId);
+
+CREATE TABLE api_keys_new (
+    KeyId INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    BotId INTEGER NOT NULL,
+    KeyHash TEXT NOT NULL UNIQUE,
+    Name TEXT NOT NULL DEFAULT '',
+    Prefix TEXT NOT NULL,
+    Scopes TEXT NOT NULL,
+    CreatedAt DATETIME NOT NULL,
+    LastUsedAt DATETIME,
+    RevokedAt DATETIME,
+    FOREIGN KEY (BotId) REFERENCES bots(UserId) ON DELETE CASCADE
+);
+INSERT INTO api_keys_new (KeyId, BotId, KeyHash, Name, Prefix, Scopes, CreatedAt, LastUsedAt, RevokedAt)
+SELECT KeyId, BotId, KeyHash, Name, Prefix, Scopes, CreatedAt, LastUsedAt, RevokedAt FROM api_keys;
+DELETE FROM sqlite_sequence WHERE name = 'api_keys_new';
+INSERT INTO sqlite_sequence (name, seq) SELECT 'api_keys_new', seq FROM sqlite_sequence WHERE name = 'api_keys';
+DROP TABLE api_keys;
+ALTER TABLE api_keys_new RENAME TO api_keys;
+CREATE INDEX api_keys_bot ON api_keys (BotId);
+
+CREATE TABLE api_key_conversations_new (
+    KeyId INTEGER NOT NULL,
+    ConversationId INTEGER NOT NULL,
+    PRIMARY KEY (KeyId, ConversationId),
+    FOREIGN KEY (KeyId) REFERENCES api_keys(KeyId) ON DELETE CASCADE,
+    FOREIGN KEY (ConversationId) REFERENCES conversations(ConversationId) ON DELETE CASCADE
+);
+INSERT INTO api_key_conversations_new (KeyId, ConversationId) SELECT KeyId, ConversationId FROM api_key_conversations;
+DROP TABLE api_key_conversations;
+ALTER TABLE api_key_conversations_new RENAME TO api_key_conversations;
+CREATE INDEX api_key_conversations_conversation ON api_key_conversations (ConversationId);
+
+CREATE TABLE oidc_identities_new (
+    Issuer TEXT NOT NULL,
+    Subject TEXT NOT NULL,
+    UserId INTEGER NOT NULL UNIQUE,
+    CreatedAt DATETIME NOT NULL,
+    PRIMARY KEY (Issuer, Subject),
+    FOREIGN KEY (UserId) REFERENCES users(Id) ON DELETE CASCADE
+);
+INSERT INTO oidc_identities_new (Issuer, Subject, UserId, CreatedAt)
+SELECT Issuer, Subject, UserId, CreatedAt FROM oidc_identities;
+DROP TABLE oidc_identities;
+ALTER TABLE oidc_identities_new RENAME TO oidc_identities;
@@ -0,0 +1,5 @@
+-- Messages are paged through by comparing their send times, which SQLite does as text: store the times sent with
+-- another offset in UTC, like the new ones. SQLite keeps milliseconds only, enough to order the messages.
+UPDATE messages
+SET SendTime = strftime('%Y-%m-%d %H:%M:%f+00:00', SendTime)
+WHERE SendTime NOT LIKE '%+00:00';
@@ -0,0 +1,6 @@
+-- The last message each participant has read, to count the unread messages of a conversation. It is not a foreign
+-- key, as the message may be deleted afterwards. The messages sent before the column existed count as read.
+ALTER TABLE participants ADD COLUMN LastReadMessageId INTEGER NOT NULL DEFAULT 0;
+UPDATE participants
+SET LastReadMessageId = COALESCE((
+    SELECT MAX(m.MessageId) FROM messages m WHERE m.ConversationId = participants.ConversationId), 0);
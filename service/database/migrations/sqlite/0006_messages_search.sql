@@ -0,0 +1,18 @@
+-- Full-text index of the text of the messages, for SearchMessages. It is an external content table: it reads the text
+-- from messages, and the triggers below keep it in sync. Migrations rebuilding the messages table must create the
+-- triggers again.
+CREATE VIRTUAL TABLE messages_fts USING fts5(Text, content='messages', content_rowid='MessageId');
+INSERT INTO messages_fts(messages_fts) VALUES ('rebuild');
+
+CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+    INSERT INTO messages_fts(rowid, Text) VALUES (new.MessageId, new.Text);
+END;
+
+CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+    INSERT INTO messages_fts(messages_fts, rowid, Text) VALUES ('delete', old.MessageId, old.Text);
+END;
+
+CREATE TRIGGER messages_fts_update AFTER UPDATE OF Text ON messages BEGIN
+    INSERT INTO messages_fts(messages_fts, rowid, Text) VALUES ('delete', old.MessageId, old.Text);
+    INSERT INTO messages_fts(rowid, Text) VALUES (new.MessageId, new.Text);
+END;
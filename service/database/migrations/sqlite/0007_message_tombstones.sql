@@ -0,0 +1,4 @@
+-- Deleted messages are kept as tombstones, without their text and photo, so the other participants see that they were
+-- deleted. DeletedAt is when the message was deleted: tombstones are purged some time after it.
+ALTER TABLE messages ADD COLUMN DeletedAt DATETIME;
+CREATE INDEX messages_deleted ON messages (DeletedAt) WHERE DeletedAt IS NOT NULL;
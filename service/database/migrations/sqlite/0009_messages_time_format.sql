@@ -0,0 +1,12 @@
+-- 0004 wrote the send times with three decimals, e.g. "12:00:05.100+00:00", while Go writes the fraction of the second
+-- without trailing zeros, and none for whole seconds, e.g. "12:00:05.1+00:00". SQLite compares them as text, so two
+-- messages sent at the same time were not equal, breaking the order of the messages and the ties of the cursors:
+-- write them like Go.
+UPDATE messages
+SET SendTime = substr(SendTime, 1, 19) || CASE
+    WHEN substr(SendTime, 21, 3) = '000' THEN ''
+    WHEN substr(SendTime, 22, 2) = '00' THEN substr(SendTime, 20, 2)
+    WHEN substr(SendTime, 23, 1) = '0' THEN substr(SendTime, 20, 3)
+    ELSE substr(SendTime, 20, 4)
+END || '+00:00'
+WHERE SendTime LIKE '____-__-__ __:__:__.___+00:00';
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestPagingMigratedMessages checks that the messages sent before the send times were stored in UTC are paged through
+// in order with the ones sent after, including the ones sent at the same time.
+func TestPagingMigratedMessages(t *testing.T) {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "wasatext.db"))
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// Migrate to the schema before 0004_messages_utc, and send two messages like the backend did then, in local time
+	d := sqliteDialect{}
+	if _, err := db.Exec(d.schemaMigrationsTable()); err != nil {
+		t.Fatalf("creating the migrations table: %v", err)
+	}
+	all, err := migrations(d)
+	if err != nil {
+		t.Fatalf("listing the migrations: %v", err)
+	}
+	for _, m := range all[:3] {
+		if err := applyMigration(db, d, m); err != nil {
+			t.Fatalf("applying migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+	}
+
+	sent := time.Date(2024, 3, 1, 12, 0, 5, 100*int(time.Millisecond), time.UTC)
+	local := time.FixedZone("CET", 3600)
+	for _, stmt := range []string{
+		"INSERT INTO users (Id, Username) VALUES (1, 'alice')",
+		"INSERT INTO conversations (ConversationId, GroupId, Name) VALUES (1, 1, 'old')",
+		"INSERT INTO participants (ConversationId, UserId) VALUES (1, 1)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	for i, sendTime := range []time.Time{sent.Add(-time.Second), sent} {
+		_, err := db.Exec(`
+            INSERT INTO messages (ConversationId, Text, SendTime, Status, SenderId, RecipientId, Photo)
+            VALUES (1, ?, ?, 'Sent', 1, 0, '')`, "migrated", sendTime.In(local))
+		if err != nil {
+			t.Fatalf("sending migrated message %d: %v", i, err)
+		}
+	}
+
+	appdb, err := New(db, Config{})
+	if errors.Is(err, ErrNoFTS5) {
+		t.Skip("run the tests with -tags sqlite_fts5: ", err)
+	} else if err != nil {
+		t.Fatalf("migrating the database: %v", err)
+	}
+	ctx := context.Background()
+	for _, sendTime := range []time.Time{sent, sent.Add(time.Second)} {
+		message := Message{ConversationId: 1, SenderId: 1, Text: "new", Status: "Sent", SendTime: sendTime}
+		if _, err := appdb.CreateMessage(ctx, message); err != nil {
+			t.Fatalf("sending a new message: %v", err)
+		}
+	}
+
+	// Newest first: the new message sent at the same time as the migrated one comes first, as its ID is higher
+	want := []int{4, 3, 2, 1}
+	var got []int
+	page := MessagePage{Limit: 1}
+	for len(got) <= len(want) {
+		details, err := appdb.GetConversationDetails(ctx, 1, 1, page)
+		if err != nil {
+			t.Fatalf("getting a page: %v", err)
+		}
+		for _, msg := range details.Messages {
+			got = append(got, msg.MessageId)
+		}
+		if details.NextCursor == nil {
+			break
+		}
+		page.Before = details.NextCursor
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paging back: got messages %v, want %v", got, want)
+	}
+
+	got = nil
+	page = MessagePage{Limit: 1, After: &MessageCursor{SendTime: sent.Add(-time.Hour)}}
+	for len(got) <= len(want) {
+		details, err := appdb.GetConversationDetails(ctx, 1, 1, page)
+		if err != nil {
+			t.Fatalf("getting a page: %v", err)
+		}
+		for _, msg := range details.Messages {
+			got = append(got, msg.MessageId)
+		}
+		if details.PrevCursor == nil {
+			break
+		}
+		page.After = details.PrevCursor
+	}
+	if !reflect.DeepEqual(got, []int{1, 2, 3, 4}) {
+		t.Errorf("paging forward: got messages %v, want [1 2 3 4]", got)
+	}
+}
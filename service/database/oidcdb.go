@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"log"
+)
+
+// CreateOIDCLogin stores a login waiting for the user to come back from the identity provider.
+func (db *appdbimpl) CreateOIDCLogin(ctx context.Context, stateHash string, login OIDCLogin) error {
+	_, err := db.c.ExecContext(ctx, "INSERT INTO oidc_logins (StateHash, Nonce, CodeVerifier, ExpiresAt) VALUES (?, ?, ?, ?)",
+		stateHash, login.Nonce, login.CodeVerifier, login.ExpiresAt.UTC())
+	return err
+}
+
+// TakeOIDCLogin returns a pending login and removes it, so each state is accepted only once. Expired logins are
+// removed as well. ErrOIDCLoginNotFound is returned if the login does not exist or has expired.
+func (db *appdbimpl) TakeOIDCLogin(ctx context.Context, stateHash string) (OIDCLogin, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	var login OIDCLogin
+	err = tx.QueryRowContext(ctx, "SELECT Nonce, CodeVerifier, ExpiresAt FROM oidc_logins WHERE StateHash = ?", stateHash).Scan(
+		&login.Nonce, &login.CodeVerifier, &login.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OIDCLogin{}, ErrOIDCLoginNotFound
+	} else if err != nil {
+		return OIDCLogin{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM oidc_logins WHERE StateHash = ? OR ExpiresAt < ?", stateHash, globaltime.Now().UTC())
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return OIDCLogin{}, err
+	}
+
+	if !login.ExpiresAt.After(globaltime.Now()) {
+		return OIDCLogin{}, ErrOIDCLoginNotFound
+	}
+	return login, nil
+}
+
+// GetOIDCUser returns the user linked to the identity. ErrUserDoesNotExist is returned if the identity has never
+// logged in.
+func (db *appdbimpl) GetOIDCUser(ctx context.Context, issuer string, subject string) (User, error) {
+	var user User
+	err := db.c.QueryRowContext(ctx, `
+        SELECT u.Id, u.Username
+        FROM oidc_identities o
+        JOIN users u ON o.UserId = u.Id
+        WHERE o.Issuer = ? AND o.Subject = ?`, issuer, subject).Scan(&user.Id, &user.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserDoesNotExist
+	}
+	return user, err
+}
+
+// CreateOIDCUser creates a new user linked to the identity. ErrUsernameTaken is returned if the username is already
+// used: existing accounts are never linked, as anyone could log in as them.
+func (db *appdbimpl) CreateOIDCUser(ctx context.Context, issuer string, subject string, username string) (User, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE Username = ?)", username).Scan(&exists)
+	if err != nil {
+		return User{}, err
+	}
+	if exists {
+		return User{}, ErrUsernameTaken
+	}
+
+	userId, err := tx.insert(ctx, "INSERT INTO users (Username) VALUES (?)", "Id", username)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO oidc_identities (Issuer, Subject, UserId, CreatedAt) VALUES (?, ?, ?, ?)",
+		issuer, subject, userId, globaltime.Now().UTC())
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{Id: uint64(userId), Username: username}, tx.Commit()
+}
+
+// IsOIDCUser tells whether the user has been created by an OpenID Connect login.
+func (db *appdbimpl) IsOIDCUser(ctx context.Context, userId uint64) (bool, error) {
+	var exists bool
+	err := db.c.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM oidc_identities WHERE UserId = ?)", userId).Scan(&exists)
+	return exists, err
+}
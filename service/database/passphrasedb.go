@@ -0,0 +1,65 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"log"
+)
+
+// GetPassphraseHash returns the stored hash of the user passphrase. ErrNoPassphrase is returned if the user has not
+// set a passphrase.
+func (db *appdbimpl) GetPassphraseHash(ctx context.Context, userId uint64) (string, error) {
+	var hash string
+	err := db.c.QueryRowContext(ctx, "SELECT Hash FROM passphrases WHERE UserId = ?", userId).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNoPassphrase
+	}
+	return hash, err
+}
+
+// SetPassphraseHash sets or replaces the hash of the user passphrase.
+func (db *appdbimpl) SetPassphraseHash(ctx context.Context, userId uint64, hash string) error {
+	_, err := db.c.ExecContext(ctx, `
+        INSERT INTO passphrases (UserId, Hash, UpdatedAt) VALUES (?, ?, ?)
+        ON CONFLICT(UserId) DO UPDATE SET Hash = excluded.Hash, UpdatedAt = excluded.UpdatedAt`,
+		userId, hash, globaltime.Now().UTC())
+	return err
+}
+
+// CreateUserWithPassphrase creates a new user with the hash of their passphrase, at once. ErrUsernameTaken is returned
+// if the username is already used: the passphrase of an existing account is never set this way.
+func (db *appdbimpl) CreateUserWithPassphrase(ctx context.Context, username string, hash string) (User, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE Username = ?)", username).Scan(&exists)
+	if err != nil {
+		return User{}, err
+	}
+	if exists {
+		return User{}, ErrUsernameTaken
+	}
+
+	userId, err := tx.insert(ctx, "INSERT INTO users (Username) VALUES (?)", "Id", username)
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO passphrases (UserId, Hash, UpdatedAt) VALUES (?, ?, ?)",
+		userId, hash, globaltime.Now().UTC())
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{Id: uint64(userId), Username: username}, tx.Commit()
+}
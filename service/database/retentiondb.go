@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"log"
+	"time"
+)
+
+// SetConversationRetention sets how long the messages of the conversation are kept before PurgeExpiredMessages purges
+// them, or keeps them forever if retention is zero. The change is recorded in the timeline with an EventRetention
+// event sent by the user, which is returned. ErrNotMember is returned if the user is not a participant.
+func (db *appdbimpl) SetConversationRetention(ctx context.Context, convId int, userId uint64, retention time.Duration) (Message, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	var username string
+	err = tx.QueryRowContext(ctx, `
+        SELECT u.Username
+        FROM participants p
+        JOIN users u ON u.Id = p.UserId
+        WHERE p.ConversationId = ? AND p.UserId = ?`, convId, userId).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrNotMember
+	} else if err != nil {
+		return Message{}, err
+	}
+
+	var seconds sql.NullInt64
+	if retention > 0 {
+		seconds = sql.NullInt64{Int64: int64(retention / time.Second), Valid: true}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE conversations SET RetentionSeconds = ? WHERE ConversationId = ?",
+		seconds, convId)
+	if err != nil {
+		return Message{}, err
+	}
+
+	event := Message{
+		ConversationId: convId,
+		SenderId:       userId,
+		Text:           RetentionEventText(username, retention),
+		Status:         "Sent",
+		SendTime:       globaltime.Now().UTC(),
+		Event:          EventRetention,
+	}
+	id, err := tx.insert(ctx, `
+        INSERT INTO messages (ConversationId, SenderId, RecipientId, Text, Status, SendTime, Event)
+        VALUES (?, ?, 0, ?, ?, ?, ?)`, "MessageId",
+		event.ConversationId, event.SenderId, event.Text, event.Status, event.SendTime, event.Event)
+	if err != nil {
+		return Message{}, err
+	}
+	event.MessageId = int(id)
+
+	_, err = tx.ExecContext(ctx, "UPDATE conversations SET LastMessageId = ? WHERE ConversationId = ?",
+		event.MessageId, convId)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return event, tx.Commit()
+}
+
+// PurgeExpiredMessages deletes the messages older than the retention period of their conversation at the time now,
+// with their reactions and photos, and returns how many. Events are kept, so the timeline still shows the settings of
+// the conversation.
+func (db *appdbimpl) PurgeExpiredMessages(ctx context.Context, now time.Time) (int64, error) {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	expiries, err := retentionExpiries(ctx, tx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	// Reactions are deleted by the foreign key, and photos are stored with the messages
+	var purged int64
+	for convId, expiry := range expiries {
+		result, err := tx.ExecContext(ctx,
+			"DELETE FROM messages WHERE ConversationId = ? AND SendTime < ? AND Event IS NULL", convId, expiry)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		purged += n
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+
+	if err := resetLastMessages(ctx, tx); err != nil {
+		return 0, err
+	}
+	return purged, tx.Commit()
+}
+
+// retentionExpiries returns, for each conversation with a retention period, the time before which its messages have
+// expired at the time now. It is computed here, as the databases differ in their time arithmetic.
+func retentionExpiries(ctx context.Context, tx *dbtx, now time.Time) (map[int]time.Time, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT ConversationId, RetentionSeconds FROM conversations WHERE RetentionSeconds IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expiries := make(map[int]time.Time)
+	for rows.Next() {
+		var convId int
+		var seconds int64
+		if err := rows.Scan(&convId, &seconds); err != nil {
+			return nil, err
+		}
+		expiries[convId] = now.Add(-time.Duration(seconds) * time.Second).UTC()
+	}
+	return expiries, rows.Err()
+}
+
+// RetentionEventText returns the text of the EventRetention event of the user setting the retention period.
+func RetentionEventText(username string, retention time.Duration) string {
+	if retention <= 0 {
+		return username + " turned off disappearing messages"
+	}
+	return fmt.Sprintf("%s set disappearing messages to %s", username, formatRetention(retention))
+}
+
+// formatRetention returns the retention period in the largest unit that divides it: days, hours, minutes or seconds.
+func formatRetention(retention time.Duration) string {
+	units := []struct {
+		length time.Duration
+		name   string
+	}{
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+		{time.Second, "second"},
+	}
+	for _, u := range units {
+		if retention%u.length == 0 {
+			n := int64(retention / u.length)
+			if n == 1 {
+				return "1 " + u.name
+			}
+			return fmt.Sprintf("%d %ss", n, u.name)
+		}
+	}
+	return retention.String()
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// HighlightStart and HighlightEnd surround the matching words in the snippets of the search results. They are control
+// characters, so they can't be confused with the text of the messages.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// SearchTerms returns the words of the text as matched by SearchMessages: the runs of letters and digits, in lower
+// case. Punctuation and search operators are ignored, so any text can be searched.
+func SearchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// SearchMessages returns the messages, of the conversations the user is a participant of, whose text has all the
+// words of the query, the most recent first. Events, and the messages of the conversations the user has left, are never
+// returned.
+func (db *appdbimpl) SearchMessages(ctx context.Context, userId uint64, search MessageSearch) (SearchResults, error) {
+	terms := SearchTerms(search.Query)
+	if len(terms) == 0 {
+		return SearchResults{}, nil
+	}
+
+	join, snippet := db.c.dialect.messageSearch()
+	query := `
+        SELECT m.MessageId, m.ConversationId, m.SenderId, ` + senderUsername + `, m.SendTime, ` + snippet + `
+        FROM messages m
+        ` + join + `
+        JOIN participants p ON p.ConversationId = m.ConversationId AND p.UserId = ?
+        LEFT JOIN users u ON u.Id = m.SenderId
+        WHERE m.Event IS NULL`
+	args := []interface{}{db.c.dialect.searchQuery(terms), userId}
+
+	if search.ConversationId != 0 {
+		query += " AND m.ConversationId = ?"
+		args = append(args, search.ConversationId)
+	}
+	if len(search.ConversationIds) > 0 {
+		query += " AND m.ConversationId IN (" + placeholders(len(search.ConversationIds)) + ")"
+		for _, id := range search.ConversationIds {
+			args = append(args, id)
+		}
+	}
+	if search.Before != nil {
+		query += " AND " + messagesBefore
+		args = append(args, search.Before.SendTime.UTC(), search.Before.SendTime.UTC(), search.Before.MessageId)
+	}
+	query += " ORDER BY m.SendTime DESC, m.MessageId DESC"
+	if search.Limit > 0 {
+		// One more, to know whether there is a next page
+		query += " LIMIT ?"
+		args = append(args, search.Limit+1)
+	}
+
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error searching messages: %v", err)
+		return SearchResults{}, err
+	}
+	defer rows.Close()
+
+	var results SearchResults
+	for rows.Next() {
+		var r SearchResult
+		err := rows.Scan(&r.MessageId, &r.ConversationId, &r.SenderId, &r.SenderUsername, &r.SendTime, &r.Snippet)
+		if err != nil {
+			return SearchResults{}, err
+		}
+		results.Results = append(results.Results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchResults{}, err
+	}
+
+	if search.Limit > 0 && len(results.Results) > search.Limit {
+		results.Results = results.Results[:search.Limit]
+		last := results.Results[search.Limit-1]
+		results.NextCursor = &MessageCursor{SendTime: last.SendTime, MessageId: last.MessageId}
+	}
+	return results, nil
+}
@@ -1,24 +1,20 @@
 package database
 
 import (
+	"context"
 	"log"
 )
 
-func (db *appdbimpl) CreateMessage(m Message) (Message, error) {
-	// Insert the message into the database using the correct SenderId
+func (db *appdbimpl) CreateMessage(ctx context.Context, m Message) (Message, error) {
+	// Insert the message into the database using the correct SenderId. The time is stored in UTC, as SQLite compares
+	// the times of the messages as text when paging through a conversation.
 	log.Printf("Attempting to create message: %+v", m)
-	res, err := db.c.Exec("INSERT INTO messages (ConversationId, SenderId, RecipientId, Text, Status, SendTime, Photo) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		m.ConversationId, m.SenderId, m.RecipientId, m.Text, m.Status, m.SendTime, m.Photo)
+	lastInsertID, err := db.c.insert(ctx, "INSERT INTO messages (ConversationId, SenderId, RecipientId, Text, Status, SendTime, Photo) VALUES (?, ?, ?, ?, ?, ?, ?)", "MessageId",
+		m.ConversationId, m.SenderId, m.RecipientId, m.Text, m.Status, m.SendTime.UTC(), m.Photo)
 	if err != nil {
 		log.Printf("Error inserting message: %v", err)
 		return m, err
 	}
-
-	lastInsertID, err := res.LastInsertId()
-	if err != nil {
-		log.Printf("Error getting last insert ID: %v", err)
-		return m, err
-	}
 	m.MessageId = int(lastInsertID)
 
 	return m, nil
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"log"
+	"time"
+)
+
+// CreateSession stores a new session for the user. Only the hash of the session token is saved, so a leaked database
+// does not give access to active sessions.
+func (db *appdbimpl) CreateSession(ctx context.Context, userId uint64, tokenHash string, userAgent string, expiresAt time.Time) (Session, error) {
+	now := globaltime.Now().UTC()
+	sessionId, err := db.c.insert(ctx, `
+        INSERT INTO sessions (TokenHash, UserId, UserAgent, CreatedAt, LastUsedAt, ExpiresAt)
+        VALUES (?, ?, ?, ?, ?, ?)`, "SessionId", tokenHash, userId, userAgent, now, now, expiresAt.UTC())
+	if err != nil {
+		return Session{}, err
+	}
+
+	return Session{
+		SessionId:  sessionId,
+		UserId:     userId,
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  expiresAt.UTC(),
+	}, nil
+}
+
+// GetUserBySession returns the owner of the session identified by the token hash, together with the session itself.
+// ErrSessionNotFound is returned if the session does not exist, has expired or has been revoked.
+func (db *appdbimpl) GetUserBySession(ctx context.Context, tokenHash string) (User, Session, error) {
+	return db.getUserBySession(ctx, "s.TokenHash = ?", tokenHash)
+}
+
+// GetUserBySessionId is like GetUserBySession, for the session with the given ID.
+func (db *appdbimpl) GetUserBySessionId(ctx context.Context, sessionId int64) (User, Session, error) {
+	return db.getUserBySession(ctx, "s.SessionId = ?", sessionId)
+}
+
+// getUserBySession returns the owner of the active session matching the condition, together with the session.
+func (db *appdbimpl) getUserBySession(ctx context.Context, condition string, arg interface{}) (User, Session, error) {
+	var user User
+	var session Session
+	var revokedAt sql.NullTime
+	err := db.c.QueryRowContext(ctx, `
+        SELECT u.Id, u.Username, s.SessionId, s.UserAgent, s.CreatedAt, s.LastUsedAt, s.ExpiresAt, s.RevokedAt
+        FROM sessions s
+        JOIN users u ON s.UserId = u.Id
+        WHERE `+condition, arg).Scan(
+		&user.Id,
+		&user.Username,
+		&session.SessionId,
+		&session.UserAgent,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.ExpiresAt,
+		&revokedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, Session{}, ErrSessionNotFound
+	} else if err != nil {
+		return User{}, Session{}, err
+	}
+
+	if revokedAt.Valid || !session.ExpiresAt.After(globaltime.Now()) {
+		return User{}, Session{}, ErrSessionNotFound
+	}
+	session.UserId = user.Id
+	return user, session, nil
+}
+
+// TouchSession records that the session has just been used.
+func (db *appdbimpl) TouchSession(ctx context.Context, sessionId int64) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE sessions SET LastUsedAt = ? WHERE SessionId = ?", globaltime.Now().UTC(), sessionId)
+	return err
+}
+
+// ListSessions returns the active sessions of the user, most recently used first.
+func (db *appdbimpl) ListSessions(ctx context.Context, userId uint64) ([]Session, error) {
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT SessionId, UserAgent, CreatedAt, LastUsedAt, ExpiresAt
+        FROM sessions
+        WHERE UserId = ? AND RevokedAt IS NULL
+        ORDER BY LastUsedAt DESC, SessionId DESC`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := globaltime.Now()
+	var sessions []Session
+	for rows.Next() {
+		session := Session{UserId: userId}
+		err := rows.Scan(&session.SessionId, &session.UserAgent, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		if !session.ExpiresAt.After(now) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Rows error in sessions: %v", err)
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession revokes one of the sessions of the user. ErrSessionNotFound is returned if the session does not
+// belong to the user or has already been revoked.
+func (db *appdbimpl) RevokeSession(ctx context.Context, userId uint64, sessionId int64) error {
+	result, err := db.c.ExecContext(ctx, "UPDATE sessions SET RevokedAt = ? WHERE SessionId = ? AND UserId = ? AND RevokedAt IS NULL",
+		globaltime.Now().UTC(), sessionId, userId)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions revokes every session of the user except keepSessionId.
+func (db *appdbimpl) RevokeOtherSessions(ctx context.Context, userId uint64, keepSessionId int64) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE sessions SET RevokedAt = ? WHERE UserId = ? AND SessionId != ? AND RevokedAt IS NULL",
+		globaltime.Now().UTC(), userId, keepSessionId)
+	return err
+}
+
+// RotateSessionToken replaces the token oldTokenHash of the session with tokenHash, so the previous token can't be used
+// anymore. ErrSessionNotFound is returned if the session is revoked, or its token is not oldTokenHash anymore: of two
+// concurrent rotations of the same token, only one succeeds.
+func (db *appdbimpl) RotateSessionToken(ctx context.Context, sessionId int64, oldTokenHash string, tokenHash string) error {
+	result, err := db.c.ExecContext(ctx, "UPDATE sessions SET TokenHash = ?, LastUsedAt = ? WHERE SessionId = ? AND TokenHash = ? AND RevokedAt IS NULL",
+		tokenHash, globaltime.Now().UTC(), sessionId, oldTokenHash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
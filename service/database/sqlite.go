@@ -0,0 +1,270 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// legacyColumns are the columns that were added to the initial SQLite schema after some databases had already been
+// created. Tables are created only if missing by the initial migration, so these are added to the older tables when it
+// is applied.
+var legacyColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "ProfilePhoto", "TEXT"},
+	{"conversations", "GroupPhoto", "TEXT"},
+}
+
+// OpenSQLite opens the SQLite database in the file. Foreign keys are enforced on every connection of the pool, as
+// SQLite enables them per connection.
+func OpenSQLite(filename string) (*sql.DB, error) {
+	return sql.Open("sqlite3", sqliteDSN(filename, url.Values{}))
+}
+
+// OpenSQLiteReadOnly opens the existing SQLite database in the file for reading only: nothing is written to it, its
+// journal mode included, and a missing file is reported instead of being created.
+func OpenSQLiteReadOnly(filename string) (*sql.DB, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("mode", "ro")
+	return sql.Open("sqlite3", sqliteDSN(filename, params))
+}
+
+// SQLiteOptions are the settings of the connections opened by OpenSQLitePools.
+type SQLiteOptions struct {
+	// JournalMode is the journal mode of the database: DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF. With WAL, reads
+	// don't wait for the writes. If empty, the mode of the database is kept
+	JournalMode string
+
+	// BusyTimeout is how long a connection waits for the lock of the database held by another connection (e.g. a
+	// backup, or the writer for a read without WAL) before failing with "database is locked"
+	BusyTimeout time.Duration
+
+	// Synchronous is how often SQLite waits for the data to reach the disk: OFF, NORMAL, FULL or EXTRA. NORMAL is
+	// safe with WAL, but a power loss may undo the last transactions. If empty, the default of SQLite (FULL)
+	Synchronous string
+
+	// ReadConns is the maximum number of connections of the read pool. If zero, there is no limit
+	ReadConns int
+}
+
+// OpenSQLitePools opens the SQLite database in the file with two pools: writer, with a single connection, so writes
+// and transactions wait in line for it instead of failing on the lock of the database, and reader, with read-only
+// connections for the other queries. writer is passed to New, and reader as Config.ReadDB. The journal mode is set by
+// writer, before reader is opened.
+func OpenSQLitePools(filename string, opts SQLiteOptions) (writer *sql.DB, reader *sql.DB, err error) {
+	params := url.Values{}
+	if opts.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10))
+	}
+	if opts.Synchronous != "" {
+		params.Set("_synchronous", opts.Synchronous)
+	}
+
+	writerParams := url.Values{}
+	for k, v := range params {
+		writerParams[k] = v
+	}
+	if opts.JournalMode != "" {
+		writerParams.Set("_journal_mode", opts.JournalMode)
+	}
+	// Transactions take the write lock as they begin, so they never fail halfway because another process is writing
+	writerParams.Set("_txlock", "immediate")
+	writer, err = sql.Open("sqlite3", sqliteDSN(filename, writerParams))
+	if err != nil {
+		return nil, nil, err
+	}
+	writer.SetMaxOpenConns(1)
+	// The connection is kept, with the settings applied when it was opened
+	writer.SetConnMaxLifetime(0)
+	writer.SetConnMaxIdleTime(0)
+	if err := writer.Ping(); err != nil {
+		_ = writer.Close()
+		return nil, nil, err
+	}
+
+	params.Set("_query_only", "on")
+	reader, err = sql.Open("sqlite3", sqliteDSN(filename, params))
+	if err != nil {
+		_ = writer.Close()
+		return nil, nil, err
+	}
+	if opts.ReadConns > 0 {
+		reader.SetMaxOpenConns(opts.ReadConns)
+		reader.SetMaxIdleConns(opts.ReadConns)
+	}
+	return writer, reader, nil
+}
+
+// sqliteDSN returns the name of the SQLite database in the file, with the parameters of its connections. Foreign keys
+// are always enabled.
+func sqliteDSN(filename string, params url.Values) string {
+	params.Set("_foreign_keys", "on")
+	return "file:" + filename + "?" + params.Encode()
+}
+
+// sqliteDialect is the dialect of SQLite.
+type sqliteDialect struct{}
+
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) insert(ctx context.Context, e execer, query string, idColumn string, args ...interface{}) (int64, error) {
+	res, err := e.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	// The ID column is always the rowid of the tables
+	return res.LastInsertId()
+}
+
+func (sqliteDialect) tableExists(ctx context.Context, q queryer, table string) (bool, error) {
+	var exists bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type='table' AND name=?)`, table).Scan(&exists)
+	return exists, err
+}
+
+func (sqliteDialect) constraintKind(err error) error {
+	var e sqlite3.Error
+	if !errors.As(err, &e) {
+		return nil
+	}
+	switch e.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		return ErrAlreadyExists
+	case sqlite3.ErrConstraintForeignKey:
+		return ErrNotFound
+	default:
+		return nil
+	}
+}
+
+// ErrNoFTS5 is returned by New for SQLite databases when go-sqlite3 has been built without the sqlite_fts5 tag.
+var ErrNoFTS5 = errors.New("SQLite was built without FTS5: build with -tags sqlite_fts5")
+
+func (sqliteDialect) checkConnection(db *sql.DB) error {
+	// Without foreign keys, deletes would leave orphaned rows behind instead of cascading
+	var foreignKeys bool
+	if err := db.QueryRow(`PRAGMA foreign_keys`).Scan(&foreignKeys); err != nil {
+		return fmt.Errorf("checking foreign keys: %w", err)
+	}
+	if !foreignKeys {
+		return errors.New("foreign keys must be enabled on the database connections, see OpenSQLite")
+	}
+	// The search of messages uses an FTS5 index, which go-sqlite3 only includes with a build tag
+	var fts5 bool
+	if err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5); err != nil {
+		return fmt.Errorf("checking FTS5: %w", err)
+	}
+	if !fts5 {
+		return ErrNoFTS5
+	}
+	return nil
+}
+
+// messageSearch matches the messages in messages_fts, the FTS5 index of their text kept by triggers.
+func (sqliteDialect) messageSearch() (string, string) {
+	return `JOIN messages_fts ON messages_fts.rowid = m.MessageId AND messages_fts MATCH ?`,
+		`snippet(messages_fts, 0, char(2), char(3), '…', 16)`
+}
+
+// searchQuery quotes each term, so they are matched as words and never read as FTS5 operators.
+func (sqliteDialect) searchQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (sqliteDialect) migrationsDir() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) schemaMigrationsTable() string {
+	return `CREATE TABLE IF NOT EXISTS schema_migrations (
+            Version INTEGER NOT NULL PRIMARY KEY,
+            Name TEXT NOT NULL,
+            AppliedAt DATETIME NOT NULL
+        );`
+}
+
+// beginMigration disables foreign keys while the migration runs, so tables can be rebuilt
+// (see https://www.sqlite.org/lang_altertable.html#otheralter); they are checked by endMigration instead.
+func (sqliteDialect) beginMigration(ctx context.Context, conn *sql.Conn) (func(), error) {
+	// PRAGMA foreign_keys has no effect inside a transaction, and applies to one connection only
+	if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF`); err != nil {
+		return nil, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = ON`); err != nil {
+			// Don't give the connection back to the pool without foreign keys
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+			log.Printf("Enabling foreign keys failed: %v\n", err)
+		}
+	}, nil
+}
+
+func (sqliteDialect) endMigration(tx *sql.Tx, m Migration) error {
+	if m.Version == 1 {
+		if err := addLegacyColumns(tx); err != nil {
+			return err
+		}
+	}
+	return checkForeignKeys(tx)
+}
+
+// addLegacyColumns adds the legacyColumns missing from tables created before them.
+func addLegacyColumns(tx *sql.Tx) error {
+	for _, c := range legacyColumns {
+		var count int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.definition))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkForeignKeys returns an error if any row references a row that does not exist.
+func checkForeignKeys(q interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}) error {
+	rows, err := q.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var table, parent string
+		var rowid sql.NullInt64
+		var fkid int
+		if err := rows.Scan(&table, &rowid, &parent, &fkid); err != nil {
+			return err
+		}
+		return fmt.Errorf("row %d of %s references a missing row of %s", rowid.Int64, table, parent)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenSQLiteReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wasatext.db")
+	if _, err := OpenSQLiteReadOnly(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("opening a missing database: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("opening a missing database created it: %v", err)
+	}
+
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatalf("creating the database: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE users (Id INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatalf("creating a table: %v", err)
+	}
+	_ = db.Close()
+
+	ro, err := OpenSQLiteReadOnly(path)
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	defer func() { _ = ro.Close() }()
+	pending, err := PendingMigrations(ro)
+	if err != nil {
+		t.Fatalf("listing the pending migrations: %v", err)
+	}
+	all, err := migrations(sqliteDialect{})
+	if err != nil {
+		t.Fatalf("reading the migrations: %v", err)
+	}
+	if len(pending) != len(all) {
+		t.Errorf("got %d pending migrations, want %d", len(pending), len(all))
+	}
+
+	if _, err := ro.Exec(`INSERT INTO users (Id) VALUES (1)`); err == nil {
+		t.Errorf("writing to the read-only database succeeded")
+	}
+	var journalMode string
+	if err := ro.QueryRow(`PRAGMA journal_mode`).Scan(&journalMode); err != nil {
+		t.Fatalf("reading the journal mode: %v", err)
+	}
+	if journalMode != "delete" {
+		t.Errorf("journal mode: got %s, want delete", journalMode)
+	}
+}
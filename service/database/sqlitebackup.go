@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+// backupRetryDelay is how long BackupSQLite waits when the source database is locked by a writer.
+const backupRetryDelay = 50 * time.Millisecond
+
+// BackupSQLite copies the SQLite database src into dest with the online backup API of SQLite, so the copy is
+// consistent even while other connections, or other processes, write to src. The copy is made in a single step,
+// holding a read lock on src: writers wait for it (up to their busy timeout) instead of restarting the backup. Anything
+// in dest is replaced.
+func BackupSQLite(ctx context.Context, src *sql.DB, dest *sql.DB) error {
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = srcConn.Close() }()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = destConn.Close() }()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			d, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			s, ok2 := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("backups are only supported on SQLite")
+			}
+
+			backup, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				// Step returns false without an error while src is locked
+				done, err := backup.Step(-1)
+				if err != nil {
+					_ = backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					_ = backup.Finish()
+					return ctx.Err()
+				case <-time.After(backupRetryDelay):
+				}
+			}
+		})
+	})
+}
+
+// CheckSQLite checks the integrity of the SQLite database, with PRAGMA integrity_check and PRAGMA foreign_key_check.
+// It returns an error listing the problems found, if any: all the ones of integrity_check, and the first broken
+// foreign key.
+func CheckSQLite(ctx context.Context, db *sql.DB) error {
+	var problems []string
+	rows, err := db.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			return err
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := checkForeignKeys(db); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("database is corrupt: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"log"
+)
+
+// GetTOTP returns the TOTP enrollment of the user. ErrNoTOTP is returned if the user never started an enrollment.
+func (db *appdbimpl) GetTOTP(ctx context.Context, userId uint64) (TOTP, error) {
+	totp := TOTP{UserId: userId}
+	err := db.c.QueryRowContext(ctx, "SELECT Secret, Confirmed, LastUsedStep FROM totp WHERE UserId = ?", userId).Scan(
+		&totp.Secret, &totp.Confirmed, &totp.LastUsedStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, ErrNoTOTP
+	}
+	return totp, err
+}
+
+// SetTOTPSecret starts a new (unconfirmed) enrollment, replacing any previous one.
+func (db *appdbimpl) SetTOTPSecret(ctx context.Context, userId uint64, secret string) error {
+	_, err := db.c.ExecContext(ctx, `
+        INSERT INTO totp (UserId, Secret, Confirmed, LastUsedStep, CreatedAt) VALUES (?, ?, FALSE, 0, ?)
+        ON CONFLICT(UserId) DO UPDATE SET
+            Secret = excluded.Secret,
+            Confirmed = FALSE,
+            LastUsedStep = 0,
+            CreatedAt = excluded.CreatedAt`,
+		userId, secret, globaltime.Now().UTC())
+	return err
+}
+
+// ConfirmTOTP completes the enrollment after the first code has been verified, and replaces the recovery codes of
+// the user.
+func (db *appdbimpl) ConfirmTOTP(ctx context.Context, userId uint64, step int64, recoveryCodeHashes []string) error {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, "UPDATE totp SET Confirmed = TRUE, LastUsedStep = ? WHERE UserId = ?", step, userId)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNoTOTP
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE UserId = ?", userId)
+	if err != nil {
+		return err
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (UserId, CodeHash) VALUES (?, ?)", userId, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep marks the time step as used. ErrTOTPCodeReused is returned if the step (or a later one) has already been
+// used, so each code is accepted only once.
+func (db *appdbimpl) UseTOTPStep(ctx context.Context, userId uint64, step int64) error {
+	result, err := db.c.ExecContext(ctx, "UPDATE totp SET LastUsedStep = ? WHERE UserId = ? AND Confirmed = TRUE AND LastUsedStep < ?",
+		step, userId, step)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+// UseRecoveryCode marks the recovery code as used. ErrRecoveryCodeNotFound is returned if the code does not exist or
+// has already been used.
+func (db *appdbimpl) UseRecoveryCode(ctx context.Context, userId uint64, codeHash string) error {
+	result, err := db.c.ExecContext(ctx, "UPDATE recovery_codes SET UsedAt = ? WHERE UserId = ? AND CodeHash = ? AND UsedAt IS NULL",
+		globaltime.Now().UTC(), userId, codeHash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+// DeleteTOTP disables two-factor authentication for the user, removing the secret and the recovery codes.
+func (db *appdbimpl) DeleteTOTP(ctx context.Context, userId uint64) error {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE UserId = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM totp WHERE UserId = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateLoginChallenge stores a pending login that is waiting for the second factor.
+func (db *appdbimpl) CreateLoginChallenge(ctx context.Context, challengeHash string, challenge LoginChallenge) error {
+	_, err := db.c.ExecContext(ctx, "INSERT INTO login_challenges (ChallengeHash, UserId, UserAgent, ExpiresAt) VALUES (?, ?, ?, ?)",
+		challengeHash, challenge.UserId, challenge.UserAgent, challenge.ExpiresAt.UTC())
+	return err
+}
+
+// GetLoginChallenge returns a pending login. ErrChallengeNotFound is returned if it does not exist or has expired.
+func (db *appdbimpl) GetLoginChallenge(ctx context.Context, challengeHash string) (LoginChallenge, error) {
+	var challenge LoginChallenge
+	err := db.c.QueryRowContext(ctx, "SELECT UserId, UserAgent, ExpiresAt, Attempts FROM login_challenges WHERE ChallengeHash = ?",
+		challengeHash).Scan(&challenge.UserId, &challenge.UserAgent, &challenge.ExpiresAt, &challenge.Attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginChallenge{}, ErrChallengeNotFound
+	} else if err != nil {
+		return LoginChallenge{}, err
+	}
+
+	if !challenge.ExpiresAt.After(globaltime.Now()) {
+		return LoginChallenge{}, ErrChallengeNotFound
+	}
+	return challenge, nil
+}
+
+// RecordLoginChallengeFailure counts a wrong second factor for the pending login.
+func (db *appdbimpl) RecordLoginChallengeFailure(ctx context.Context, challengeHash string) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE login_challenges SET Attempts = Attempts + 1 WHERE ChallengeHash = ?", challengeHash)
+	return err
+}
+
+// DeleteLoginChallenge removes a pending login, and any other expired one.
+func (db *appdbimpl) DeleteLoginChallenge(ctx context.Context, challengeHash string) error {
+	_, err := db.c.ExecContext(ctx, "DELETE FROM login_challenges WHERE ChallengeHash = ? OR ExpiresAt < ?",
+		challengeHash, globaltime.Now().UTC())
+	return err
+}
@@ -1,56 +1,225 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
 	"log"
-	"time"
+	"strings"
 )
 
-func (db *appdbimpl) SetUserPhoto(userId uint64, photoData string) error {
-	_, err := db.c.Exec("UPDATE users SET ProfilePhoto = ? WHERE Id = ?",
+func (db *appdbimpl) SetUserPhoto(ctx context.Context, userId uint64, photoData string) error {
+	_, err := db.c.ExecContext(ctx, "UPDATE users SET ProfilePhoto = ? WHERE Id = ?",
 		photoData, userId)
 	return err
 }
 
-func (db *appdbimpl) SetGroupPhoto(groupId int, photoData string) error {
-	_, err := db.c.Exec("UPDATE conversations SET GroupPhoto = ? WHERE ConversationId = ? AND GroupId = 1",
+// GetUserPhoto returns the photo of the user, empty if not set. ErrUserDoesNotExist is returned if the user does not
+// exist.
+func (db *appdbimpl) GetUserPhoto(ctx context.Context, userId uint64) (string, error) {
+	var photo string
+	err := db.c.QueryRowContext(ctx, "SELECT COALESCE(ProfilePhoto, '') FROM users WHERE Id = ?", userId).Scan(&photo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserDoesNotExist
+	}
+	return photo, err
+}
+
+// DeleteUser deletes the user with the bots it owns, which nobody could manage anymore. Their messages are kept for
+// the other participants, attributed to DeletedUserId, and the conversations left without participants are deleted.
+// ErrUserDoesNotExist is returned if the user does not exist.
+func (db *appdbimpl) DeleteUser(ctx context.Context, userId uint64) error {
+	tx, err := db.c.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Printf("Transaction rollback failed: %v\n", err)
+		}
+	}()
+
+	bots, err := queryIds(ctx, tx, "SELECT UserId FROM bots WHERE OwnerId = ?", userId)
+	if err != nil {
+		return err
+	}
+	userIds := append([]interface{}{userId}, bots...)
+	in := placeholders(len(userIds))
+
+	// The conversations of the users, read before their participants are deleted
+	conversationIds, err := queryIds(ctx, tx,
+		"SELECT DISTINCT ConversationId FROM participants WHERE UserId IN ("+in+")", userIds...)
+	if err != nil {
+		return err
+	}
+
+	// Messages don't reference the users with a foreign key, so they are kept: only who sent and received them is
+	// cleared
+	args := append([]interface{}{DeletedUserId}, userIds...)
+	_, err = tx.ExecContext(ctx, "UPDATE messages SET SenderId = ? WHERE SenderId IN ("+in+")", args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE messages SET RecipientId = ? WHERE RecipientId IN ("+in+")", args...)
+	if err != nil {
+		return err
+	}
+
+	// The rest of the data of the users (participants, comments, sessions, passphrase, two-factor authentication,
+	// bots and API keys, identities) is deleted by the foreign keys, and the photo with the row
+	result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE Id IN ("+in+")", userIds...)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrUserDoesNotExist
+	}
+
+	// Nobody can see a conversation without participants anymore, so delete it with its messages, like LeaveGroup
+	if len(conversationIds) > 0 {
+		_, err = tx.ExecContext(ctx, `
+        DELETE FROM conversations
+        WHERE ConversationId IN (`+placeholders(len(conversationIds))+`)
+        AND NOT EXISTS (SELECT 1 FROM participants p WHERE p.ConversationId = conversations.ConversationId)`,
+			conversationIds...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// queryIds returns the IDs read by the query, as arguments for an IN list.
+func queryIds(ctx context.Context, tx *dbtx, query string, args ...interface{}) ([]interface{}, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SetGroupPhoto sets the photo of the group. ErrGroupNotFound is returned if the group does not exist, and ErrNotGroup
+// if it is a direct conversation.
+func (db *appdbimpl) SetGroupPhoto(ctx context.Context, groupId int, photoData string) error {
+	if err := db.checkGroup(ctx, groupId); err != nil {
+		return err
+	}
+
+	_, err := db.c.ExecContext(ctx, "UPDATE conversations SET GroupPhoto = ? WHERE ConversationId = ? AND GroupId = 1",
 		photoData, groupId)
 	return err
 }
 
-func (db *appdbimpl) GetConversations(userId uint64) ([]ConversationPreview, error) {
+// GetConversations returns a page of the previews of the conversations of the user selected by the filter, the most
+// recent last message first and the conversations without messages last.
+func (db *appdbimpl) GetConversations(ctx context.Context, userId uint64, filter ConversationFilter) (ConversationList, error) {
+	// Photos are large: they are only read when asked for
+	photo := "NULL"
+	if filter.WithPhotos {
+		photo = "c.GroupPhoto"
+	}
+
+	// The previews are computed first, so the filters can use their names and unread counts
 	query := `
-        SELECT DISTINCT  -- Add DISTINCT to prevent duplicates
-            c.ConversationId,
-            CASE 
-                WHEN c.GroupId = 1 THEN c.Name
-                WHEN u.Username IS NOT NULL THEN u.Username
-                ELSE 'Unknown'
-            END as Name,
-            c.GroupPhoto as Photo,
-            m.SendTime as LastMessageTime,
-            m.Text as LastMessageText,
-            CASE WHEN m.Photo IS NOT NULL AND m.Photo != '' THEN 1 ELSE 0 END as IsPhoto,  -- Fix photo check
-            CASE WHEN c.GroupId = 1 THEN 1 ELSE 0 END as IsGroup
-        FROM conversations c
-        INNER JOIN participants p ON c.ConversationId = p.ConversationId AND p.UserId = ?
-        LEFT JOIN messages m ON c.LastMessageId = m.MessageId
-        LEFT JOIN participants p2 ON c.ConversationId = p2.ConversationId AND p2.UserId != ?
-        LEFT JOIN users u ON p2.UserId = u.Id
-        GROUP BY c.ConversationId  -- Group by to avoid duplicates
-        ORDER BY COALESCE(m.SendTime, '1970-01-01') DESC`
-
-	rows, err := db.c.Query(query, userId, userId)
+        SELECT ConversationId, Name, Photo, LastMessageId, LastMessageTime, LastMessageText, IsPhoto, IsGroup,
+            LastMessageDeleted, UnreadCount
+        FROM (
+            SELECT
+                c.ConversationId,
+                CASE 
+                    WHEN c.GroupId = 1 THEN c.Name
+                    ELSE COALESCE((
+                        SELECT u.Username
+                        FROM participants p2
+                        JOIN users u ON p2.UserId = u.Id
+                        WHERE p2.ConversationId = c.ConversationId AND p2.UserId != ?
+                        ORDER BY p2.UserId
+                        LIMIT 1), '` + DeletedUsername + `')
+                END as Name,
+                ` + photo + ` as Photo,
+                m.MessageId as LastMessageId,
+                m.SendTime as LastMessageTime,
+                COALESCE(m.SendTime, ?) as LastActivity,
+                m.Text as LastMessageText,
+                CASE WHEN m.Photo IS NOT NULL AND m.Photo != '' THEN 1 ELSE 0 END as IsPhoto,  -- Fix photo check
+                CASE WHEN c.GroupId = 1 THEN 1 ELSE 0 END as IsGroup,
+                CASE WHEN m.DeletedAt IS NOT NULL THEN 1 ELSE 0 END as LastMessageDeleted,
+                (
+                    SELECT COUNT(*)
+                    FROM messages unread
+                    WHERE unread.ConversationId = c.ConversationId
+                        AND unread.MessageId > p.LastReadMessageId
+                        AND unread.SenderId != ?
+                        AND unread.DeletedAt IS NULL
+                        AND unread.Event IS NULL
+                ) as UnreadCount
+            FROM conversations c
+            INNER JOIN participants p ON c.ConversationId = p.ConversationId AND p.UserId = ?
+            LEFT JOIN messages m ON c.LastMessageId = m.MessageId
+        ) previews
+        WHERE 1 = 1`
+	args := []interface{}{userId, NoMessageTime, userId, userId}
+
+	if filter.GroupsOnly {
+		query += " AND IsGroup = 1"
+	}
+	if filter.DirectOnly {
+		query += " AND IsGroup = 0"
+	}
+	if filter.UnreadOnly {
+		query += " AND UnreadCount > 0"
+	}
+	if filter.Name != "" {
+		query += " AND LOWER(Name) LIKE LOWER(?) ESCAPE '\\'"
+		args = append(args, containsPattern(filter.Name))
+	}
+	if len(filter.ConversationIds) > 0 {
+		query += " AND ConversationId IN (" + placeholders(len(filter.ConversationIds)) + ")"
+		for _, id := range filter.ConversationIds {
+			args = append(args, id)
+		}
+	}
+	if filter.After != nil {
+		// The time of the last message is in UTC, like the stored ones
+		query += " AND (LastActivity < ? OR (LastActivity = ? AND ConversationId < ?))"
+		args = append(args, filter.After.LastMessageTime.UTC(), filter.After.LastMessageTime.UTC(),
+			filter.After.ConversationId)
+	}
+	query += " ORDER BY LastActivity DESC, ConversationId DESC"
+	if filter.Limit > 0 {
+		// One more, to know whether there is a next page
+		query += " LIMIT ?"
+		args = append(args, filter.Limit+1)
+	}
+
+	rows, err := db.c.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Printf("Query error: %v", err)
-		return nil, err
+		return ConversationList{}, err
 	}
 	defer rows.Close()
 
-	var conversations []ConversationPreview
+	var list ConversationList
 	for rows.Next() {
 		var conv ConversationPreview
 		var photoNull sql.NullString
+		var lastMessageId sql.NullInt64
 		var textNull sql.NullString
 		var timeNull sql.NullTime
 
@@ -58,65 +227,94 @@ func (db *appdbimpl) GetConversations(userId uint64) ([]ConversationPreview, err
 			&conv.ConversationId,
 			&conv.Name,
 			&photoNull,
+			&lastMessageId,
 			&timeNull,
 			&textNull,
 			&conv.IsPhoto,
 			&conv.IsGroup,
+			&conv.LastMessageDeleted,
+			&conv.UnreadCount,
 		)
 		if err != nil {
 			log.Printf("Scan error: %v", err)
-			return nil, err
+			return ConversationList{}, err
 		}
 
 		if photoNull.Valid {
 			conv.Photo = photoNull.String
 		}
-		if textNull.Valid {
+		conv.LastMessageId = int(lastMessageId.Int64)
+		if conv.LastMessageDeleted {
+			conv.LastMessageText = DeletedMessageText
+		} else if textNull.Valid {
 			conv.LastMessageText = textNull.String
 		}
 		if timeNull.Valid {
 			conv.LastMessageTime = timeNull.Time
 		} else {
-			conv.LastMessageTime = time.Now()
+			conv.LastMessageTime = globaltime.Now()
 		}
 
-		conversations = append(conversations, conv)
+		list.Conversations = append(list.Conversations, conv)
 	}
 
 	if err = rows.Err(); err != nil {
 		log.Printf("Rows error: %v", err)
-		return nil, err
+		return ConversationList{}, err
+	}
+
+	if filter.Limit > 0 && len(list.Conversations) > filter.Limit {
+		list.Conversations = list.Conversations[:filter.Limit]
+		next := PreviewCursorOf(list.Conversations[filter.Limit-1])
+		list.NextCursor = &next
 	}
+	return list, nil
+}
 
-	return conversations, nil
+// MarkConversationRead records that the user has read the messages of the conversation up to messageId. The messages
+// read before are not marked unread if messageId is older.
+func (db *appdbimpl) MarkConversationRead(ctx context.Context, convId int, userId uint64, messageId int) error {
+	_, err := db.c.ExecContext(ctx, `
+        UPDATE participants SET LastReadMessageId = ?
+        WHERE ConversationId = ? AND UserId = ? AND LastReadMessageId < ?`,
+		messageId, convId, userId, messageId)
+	return err
 }
 
-func (db *appdbimpl) GetConversationDetails(convId int, userId uint64) (ConversationDetails, error) {
+// GetConversationDetails returns the conversation with a page of its messages, the most recent first, including the
+// tombstones of the deleted ones, and their comments in the order they were added. The cursors of the older and newer
+// messages are set if there are any.
+func (db *appdbimpl) GetConversationDetails(ctx context.Context, convId int, userId uint64, page MessagePage) (ConversationDetails, error) {
 	log.Printf("Getting details for conversation %d", convId)
 
 	var conv ConversationDetails
 	var photoNull sql.NullString // For handling NULL photo
+	var retentionNull sql.NullInt64
 
 	// Get conversation info
-	err := db.c.QueryRow(`
+	err := db.c.QueryRowContext(ctx, `
         SELECT 
             c.ConversationId,
             CASE 
                 WHEN c.GroupId = 1 THEN c.Name
                 WHEN u.Username IS NOT NULL THEN u.Username
-                ELSE 'Unknown'
+                ELSE '`+DeletedUsername+`'
             END as Name,
             c.GroupPhoto as Photo,
-            c.GroupId = 1 as IsGroup
+            c.GroupId = 1 as IsGroup,
+            c.RetentionSeconds
         FROM conversations c
         LEFT JOIN participants p ON c.ConversationId = p.ConversationId AND p.UserId != ?
         LEFT JOIN users u ON p.UserId = u.Id
-        WHERE c.ConversationId = ?`,
+        WHERE c.ConversationId = ?
+        ORDER BY p.UserId
+        LIMIT 1`,
 		userId, convId).Scan(
 		&conv.ConversationId,
 		&conv.Name,
 		&photoNull,
 		&conv.IsGroup,
+		&retentionNull,
 	)
 	if err != nil {
 		log.Printf("Error getting conversation info: %v", err)
@@ -127,9 +325,12 @@ func (db *appdbimpl) GetConversationDetails(convId int, userId uint64) (Conversa
 	if photoNull.Valid {
 		conv.Photo = photoNull.String
 	}
+	conv.RetentionSeconds = retentionNull.Int64
 
-	// Get messages with sender info and comments
-	rows, err := db.c.Query(`
+	// Get messages with sender info and comments. When reading forward from After the page is read oldest first, and
+	// one more message than the limit is read to know whether there are more.
+	forward := page.After != nil && page.Before == nil
+	query := `
         SELECT 
             m.MessageId,
             m.Text,
@@ -137,20 +338,43 @@ func (db *appdbimpl) GetConversationDetails(convId int, userId uint64) (Conversa
             m.Status,
             m.SenderId,
             m.Photo,
-            u.Username as SenderUsername
+            m.DeletedAt,
+            m.Event,
+            ` + senderUsername + ` as SenderUsername
         FROM messages m
-        JOIN users u ON m.SenderId = u.Id
-        WHERE m.ConversationId = ?
-        ORDER BY m.SendTime DESC`, convId)
+        LEFT JOIN users u ON m.SenderId = u.Id
+        WHERE m.ConversationId = ?`
+	args := []interface{}{convId}
+	if page.Before != nil {
+		query += " AND " + messagesBefore
+		args = append(args, page.Before.SendTime.UTC(), page.Before.SendTime.UTC(), page.Before.MessageId)
+	}
+	if page.After != nil {
+		query += " AND " + messagesAfter
+		args = append(args, page.After.SendTime.UTC(), page.After.SendTime.UTC(), page.After.MessageId)
+	}
+	if forward {
+		query += " ORDER BY m.SendTime, m.MessageId"
+	} else {
+		query += " ORDER BY m.SendTime DESC, m.MessageId DESC"
+	}
+	if page.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, page.Limit+1)
+	}
+	rows, err := db.c.QueryContext(ctx, query, args...)
 	if err != nil {
 		log.Printf("Error getting messages: %v", err)
 		return conv, err
 	}
 	defer rows.Close()
 
+	var messageIds []int
 	for rows.Next() {
 		var msg MessageWithComments
 		var photoNull sql.NullString
+		var deletedAt sql.NullTime
+		var event sql.NullString
 		err := rows.Scan(
 			&msg.MessageId,
 			&msg.Text,
@@ -158,6 +382,8 @@ func (db *appdbimpl) GetConversationDetails(convId int, userId uint64) (Conversa
 			&msg.Status,
 			&msg.SenderId,
 			&photoNull,
+			&deletedAt,
+			&event,
 			&msg.SenderUsername,
 		)
 		if err != nil {
@@ -168,70 +394,197 @@ func (db *appdbimpl) GetConversationDetails(convId int, userId uint64) (Conversa
 		if photoNull.Valid {
 			msg.Photo = photoNull.String
 		}
-
-		// Get comments for this message
-		comments, err := db.getMessageComments(msg.MessageId)
-		if err != nil {
-			log.Printf("Error getting comments: %v", err)
-			return conv, err
+		if deletedAt.Valid {
+			msg.DeletedAt = &deletedAt.Time
+			msg.Text = DeletedMessageText
 		}
-		msg.Comments = comments
+		msg.Event = event.String
 
 		conv.Messages = append(conv.Messages, msg)
+		messageIds = append(messageIds, msg.MessageId)
 	}
 
 	if err = rows.Err(); err != nil {
 		log.Printf("Rows error in messages: %v", err)
 		return conv, err
 	}
+	_ = rows.Close()
+
+	more := page.Limit > 0 && len(conv.Messages) > page.Limit
+	if more {
+		conv.Messages = conv.Messages[:page.Limit]
+		messageIds = messageIds[:page.Limit]
+	}
+	if forward {
+		for i, j := 0, len(conv.Messages)-1; i < j; i, j = i+1, j-1 {
+			conv.Messages[i], conv.Messages[j] = conv.Messages[j], conv.Messages[i]
+		}
+	}
+	if err := db.setMessageCursors(ctx, &conv, page, more && !forward, more && forward); err != nil {
+		log.Printf("Error checking for more messages: %v", err)
+		return conv, err
+	}
+
+	// Get the comments of all the messages at once, instead of a query for each message
+	comments, err := db.getMessagesComments(ctx, messageIds)
+	if err != nil {
+		log.Printf("Error getting comments: %v", err)
+		return conv, err
+	}
+	for i := range conv.Messages {
+		conv.Messages[i].Comments = comments[conv.Messages[i].MessageId]
+	}
 
 	return conv, nil
 }
 
-func (db *appdbimpl) getMessageComments(messageId int) ([]Comment, error) {
-	rows, err := db.c.Query(`
+// senderUsername is the username of the sender u of a message, LEFT JOINed as it is missing once the sender is
+// deleted.
+const senderUsername = "COALESCE(u.Username, '" + DeletedUsername + "')"
+
+// messagesBefore and messagesAfter select the messages older and newer than a cursor, whose send time is passed
+// twice, in UTC like the stored ones, and then its message ID. The ID breaks the ties between messages sent at the
+// same time.
+const (
+	messagesBefore = "(m.SendTime < ? OR (m.SendTime = ? AND m.MessageId < ?))"
+	messagesAfter  = "(m.SendTime > ? OR (m.SendTime = ? AND m.MessageId > ?))"
+)
+
+// setMessageCursors sets the cursors of the messages older and newer than the page of the conversation, if there are
+// any. hasOlder and hasNewer tell that there are, when already known from the page query. A page without messages
+// has no cursors.
+func (db *appdbimpl) setMessageCursors(ctx context.Context, conv *ConversationDetails, page MessagePage, hasOlder bool, hasNewer bool) error {
+	if len(conv.Messages) == 0 {
+		return nil
+	}
+	newest := CursorOf(conv.Messages[0].Message)
+	oldest := CursorOf(conv.Messages[len(conv.Messages)-1].Message)
+
+	// Without a cursor on a side the page query reached the end of the history on that side, unless it stopped at
+	// the limit
+	var err error
+	if !hasOlder && page.After != nil {
+		hasOlder, err = db.hasMessages(ctx, conv.ConversationId, messagesBefore, oldest)
+		if err != nil {
+			return err
+		}
+	}
+	if !hasNewer && page.Before != nil {
+		hasNewer, err = db.hasMessages(ctx, conv.ConversationId, messagesAfter, newest)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hasOlder {
+		conv.NextCursor = &oldest
+	}
+	if hasNewer {
+		conv.PrevCursor = &newest
+	}
+	return nil
+}
+
+// hasMessages tells whether the conversation has messages on the side of the cursor selected by the condition,
+// messagesBefore or messagesAfter.
+func (db *appdbimpl) hasMessages(ctx context.Context, convId int, condition string, cursor MessageCursor) (bool, error) {
+	var exists bool
+	err := db.c.QueryRowContext(ctx, `
+        SELECT EXISTS (
+            SELECT 1 FROM messages m
+            WHERE m.ConversationId = ? AND `+condition+`
+        )`, convId, cursor.SendTime.UTC(), cursor.SendTime.UTC(), cursor.MessageId).Scan(&exists)
+	return exists, err
+}
+
+// maxBatchSize is the largest number of values in the IN list of a batched query, well below the limit on the
+// variables of a query of both SQLite and PostgreSQL.
+const maxBatchSize = 500
+
+// getMessagesComments returns the comments of the messages by message ID, each in the order it was added. The
+// comments are read with a query for each maxBatchSize messages.
+func (db *appdbimpl) getMessagesComments(ctx context.Context, messageIds []int) (map[int][]Comment, error) {
+	comments := make(map[int][]Comment)
+	for len(messageIds) > 0 {
+		batch := messageIds
+		if len(batch) > maxBatchSize {
+			batch = batch[:maxBatchSize]
+		}
+		messageIds = messageIds[len(batch):]
+
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		err := db.queryComments(ctx, comments, `
         SELECT 
+            c.MessageId,
             c.UserId,
             u.Username,
             c.Emoji
         FROM comments c
         JOIN users u ON c.UserId = u.Id
-        WHERE c.MessageId = ?`, messageId)
+        WHERE c.MessageId IN (`+placeholders(len(batch))+`)
+        ORDER BY c.CommentId`, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return comments, nil
+}
+
+// queryComments runs the query of comments, and adds them to the comments of their messages.
+func (db *appdbimpl) queryComments(ctx context.Context, comments map[int][]Comment, query string, args ...interface{}) error {
+	rows, err := db.c.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var comments []Comment
 	for rows.Next() {
+		var messageId int
 		var comment Comment
-		err := rows.Scan(&comment.UserId, &comment.Username, &comment.Emoji)
+		err := rows.Scan(&messageId, &comment.UserId, &comment.Username, &comment.Emoji)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		comments = append(comments, comment)
+		comments[messageId] = append(comments[messageId], comment)
 	}
 
 	if err = rows.Err(); err != nil {
 		log.Printf("Rows error in comments: %v", err)
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	return comments, nil
+// likeEscaper escapes the wildcards of LIKE patterns, and the escape character itself.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// containsPattern returns the LIKE pattern of the texts containing text, whose % and _ are matched literally. The LIKE
+// must be followed by ESCAPE '\'.
+func containsPattern(text string) string {
+	return "%" + likeEscaper.Replace(text) + "%"
+}
+
+// placeholders returns n comma separated ? placeholders, for an IN list.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
 }
 
-func (db *appdbimpl) SearchUsers(query string) ([]User, error) {
+func (db *appdbimpl) SearchUsers(ctx context.Context, query string) ([]User, error) {
 	log.Printf("SearchUsers called with query: %s", query)
 
-	// Use LIKE with wildcards for partial matching
+	// Use LIKE with wildcards for partial, case-insensitive matching
 	searchQuery := `
-        SELECT Id, Username 
-        FROM users 
-        WHERE Username LIKE ?
-        ORDER BY Username`
+        SELECT u.Id, u.Username, b.UserId IS NOT NULL
+        FROM users u
+        LEFT JOIN bots b ON b.UserId = u.Id
+        WHERE LOWER(u.Username) LIKE LOWER(?) ESCAPE '\'
+        ORDER BY u.Username`
 
 	log.Printf("Executing query: %s", searchQuery)
-	rows, err := db.c.Query(searchQuery, "%"+query+"%")
+	rows, err := db.c.QueryContext(ctx, searchQuery, containsPattern(query))
 	if err != nil {
 		log.Printf("Error executing query: %v", err)
 		return nil, err
@@ -241,7 +594,7 @@ func (db *appdbimpl) SearchUsers(query string) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.Id, &user.Username)
+		err := rows.Scan(&user.Id, &user.Username, &user.IsBot)
 		if err != nil {
 			log.Printf("Error scanning row: %v", err)
 			return nil, err
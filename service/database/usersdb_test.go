@@ -0,0 +1,265 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// benchMessages is the number of messages of the conversation of BenchmarkGetConversationDetails.
+const benchMessages = 50000
+
+// busyConversation is a SQLite database with a group holding many messages, seeded once and shared by the
+// benchmarks. TestMain removes it.
+var busyConversation struct {
+	once   sync.Once
+	dir    string
+	db     *sql.DB
+	appdb  AppDatabase
+	convId int
+	userId uint64
+	// messageIds are the messages of the group, the most recent first
+	messageIds []int
+	err        error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if busyConversation.db != nil {
+		_ = busyConversation.db.Close()
+	}
+	if busyConversation.dir != "" {
+		_ = os.RemoveAll(busyConversation.dir)
+	}
+	os.Exit(code)
+}
+
+// openSQLite opens a new SQLite database in the file. It returns ErrNoFTS5 if SQLite has been built without FTS5.
+func openSQLite(path string) (*sql.DB, AppDatabase, error) {
+	db, err := OpenSQLite(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	appdb, err := New(db, Config{})
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	return db, appdb, nil
+}
+
+// seedConversation creates three users and a group with the messages, sent by the first one, one second apart. The
+// second user reacts to one message every 10 and the third to one every 7, before the second one on the even
+// messages. It returns the group and the first user.
+func seedConversation(ctx context.Context, db *sql.DB, appdb AppDatabase, messages int) (int, uint64, error) {
+	var users []User
+	for _, username := range []string{"alice", "bob", "carol"} {
+		user, err := appdb.CreateUser(ctx, User{Username: username})
+		if err != nil {
+			return 0, 0, err
+		}
+		users = append(users, user)
+	}
+	group, err := appdb.CreateGroup(ctx, "busy", users[0].Id)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, user := range users[1:] {
+		if err := appdb.AddUserToGroup(ctx, user.Username, group.ConversationId); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// A single transaction, as one for each message would take minutes
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	sendTime := time.Now().UTC().Add(-time.Duration(messages) * time.Second)
+	for i := 0; i < messages; i++ {
+		result, err := tx.ExecContext(ctx, `
+            INSERT INTO messages (ConversationId, SenderId, RecipientId, Text, Status, SendTime, Photo)
+            VALUES (?, ?, 0, ?, 'Sent', ?, '')`,
+			group.ConversationId, users[0].Id, fmt.Sprintf("message %d", i), sendTime.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			return 0, 0, err
+		}
+		messageId, err := result.LastInsertId()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var reactions []User
+		if i%10 == 0 {
+			reactions = append(reactions, users[1])
+		}
+		if i%7 == 0 {
+			reactions = append(reactions, users[2])
+		}
+		if i%2 == 0 && len(reactions) == 2 {
+			reactions[0], reactions[1] = reactions[1], reactions[0]
+		}
+		for _, user := range reactions {
+			_, err = tx.ExecContext(ctx, "INSERT INTO comments (MessageId, UserId, Emoji) VALUES (?, ?, ?)",
+				messageId, user.Id, "👍 "+user.Username)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return group.ConversationId, users[0].Id, nil
+}
+
+// commentsPerMessage reads the comments of the messages like GetConversationDetails used to, with a query for each
+// message.
+func commentsPerMessage(ctx context.Context, db *sql.DB, messageIds []int) (map[int][]Comment, error) {
+	comments := make(map[int][]Comment)
+	for _, id := range messageIds {
+		rows, err := db.QueryContext(ctx, `
+            SELECT c.UserId, u.Username, c.Emoji
+            FROM comments c
+            JOIN users u ON c.UserId = u.Id
+            WHERE c.MessageId = ?
+            ORDER BY c.CommentId`, id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var comment Comment
+			if err := rows.Scan(&comment.UserId, &comment.Username, &comment.Emoji); err != nil {
+				_ = rows.Close()
+				return nil, err
+			}
+			comments[id] = append(comments[id], comment)
+		}
+		_ = rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return comments, nil
+}
+
+// TestGetConversationDetailsComments checks that the comments read in batches are the ones read a message at a
+// time, in a conversation with messages in more than one batch.
+func TestGetConversationDetailsComments(t *testing.T) {
+	db, appdb, err := openSQLite(filepath.Join(t.TempDir(), "wasatext.db"))
+	if errors.Is(err, ErrNoFTS5) {
+		t.Skip("run the tests with -tags sqlite_fts5: ", err)
+	} else if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	ctx := context.Background()
+	messages := 2*maxBatchSize + 123
+	convId, userId, err := seedConversation(ctx, db, appdb, messages)
+	if err != nil {
+		t.Fatalf("seeding the conversation: %v", err)
+	}
+
+	details, err := appdb.GetConversationDetails(ctx, convId, userId, MessagePage{})
+	if err != nil {
+		t.Fatalf("getting the conversation: %v", err)
+	}
+	if len(details.Messages) != messages {
+		t.Fatalf("got %d messages, want %d", len(details.Messages), messages)
+	}
+	var messageIds []int
+	for _, msg := range details.Messages {
+		messageIds = append(messageIds, msg.MessageId)
+	}
+	want, err := commentsPerMessage(ctx, db, messageIds)
+	if err != nil {
+		t.Fatalf("reading the comments of each message: %v", err)
+	}
+
+	commented := 0
+	for _, msg := range details.Messages {
+		if !reflect.DeepEqual(msg.Comments, want[msg.MessageId]) {
+			t.Errorf("comments of message %d: got %v, want %v", msg.MessageId, msg.Comments, want[msg.MessageId])
+		}
+		if len(msg.Comments) > 0 {
+			commented++
+		}
+	}
+	if commented != len(want) || commented == 0 {
+		t.Errorf("got %d messages with comments, want %d", commented, len(want))
+	}
+}
+
+// BenchmarkGetConversationDetails times opening a conversation with benchMessages messages, some with reactions. The
+// comments sub-benchmarks compare reading the reactions with a query for up to maxBatchSize messages, like
+// GetConversationDetails does, and with the former query per message.
+func BenchmarkGetConversationDetails(b *testing.B) {
+	// The database methods log every call
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+
+	ctx := context.Background()
+	busyConversation.once.Do(func() {
+		c := &busyConversation
+		if c.dir, c.err = os.MkdirTemp("", "wasatext-bench"); c.err != nil {
+			return
+		}
+		if c.db, c.appdb, c.err = openSQLite(filepath.Join(c.dir, "wasatext.db")); c.err != nil {
+			return
+		}
+		if c.convId, c.userId, c.err = seedConversation(ctx, c.db, c.appdb, benchMessages); c.err != nil {
+			return
+		}
+		var details ConversationDetails
+		if details, c.err = c.appdb.GetConversationDetails(ctx, c.convId, c.userId, MessagePage{}); c.err != nil {
+			return
+		}
+		for _, msg := range details.Messages {
+			c.messageIds = append(c.messageIds, msg.MessageId)
+		}
+	})
+	c := &busyConversation
+	if errors.Is(c.err, ErrNoFTS5) {
+		b.Skip("run the benchmarks with -tags sqlite_fts5: ", c.err)
+	} else if c.err != nil {
+		b.Fatalf("seeding the conversation: %v", c.err)
+	}
+
+	b.Run("details", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			details, err := c.appdb.GetConversationDetails(ctx, c.convId, c.userId, MessagePage{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(details.Messages) != benchMessages {
+				b.Fatalf("got %d messages, want %d", len(details.Messages), benchMessages)
+			}
+		}
+	})
+	b.Run("comments/batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.appdb.(*appdbimpl).getMessagesComments(ctx, c.messageIds); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("comments/per-message", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := commentsPerMessage(ctx, c.db, c.messageIds); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
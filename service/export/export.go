@@ -0,0 +1,240 @@
+/*
+Package export builds the archive of the data WASAText holds about a user, and builds it in the background for the
+users who ask for it.
+
+The archive is a ZIP file with:
+
+	profile.json                      the account: ID, username, whether it is a bot, and its photo
+	profile-photo.<ext>               the photo of the user, if any
+	sessions.json                     the sessions of the user (devices and times, not the tokens)
+	bots.json                         the bots the user owns
+	conversations.json                the conversations of the user, with the paths of their files
+	conversations/<id>/photo.<ext>    the photo of a group, if any
+	conversations/<id>/messages.json  the messages of a conversation, the most recent first, with their reactions
+	reactions.json                    the reactions added by the user
+	media/<message id>.<ext>          the photos sent in the messages
+
+Photos are stored by the database encoded in base64; they are decoded into image files, named after their type.
+*/
+package export
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"io"
+	"net/http"
+	"time"
+)
+
+// pageSize is the number of messages read with each query
+const pageSize = 500
+
+// imageExtensions are the extensions of the photo files, by their detected content type
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+type profile struct {
+	Id       uint64 `json:"id"`
+	Username string `json:"username"`
+	IsBot    bool   `json:"isBot"`
+	Photo    string `json:"photo,omitempty"`
+}
+
+type conversation struct {
+	ConversationId int    `json:"conversationId"`
+	Name           string `json:"name"`
+	IsGroup        bool   `json:"isGroup"`
+	Photo          string `json:"photo,omitempty"`
+	Messages       string `json:"messages"`
+}
+
+type message struct {
+	MessageId      int                `json:"messageId"`
+	Text           string             `json:"text"`
+	SendTime       time.Time          `json:"sendTime"`
+	Status         string             `json:"status"`
+	SenderId       uint64             `json:"senderId"`
+	SenderUsername string             `json:"senderUsername"`
+	Photo          string             `json:"photo,omitempty"`
+	DeletedAt      *time.Time         `json:"deletedAt,omitempty"`
+	Event          string             `json:"event,omitempty"`
+	Reactions      []database.Comment `json:"reactions"`
+}
+
+type reaction struct {
+	ConversationId int    `json:"conversationId"`
+	MessageId      int    `json:"messageId"`
+	Emoji          string `json:"emoji"`
+}
+
+// Write writes the archive of the data of the user to w.
+func Write(ctx context.Context, db database.AppDatabase, userId uint64, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	user, err := db.GetUser(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("getting the user: %w", err)
+	}
+	p := profile{Id: user.Id, Username: user.Username, IsBot: user.IsBot}
+	photo, err := db.GetUserPhoto(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("getting the photo of the user: %w", err)
+	}
+	if photo != "" {
+		if p.Photo, err = writePhoto(zw, "profile-photo", photo); err != nil {
+			return err
+		}
+	}
+	if err := writeJSON(zw, "profile.json", p); err != nil {
+		return err
+	}
+
+	sessions, err := db.ListSessions(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("listing the sessions: %w", err)
+	}
+	if sessions == nil {
+		sessions = []database.Session{}
+	}
+	if err := writeJSON(zw, "sessions.json", sessions); err != nil {
+		return err
+	}
+	bots, err := db.ListBots(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("listing the bots: %w", err)
+	}
+	if bots == nil {
+		bots = []database.Bot{}
+	}
+	if err := writeJSON(zw, "bots.json", bots); err != nil {
+		return err
+	}
+
+	list, err := db.GetConversations(ctx, userId, database.ConversationFilter{WithPhotos: true})
+	if err != nil {
+		return fmt.Errorf("listing the conversations: %w", err)
+	}
+	conversations := []conversation{}
+	reactions := []reaction{}
+	for _, preview := range list.Conversations {
+		dir := fmt.Sprintf("conversations/%d/", preview.ConversationId)
+		c := conversation{
+			ConversationId: preview.ConversationId,
+			Name:           preview.Name,
+			IsGroup:        preview.IsGroup,
+			Messages:       dir + "messages.json",
+		}
+		if preview.Photo != "" {
+			if c.Photo, err = writePhoto(zw, dir+"photo", preview.Photo); err != nil {
+				return err
+			}
+		}
+		own, err := writeMessages(ctx, zw, db, userId, c)
+		if err != nil {
+			return err
+		}
+		reactions = append(reactions, own...)
+		conversations = append(conversations, c)
+	}
+	if err := writeJSON(zw, "conversations.json", conversations); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "reactions.json", reactions); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeMessages writes the messages of the conversation, a page at a time, with their photos. It returns the
+// reactions added by the user.
+func writeMessages(ctx context.Context, zw *zip.Writer, db database.AppDatabase, userId uint64, c conversation) ([]reaction, error) {
+	// The messages are read before the file is created, as files of the archive are written one at a time
+	var messages []message
+	var reactions []reaction
+	page := database.MessagePage{Limit: pageSize}
+	for {
+		details, err := db.GetConversationDetails(ctx, c.ConversationId, userId, page)
+		if err != nil {
+			return nil, fmt.Errorf("getting the messages of conversation %d: %w", c.ConversationId, err)
+		}
+		for _, m := range details.Messages {
+			msg := message{
+				MessageId:      m.MessageId,
+				Text:           m.Text,
+				SendTime:       m.SendTime.UTC(),
+				Status:         m.Status,
+				SenderId:       m.SenderId,
+				SenderUsername: m.SenderUsername,
+				DeletedAt:      m.DeletedAt,
+				Event:          m.Event,
+				Reactions:      m.Comments,
+			}
+			if msg.Reactions == nil {
+				msg.Reactions = []database.Comment{}
+			}
+			if m.Photo != "" {
+				if msg.Photo, err = writePhoto(zw, fmt.Sprintf("media/%d", m.MessageId), m.Photo); err != nil {
+					return nil, err
+				}
+			}
+			for _, cm := range m.Comments {
+				if cm.UserId == userId {
+					reactions = append(reactions, reaction{ConversationId: c.ConversationId, MessageId: m.MessageId, Emoji: cm.Emoji})
+				}
+			}
+			messages = append(messages, msg)
+		}
+		if details.NextCursor == nil {
+			break
+		}
+		page.Before = details.NextCursor
+	}
+
+	if messages == nil {
+		messages = []message{}
+	}
+	return reactions, writeJSON(zw, c.Messages, messages)
+}
+
+// writePhoto writes the photo, encoded in base64, into the archive as an image file named base plus the extension of
+// its type, and returns the name. Photos that aren't valid base64 are written as they are, with the .base64 extension.
+func writePhoto(zw *zip.Writer, base string, photo string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(photo)
+	name := base + ".base64"
+	if err != nil {
+		data = []byte(photo)
+	} else if ext, ok := imageExtensions[http.DetectContentType(data)]; ok {
+		name = base + ext
+	} else {
+		name = base + ".bin"
+	}
+
+	f, err := zw.Create(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// writeJSON writes the value into the archive as an indented JSON file.
+func writeJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,258 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database/memory"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+// start is the time of the first message of the seeded conversations
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// pngPhoto is the start of a PNG file, enough for its type to be detected
+var pngPhoto = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+// seed holds the data created by seedDatabase.
+type seed struct {
+	alice, bob, carol database.User
+
+	// direct is the conversation of alice and bob, with more messages than a page; group the group of the three;
+	// other the conversation of bob and carol
+	direct, group, other int
+
+	// photoMessage is the message of direct with a photo, and reacted the one alice reacted to
+	photoMessage, reacted int
+}
+
+func check(t *testing.T, err error, format string, args ...interface{}) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+	}
+}
+
+func sendMessage(t *testing.T, db database.AppDatabase, convId int, sender database.User, m database.Message) int {
+	t.Helper()
+	m.ConversationId = convId
+	m.SenderId = sender.Id
+	m.Status = "sent"
+	m, err := db.CreateMessage(ctx, m)
+	check(t, err, "sending %q", m.Text)
+	check(t, db.UpdateLastMessage(ctx, m.MessageId, convId), "updating the last message to %q", m.Text)
+	return m.MessageId
+}
+
+// seedDatabase creates alice, bob and carol, with the conversations of seed. Everything of bob and carol that alice
+// can't see contains "secret".
+func seedDatabase(t *testing.T, db database.AppDatabase) seed {
+	t.Helper()
+	var s seed
+	var err error
+	s.alice, err = db.CreateUser(ctx, database.User{Username: "alice"})
+	check(t, err, "creating alice")
+	s.bob, err = db.CreateUser(ctx, database.User{Username: "bob"})
+	check(t, err, "creating bob")
+	s.carol, err = db.CreateUser(ctx, database.User{Username: "carol"})
+	check(t, err, "creating carol")
+	photo := base64.StdEncoding.EncodeToString(pngPhoto)
+	check(t, db.SetUserPhoto(ctx, s.alice.Id, photo), "setting the photo of alice")
+	_, err = db.CreateSession(ctx, s.alice.Id, "alice-token", "alice phone", globaltime.Now().Add(time.Hour))
+	check(t, err, "creating a session")
+	_, err = db.CreateSession(ctx, s.bob.Id, "bob-token", "secret laptop", globaltime.Now().Add(time.Hour))
+	check(t, err, "creating a session")
+	_, err = db.CreateBot(ctx, s.bob.Id, "secretbot")
+	check(t, err, "creating a bot")
+
+	s.direct, err = db.GetOrCreateDirectConversation(ctx, s.alice.Id, s.bob.Id, true)
+	check(t, err, "creating the conversation of alice and bob")
+	for i := 0; i < pageSize+3; i++ {
+		sender := s.alice
+		if i%2 == 1 {
+			sender = s.bob
+		}
+		m := database.Message{Text: fmt.Sprintf("message %d", i), SendTime: start.Add(time.Duration(i) * time.Second)}
+		if i == 10 {
+			m.Photo = photo
+		}
+		id := sendMessage(t, db, s.direct, sender, m)
+		if i == 10 {
+			s.photoMessage = id
+		}
+		if i == 20 {
+			s.reacted = id
+		}
+	}
+	check(t, db.CommentMessage(ctx, s.reacted, s.alice.Id, "👍"), "reacting as alice")
+	check(t, db.CommentMessage(ctx, s.photoMessage, s.bob.Id, "😂"), "reacting as bob")
+
+	g, err := db.CreateGroup(ctx, "team", s.alice.Id)
+	check(t, err, "creating the group")
+	s.group = g.ConversationId
+	check(t, db.AddUserToGroup(ctx, "bob", s.group), "adding bob to the group")
+	check(t, db.SetGroupPhoto(ctx, s.group, photo), "setting the photo of the group")
+	sendMessage(t, db, s.group, s.bob, database.Message{Text: "hello team", SendTime: start.Add(time.Hour)})
+
+	s.other, err = db.GetOrCreateDirectConversation(ctx, s.bob.Id, s.carol.Id, true)
+	check(t, err, "creating the conversation of bob and carol")
+	otherMessage := sendMessage(t, db, s.other, s.bob, database.Message{Text: "secret", SendTime: start, Photo: photo})
+	check(t, db.CommentMessage(ctx, otherMessage, s.carol.Id, "secret"), "reacting as carol")
+	return s
+}
+
+// readArchive returns the files of the ZIP archive by name.
+func readArchive(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	check(t, err, "opening the archive")
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		check(t, err, "opening %s", f.Name)
+		files[f.Name], err = io.ReadAll(r)
+		check(t, err, "reading %s", f.Name)
+		_ = r.Close()
+	}
+	return files
+}
+
+// decodeFile decodes the JSON file of the archive into v.
+func decodeFile(t *testing.T, files map[string][]byte, name string, v interface{}) {
+	t.Helper()
+	data, ok := files[name]
+	if !ok {
+		t.Fatalf("%s is missing", name)
+	}
+	check(t, json.Unmarshal(data, v), "decoding %s", name)
+}
+
+func TestWrite(t *testing.T) {
+	db := memory.New()
+	s := seedDatabase(t, db)
+
+	var buf bytes.Buffer
+	check(t, Write(ctx, db, s.alice.Id, &buf), "writing the archive")
+	files := readArchive(t, buf.Bytes())
+
+	var p profile
+	decodeFile(t, files, "profile.json", &p)
+	if p.Id != s.alice.Id || p.Username != "alice" || p.IsBot || p.Photo != "profile-photo.png" {
+		t.Errorf("profile: got %+v", p)
+	}
+	if !bytes.Equal(files["profile-photo.png"], pngPhoto) {
+		t.Errorf("profile photo: got %q, want the decoded photo", files["profile-photo.png"])
+	}
+
+	var sessions []database.Session
+	decodeFile(t, files, "sessions.json", &sessions)
+	if len(sessions) != 1 || sessions[0].UserAgent != "alice phone" {
+		t.Errorf("sessions: got %+v, want the one of alice", sessions)
+	}
+	var bots []database.Bot
+	decodeFile(t, files, "bots.json", &bots)
+	if len(bots) != 0 {
+		t.Errorf("bots: got %+v, want none", bots)
+	}
+
+	var conversations []conversation
+	decodeFile(t, files, "conversations.json", &conversations)
+	want := []conversation{
+		{ConversationId: s.group, Name: "team", IsGroup: true, Photo: fmt.Sprintf("conversations/%d/photo.png", s.group),
+			Messages: fmt.Sprintf("conversations/%d/messages.json", s.group)},
+		{ConversationId: s.direct, Name: "bob", Messages: fmt.Sprintf("conversations/%d/messages.json", s.direct)},
+	}
+	if fmt.Sprint(conversations) != fmt.Sprint(want) {
+		t.Errorf("conversations: got %+v, want %+v", conversations, want)
+	}
+	if !bytes.Equal(files[want[0].Photo], pngPhoto) {
+		t.Errorf("group photo: got %q, want the decoded photo", files[want[0].Photo])
+	}
+
+	// The messages of the direct conversation are on more than one page, and all of them are written
+	var messages []message
+	decodeFile(t, files, want[1].Messages, &messages)
+	if len(messages) != pageSize+3 {
+		t.Fatalf("got %d messages, want %d", len(messages), pageSize+3)
+	}
+	for i, m := range messages {
+		wantText := fmt.Sprintf("message %d", pageSize+2-i)
+		if m.Text != wantText || !m.SendTime.Equal(start.Add(time.Duration(pageSize+2-i)*time.Second)) {
+			t.Errorf("message %d: got %q at %v, want %q, the most recent first", i, m.Text, m.SendTime, wantText)
+		}
+		switch m.MessageId {
+		case s.photoMessage:
+			if wantPhoto := fmt.Sprintf("media/%d.png", m.MessageId); m.Photo != wantPhoto || len(m.Reactions) != 1 ||
+				m.Reactions[0].Emoji != "😂" {
+				t.Errorf("message with a photo: got %+v, want the photo %s and the reaction of bob", m, wantPhoto)
+			}
+		case s.reacted:
+			if len(m.Reactions) != 1 || m.Reactions[0].Username != "alice" {
+				t.Errorf("reacted message: got reactions %+v, want the one of alice", m.Reactions)
+			}
+		default:
+			if m.Photo != "" || len(m.Reactions) != 0 {
+				t.Errorf("message %d: got photo %q and reactions %+v, want none", m.MessageId, m.Photo, m.Reactions)
+			}
+		}
+	}
+	if !bytes.Equal(files[fmt.Sprintf("media/%d.png", s.photoMessage)], pngPhoto) {
+		t.Errorf("photo of the message is missing or not decoded")
+	}
+
+	var reactions []reaction
+	decodeFile(t, files, "reactions.json", &reactions)
+	if len(reactions) != 1 || reactions[0] != (reaction{ConversationId: s.direct, MessageId: s.reacted, Emoji: "👍"}) {
+		t.Errorf("reactions: got %+v, want the one of alice", reactions)
+	}
+
+	// Nothing of the conversations of the others, nor of their sessions and bots
+	for name, data := range files {
+		if strings.HasPrefix(name, fmt.Sprintf("conversations/%d/", s.other)) || strings.Contains(string(data), "secret") {
+			t.Errorf("%s holds data of the other users", name)
+		}
+	}
+	if len(files) != 10 {
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		t.Errorf("got the files %v, want 10", names)
+	}
+}
+
+func TestWritePhotos(t *testing.T) {
+	tests := map[string]struct {
+		photo string
+		name  string
+		data  []byte
+	}{
+		"PNG":          {base64.StdEncoding.EncodeToString(pngPhoto), "photo.png", pngPhoto},
+		"unknown type": {base64.StdEncoding.EncodeToString([]byte("plain text")), "photo.bin", []byte("plain text")},
+		"not base64":   {"not base64!", "photo.base64", []byte("not base64!")},
+	}
+	for name, tt := range tests {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		written, err := writePhoto(zw, "photo", tt.photo)
+		check(t, err, "%s: writing the photo", name)
+		check(t, zw.Close(), "%s: closing the archive", name)
+
+		if written != tt.name {
+			t.Errorf("%s: got the name %s, want %s", name, written, tt.name)
+		}
+		if data := readArchive(t, buf.Bytes())[tt.name]; !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: got %q, want %q", name, data, tt.data)
+		}
+	}
+}
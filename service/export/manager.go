@@ -0,0 +1,261 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Status is the state of the export of a user.
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusReady   Status = "ready"
+	StatusFailed  Status = "failed"
+)
+
+var (
+	// ErrNoExport is returned when the user has no export, or it has expired
+	ErrNoExport = errors.New("no export")
+
+	// ErrNotReady is returned when the archive of the export is not ready, because it is being built or it failed
+	ErrNotReady = errors.New("export not ready")
+)
+
+// Job is the export of a user.
+type Job struct {
+	Status    Status    `json:"status"`
+	StartedAt time.Time `json:"startedAt"`
+
+	// Size is the size of the archive, and ExpiresAt when it is removed, once it is ready
+	Size      int64      `json:"size,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Config configures a Manager.
+type Config struct {
+	// Logger receives the errors of the exports
+	Logger logrus.FieldLogger
+
+	// Database is where the data are read from
+	Database database.AppDatabase
+
+	// Dir is the directory of the archives, created if missing. Archives left by a previous run are removed
+	Dir string
+
+	// TTL is how long an archive is kept once it is ready
+	TTL time.Duration
+}
+
+// job is an export, with the file of its archive.
+type job struct {
+	Job
+	path string
+	done chan struct{}
+
+	// removed tells that the export was removed while being built, so its archive must be removed once done
+	removed bool
+}
+
+// Manager builds the archives of the users in the background, one at a time for each user, and keeps each one until
+// it expires or the user asks for a new one. The state of the exports is kept in memory only. It is safe for
+// concurrent use.
+type Manager struct {
+	cfg Config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[uint64]*job
+}
+
+// New returns a new Manager with the configuration.
+func New(cfg Config) (*Manager, error) {
+	if cfg.Logger == nil || cfg.Database == nil {
+		return nil, errors.New("logger and database are required")
+	}
+	if cfg.TTL <= 0 {
+		return nil, errors.New("export TTL must be positive")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	for _, pattern := range []string{"*.zip", "*.zip.partial"} {
+		stale, err := filepath.Glob(filepath.Join(cfg.Dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range stale {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{cfg: cfg, ctx: ctx, cancel: cancel, jobs: make(map[uint64]*job)}, nil
+}
+
+// Start starts a new export for the user, replacing the previous one, unless one is already being built. It returns
+// the export, and a channel closed when it is done.
+func (m *Manager) Start(userId uint64) (Job, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+	if j, ok := m.jobs[userId]; ok {
+		if j.Status == StatusPending {
+			return j.Job, j.done
+		}
+		m.remove(userId, j)
+	}
+
+	j := &job{
+		Job:  Job{Status: StatusPending, StartedAt: globaltime.Now()},
+		path: filepath.Join(m.cfg.Dir, fmt.Sprintf("%d-%d.zip", userId, globaltime.Now().UnixNano())),
+		done: make(chan struct{}),
+	}
+	m.jobs[userId] = j
+	m.wg.Add(1)
+	go m.run(userId, j)
+	return j.Job, j.done
+}
+
+// Get returns the export of the user, or ErrNoExport.
+func (m *Manager) Get(userId uint64) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+	j, ok := m.jobs[userId]
+	if !ok {
+		return Job{}, ErrNoExport
+	}
+	return j.Job, nil
+}
+
+// Open opens the archive of the export of the user. It returns ErrNoExport or ErrNotReady if there is no archive.
+func (m *Manager) Open(userId uint64) (*os.File, Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+	j, ok := m.jobs[userId]
+	if !ok {
+		return nil, Job{}, ErrNoExport
+	}
+	if j.Status != StatusReady {
+		return nil, j.Job, ErrNotReady
+	}
+	// The file is removed only with the lock held, and an open file can still be read once removed
+	f, err := os.Open(j.path)
+	return f, j.Job, err
+}
+
+// Remove removes the export of the user, if any, with its archive. An archive being built is removed once it is done.
+func (m *Manager) Remove(userId uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[userId]
+	if !ok {
+		return
+	}
+	if j.Status == StatusPending {
+		j.removed = true
+		delete(m.jobs, userId)
+		return
+	}
+	m.remove(userId, j)
+}
+
+// Close cancels the exports being built, and waits for them to stop.
+func (m *Manager) Close() error {
+	m.cancel()
+	m.wg.Wait()
+	return nil
+}
+
+// run builds the archive of the export, and records the outcome.
+func (m *Manager) run(userId uint64, j *job) {
+	defer m.wg.Done()
+	defer close(j.done)
+
+	size, err := m.write(userId, j.path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j.removed {
+		if err == nil {
+			m.removeArchive(j)
+		}
+		return
+	}
+	if err != nil {
+		m.cfg.Logger.WithError(err).WithField("user", userId).Error("export failed")
+		j.Status = StatusFailed
+		return
+	}
+	j.Status = StatusReady
+	j.Size = size
+	expiresAt := globaltime.Now().Add(m.cfg.TTL)
+	j.ExpiresAt = &expiresAt
+}
+
+// write writes the archive of the user to a temporary file, renamed to path once it is complete, and returns its size.
+func (m *Manager) write(userId uint64, path string) (int64, error) {
+	tmp := path + ".partial"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	err = Write(m.ctx, m.cfg.Database, userId, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// sweep removes the expired exports. The lock must be held.
+func (m *Manager) sweep() {
+	now := globaltime.Now()
+	for userId, j := range m.jobs {
+		if j.Status == StatusReady && !now.Before(*j.ExpiresAt) {
+			m.remove(userId, j)
+		}
+	}
+}
+
+// remove removes the export, and its archive. The lock must be held, and the export must not be pending.
+func (m *Manager) remove(userId uint64, j *job) {
+	m.removeArchive(j)
+	delete(m.jobs, userId)
+}
+
+// removeArchive removes the archive of the export, if any.
+func (m *Manager) removeArchive(j *job) {
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		m.cfg.Logger.WithError(err).Error("can't remove an export")
+	}
+}
@@ -0,0 +1,167 @@
+package export
+
+import (
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database/memory"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testTTL = time.Hour
+
+// newManager returns a Manager of the database, with its archives in a temporary directory, which is returned too.
+func newManager(t *testing.T, db database.AppDatabase) (*Manager, string) {
+	t.Helper()
+	globaltime.FixedTime = start
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	dir := t.TempDir()
+	m, err := New(Config{Logger: logger, Database: db, Dir: dir, TTL: testTTL})
+	check(t, err, "creating the manager")
+	t.Cleanup(func() { _ = m.Close() })
+	return m, dir
+}
+
+// archives returns the files in the directory of the archives.
+func archives(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	check(t, err, "listing the archives")
+	return files
+}
+
+// export builds the export of the user, and returns it once done.
+func export(t *testing.T, m *Manager, userId uint64) Job {
+	t.Helper()
+	job, done := m.Start(userId)
+	if job.Status != StatusPending || !job.StartedAt.Equal(globaltime.Now()) {
+		t.Errorf("started export: got %+v, want a pending one started now", job)
+	}
+	<-done
+	job, err := m.Get(userId)
+	check(t, err, "getting the export")
+	return job
+}
+
+func TestManagerExport(t *testing.T) {
+	db := memory.New()
+	s := seedDatabase(t, db)
+	m, dir := newManager(t, db)
+
+	job := export(t, m, s.alice.Id)
+	if job.Status != StatusReady || job.Size == 0 || job.ExpiresAt == nil || !job.ExpiresAt.Equal(start.Add(testTTL)) {
+		t.Fatalf("export: got %+v, want a ready one expiring after the TTL", job)
+	}
+	f, opened, err := m.Open(s.alice.Id)
+	check(t, err, "opening the archive")
+	data, err := io.ReadAll(f)
+	_ = f.Close()
+	check(t, err, "reading the archive")
+	if int64(len(data)) != job.Size || opened != job {
+		t.Errorf("opened export: got %+v with %d bytes, want %+v", opened, len(data), job)
+	}
+	var p profile
+	decodeFile(t, readArchive(t, data), "profile.json", &p)
+	if p.Id != s.alice.Id {
+		t.Errorf("archive of user %d, want %d", p.Id, s.alice.Id)
+	}
+
+	// Other users have no export, even while the one of alice is ready
+	if _, err := m.Get(s.bob.Id); !errors.Is(err, ErrNoExport) {
+		t.Errorf("getting the export of another user: got %v, want ErrNoExport", err)
+	}
+	if _, _, err := m.Open(s.bob.Id); !errors.Is(err, ErrNoExport) {
+		t.Errorf("opening the export of another user: got %v, want ErrNoExport", err)
+	}
+
+	// A new export replaces the previous one, and its archive
+	first := archives(t, dir)
+	globaltime.FixedTime = start.Add(time.Minute)
+	job = export(t, m, s.alice.Id)
+	if job.Status != StatusReady || !job.StartedAt.Equal(globaltime.Now()) {
+		t.Errorf("new export: got %+v, want a ready one started now", job)
+	}
+	if files := archives(t, dir); len(first) != 1 || len(files) != 1 || files[0] == first[0] {
+		t.Errorf("archives after a new export: got %v, the previous %v", files, first)
+	}
+
+	m.Remove(s.alice.Id)
+	if _, err := m.Get(s.alice.Id); !errors.Is(err, ErrNoExport) {
+		t.Errorf("getting a removed export: got %v, want ErrNoExport", err)
+	}
+	if files := archives(t, dir); len(files) != 0 {
+		t.Errorf("archives after the removal: got %v, want none", files)
+	}
+}
+
+func TestManagerExpiry(t *testing.T) {
+	db := memory.New()
+	s := seedDatabase(t, db)
+	m, dir := newManager(t, db)
+	export(t, m, s.alice.Id)
+
+	globaltime.FixedTime = start.Add(testTTL - time.Second)
+	if _, err := m.Get(s.alice.Id); err != nil {
+		t.Errorf("getting the export before it expires: %v", err)
+	}
+
+	globaltime.FixedTime = start.Add(testTTL)
+	if _, _, err := m.Open(s.alice.Id); !errors.Is(err, ErrNoExport) {
+		t.Errorf("opening an expired export: got %v, want ErrNoExport", err)
+	}
+	if files := archives(t, dir); len(files) != 0 {
+		t.Errorf("archives after the expiry: got %v, want none", files)
+	}
+}
+
+func TestManagerFailure(t *testing.T) {
+	m, dir := newManager(t, memory.New())
+
+	// The user does not exist
+	job := export(t, m, 42)
+	if job.Status != StatusFailed || job.ExpiresAt != nil {
+		t.Errorf("failed export: got %+v", job)
+	}
+	if _, _, err := m.Open(42); !errors.Is(err, ErrNotReady) {
+		t.Errorf("opening a failed export: got %v, want ErrNotReady", err)
+	}
+	if files := archives(t, dir); len(files) != 0 {
+		t.Errorf("archives after a failed export: got %v, want none", files)
+	}
+}
+
+func TestManagerCleanup(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"1-1.zip", "2-1.zip.partial", "other.txt"} {
+		check(t, os.WriteFile(filepath.Join(dir, name), []byte("stale"), 0o600), "writing %s", name)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	m, err := New(Config{Logger: logger, Database: memory.New(), Dir: dir, TTL: testTTL})
+	check(t, err, "creating the manager")
+	defer func() { _ = m.Close() }()
+
+	// Archives left by a previous run are removed, other files are not
+	if files := archives(t, dir); len(files) != 1 || filepath.Base(files[0]) != "other.txt" {
+		t.Errorf("files after the start: got %v, want other.txt", files)
+	}
+	if _, err := m.Get(1); !errors.Is(err, ErrNoExport) {
+		t.Errorf("getting the export of a previous run: got %v, want ErrNoExport", err)
+	}
+
+	if _, err := New(Config{Logger: logger, Database: memory.New(), Dir: dir}); err == nil {
+		t.Errorf("creating a manager without TTL succeeded")
+	}
+	if _, err := New(Config{Database: memory.New(), Dir: dir, TTL: testTTL}); err == nil {
+		t.Errorf("creating a manager without logger succeeded")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Package jwt issues and verifies the signed access tokens of WASAText (JSON Web Tokens, RFC 7519).
+
+Tokens are signed with EdDSA (Ed25519) or ES256, depending on the configured keys, and carry the user ID in the "sub"
+claim. The public keys are published as a JWKS, so other services can verify WASAText identities without calling the
+web API.
+*/
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when a token is malformed, has an invalid signature, is signed with an unknown key or
+// has expired
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the claims of WASAText access tokens.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+
+	// SessionId is the ID of the session the token has been issued for. The session holds the refresh token
+	SessionId int64 `json:"sid"`
+}
+
+// header is the JOSE header of the tokens
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// KeySet is the set of active signing keys. It is safe for concurrent use.
+type KeySet struct {
+	keys []key
+}
+
+// Sign returns a token with the claims, signed with the first key.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	k := ks.keys[0]
+	h, err := json.Marshal(header{Alg: k.alg, Typ: "JWT", Kid: k.kid})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	var signature []byte
+	switch signer := k.signer.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(signer, []byte(signingInput))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		r, s, err := ecdsa.Sign(rand.Reader, signer, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed-size R || S encoding instead of ASN.1 (RFC 7518, section 3.4)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	default:
+		return "", fmt.Errorf("unsupported signer %T", signer)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature of the token with the key named by its "kid", and its expiration time. It returns the
+// claims of the token, which the caller must check further (e.g., the issuer). ErrInvalidToken is returned if the
+// token is not valid.
+func (ks *KeySet) Verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var k *key
+	for i := range ks.keys {
+		if ks.keys[i].kid == h.Kid {
+			k = &ks.keys[i]
+			break
+		}
+	}
+	// The algorithm must match the key, so tokens can't pick a weaker (or no) algorithm
+	if k == nil || h.Alg != k.alg {
+		return Claims{}, ErrInvalidToken
+	}
+	if !verifySignature(k.signer.Public(), parts[0]+"."+parts[1], signature) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return Claims{}, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// JWKS returns the public keys, to be published at the JWKS endpoint.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	for _, k := range ks.keys {
+		jwks.Keys = append(jwks.Keys, k.public)
+	}
+	return jwks
+}
+
+// verifySignature checks the signature with the public key.
+func verifySignature(public crypto.PublicKey, signingInput string, signature []byte) bool {
+	switch public := public.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(public, []byte(signingInput), signature)
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, digest[:], r, s)
+	default:
+		return false
+	}
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
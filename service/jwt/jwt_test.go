@@ -0,0 +1,292 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// now is the time the tokens of the tests are verified at
+var now = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// encodeKeys returns the private keys as PEM encoded PKCS#8 blocks.
+func encodeKeys(t *testing.T, privates ...interface{}) []byte {
+	t.Helper()
+	var data []byte
+	for _, private := range privates {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			t.Fatalf("encoding the key: %v", err)
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+	return data
+}
+
+// newKeySet returns the key set of the private keys, loaded like the configured ones.
+func newKeySet(t *testing.T, privates ...interface{}) *KeySet {
+	t.Helper()
+	ks, err := LoadKeys(encodeKeys(t, privates...))
+	if err != nil {
+		t.Fatalf("loading the keys: %v", err)
+	}
+	return ks
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating the key: %v", err)
+	}
+	return private
+}
+
+func newECDSAKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("generating the key: %v", err)
+	}
+	return private
+}
+
+func testClaims() Claims {
+	return Claims{
+		Issuer:    "wasatext",
+		Subject:   "42",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(15 * time.Minute).Unix(),
+		SessionId: 7,
+	}
+}
+
+// tokenHeader returns the decoded header of the token.
+func tokenHeader(t *testing.T, token string) header {
+	t.Helper()
+	var h header
+	if err := decodeSegment(strings.Split(token, ".")[0], &h); err != nil {
+		t.Fatalf("decoding the header: %v", err)
+	}
+	return h
+}
+
+func TestSignVerify(t *testing.T) {
+	tests := map[string]struct {
+		private interface{}
+		alg     string
+	}{
+		"Ed25519": {newEd25519Key(t), EdDSA},
+		"P-256":   {newECDSAKey(t, elliptic.P256()), ES256},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ks := newKeySet(t, tt.private)
+			token, err := ks.Sign(testClaims())
+			if err != nil {
+				t.Fatalf("signing: %v", err)
+			}
+			h := tokenHeader(t, token)
+			if h.Alg != tt.alg || h.Typ != "JWT" || h.Kid != ks.keys[0].kid {
+				t.Errorf("header: got %+v, want alg %s and kid %s", h, tt.alg, ks.keys[0].kid)
+			}
+
+			claims, err := ks.Verify(token, now)
+			if err != nil {
+				t.Fatalf("verifying: %v", err)
+			}
+			if claims != testClaims() {
+				t.Errorf("claims: got %+v, want %+v", claims, testClaims())
+			}
+
+			// Any change to the token breaks the signature
+			parts := strings.Split(token, ".")
+			other := testClaims()
+			other.Subject = "1"
+			payload, _ := json.Marshal(other)
+			changed := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+			if _, err := ks.Verify(changed, now); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("verifying a token with changed claims: got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	ks := newKeySet(t, newEd25519Key(t))
+	token, err := ks.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	expiry := time.Unix(testClaims().ExpiresAt, 0)
+
+	if _, err := ks.Verify(token, expiry.Add(-time.Second)); err != nil {
+		t.Errorf("verifying a token about to expire: %v", err)
+	}
+	if _, err := ks.Verify(token, expiry); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("verifying an expired token: got %v, want ErrInvalidToken", err)
+	}
+}
+
+// TestVerifyRejectsForgedHeaders checks tokens signed with a valid key but whose header names another algorithm or
+// key: only the signature checks of the key are applied, whatever the header says.
+func TestVerifyRejectsForgedHeaders(t *testing.T) {
+	ks := newKeySet(t, newEd25519Key(t), newECDSAKey(t, elliptic.P256()))
+	valid, err := ks.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	parts := strings.Split(valid, ".")
+
+	// signWith signs the claims with the first key, under the header
+	signWith := func(alg string, kid string) string {
+		k := ks.keys[0]
+		k.alg, k.kid = alg, kid
+		token, err := (&KeySet{keys: []key{k}}).Sign(testClaims())
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return token
+	}
+	encodeHeader := func(h header) string {
+		data, _ := json.Marshal(h)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	tests := map[string]string{
+		"algorithm of the other key": signWith(ES256, ks.keys[0].kid),
+		"key ID of the other key":    signWith(EdDSA, ks.keys[1].kid),
+		"symmetric algorithm":        signWith("HS256", ks.keys[0].kid),
+		"unknown key ID":             signWith(EdDSA, "unknown"),
+		"no key ID":                  signWith(EdDSA, ""),
+		"no algorithm":               encodeHeader(header{Alg: "none", Typ: "JWT", Kid: ks.keys[0].kid}) + "." + parts[1] + ".",
+		"no signature":               parts[0] + "." + parts[1] + ".",
+		"malformed header":           "!" + parts[0] + "." + parts[1] + "." + parts[2],
+		"malformed signature":        parts[0] + "." + parts[1] + ".!" + parts[2],
+		"two segments":               parts[0] + "." + parts[1],
+		"four segments":              valid + ".",
+	}
+	for name, token := range tests {
+		if _, err := ks.Verify(token, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+
+	// A token of another key set is refused
+	other, err := newKeySet(t, newEd25519Key(t)).Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	if _, err := ks.Verify(other, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token of another key: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := newEd25519Key(t), newECDSAKey(t, elliptic.P256())
+	before := newKeySet(t, oldKey)
+	oldToken, err := before.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	// The new key signs, the old one still verifies
+	during := newKeySet(t, newKey, oldKey)
+	newToken, err := during.Sign(testClaims())
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+	if h := tokenHeader(t, newToken); h.Alg != ES256 || h.Kid != during.keys[0].kid {
+		t.Errorf("token signed during the rotation: got header %+v, want the new key", h)
+	}
+	if _, err := during.Verify(oldToken, now); err != nil {
+		t.Errorf("verifying a token of the old key during the rotation: %v", err)
+	}
+	if _, err := during.Verify(newToken, now); err != nil {
+		t.Errorf("verifying a token of the new key: %v", err)
+	}
+	if len(during.JWKS().Keys) != 2 {
+		t.Errorf("published keys during the rotation: got %d, want 2", len(during.JWKS().Keys))
+	}
+
+	// Once the old key is removed its tokens are refused
+	after := newKeySet(t, newKey)
+	if _, err := after.Verify(oldToken, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("verifying a token of a removed key: got %v, want ErrInvalidToken", err)
+	}
+	if _, err := after.Verify(newToken, now); err != nil {
+		t.Errorf("verifying a token of the new key after the rotation: %v", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	ks := newKeySet(t, newEd25519Key(t), newECDSAKey(t, elliptic.P256()))
+	jwks := ks.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(jwks.Keys))
+	}
+	want := []JWK{
+		{Kty: "OKP", Kid: ks.keys[0].kid, Use: "sig", Alg: EdDSA, Crv: "Ed25519"},
+		{Kty: "EC", Kid: ks.keys[1].kid, Use: "sig", Alg: ES256, Crv: "P-256"},
+	}
+	for i, k := range jwks.Keys {
+		if k.Kty != want[i].Kty || k.Kid != want[i].Kid || k.Use != want[i].Use || k.Alg != want[i].Alg ||
+			k.Crv != want[i].Crv || k.X == "" {
+			t.Errorf("key %d: got %+v, want %+v", i, k, want[i])
+		}
+	}
+	if jwks.Keys[0].Y != "" || jwks.Keys[1].Y == "" {
+		t.Errorf("y coordinates: got %q and %q, want only the EC one", jwks.Keys[0].Y, jwks.Keys[1].Y)
+	}
+}
+
+// TestThumbprint checks the key IDs against the example of RFC 8037, appendix A.3.
+func TestThumbprint(t *testing.T) {
+	seed, _ := base64.RawURLEncoding.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	k, err := newKey(ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		t.Fatalf("creating the key: %v", err)
+	}
+	if k.public.X != "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo" {
+		t.Errorf("public key: got %s", k.public.X)
+	}
+	if k.kid != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Errorf("key ID: got %s, want kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", k.kid)
+	}
+}
+
+func TestLoadKeysErrors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating the key: %v", err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(newECDSAKey(t, elliptic.P256()))
+	if err != nil {
+		t.Fatalf("encoding the key: %v", err)
+	}
+
+	tests := map[string][]byte{
+		"no key":       []byte("not a PEM file"),
+		"RSA key":      encodeKeys(t, rsaKey),
+		"P-384 key":    encodeKeys(t, newECDSAKey(t, elliptic.P384())),
+		"SEC 1 key":    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+		"invalid DER":  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}),
+		"one bad key":  append(encodeKeys(t, newEd25519Key(t)), encodeKeys(t, rsaKey)...),
+		"empty string": nil,
+	}
+	for name, data := range tests {
+		if _, err := LoadKeys(data); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
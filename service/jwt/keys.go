@@ -0,0 +1,141 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Supported signing algorithms
+const (
+	// EdDSA is the Ed25519 signature algorithm (RFC 8037)
+	EdDSA = "EdDSA"
+
+	// ES256 is ECDSA with the P-256 curve and SHA-256 (RFC 7518)
+	ES256 = "ES256"
+)
+
+// key is a signing key, together with its public JWK
+type key struct {
+	kid    string
+	alg    string
+	signer crypto.Signer
+	public JWK
+}
+
+// JWK is a public JSON Web Key (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set, as published at the JWKS endpoint.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadKeys parses the signing keys from PEM encoded PKCS#8 private keys ("PRIVATE KEY" blocks), as generated by
+// `openssl genpkey -algorithm ed25519` or `openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256`.
+//
+// The first key signs new tokens, while all keys are accepted when verifying tokens and are published in the JWKS.
+// To rotate keys, put the new key first and remove the old one once the tokens it signed have expired. Key IDs are
+// the JWK thumbprints of the keys (RFC 7638), so they don't need to be configured.
+func LoadKeys(data []byte) (*KeySet, error) {
+	var keys []key
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("unsupported PEM block %q, expected PKCS#8 \"PRIVATE KEY\"", block.Type)
+		}
+
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing private key: %w", err)
+		}
+		k, err := newKey(parsed)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no private key found")
+	}
+	return &KeySet{keys: keys}, nil
+}
+
+// newKey wraps an Ed25519 or P-256 private key.
+func newKey(private interface{}) (key, error) {
+	var k key
+	switch private := private.(type) {
+	case ed25519.PrivateKey:
+		k.alg = EdDSA
+		k.signer = private
+		k.public = JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(private.Public().(ed25519.PublicKey)),
+		}
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return key{}, errors.New("unsupported curve, only P-256 is supported")
+		}
+		k.alg = ES256
+		k.signer = private
+		k.public = JWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(private.X.FillBytes(make([]byte, 32))),
+			Y:   base64.RawURLEncoding.EncodeToString(private.Y.FillBytes(make([]byte, 32))),
+		}
+	default:
+		return key{}, fmt.Errorf("unsupported key type %T, only Ed25519 and P-256 keys are supported", private)
+	}
+
+	k.kid = thumbprint(k.public)
+	k.public.Kid = k.kid
+	k.public.Use = "sig"
+	k.public.Alg = k.alg
+	return k, nil
+}
+
+// thumbprint returns the JWK thumbprint of the public key (RFC 7638).
+func thumbprint(public JWK) string {
+	// Required members only, in lexicographic order
+	var members interface{}
+	if public.Kty == "EC" {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{public.Crv, public.Kty, public.X, public.Y}
+	} else {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{public.Crv, public.Kty, public.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,275 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// clockSkew is the tolerance when checking the expiration time of ID tokens
+	clockSkew = time.Minute
+
+	// keysRefreshInterval is the minimum time between two fetches of the provider keys, so tokens with unknown key
+	// IDs can't be used to flood the provider
+	keysRefreshInterval = time.Minute
+)
+
+// Claims are the claims of a verified ID token used by the application.
+type Claims struct {
+	// Subject is the identifier of the user at the provider. It is unique and never reassigned for a given issuer
+	Subject string `json:"sub"`
+
+	PreferredUsername string `json:"preferred_username"`
+	Email             string `json:"email"`
+	Name              string `json:"name"`
+}
+
+// idTokenClaims are all the claims checked when verifying an ID token
+type idTokenClaims struct {
+	Claims
+	Issuer          string   `json:"iss"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	ExpiresAt       int64    `json:"exp"`
+	Nonce           string   `json:"nonce"`
+}
+
+// audience is the "aud" claim, which can be either a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// jwk is a JSON Web Key (RFC 7517). Only RSA and P-256 EC keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet is a cached copy of the provider keys
+type keySet struct {
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// verifyIDToken checks the signature and the claims of the ID token (OpenID Connect Core, section 3.1.3.7).
+func (c *Client) verifyIDToken(ctx context.Context, rawToken string, nonce string) (Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, fmt.Errorf("%w: malformed ID token", ErrLoginFailed)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, fmt.Errorf("%w: malformed ID token header", ErrLoginFailed)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: malformed ID token signature", ErrLoginFailed)
+	}
+
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, fmt.Errorf("%w: malformed ID token claims", ErrLoginFailed)
+	}
+
+	switch {
+	case claims.Issuer != c.cfg.Issuer:
+		return Claims{}, fmt.Errorf("%w: unexpected issuer %q", ErrLoginFailed, claims.Issuer)
+	case !claims.Audience.contains(c.cfg.ClientID):
+		return Claims{}, fmt.Errorf("%w: ID token not issued for this client", ErrLoginFailed)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != c.cfg.ClientID:
+		return Claims{}, fmt.Errorf("%w: ID token not issued for this client", ErrLoginFailed)
+	case globaltime.Now().After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)):
+		return Claims{}, fmt.Errorf("%w: ID token expired", ErrLoginFailed)
+	case claims.Nonce != nonce:
+		return Claims{}, fmt.Errorf("%w: nonce mismatch", ErrLoginFailed)
+	case claims.Subject == "":
+		return Claims{}, fmt.Errorf("%w: no subject in the ID token", ErrLoginFailed)
+	}
+
+	return claims.Claims, nil
+}
+
+// key returns the provider key with the given ID. Keys are fetched again if the ID is unknown, as providers rotate
+// their keys.
+func (c *Client) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keys != nil {
+		if key, ok := c.keys.lookup(kid); ok {
+			return key, nil
+		}
+		if globaltime.Since(c.keys.fetchedAt) < keysRefreshInterval {
+			return nil, fmt.Errorf("%w: unknown signing key %q", ErrLoginFailed, kid)
+		}
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := c.getJSON(ctx, c.provider.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching the provider keys: %w", err)
+	}
+
+	keys := &keySet{keys: make(map[string]crypto.PublicKey), fetchedAt: globaltime.Now()}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Keys of unsupported types are skipped
+			continue
+		}
+		keys.keys[k.Kid] = key
+	}
+	c.keys = keys
+
+	if key, ok := c.keys.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown signing key %q", ErrLoginFailed, kid)
+}
+
+// lookup returns the key with the given ID. If the ID is empty, the key is returned only if it is the only one.
+func (s *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// publicKey decodes the key.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks the JWS signature. Only RS256 and ES256 are accepted: in particular, unsigned tokens ("none")
+// and symmetric algorithms are always rejected.
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		if len(signature) != 64 {
+			return errors.New("invalid ID token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return errors.New("invalid ID token signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,236 @@
+/*
+Package oidc implements the relying party side of OpenID Connect login, using the authorization code flow with PKCE
+(RFC 7636).
+
+The provider is discovered lazily from the issuer URL (`/.well-known/openid-configuration`) on first use, so the web
+API can start even if the identity provider is temporarily unreachable. ID tokens are verified against the provider
+keys (JWKS), which are refreshed when a token is signed with an unknown key.
+
+Plain HTTP issuers are accepted, so the flow can be tried against a local mock issuer.
+*/
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultScopes are the scopes requested to the provider
+var defaultScopes = []string{"openid", "profile", "email"}
+
+// ErrLoginFailed is returned when the provider rejects the authorization code, or returns an invalid ID token
+var ErrLoginFailed = errors.New("OIDC login failed")
+
+// Config is the configuration of the relying party.
+type Config struct {
+	// Issuer is the issuer URL of the provider, exactly as it appears in its ID tokens
+	Issuer string
+
+	// ClientID is the client ID registered with the provider
+	ClientID string
+
+	// ClientSecret is the client secret. It can be empty for public clients
+	ClientSecret string
+
+	// RedirectURL is the URL where the provider sends the user back after the login
+	RedirectURL string
+
+	// HTTPClient is the client used to talk to the provider. If nil, a client with a 10 seconds timeout is used
+	HTTPClient *http.Client
+}
+
+// Client is an OpenID Connect relying party. It is safe for concurrent use.
+type Client struct {
+	cfg Config
+
+	mu       sync.Mutex
+	provider *providerMetadata
+	keys     *keySet
+}
+
+// providerMetadata is the subset of the discovery document used by the client
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// NewClient returns a new client. No request is made to the provider until the first login.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("issuer is required")
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("client ID is required")
+	}
+	if cfg.RedirectURL == "" {
+		return nil, errors.New("redirect URL is required")
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// Issuer returns the issuer URL of the provider. Together with the subject, it identifies users.
+func (c *Client) Issuer() string {
+	return c.cfg.Issuer
+}
+
+// NewState returns a random value suitable for the state and nonce parameters.
+func NewState() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// NewPKCE returns a new PKCE code verifier, and the matching S256 code challenge.
+func NewPKCE() (verifier string, challenge string, err error) {
+	verifier, err = NewState()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// AuthCodeURL returns the URL of the provider where the user has to be sent to log in.
+func (c *Client) AuthCodeURL(ctx context.Context, state string, nonce string, codeChallenge string) (string, error) {
+	provider, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", c.cfg.ClientID)
+	params.Set("redirect_uri", c.cfg.RedirectURL)
+	params.Set("scope", strings.Join(defaultScopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", codeChallenge)
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange redeems the authorization code at the token endpoint, and returns the claims of the verified ID token.
+// ErrLoginFailed is returned if the provider rejects the code or the ID token is not valid.
+func (c *Client) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (Claims, error) {
+	provider, err := c.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", c.cfg.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	if c.cfg.ClientSecret == "" {
+		form.Set("client_id", c.cfg.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.cfg.ClientSecret != "" {
+		// client_secret_basic: credentials are form-encoded before being put in the header (RFC 6749, section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	}
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return Claims{}, fmt.Errorf("requesting token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var token tokenResponse
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Claims{}, fmt.Errorf("reading token response: %w", err)
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return Claims{}, fmt.Errorf("decoding token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return Claims{}, fmt.Errorf("%w: token endpoint: %s %s", ErrLoginFailed, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return Claims{}, fmt.Errorf("%w: no ID token in the response", ErrLoginFailed)
+	}
+
+	return c.verifyIDToken(ctx, token.IDToken, nonce)
+}
+
+// discover fetches the discovery document of the provider, once.
+func (c *Client) discover(ctx context.Context) (*providerMetadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+
+	var provider providerMetadata
+	err := c.getJSON(ctx, strings.TrimSuffix(c.cfg.Issuer, "/")+"/.well-known/openid-configuration", &provider)
+	if err != nil {
+		return nil, fmt.Errorf("discovering the provider: %w", err)
+	}
+	if provider.Issuer != c.cfg.Issuer {
+		return nil, fmt.Errorf("discovering the provider: issuer mismatch: %q", provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovering the provider: incomplete provider metadata")
+	}
+
+	c.provider = &provider
+	return c.provider, nil
+}
+
+// getJSON fetches a JSON document from the provider.
+func (c *Client) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,208 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc/oidctest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClientID = "wasatext"
+
+// newTestClient returns a client of a new mock issuer.
+func newTestClient(t *testing.T) (*Client, *oidctest.Issuer) {
+	t.Helper()
+	issuer := oidctest.NewIssuer(t, testClientID)
+	client, err := NewClient(Config{Issuer: issuer.URL, ClientID: testClientID, RedirectURL: oidctest.RedirectURL})
+	if err != nil {
+		t.Fatalf("creating the client: %v", err)
+	}
+	return client, issuer
+}
+
+// login is a login started by the client, and completed at the provider as subject
+type login struct {
+	code     string
+	verifier string
+	nonce    string
+}
+
+func startLogin(t *testing.T, client *Client, issuer *oidctest.Issuer, subject string) login {
+	t.Helper()
+	state, _ := NewState()
+	nonce, _ := NewState()
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatalf("generating PKCE: %v", err)
+	}
+	authURL, err := client.AuthCodeURL(context.Background(), state, nonce, challenge)
+	if err != nil {
+		t.Fatalf("getting the authorization URL: %v", err)
+	}
+	code, err := issuer.Authorize(authURL, subject)
+	if err != nil {
+		t.Fatalf("logging in at the provider: %v", err)
+	}
+	return login{code: code, verifier: verifier, nonce: nonce}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	client, issuer := newTestClient(t)
+	authURL, err := client.AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-challenge")
+	if err != nil {
+		t.Fatalf("getting the authorization URL: %v", err)
+	}
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize?") {
+		t.Errorf("authorization URL %s is not at the provider", authURL)
+	}
+	u, _ := url.Parse(authURL)
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          oidctest.RedirectURL,
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        "the-challenge",
+		"code_challenge_method": "S256",
+	}
+	for param, value := range want {
+		if got := u.Query().Get(param); got != value {
+			t.Errorf("parameter %s: got %q, want %q", param, got, value)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	client, issuer := newTestClient(t)
+	l := startLogin(t, client, issuer, "alice")
+
+	claims, err := client.Exchange(context.Background(), l.code, l.verifier, l.nonce)
+	if err != nil {
+		t.Fatalf("exchanging the code: %v", err)
+	}
+	if claims.Subject != "alice" || claims.PreferredUsername != "alice" {
+		t.Errorf("claims: got %+v, want subject alice", claims)
+	}
+
+	// Codes are redeemed once
+	_, err = client.Exchange(context.Background(), l.code, l.verifier, l.nonce)
+	if !errors.Is(err, ErrLoginFailed) {
+		t.Errorf("exchanging the code again: got %v, want ErrLoginFailed", err)
+	}
+}
+
+func TestExchangeWrongCodeVerifier(t *testing.T) {
+	client, issuer := newTestClient(t)
+	l := startLogin(t, client, issuer, "alice")
+
+	other, _, _ := NewPKCE()
+	_, err := client.Exchange(context.Background(), l.code, other, l.nonce)
+	if !errors.Is(err, ErrLoginFailed) {
+		t.Errorf("exchanging the code with another verifier: got %v, want ErrLoginFailed", err)
+	}
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	globaltime.FixedTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+
+	tests := []struct {
+		name   string
+		modify func(claims map[string]interface{})
+	}{
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "http://attacker.example" }},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "other-client" }},
+		{"other authorized party", func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "other-client"}
+			c["azp"] = "other-client"
+		}},
+		{"expired", func(c map[string]interface{}) { c["exp"] = globaltime.Now().Add(-clockSkew - time.Second).Unix() }},
+		{"other nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }},
+		{"no nonce", func(c map[string]interface{}) { delete(c, "nonce") }},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, issuer := newTestClient(t)
+			issuer.ModifyClaims(tt.modify)
+			l := startLogin(t, client, issuer, "alice")
+			_, err := client.Exchange(context.Background(), l.code, l.verifier, l.nonce)
+			if !errors.Is(err, ErrLoginFailed) {
+				t.Errorf("got %v, want ErrLoginFailed", err)
+			}
+		})
+	}
+}
+
+func TestExchangeAcceptsClockSkew(t *testing.T) {
+	globaltime.FixedTime = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+
+	client, issuer := newTestClient(t)
+	issuer.ModifyClaims(func(c map[string]interface{}) {
+		c["exp"] = globaltime.Now().Add(-clockSkew / 2).Unix()
+		c["aud"] = []string{testClientID, "other-client"}
+		c["azp"] = testClientID
+	})
+	l := startLogin(t, client, issuer, "alice")
+	if _, err := client.Exchange(context.Background(), l.code, l.verifier, l.nonce); err != nil {
+		t.Errorf("exchanging a token expired within the clock skew: %v", err)
+	}
+}
+
+func TestVerifyIDTokenSignature(t *testing.T) {
+	client, issuer := newTestClient(t)
+	ctx := context.Background()
+	if _, err := client.discover(ctx); err != nil {
+		t.Fatalf("discovering the provider: %v", err)
+	}
+	claims := issuer.Claims("alice", "nonce")
+
+	valid := oidctest.Sign(issuer.Key, oidctest.KeyID, claims)
+	if _, err := client.verifyIDToken(ctx, valid, "nonce"); err != nil {
+		t.Fatalf("verifying a valid token: %v", err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating a key: %v", err)
+	}
+	parts := strings.Split(valid, ".")
+	payload := base64.RawURLEncoding.EncodeToString(mustJSON(t, map[string]interface{}{
+		"iss": claims["iss"], "sub": "mallory", "aud": claims["aud"], "exp": claims["exp"], "nonce": "nonce",
+	}))
+
+	unsigned := base64.RawURLEncoding.EncodeToString(mustJSON(t, map[string]string{"alg": "none"}))
+	symmetric := base64.RawURLEncoding.EncodeToString(mustJSON(t, map[string]string{"alg": "HS256", "kid": oidctest.KeyID}))
+
+	tests := map[string]string{
+		"signed with another key": oidctest.Sign(otherKey, oidctest.KeyID, claims),
+		"unknown key ID":          oidctest.Sign(issuer.Key, "other-key", claims),
+		"changed claims":          parts[0] + "." + payload + "." + parts[2],
+		"unsigned":                unsigned + "." + parts[1] + ".",
+		"symmetric":               symmetric + "." + parts[1] + "." + parts[2],
+		"malformed":               parts[0] + "." + parts[1],
+	}
+	for name, token := range tests {
+		if _, err := client.verifyIDToken(ctx, token, "nonce"); !errors.Is(err, ErrLoginFailed) {
+			t.Errorf("%s: got %v, want ErrLoginFailed", name, err)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("encoding JSON: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,243 @@
+/*
+Package oidctest provides a mock OpenID Connect provider, to test the login flow of package oidc without a real
+identity provider.
+
+The provider serves the discovery document, its keys and the token endpoint over plain HTTP. Logins are started with
+Authorize, which plays the part of the user logging in at the provider, and completed at the token endpoint, which
+checks the PKCE code verifier (S256) and issues an RS256 ID token:
+
+	issuer := oidctest.NewIssuer(t, "client")
+	client, _ := oidc.NewClient(oidc.Config{Issuer: issuer.URL, ClientID: "client", RedirectURL: oidctest.RedirectURL})
+	authURL, _ := client.AuthCodeURL(ctx, state, nonce, challenge)
+	code, _ := issuer.Authorize(authURL, "subject")
+	claims, err := client.Exchange(ctx, code, verifier, nonce)
+*/
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RedirectURL is the redirect URL accepted by the provider
+const RedirectURL = "http://localhost/login/callback"
+
+// KeyID is the ID of the signing key of the provider
+const KeyID = "test-key"
+
+// Issuer is a mock OpenID Connect provider. It is safe for concurrent use.
+type Issuer struct {
+	// URL is the issuer URL of the provider
+	URL string
+
+	// ClientID is the only client accepted by the provider
+	ClientID string
+
+	// Key is the key signing the ID tokens
+	Key *rsa.PrivateKey
+
+	mu sync.Mutex
+
+	// grants are the authorization codes not redeemed yet
+	grants map[string]grant
+
+	// modify changes the claims of the ID tokens before they are signed
+	modify func(claims map[string]interface{})
+}
+
+// grant is a login completed at the provider, waiting for the code to be redeemed
+type grant struct {
+	subject       string
+	nonce         string
+	codeChallenge string
+}
+
+// NewIssuer starts a new provider, stopped at the end of the test.
+func NewIssuer(t testing.TB, clientID string) *Issuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating the provider key: %v", err)
+	}
+	issuer := &Issuer{
+		ClientID: clientID,
+		Key:      key,
+		grants:   make(map[string]grant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/jwks", issuer.jwks)
+	mux.HandleFunc("/token", issuer.token)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	issuer.URL = server.URL
+	return issuer
+}
+
+// ModifyClaims sets a function that changes the claims of the next ID tokens before they are signed, e.g. to test
+// the rejection of invalid ones.
+func (i *Issuer) ModifyClaims(modify func(claims map[string]interface{})) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.modify = modify
+}
+
+// Authorize logs the user in at the authorization URL returned by the client, and returns the authorization code the
+// provider would send back to the redirect URL.
+func (i *Issuer) Authorize(authURL string, subject string) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+	switch {
+	case params.Get("response_type") != "code":
+		return "", errors.New("unsupported response type")
+	case params.Get("client_id") != i.ClientID:
+		return "", errors.New("unknown client")
+	case params.Get("redirect_uri") != RedirectURL:
+		return "", errors.New("unknown redirect URI")
+	case params.Get("code_challenge_method") != "S256" || params.Get("code_challenge") == "":
+		return "", errors.New("PKCE is required")
+	}
+
+	code := randomString()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.grants[code] = grant{
+		subject:       subject,
+		nonce:         params.Get("nonce"),
+		codeChallenge: params.Get("code_challenge"),
+	}
+	return code, nil
+}
+
+// Sign returns the claims signed as an ID token with the given key.
+func Sign(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Claims returns the claims of a valid ID token for the subject, expiring in an hour.
+func (i *Issuer) Claims(subject string, nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                i.URL,
+		"sub":                subject,
+		"aud":                i.ClientID,
+		"exp":                globaltime.Now().Add(time.Hour).Unix(),
+		"iat":                globaltime.Now().Unix(),
+		"nonce":              nonce,
+		"preferred_username": subject,
+	}
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 i.URL,
+		"authorization_endpoint": i.URL + "/authorize",
+		"token_endpoint":         i.URL + "/token",
+		"jwks_uri":               i.URL + "/jwks",
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(i.Key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.Key.E)).Bytes()),
+		}},
+	})
+}
+
+// token redeems an authorization code, once, if the code verifier matches the code challenge.
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+
+	i.mu.Lock()
+	g, ok := i.grants[r.PostForm.Get("code")]
+	delete(i.grants, r.PostForm.Get("code"))
+	modify := i.modify
+	i.mu.Unlock()
+
+	// Confidential clients authenticate with client_secret_basic, public ones send their ID only
+	clientID := r.PostForm.Get("client_id")
+	if username, _, ok := r.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(username)
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		tokenError(w, "unsupported_grant_type")
+		return
+	case clientID != i.ClientID:
+		tokenError(w, "invalid_client")
+		return
+	case !ok, r.PostForm.Get("redirect_uri") != RedirectURL:
+		tokenError(w, "invalid_grant")
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.codeChallenge:
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	claims := i.Claims(g.subject, g.nonce)
+	if modify != nil {
+		modify(claims)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     Sign(i.Key, KeyID, claims),
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,140 @@
+/*
+Package throttle slows down repeated failed attempts (e.g., logins), keyed by an arbitrary string such as a username or
+an IP address.
+
+After a number of free attempts, each failure blocks the key for an exponentially growing delay; after too many
+failures the key is locked out for a longer time. Failures are forgotten after a quiet period, or when the caller
+reports a success.
+
+State is kept in memory only: it is lost on restart, and it is not shared between instances of the web API.
+Functions take the current time as a parameter, so callers should pass globaltime.Now() to allow testing with a fixed
+clock.
+*/
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often stale entries are removed from memory
+const sweepInterval = time.Minute
+
+// Policy configures a Throttler.
+type Policy struct {
+	// FreeAttempts is the number of failures allowed without any delay
+	FreeAttempts int
+
+	// BaseDelay is the delay after the first failure beyond FreeAttempts. It doubles at each further failure
+	BaseDelay time.Duration
+
+	// MaxDelay caps the exponential delay
+	MaxDelay time.Duration
+
+	// LockoutAttempts is the number of failures after which the key is locked out. Zero disables lockouts
+	LockoutAttempts int
+
+	// LockoutDuration is how long a key stays locked out
+	LockoutDuration time.Duration
+
+	// Window is the quiet period after which failures are forgotten
+	Window time.Duration
+}
+
+// entry is the state of a key
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Throttler tracks failures by key. It is safe for concurrent use.
+type Throttler struct {
+	policy Policy
+
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+}
+
+// New returns a new Throttler with the policy.
+func New(policy Policy) *Throttler {
+	return &Throttler{
+		policy:  policy,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Wait returns how long the key is still blocked, or zero if a new attempt is allowed.
+func (t *Throttler) Wait(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(now)
+	e, ok := t.entries[key]
+	if !ok || !now.Before(e.blockedUntil) {
+		return 0
+	}
+	return e.blockedUntil.Sub(now)
+}
+
+// Fail records a failed attempt for the key, and returns how long the key is now blocked (zero if it is not).
+func (t *Throttler) Fail(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(now)
+	e, ok := t.entries[key]
+	if !ok || t.expired(e, now) {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	switch {
+	case t.policy.LockoutAttempts > 0 && e.failures >= t.policy.LockoutAttempts:
+		e.blockedUntil = now.Add(t.policy.LockoutDuration)
+	case e.failures > t.policy.FreeAttempts:
+		delay := t.policy.BaseDelay
+		for i := t.policy.FreeAttempts + 1; i < e.failures && delay < t.policy.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > t.policy.MaxDelay {
+			delay = t.policy.MaxDelay
+		}
+		e.blockedUntil = now.Add(delay)
+	}
+
+	if !now.Before(e.blockedUntil) {
+		return 0
+	}
+	return e.blockedUntil.Sub(now)
+}
+
+// Reset forgets the failures of the key, e.g. after a successful attempt.
+func (t *Throttler) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, key)
+}
+
+// sweep removes the entries whose failures can be forgotten. It must be called with the lock held.
+func (t *Throttler) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < sweepInterval {
+		return
+	}
+	t.lastSweep = now
+
+	for key, e := range t.entries {
+		if t.expired(e, now) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// expired tells whether the failures of the entry can be forgotten.
+func (t *Throttler) expired(e *entry, now time.Time) bool {
+	return now.Sub(e.lastFailure) > t.policy.Window && !now.Before(e.blockedUntil)
+}
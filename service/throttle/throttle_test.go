@@ -0,0 +1,128 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+var testPolicy = Policy{
+	FreeAttempts:    2,
+	BaseDelay:       time.Second,
+	MaxDelay:        8 * time.Second,
+	LockoutAttempts: 10,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+func TestExponentialDelay(t *testing.T) {
+	th := New(testPolicy)
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	now := start
+	for i, delay := range want {
+		if got := th.Fail("alice", now); got != delay {
+			t.Errorf("failure %d: got delay %v, want %v", i+1, got, delay)
+		}
+		if got := th.Wait("alice", now); got != delay {
+			t.Errorf("wait after failure %d: got %v, want %v", i+1, got, delay)
+		}
+		if delay > 0 {
+			if got := th.Wait("alice", now.Add(delay-time.Millisecond)); got != time.Millisecond {
+				t.Errorf("wait before the end of delay %d: got %v, want 1ms", i+1, got)
+			}
+		}
+		now = now.Add(delay)
+		if got := th.Wait("alice", now); got != 0 {
+			t.Errorf("wait at the end of delay %d: got %v, want 0", i+1, got)
+		}
+	}
+
+	// Other keys are not affected
+	if got := th.Wait("bob", start.Add(3*time.Second)); got != 0 {
+		t.Errorf("wait of another key: got %v, want 0", got)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	th := New(testPolicy)
+	now := start
+	for i := 1; i < testPolicy.LockoutAttempts; i++ {
+		now = now.Add(th.Fail("alice", now))
+	}
+	if got := th.Fail("alice", now); got != testPolicy.LockoutDuration {
+		t.Fatalf("failure %d: got delay %v, want the lockout of %v", testPolicy.LockoutAttempts, got, testPolicy.LockoutDuration)
+	}
+	if got := th.Wait("alice", now.Add(testPolicy.LockoutDuration-time.Second)); got != time.Second {
+		t.Errorf("wait before the end of the lockout: got %v, want 1s", got)
+	}
+
+	// The lockout expires, but the failures are still counted within the window
+	now = now.Add(testPolicy.LockoutDuration)
+	if got := th.Wait("alice", now); got != 0 {
+		t.Errorf("wait at the end of the lockout: got %v, want 0", got)
+	}
+	if got := th.Fail("alice", now); got != testPolicy.LockoutDuration {
+		t.Errorf("failure after the lockout: got delay %v, want the lockout of %v", got, testPolicy.LockoutDuration)
+	}
+}
+
+func TestReset(t *testing.T) {
+	th := New(testPolicy)
+	for i := 0; i < 4; i++ {
+		th.Fail("alice", start)
+	}
+	th.Reset("alice")
+	if got := th.Wait("alice", start); got != 0 {
+		t.Errorf("wait after a reset: got %v, want 0", got)
+	}
+	// The next failure is the first one again
+	if got := th.Fail("alice", start); got != 0 {
+		t.Errorf("failure after a reset: got delay %v, want 0", got)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	th := New(testPolicy)
+	for i := 0; i < 3; i++ {
+		th.Fail("alice", start)
+	}
+
+	// Failures within the window are counted
+	now := start.Add(testPolicy.Window)
+	if got := th.Fail("alice", now); got != 2*time.Second {
+		t.Errorf("failure within the window: got delay %v, want 2s", got)
+	}
+	// and forgotten after a quiet window
+	now = now.Add(testPolicy.Window + time.Second)
+	if got := th.Fail("alice", now); got != 0 {
+		t.Errorf("failure after a quiet window: got delay %v, want 0", got)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	th := New(testPolicy)
+	th.Fail("alice", start)
+	th.Fail("bob", start.Add(30*time.Minute))
+
+	th.Wait("carol", start.Add(testPolicy.Window+time.Second))
+	if _, ok := th.entries["alice"]; ok {
+		t.Errorf("the stale entry has not been removed")
+	}
+	if _, ok := th.entries["bob"]; !ok {
+		t.Errorf("the entry within the window has been removed")
+	}
+}
+
+func TestNoLockout(t *testing.T) {
+	policy := testPolicy
+	policy.LockoutAttempts = 0
+	th := New(policy)
+	var delay time.Duration
+	for i := 0; i < 20; i++ {
+		delay = th.Fail("alice", start)
+	}
+	if delay != policy.MaxDelay {
+		t.Errorf("delay without lockouts: got %v, want the maximum %v", delay, policy.MaxDelay)
+	}
+}
@@ -0,0 +1,103 @@
+package totp
+
+import (
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the test vectors of RFC 6238 (appendix B), "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// rfcVectors are the SHA1 test vectors of RFC 6238, truncated to the last Digits digits of the 8 digits codes
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+// setTime fixes globaltime at the Unix time until the end of the test.
+func setTime(t *testing.T, unix int64) {
+	globaltime.FixedTime = time.Unix(unix, 0).UTC()
+	t.Cleanup(func() { globaltime.FixedTime = time.Time{} })
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		setTime(t, v.unix)
+		code, err := Code(rfcSecret, Step(globaltime.Now()))
+		if err != nil {
+			t.Fatalf("code at %d: %v", v.unix, err)
+		}
+		if code != v.code {
+			t.Errorf("code at %d: got %s, want %s", v.unix, code, v.code)
+		}
+
+		step, ok := Validate(rfcSecret, v.code, globaltime.Now())
+		if !ok || step != Step(globaltime.Now()) {
+			t.Errorf("validating the code at %d: got step %d (%v), want %d", v.unix, step, ok, Step(globaltime.Now()))
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	code, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || code != "287082" {
+		t.Errorf("code with a lowercase secret: got %s (%v), want 287082", code, err)
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	setTime(t, 1111111111)
+	current := Step(globaltime.Now())
+
+	for offset := int64(-Skew - 1); offset <= Skew+1; offset++ {
+		code, err := Code(rfcSecret, current+offset)
+		if err != nil {
+			t.Fatalf("code at step %+d: %v", offset, err)
+		}
+		step, ok := Validate(rfcSecret, code, globaltime.Now())
+		want := offset >= -Skew && offset <= Skew
+		if ok != want {
+			t.Errorf("code at step %+d: got valid %v, want %v", offset, ok, want)
+		} else if ok && step != current+offset {
+			t.Errorf("code at step %+d: got step %d, want %d", offset, step, current+offset)
+		}
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	setTime(t, 59)
+	for _, code := range []string{"", "28708", "2870820", "abcdef", "287083"} {
+		if _, ok := Validate(rfcSecret, code, globaltime.Now()); ok {
+			t.Errorf("code %q: got valid, want invalid", code)
+		}
+	}
+	if _, ok := Validate(rfcSecret, " 287082 ", globaltime.Now()); !ok {
+		t.Errorf("code with spaces around: got invalid, want valid")
+	}
+	if _, ok := Validate("not base32!", "287082", globaltime.Now()); ok {
+		t.Errorf("code with an invalid secret: got valid, want invalid")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("generating the secret: %v", err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != secretSize {
+		t.Errorf("secret %q: got %d bytes (%v), want %d", secret, len(key), err, secretSize)
+	}
+	if other, _ := GenerateSecret(); other == secret {
+		t.Errorf("two secrets are equal")
+	}
+}
@@ -6,10 +6,49 @@ const instance = axios.create({
 });
 instance.interceptors.request.use(config => {
     const token = localStorage.getItem('token');
-    if (token) {
+    if (token && !config.headers.Authorization) {
         config.headers.Authorization = `Bearer ${token}`;
     }
     return config;
 });
 
+// When access tokens are enabled, they are short-lived: on 401 the refresh token is used to get a new one, and the
+// request is retried once. Concurrent requests share the same refresh, as each refresh token can be used only once.
+let refreshing = null;
+
+function refreshSession() {
+    if (!refreshing) {
+        const refreshToken = localStorage.getItem('refreshToken');
+        refreshing = instance.post('/session/refresh', { refreshToken })
+            .then(response => {
+                localStorage.setItem('token', response.data.token);
+                localStorage.setItem('refreshToken', response.data.refreshToken);
+                return response.data.token;
+            })
+            .finally(() => {
+                refreshing = null;
+            });
+    }
+    return refreshing;
+}
+
+instance.interceptors.response.use(response => response, async error => {
+    const config = error.config;
+    // Login endpoints return 401 for wrong credentials, not for expired tokens
+    const isLogin = config && (config.url.startsWith('/session/') || (config.url === '/session' && config.method === 'post'));
+    if (!error.response || error.response.status !== 401 || !config || config.retried || isLogin ||
+        !localStorage.getItem('refreshToken')) {
+        return Promise.reject(error);
+    }
+
+    try {
+        const token = await refreshSession();
+        config.retried = true;
+        config.headers.Authorization = `Bearer ${token}`;
+        return instance(config);
+    } catch (refreshError) {
+        return Promise.reject(error);
+    }
+});
+
 export default instance;